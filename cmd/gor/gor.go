@@ -82,6 +82,30 @@ func main() {
 		goreplay.Debug(0, "Started example file server for current directory on address ", args[1])
 
 		log.Fatal(http.ListenAndServe(args[1], loggingMiddleware(args[1], http.FileServer(http.Dir(dir)))))
+	} else if len(args) > 0 && args[0] == "mock-server" {
+		flag.CommandLine.Parse(args[1:])
+		if flag.NArg() != 1 || len(goreplay.Settings.InputFile) == 0 {
+			log.Fatal("You should specify recordings and port and IP (optional) for the mock server. Example: `gor mock-server --input-file requests.gor :8080`")
+		}
+		server, err := goreplay.NewMockServer(&goreplay.Settings.MockServerConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = server.Load(goreplay.Settings.InputFile...); err != nil {
+			log.Fatal(err)
+		}
+		if server.Len() == 0 {
+			log.Fatal("No recorded responses found, record them with --input-raw-track-response")
+		}
+
+		goreplay.Debug(0, "Started mock server with", server.Len(), "recorded responses on address", flag.Arg(0))
+
+		if goreplay.Settings.Pprof != "" {
+			go func() {
+				log.Println(http.ListenAndServe(goreplay.Settings.Pprof, nil))
+			}()
+		}
+		log.Fatal(http.ListenAndServe(flag.Arg(0), server))
 	} else {
 		flag.Parse()
 		goreplay.CheckSettings()
@@ -129,6 +153,11 @@ func main() {
 		exit = 0
 	}
 	emitter.Close()
+	for _, out := range plugins.Outputs {
+		if f, ok := out.(goreplay.Failer); ok && f.Failed() {
+			exit = 1
+		}
+	}
 	os.Exit(exit)
 }
 
@@ -3,9 +3,9 @@ package goreplay
 import (
 	"fmt"
 	"github.com/buger/goreplay/internal/byteutils"
+	"github.com/buger/goreplay/proto"
 	"hash/fnv"
 	"io"
-	"log"
 	"sync"
 
 	"github.com/coocood/freecache"
@@ -76,6 +76,7 @@ func (e *Emitter) Close() {
 func CopyMulty(src PluginReader, writers ...PluginWriter) error {
 	wIndex := 0
 	modifier := NewHTTPModifier(&Settings.ModifierConfig)
+	redisModifier := NewRedisModifier(&Settings.RedisModifierConfig)
 	filteredRequests := freecache.NewCache(200 * 1024 * 1024) // 200M
 
 	for {
@@ -87,7 +88,9 @@ func CopyMulty(src PluginReader, writers ...PluginWriter) error {
 			return err
 		}
 		if msg != nil && len(msg.Data) > 0 {
-			if len(msg.Data) > int(Settings.CopyBufferSize) {
+			// parts of streamed messages are bounded by their chunk size
+			chunk, more := payloadChunk(msg.Meta)
+			if len(msg.Data) > int(Settings.CopyBufferSize) && chunk == 0 {
 				msg.Data = msg.Data[:Settings.CopyBufferSize]
 			}
 			meta := payloadMeta(msg.Meta)
@@ -100,10 +103,15 @@ func CopyMulty(src PluginReader, writers ...PluginWriter) error {
 			if Settings.Verbose >= 3 {
 				Debug(3, "[EMITTER] input: ", byteutils.SliceToString(msg.Meta[:len(msg.Meta)-1]), " from: ", src)
 			}
-			if modifier != nil {
+			if modifier != nil || redisModifier != nil {
 				Debug(3, "[EMITTER] modifier:", requestID, "from:", src)
 				if isRequestPayload(msg.Meta) {
-					msg.Data = modifier.Rewrite(msg.Data)
+					if modifier != nil {
+						msg.Data = modifier.Rewrite(msg.Data)
+					}
+					if redisModifier != nil && len(msg.Data) > 0 {
+						msg.Data = redisModifier.Rewrite(msg.Data)
+					}
 					// If modifier tells to skip request
 					if len(msg.Data) == 0 {
 						filteredRequests.Set(requestID, []byte{}, 60) //
@@ -114,13 +122,17 @@ func CopyMulty(src PluginReader, writers ...PluginWriter) error {
 				} else {
 					_, err := filteredRequests.Get(requestID)
 					if err == nil {
-						filteredRequests.Del(requestID)
+						// WebSocket messages share the ID of the filtered upgrade request,
+						// body chunks share the ID of their streamed request
+						if !isWebSocketPayload(msg.Meta) && msg.Meta[0] != RequestChunkPayload && !more && string(proto.Status(msg.Data)) != "101" {
+							filteredRequests.Del(requestID)
+						}
 						continue
 					}
 				}
 			}
 
-			if Settings.PrettifyHTTP {
+			if Settings.PrettifyHTTP && chunk == 0 {
 				msg.Data = prettifyHTTP(msg.Data)
 				if len(msg.Data) == 0 {
 					continue
@@ -129,16 +141,23 @@ func CopyMulty(src PluginReader, writers ...PluginWriter) error {
 
 			if Settings.SplitOutput {
 				if Settings.RecognizeTCPSessions {
-					if !PRO {
-						log.Fatal("Detailed TCP sessions work only with PRO license")
-					}
+					// all messages of a captured connection go to the same output
+					connID, _ := payloadSession(msg.Meta)
 					hasher := fnv.New32a()
-					hasher.Write(meta[1])
+					hasher.Write(connID)
 
 					wIndex = int(hasher.Sum32()) % len(writers)
 					if _, err := writers[wIndex].PluginWrite(msg); err != nil {
 						return err
 					}
+				} else if chunk != 0 {
+					// parts of a streamed message go to the same output
+					hasher := fnv.New32a()
+					hasher.Write(requestID)
+
+					if _, err := writers[int(hasher.Sum32())%len(writers)].PluginWrite(msg); err != nil {
+						return err
+					}
 				} else {
 					// Simple round robin
 					if _, err := writers[wIndex].PluginWrite(msg); err != nil {
@@ -91,6 +91,60 @@ func TestEmitterFiltered(t *testing.T) {
 	Settings.ModifierConfig = HTTPModifierConfig{}
 }
 
+func TestEmitterFilteredStream(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	input := NewTestInput()
+	input.skipHeader = true
+
+	var received []byte
+	output := NewTestOutput(func(msg *Message) {
+		received = append(received, msg.Meta[0])
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input},
+		Outputs: []PluginWriter{output},
+	}
+	plugins.All = append(plugins.All, input, output)
+
+	Settings.ModifierConfig = HTTPModifierConfig{Methods: HTTPMethods{[]byte("GET")}}
+
+	emitter := &Emitter{}
+	go emitter.Start(plugins, "")
+
+	// all parts of the filtered streamed request and of its response are skipped
+	id := uuid()
+	parts := []struct {
+		payloadType byte
+		chunk       uint32
+		more        bool
+		data        string
+	}{
+		{RequestPayload, 1, true, "POST / HTTP/1.1\r\nContent-Length: 4\r\n\r\n"},
+		{RequestChunkPayload, 2, false, "body"},
+		{ResponsePayload, 1, true, "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\n"},
+		{ResponseChunkPayload, 2, false, "body"},
+	}
+	for _, p := range parts {
+		input.EmitBytes(append(payloadChunkHeader(p.payloadType, id, time.Now().UnixNano(), -1, []byte("conn"), 1, p.chunk, p.more), p.data...))
+	}
+
+	wg.Add(2)
+	id = uuid()
+	input.EmitBytes(append(payloadHeader(RequestPayload, id, time.Now().UnixNano(), -1), "GET / HTTP/1.1\r\n\r\n"...))
+	input.EmitBytes(append(payloadHeader(ResponsePayload, id, time.Now().UnixNano()+1, 1), "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"...))
+
+	wg.Wait()
+	emitter.Close()
+	if string(received) != "12" {
+		t.Errorf("expected only the GET request and its response, got %q", received)
+	}
+
+	Settings.ModifierConfig = HTTPModifierConfig{}
+}
+
 func TestEmitterSplitRoundRobin(t *testing.T) {
 	wg := new(sync.WaitGroup)
 
@@ -100,11 +100,24 @@ func (h *HTTPHashFilters) Set(value string) error {
 
 	f := hashFilter{name: []byte(valArr[0])}
 
-	val := strings.TrimSpace(valArr[1])
+	percent, err := parsePercent(valArr[1])
+	if err != nil {
+		return err
+	}
+	f.percent = percent
+
+	*h = append(*h, f)
+
+	return nil
+}
+
+// parsePercent parses fraction of hash filters like 25%
+func parsePercent(value string) (uint32, error) {
+	val := strings.TrimSpace(value)
 
 	if strings.Contains(val, "%") {
 		p, _ := strconv.ParseInt(val[:len(val)-1], 0, 0)
-		f.percent = uint32(p)
+		return uint32(p), nil
 	} else if strings.Contains(val, "/") {
 		// DEPRECATED format
 		var num, den uint64
@@ -113,14 +126,9 @@ func (h *HTTPHashFilters) Set(value string) error {
 		num, _ = strconv.ParseUint(fracArr[0], 10, 64)
 		den, _ = strconv.ParseUint(fracArr[1], 10, 64)
 
-		f.percent = uint32((float64(num) / float64(den)) * 100)
-	} else {
-		return errors.New("Value should be percent and contain '%'")
+		return uint32((float64(num) / float64(den)) * 100), nil
 	}
-
-	*h = append(*h, f)
-
-	return nil
+	return 0, errors.New("Value should be percent and contain '%'")
 }
 
 // Handling of --http-set-header option
@@ -56,8 +56,41 @@ func (h payloadQueue) Idx(i int) *filePayload {
 	return h.s[i]
 }
 
+// fileRecords reads records of a file written by FileOutput in order of the
+// file
+type fileRecords struct {
+	reader *bufio.Reader
+	line   int
+}
+
+// next returns the next record without its trailing new line, io.EOF is
+// returned at the end of the file
+func (r *fileRecords) next() ([]byte, error) {
+	payloadSeparatorAsBytes := []byte(payloadSeparator)
+	var buffer bytes.Buffer
+
+	for {
+		line, err := r.reader.ReadBytes('\n')
+		r.line++
+
+		if err != nil {
+			return nil, err
+		}
+
+		if bytes.Equal(payloadSeparatorAsBytes[1:], line) {
+			asBytes := buffer.Bytes()
+			if len(asBytes) == 0 {
+				return asBytes, nil
+			}
+			return asBytes[:len(asBytes)-1], nil
+		}
+
+		buffer.Write(line)
+	}
+}
+
 type fileInputReader struct {
-	reader    *bufio.Reader
+	records   fileRecords
 	file      io.ReadCloser
 	closed    int32 // Value of 0 indicates that the file is still open.
 	s3        bool
@@ -68,15 +101,10 @@ type fileInputReader struct {
 }
 
 func (f *fileInputReader) parse(init chan struct{}) error {
-	payloadSeparatorAsBytes := []byte(payloadSeparator)
-	var buffer bytes.Buffer
 	var initialized bool
 
-	lineNum := 0
-
 	for {
-		line, err := f.reader.ReadBytes('\n')
-		lineNum++
+		data, err := f.records.next()
 
 		if err != nil {
 			if err != io.EOF {
@@ -93,46 +121,36 @@ func (f *fileInputReader) parse(init chan struct{}) error {
 			return err
 		}
 
-		if bytes.Equal(payloadSeparatorAsBytes[1:], line) {
-			asBytes := buffer.Bytes()
-			meta := payloadMeta(asBytes)
+		meta := payloadMeta(data)
 
-			if len(meta) < 3 {
-				Debug(1, fmt.Sprintf("Found malformed record, file: %s, line %d", f.path, lineNum))
-				buffer = bytes.Buffer{}
-				continue
-			}
-
-			timestamp, _ := strconv.ParseInt(string(meta[2]), 10, 64)
-			data := asBytes[:len(asBytes)-1]
+		if len(meta) < 3 {
+			Debug(1, fmt.Sprintf("Found malformed record, file: %s, line %d", f.path, f.records.line))
+			continue
+		}
 
-			f.queue.Lock()
-			heap.Push(&f.queue, &filePayload{
-				timestamp: timestamp,
-				data:      data,
-			})
-			f.queue.Unlock()
+		timestamp, _ := strconv.ParseInt(string(meta[2]), 10, 64)
 
-			for {
-				if f.queue.Len() < f.readDepth {
-					break
-				}
+		f.queue.Lock()
+		heap.Push(&f.queue, &filePayload{
+			timestamp: timestamp,
+			data:      data,
+		})
+		f.queue.Unlock()
 
-				if !initialized {
-					close(init)
-					initialized = true
-				}
+		for {
+			if f.queue.Len() < f.readDepth {
+				break
+			}
 
-				if !f.dryRun {
-					time.Sleep(100 * time.Millisecond)
-				}
+			if !initialized {
+				close(init)
+				initialized = true
 			}
 
-			buffer = bytes.Buffer{}
-			continue
+			if !f.dryRun {
+				time.Sleep(100 * time.Millisecond)
+			}
 		}
-
-		buffer.Write(line)
 	}
 }
 
@@ -164,7 +182,9 @@ func (f *fileInputReader) Close() error {
 	return nil
 }
 
-func newFileInputReader(path string, readDepth int, dryRun bool) *fileInputReader {
+// openFile opens a file written by FileOutput, local or on S3, gzipped files
+// are decompressed
+func openFile(path string) (io.ReadCloser, *bufio.Reader, error) {
 	var file io.ReadCloser
 	var err error
 
@@ -175,21 +195,29 @@ func newFileInputReader(path string, readDepth int, dryRun bool) *fileInputReade
 	}
 
 	if err != nil {
-		Debug(0, fmt.Sprintf("[INPUT-FILE] err: %q", err))
-		return nil
+		return nil, nil, err
 	}
 
-	r := &fileInputReader{path: path, file: file, closed: 0, readDepth: readDepth, dryRun: dryRun}
 	if strings.HasSuffix(path, ".gz") {
 		gzReader, err := gzip.NewReader(file)
 		if err != nil {
-			Debug(0, fmt.Sprintf("[INPUT-FILE] err: %q", err))
-			return nil
+			file.Close()
+			return nil, nil, err
 		}
-		r.reader = bufio.NewReader(gzReader)
-	} else {
-		r.reader = bufio.NewReader(file)
+		return file, bufio.NewReader(gzReader), nil
 	}
+	return file, bufio.NewReader(file), nil
+}
+
+func newFileInputReader(path string, readDepth int, dryRun bool) *fileInputReader {
+	file, reader, err := openFile(path)
+	if err != nil {
+		Debug(0, fmt.Sprintf("[INPUT-FILE] err: %q", err))
+		return nil
+	}
+
+	r := &fileInputReader{path: path, file: file, closed: 0, readDepth: readDepth, dryRun: dryRun}
+	r.records.reader = reader
 
 	heap.Init(&r.queue)
 
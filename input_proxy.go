@@ -0,0 +1,283 @@
+package goreplay
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyInputConfig struct for holding proxy input configuration
+type ProxyInputConfig struct {
+	Upstream           string `json:"input-proxy-upstream"`
+	CertFile           string `json:"input-proxy-tls-cert"`
+	KeyFile            string `json:"input-proxy-tls-key"`
+	UpstreamSkipVerify bool   `json:"input-proxy-upstream-skip-verify"`
+}
+
+type proxyContextKey struct{}
+
+type proxyConnContextKey struct{}
+
+// proxyConn numbers requests of a client connection
+type proxyConn struct {
+	id  []byte
+	seq uint32
+}
+
+// proxyCall is shared by the handler and the response hook of a single request
+type proxyCall struct {
+	id      []byte
+	start   time.Time
+	conn    *proxyConn
+	seq     uint32
+	request *proxyBody // nil if the request has no body
+}
+
+// proxyBody records the body of a request or a response while it is being
+// forwarded, at most limit bytes are kept. done is called once, when the body
+// was read or closed.
+type proxyBody struct {
+	body  io.ReadCloser
+	limit int
+	done  func(body []byte, complete bool)
+
+	mu        sync.Mutex
+	buf       []byte
+	truncated bool
+	complete  bool // the body was read till the end and was not truncated
+	finished  bool
+}
+
+func (b *proxyBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.mu.Lock()
+	if !b.finished {
+		room := b.limit - len(b.buf)
+		if n > room {
+			b.truncated = true
+		} else {
+			room = n
+		}
+		b.buf = append(b.buf, p[:room]...)
+		b.complete = err == io.EOF && !b.truncated
+	}
+	b.mu.Unlock()
+	if err != nil {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *proxyBody) Close() error {
+	err := b.body.Close()
+	b.finish()
+	return err
+}
+
+func (b *proxyBody) finish() {
+	b.mu.Lock()
+	if b.finished {
+		b.mu.Unlock()
+		return
+	}
+	b.finished = true
+	b.mu.Unlock()
+	b.done(b.buf, b.complete)
+}
+
+// ProxyInput is a reverse proxy which forwards requests to the upstream and
+// records both requests and upstream responses. Unlike RAWInput it does not
+// need any special privileges.
+type ProxyInput struct {
+	data     chan *Message
+	address  string
+	config   *ProxyInputConfig
+	listener net.Listener
+	server   *http.Server
+	stop     chan bool // Channel used only to indicate goroutine should shutdown
+
+	bufferSize int // recorded bodies are truncated to copy-buffer-size
+}
+
+// NewProxyInput constructor for ProxyInput. Accepts address with port which it will listen on.
+func NewProxyInput(address string, config *ProxyInputConfig) (i *ProxyInput) {
+	i = new(ProxyInput)
+	i.data = make(chan *Message, 1000)
+	i.stop = make(chan bool)
+	i.config = config
+	i.bufferSize = int(Settings.CopyBufferSize)
+	if i.bufferSize < 1 {
+		i.bufferSize = 5 << 20
+	}
+
+	upstream, err := url.Parse(config.Upstream)
+	if err != nil || upstream.Host == "" {
+		log.Fatalf("[INPUT-PROXY] invalid upstream URL %q, example: --input-proxy-upstream http://127.0.0.1:8000", config.Upstream)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	proxy.ModifyResponse = i.response
+	if config.UpstreamSkipVerify {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		proxy.Transport = transport
+	}
+	i.server = &http.Server{
+		Handler: i.handler(proxy),
+		ConnContext: func(ctx context.Context, _ net.Conn) context.Context {
+			return context.WithValue(ctx, proxyConnContextKey{}, &proxyConn{id: uuid()})
+		},
+	}
+
+	i.listen(address)
+
+	return
+}
+
+// PluginRead reads message from this plugin
+func (i *ProxyInput) PluginRead() (*Message, error) {
+	select {
+	case <-i.stop:
+		return nil, ErrorStopped
+	case msg := <-i.data:
+		return msg, nil
+	}
+}
+
+// Close closes this plugin
+func (i *ProxyInput) Close() error {
+	close(i.stop)
+	return i.server.Close()
+}
+
+func (i *ProxyInput) emit(msg *Message) {
+	select {
+	case <-i.stop:
+	case i.data <- msg:
+	}
+}
+
+func (i *ProxyInput) handler(proxy http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := &proxyCall{id: uuid(), start: time.Now()}
+		call.conn = r.Context().Value(proxyConnContextKey{}).(*proxyConn)
+		call.seq = atomic.AddUint32(&call.conn.seq, 1)
+
+		// record HTTP/2 requests in HTTP/1.1 form, like every other input
+		dump := *r
+		dump.ProtoMajor, dump.ProtoMinor = 1, 1
+		head, err := httputil.DumpRequest(&dump, false)
+		if err != nil {
+			Debug(1, "[INPUT-PROXY] failed to read request:", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		chunked := len(r.TransferEncoding) > 0
+		emit := func(body []byte, complete bool) {
+			i.emit(&Message{
+				Meta: payloadSessionHeader(RequestPayload, call.id, call.start.UnixNano(), -1, call.conn.id, call.seq),
+				Data: appendProxyBody(head, body, chunked, complete),
+			})
+		}
+		// the request is recorded once its body is forwarded
+		if r.Body == nil || r.Body == http.NoBody {
+			emit(nil, true)
+		} else {
+			call.request = &proxyBody{body: r.Body, limit: i.bufferSize, done: emit}
+			r.Body = call.request
+			defer call.request.finish()
+		}
+
+		proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyContextKey{}, call)))
+	})
+}
+
+// appendProxyBody appends the recorded body to the message head, chunked
+// bodies are encoded again
+func appendProxyBody(head, body []byte, chunked, complete bool) []byte {
+	if !chunked {
+		return append(head, body...)
+	}
+	buf := bytes.NewBuffer(head)
+	w := httputil.NewChunkedWriter(buf)
+	w.Write(body)
+	if complete {
+		w.Close()
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+// response records the upstream response once it is sent to the client, the
+// body is recorded while it is being streamed
+func (i *ProxyInput) response(resp *http.Response) error {
+	call, ok := resp.Request.Context().Value(proxyContextKey{}).(*proxyCall)
+	if !ok {
+		return nil
+	}
+
+	dump := *resp
+	dump.ProtoMajor, dump.ProtoMinor = 1, 1
+	chunked := len(resp.TransferEncoding) > 0
+	emit := func(body []byte, complete bool) {
+		stop := time.Now()
+		if !chunked && dump.ContentLength < 0 {
+			// the body was delimited by the end of the connection
+			dump.ContentLength = int64(len(body))
+		}
+		head, err := httputil.DumpResponse(&dump, false)
+		if err != nil {
+			Debug(1, "[INPUT-PROXY] failed to record response:", err)
+			return
+		}
+		if call.request != nil {
+			// the request is recorded first, with the part the upstream read
+			call.request.finish()
+		}
+		i.emit(&Message{
+			Meta: payloadSessionHeader(ResponsePayload, call.id, call.start.UnixNano(), stop.UnixNano()-call.start.UnixNano(), call.conn.id, call.seq),
+			Data: appendProxyBody(head, body, chunked, complete),
+		})
+	}
+	// the body of 101 Switching Protocols is the upgraded connection
+	if resp.StatusCode == http.StatusSwitchingProtocols || resp.Body == nil || resp.Body == http.NoBody {
+		emit(nil, true)
+		return nil
+	}
+	resp.Body = &proxyBody{body: resp.Body, limit: i.bufferSize, done: emit}
+	return nil
+}
+
+func (i *ProxyInput) listen(address string) {
+	var err error
+
+	i.listener, err = net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal("[INPUT-PROXY] listener failure:", err)
+	}
+	i.address = i.listener.Addr().String()
+
+	go func() {
+		if i.config.CertFile != "" || i.config.KeyFile != "" {
+			err = i.server.ServeTLS(i.listener, i.config.CertFile, i.config.KeyFile)
+		} else {
+			err = i.server.Serve(i.listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal("[INPUT-PROXY] serve failure ", err)
+		}
+	}()
+}
+
+func (i *ProxyInput) String() string {
+	return "Proxy input: " + i.address + " -> " + i.config.Upstream
+}
@@ -0,0 +1,121 @@
+package goreplay
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyInput(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if string(body) != "a=1&b=2" {
+			t.Error("Wrong POST body:", string(body))
+		}
+		w.Header().Set("X-Upstream", "1")
+		w.Write([]byte("upstream response"))
+	}))
+	defer upstream.Close()
+
+	input := NewProxyInput("127.0.0.1:0", &ProxyInputConfig{Upstream: upstream.URL})
+	defer input.Close()
+
+	resp, err := http.Post("http://"+input.address+"/test?a=b", "application/x-www-form-urlencoded", strings.NewReader("a=1&b=2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "upstream response" || resp.Header.Get("X-Upstream") != "1" {
+		t.Errorf("Client should receive upstream response, got %q", body)
+	}
+
+	req, _ := input.PluginRead()
+	if !isRequestPayload(req.Meta) || !bytes.HasPrefix(req.Data, []byte("POST /test?a=b HTTP/1.1\r\n")) || !bytes.HasSuffix(req.Data, []byte("\r\n\r\na=1&b=2")) {
+		t.Errorf("Wrong request %q %q", req.Meta, req.Data)
+	}
+	res, _ := input.PluginRead()
+	if res.Meta[0] != ResponsePayload || !bytes.Equal(payloadID(req.Meta), payloadID(res.Meta)) {
+		t.Errorf("Response should have request id %q %q", req.Meta, res.Meta)
+	}
+	if meta := payloadMeta(res.Meta); len(meta) < 4 || bytes.HasPrefix(meta[3], []byte("-")) {
+		t.Errorf("Response should have latency %q", res.Meta)
+	}
+	if !bytes.HasPrefix(res.Data, []byte("HTTP/1.1 200 OK\r\n")) || !bytes.Contains(res.Data, []byte("Content-Length: 17\r\n")) ||
+		!bytes.HasSuffix(res.Data, []byte("\r\n\r\nupstream response")) {
+		t.Errorf("Wrong response %q", res.Data)
+	}
+}
+
+func TestProxyInputStreamedResponse(t *testing.T) {
+	next := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		<-next
+		w.Write([]byte("data: 2\n\n"))
+	}))
+	defer upstream.Close()
+
+	input := NewProxyInput("127.0.0.1:0", &ProxyInputConfig{Upstream: upstream.URL})
+	defer input.Close()
+	input.bufferSize = 12
+
+	resp, err := http.Get("http://" + input.address + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// the first event reaches the client before the response ends
+	event := make([]byte, 9)
+	if _, err := io.ReadFull(resp.Body, event); err != nil || string(event) != "data: 1\n\n" {
+		t.Fatalf("expected the first event, got %q %v", event, err)
+	}
+	close(next)
+	if rest, _ := io.ReadAll(resp.Body); string(rest) != "data: 2\n\n" {
+		t.Errorf("expected the second event, got %q", rest)
+	}
+
+	req, _ := input.PluginRead()
+	if !isRequestPayload(req.Meta) || !bytes.HasPrefix(req.Data, []byte("GET /events HTTP/1.1\r\n")) {
+		t.Errorf("Wrong request %q %q", req.Meta, req.Data)
+	}
+	// the recorded body is truncated to the buffer size
+	res, _ := input.PluginRead()
+	if res.Meta[0] != ResponsePayload || !bytes.HasSuffix(res.Data, []byte("\r\n\r\nc\r\ndata: 1\n\ndat\r\n")) {
+		t.Errorf("Wrong response %q", res.Data)
+	}
+}
+
+func TestProxyInputUpstreamError(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+
+	input := NewProxyInput("127.0.0.1:0", &ProxyInputConfig{Upstream: upstream.URL})
+	defer input.Close()
+
+	resp, err := http.Post("http://"+input.address+"/test", "text/plain", strings.NewReader("a=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected 502, got %d", resp.StatusCode)
+	}
+
+	// the request is recorded without a response
+	req, _ := input.PluginRead()
+	if !isRequestPayload(req.Meta) || !bytes.HasPrefix(req.Data, []byte("POST /test HTTP/1.1\r\n")) {
+		t.Errorf("Wrong request %q %q", req.Meta, req.Data)
+	}
+	select {
+	case msg := <-input.data:
+		t.Errorf("unexpected message %q", msg.Meta)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
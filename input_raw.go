@@ -40,11 +40,11 @@ func NewRAWInput(address string, config RAWInputConfig) (i *RAWInput) {
 	host, _ports, err := net.SplitHostPort(address)
 	if err != nil {
 		// If we are reading pcap file, no port needed
-		if strings.HasSuffix(address, "pcap") {
+		if capture.IsFile(address) {
 			host = address
 			_ports = "0"
 			err = nil
-		} else if strings.HasPrefix(address, "k8s://") {
+		} else if strings.HasPrefix(address, "k8s://") || strings.HasPrefix(address, "netns://") || strings.HasPrefix(address, "pid://") {
 			portIndex := strings.LastIndex(address, ":")
 			host = address[:portIndex]
 			_ports = address[portIndex+1:]
@@ -53,7 +53,7 @@ func NewRAWInput(address string, config RAWInputConfig) (i *RAWInput) {
 		}
 	}
 
-	if strings.HasSuffix(host, "pcap") {
+	if capture.IsFile(host) {
 		i.config.Engine = capture.EnginePcapFile
 	}
 
@@ -88,16 +88,37 @@ func (i *RAWInput) PluginRead() (*Message, error) {
 		return nil, ErrorStopped
 	case msgTCP = <-i.listener.Messages():
 		msg.Data = msgTCP.Data()
+		msg.packets = msgTCP.Packets()
 	}
 
 	var msgType byte = ResponsePayload
 	if msgTCP.Direction == tcp.DirIncoming {
 		msgType = RequestPayload
-		if i.config.RealIPHeader != "" {
+		if i.config.RealIPHeader != "" && msgTCP.Opcode == 0 && msgTCP.Chunk <= 1 {
 			msg.Data = proto.SetHeader(msg.Data, []byte(i.config.RealIPHeader), []byte(msgTCP.SrcAddr))
 		}
 	}
-	msg.Meta = payloadHeader(msgType, msgTCP.UUID(), msgTCP.Start.UnixNano(), msgTCP.End.UnixNano()-msgTCP.Start.UnixNano())
+	if msgTCP.Opcode != 0 {
+		msgType = WebSocketResponsePayload
+		if msgTCP.Direction == tcp.DirIncoming {
+			msgType = WebSocketRequestPayload
+		}
+		msg.Meta = payloadWebSocketHeader(msgType, msgTCP.UUID(), msgTCP.Start.UnixNano(), msgTCP.End.UnixNano()-msgTCP.Start.UnixNano(), msgTCP.ConnUUID(), msgTCP.Seq, msgTCP.Opcode)
+	} else if msgTCP.Chunk != 0 {
+		if msgTCP.Chunk > 1 {
+			msgType = ResponseChunkPayload
+			if msgTCP.Direction == tcp.DirIncoming {
+				msgType = RequestChunkPayload
+			}
+		}
+		msg.Meta = payloadChunkHeader(msgType, msgTCP.UUID(), msgTCP.Start.UnixNano(), msgTCP.End.UnixNano()-msgTCP.Start.UnixNano(), msgTCP.ConnUUID(), msgTCP.Seq, msgTCP.Chunk, msgTCP.More)
+	} else {
+		msg.Meta = payloadSessionHeader(msgType, msgTCP.UUID(), msgTCP.Start.UnixNano(), msgTCP.End.UnixNano()-msgTCP.Start.UnixNano(), msgTCP.ConnUUID(), msgTCP.Seq)
+	}
+
+	if pod := i.pod(msgTCP); pod != nil {
+		msg.Meta = payloadWithPod(msg.Meta, pod.Namespace, pod.Name, pod.Labels)
+	}
 
 	// to be removed....
 	if msgTCP.Truncated {
@@ -115,6 +136,19 @@ func (i *RAWInput) PluginRead() (*Message, error) {
 	return &msg, nil
 }
 
+// pod returns the pod which sent or received the message, the pod of the
+// server is preferred
+func (i *RAWInput) pod(m *tcp.Message) *capture.Pod {
+	server, client := m.DstAddr, m.SrcAddr
+	if m.Direction != tcp.DirIncoming {
+		server, client = client, server
+	}
+	if pod := i.listener.Pod(server); pod != nil {
+		return pod
+	}
+	return i.listener.Pod(client)
+}
+
 func (i *RAWInput) listen(address string) {
 	var err error
 	i.listener, err = capture.NewListener(i.host, i.ports, i.config)
@@ -355,3 +355,80 @@ func BenchmarkRAWInputWithReplay(b *testing.B) {
 	b.ReportMetric(float64(replayCounter), "replayed")
 	emitter.Close()
 }
+
+func TestRAWInputPodMeta(t *testing.T) {
+	header := payloadSessionHeader(RequestPayload, []byte("7f00000185f07f0000011f9000000003"), 1, 2, []byte("7f00000185f07f0000011f90"), 3)
+	header = payloadWithPod(header, "default", "web-1", map[string]string{"tier": "front", "app": "web"})
+	expected := "1 7f00000185f07f0000011f9000000003 1 2 7f00000185f07f0000011f90 3 pod=default/web-1 labels=app=web,tier=front\n"
+	if string(header) != expected {
+		t.Errorf("expected %q, got %q", expected, header)
+	}
+	if conn, seq := payloadSession(header); string(conn) != "7f00000185f07f0000011f90" || seq != 3 {
+		t.Errorf("pod should not change the session %q %d", conn, seq)
+	}
+
+	header = payloadWebSocketHeader(WebSocketRequestPayload, []byte("id"), 1, 2, []byte("conn"), 3, 1)
+	header = payloadWithPod(header, "default", "web-1", nil)
+	if string(header) != "4 id 1 2 conn 3 1 pod=default/web-1\n" || payloadOpcode(header) != 1 {
+		t.Errorf("unexpected header %q", header)
+	}
+}
+
+func TestRAWInputChunkMeta(t *testing.T) {
+	header := payloadChunkHeader(RequestChunkPayload, []byte("id"), 1, 2, []byte("conn"), 3, 2, true)
+	if string(header) != "6 id 1 2 conn 3 2 1\n" {
+		t.Errorf("unexpected header %q", header)
+	}
+	if chunk, more := payloadChunk(header); chunk != 2 || !more {
+		t.Errorf("expected chunk 2 with more parts, got %d %v", chunk, more)
+	}
+	if !isOriginPayload(header) || isRequestPayload(header) {
+		t.Error("body chunks should be forwarded as captured payloads but not replayed as requests")
+	}
+
+	header = payloadWithPod(payloadChunkHeader(ResponsePayload, []byte("id"), 1, 2, []byte("conn"), 3, 1, false), "default", "web-1", nil)
+	if chunk, more := payloadChunk(header); chunk != 1 || more {
+		t.Errorf("expected the last chunk 1, got %d %v", chunk, more)
+	}
+	// opcode of WebSocket messages and pods are not chunks
+	for _, h := range [][]byte{
+		payloadWebSocketHeader(WebSocketRequestPayload, []byte("id"), 1, 2, []byte("conn"), 3, 1),
+		payloadWithPod(payloadSessionHeader(RequestPayload, []byte("id"), 1, 2, []byte("conn"), 3), "default", "web-1", map[string]string{"app": "web"}),
+	} {
+		if chunk, _ := payloadChunk(h); chunk != 0 {
+			t.Errorf("%q is not a chunk", h)
+		}
+	}
+}
+
+func TestRAWInputPodChunkMeta(t *testing.T) {
+	labels := map[string]string{"app": "web", "tier": "front"}
+	header := payloadWithPod(payloadChunkHeader(RequestChunkPayload, []byte("id"), 1, 2, []byte("conn"), 3, 2, true), "default", "web-1", labels)
+	if chunk, more := payloadChunk(header); chunk != 2 || !more {
+		t.Errorf("expected chunk 2 with more parts, got %d %v", chunk, more)
+	}
+	if conn, seq := payloadSession(header); string(conn) != "conn" || seq != 3 {
+		t.Errorf("pod should not change the session %q %d", conn, seq)
+	}
+	if opcode := payloadOpcode(header); opcode != 0 {
+		t.Errorf("chunks have no opcode, got %d", opcode)
+	}
+
+	header = payloadWithPod(payloadWebSocketHeader(WebSocketResponsePayload, []byte("id"), 1, 2, []byte("conn"), 3, 2), "default", "web-1", labels)
+	if opcode := payloadOpcode(header); opcode != 2 {
+		t.Errorf("expected opcode 2, got %d", opcode)
+	}
+	if chunk, _ := payloadChunk(header); chunk != 0 {
+		t.Errorf("%q is not a chunk", header)
+	}
+
+	// whole messages with a pod have neither chunks nor opcodes
+	header = payloadWithPod(payloadSessionHeader(ResponsePayload, []byte("id"), 1, 2, []byte("conn"), 3), "default", "web-1", labels)
+	if chunk, _ := payloadChunk(header); chunk != 0 || payloadOpcode(header) != 0 {
+		t.Errorf("unexpected fields of %q", header)
+	}
+	header = payloadWithPod(payloadHeader(RequestPayload, []byte("7f00000185f07f0000011f9000000003"), 1, 2), "default", "web-1", nil)
+	if conn, seq := payloadSession(header); string(conn) != "7f00000185f07f0000011f90" || seq != 0 {
+		t.Errorf("pod is not a session %q %d", conn, seq)
+	}
+}
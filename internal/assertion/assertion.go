@@ -0,0 +1,323 @@
+// Package assertion checks responses of the replay target against rules, to
+// fail regression runs replaying recorded traffic
+package assertion
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/buger/goreplay/internal/httpdiff"
+)
+
+// Types of rules
+const (
+	StatusEqualsOriginal = "status_equals_original"
+	StatusNot5xx         = "status_not_5xx"
+	JSONPathEquals       = "json_path_equals"
+	Latency              = "latency"
+	BodyMatches          = "body_matches"
+)
+
+// maxExamples limits failures kept for the summary of a rule
+const maxExamples = 5
+
+// Rules is the content of a rules file
+type Rules struct {
+	// default for rules without max_failure_rate, 0 fails on any failure
+	MaxFailureRate float64 `json:"max_failure_rate"`
+	Rules          []*Rule `json:"rules"`
+}
+
+// Rule is an assertion on responses of requests matching Method and Path
+type Rule struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// empty Method matches any method, Path is a regular expression
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// json_path_equals compares the field at JSONPath, like items.0.id, with Value
+	JSONPath string          `json:"json_path"`
+	Value    json.RawMessage `json:"value"`
+	// latency fails responses slower than MaxLatency, like 300ms
+	MaxLatency string `json:"max_latency"`
+	// body_matches fails bodies not matching Regexp
+	Regexp         string   `json:"regexp"`
+	MaxFailureRate *float64 `json:"max_failure_rate"`
+
+	path       *regexp.Regexp
+	body       *regexp.Regexp
+	jsonPath   []string
+	value      interface{}
+	maxLatency time.Duration
+}
+
+// Exchange is a replayed request with its responses
+type Exchange struct {
+	Method, Path string
+	// Original is nil if the recording has no responses, Replayed is nil if
+	// the replay target did not answer
+	Original, Replayed *httpdiff.Response
+	Latency            time.Duration
+}
+
+// Load reads the rules file
+func Load(path string) (*Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse parses and validates JSON rules
+func Parse(data []byte) (*Rules, error) {
+	rules := new(Rules)
+	if err := json.Unmarshal(data, rules); err != nil {
+		return nil, err
+	}
+	if len(rules.Rules) == 0 {
+		return nil, errors.New("no rules")
+	}
+	for i, r := range rules.Rules {
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("rule %d: %s", i+1, err)
+		}
+	}
+	return rules, nil
+}
+
+func (r *Rule) compile() (err error) {
+	if r.Path != "" {
+		if r.path, err = regexp.Compile(r.Path); err != nil {
+			return err
+		}
+	}
+	switch r.Type {
+	case StatusEqualsOriginal, StatusNot5xx:
+	case JSONPathEquals:
+		if r.JSONPath == "" || len(r.Value) == 0 {
+			return errors.New("json_path and value are required")
+		}
+		r.jsonPath = strings.Split(r.JSONPath, ".")
+		if err = json.Unmarshal(r.Value, &r.value); err != nil {
+			return err
+		}
+	case Latency:
+		if r.maxLatency, err = time.ParseDuration(r.MaxLatency); err != nil || r.maxLatency <= 0 {
+			return fmt.Errorf("invalid max_latency %q", r.MaxLatency)
+		}
+	case BodyMatches:
+		if r.body, err = regexp.Compile(r.Regexp); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown type %q", r.Type)
+	}
+	if r.Name == "" {
+		r.Name = strings.TrimSpace(r.Type + " " + r.Method + " " + r.Path)
+	}
+	return nil
+}
+
+// Applies reports whether the rule checks the exchange
+func (r *Rule) Applies(e *Exchange) bool {
+	if r.Method != "" && !strings.EqualFold(r.Method, e.Method) {
+		return false
+	}
+	if r.path != nil && !r.path.MatchString(e.Path) {
+		return false
+	}
+	// there is nothing to compare with
+	return r.Type != StatusEqualsOriginal || e.Original != nil
+}
+
+// Check returns the failure of the exchange, or an empty string
+func (r *Rule) Check(e *Exchange) string {
+	resp := e.Replayed
+	if resp == nil {
+		return "no response"
+	}
+	switch r.Type {
+	case StatusEqualsOriginal:
+		if resp.Status != e.Original.Status {
+			return fmt.Sprintf("status %d != %d", resp.Status, e.Original.Status)
+		}
+	case StatusNot5xx:
+		if resp.Status >= 500 {
+			return fmt.Sprintf("status %d", resp.Status)
+		}
+	case JSONPathEquals:
+		var body interface{}
+		if err := json.Unmarshal(resp.Body, &body); err != nil {
+			return "body is not JSON"
+		}
+		v, ok := lookup(body, r.jsonPath)
+		if !ok {
+			return r.JSONPath + ": missing"
+		}
+		if !reflect.DeepEqual(v, r.value) {
+			actual, _ := json.Marshal(v)
+			return fmt.Sprintf("%s: %s != %s", r.JSONPath, actual, r.Value)
+		}
+	case Latency:
+		if e.Latency > r.maxLatency {
+			return fmt.Sprintf("latency %s > %s", e.Latency.Round(time.Millisecond), r.maxLatency)
+		}
+	case BodyMatches:
+		if !r.body.Match(resp.Body) {
+			return "body does not match " + r.Regexp
+		}
+	}
+	return ""
+}
+
+// lookup returns the field of the JSON value at the path, array elements are
+// selected by their index
+func lookup(v interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		switch value := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = value[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(value) {
+				return nil, false
+			}
+			v = value[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// Checker checks exchanges against the rules, it is safe for concurrent use
+type Checker struct {
+	mu      sync.Mutex
+	rules   *Rules
+	results []*Result
+}
+
+// Result of a rule
+type Result struct {
+	Rule           string
+	Requests       uint64
+	Failures       uint64
+	MaxFailureRate float64
+	Examples       []string
+}
+
+// FailureRate returns the share of failed requests
+func (r *Result) FailureRate() float64 {
+	if r.Requests == 0 {
+		return 0
+	}
+	return float64(r.Failures) / float64(r.Requests)
+}
+
+// Passed reports whether the failure rate is within the threshold of the rule
+func (r *Result) Passed() bool {
+	return r.FailureRate() <= r.MaxFailureRate
+}
+
+// NewChecker returns a Checker of the rules
+func NewChecker(rules *Rules) *Checker {
+	c := &Checker{rules: rules}
+	for _, r := range rules.Rules {
+		rate := rules.MaxFailureRate
+		if r.MaxFailureRate != nil {
+			rate = *r.MaxFailureRate
+		}
+		c.results = append(c.results, &Result{Rule: r.Name, MaxFailureRate: rate})
+	}
+	return c
+}
+
+// NeedsOriginal reports whether any rule compares with the original response
+func (c *Checker) NeedsOriginal() bool {
+	for _, r := range c.rules.Rules {
+		if r.Type == StatusEqualsOriginal {
+			return true
+		}
+	}
+	return false
+}
+
+// Check checks the exchange against all rules which apply to it
+func (c *Checker) Check(e *Exchange) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, r := range c.rules.Rules {
+		if !r.Applies(e) {
+			continue
+		}
+		result := c.results[i]
+		result.Requests++
+		if failure := r.Check(e); failure != "" {
+			result.Failures++
+			if len(result.Examples) < maxExamples {
+				result.Examples = append(result.Examples, e.Method+" "+e.Path+": "+failure)
+			}
+		}
+	}
+}
+
+// Results returns a copy of results of all rules
+func (c *Checker) Results() []Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	results := make([]Result, len(c.results))
+	for i, r := range c.results {
+		results[i] = *r
+		results[i].Examples = append([]string(nil), r.Examples...)
+	}
+	return results
+}
+
+// Passed reports whether all rules passed
+func (c *Checker) Passed() bool {
+	for _, r := range c.Results() {
+		if !r.Passed() {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteSummary writes a table of results with examples of failures
+func (c *Checker) WriteSummary(w io.Writer) error {
+	results := c.Results()
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RULE\tREQUESTS\tFAILURES\tFAILURE RATE\tMAX RATE\tRESULT\t")
+	for _, r := range results {
+		result := "PASS"
+		if !r.Passed() {
+			result = "FAIL"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.2f%%\t%.2f%%\t%s\t\n", r.Rule, r.Requests, r.Failures, r.FailureRate()*100, r.MaxFailureRate*100, result)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, r := range results {
+		for _, example := range r.Examples {
+			if _, err := fmt.Fprintf(w, "%s: %s\n", r.Rule, example); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
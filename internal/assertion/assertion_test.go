@@ -0,0 +1,123 @@
+package assertion
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/internal/httpdiff"
+)
+
+const rulesJSON = `{
+	"max_failure_rate": 0,
+	"rules": [
+		{"type": "status_equals_original"},
+		{"name": "no server errors", "type": "status_not_5xx", "max_failure_rate": 0.5},
+		{"type": "json_path_equals", "method": "POST", "path": "^/orders", "json_path": "items.0.state", "value": "created"},
+		{"type": "latency", "max_latency": "100ms"},
+		{"type": "body_matches", "path": "^/health", "regexp": "^ok$"}
+	]
+}`
+
+func response(status int, body string) *httpdiff.Response {
+	return &httpdiff.Response{Status: status, Body: []byte(body)}
+}
+
+func TestParse(t *testing.T) {
+	for _, data := range []string{
+		`{"rules": []}`,
+		`{"rules": [{"type": "unknown"}]}`,
+		`{"rules": [{"type": "latency", "max_latency": "fast"}]}`,
+		`{"rules": [{"type": "json_path_equals", "json_path": "a"}]}`,
+		`{"rules": [{"type": "body_matches", "regexp": "("}]}`,
+		`{"rules": [{"type": "status_not_5xx", "path": "("}]}`,
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("expected error for %s", data)
+		}
+	}
+	rules, err := Parse([]byte(rulesJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules.Rules[0].Name != "status_equals_original" || rules.Rules[2].Name != "json_path_equals POST ^/orders" {
+		t.Errorf("wrong default names %q %q", rules.Rules[0].Name, rules.Rules[2].Name)
+	}
+}
+
+func TestRuleCheck(t *testing.T) {
+	rules, err := Parse([]byte(rulesJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameStatus, no5xx, state, latency, health := rules.Rules[0], rules.Rules[1], rules.Rules[2], rules.Rules[3], rules.Rules[4]
+
+	for i, tt := range []struct {
+		rule     *Rule
+		exchange Exchange
+		applies  bool
+		failure  string
+	}{
+		{sameStatus, Exchange{Method: "GET", Path: "/", Original: response(200, ""), Replayed: response(404, "")}, true, "status 404 != 200"},
+		{sameStatus, Exchange{Method: "GET", Path: "/", Replayed: response(404, "")}, false, ""},
+		{no5xx, Exchange{Method: "GET", Path: "/", Replayed: response(503, "")}, true, "status 503"},
+		{no5xx, Exchange{Method: "GET", Path: "/"}, true, "no response"},
+		{state, Exchange{Method: "POST", Path: "/orders", Replayed: response(200, `{"items":[{"state":"created"}]}`)}, true, ""},
+		{state, Exchange{Method: "POST", Path: "/orders", Replayed: response(200, `{"items":[{"state":"failed"}]}`)}, true, `items.0.state: "failed" != "created"`},
+		{state, Exchange{Method: "POST", Path: "/orders", Replayed: response(200, `{"items":[]}`)}, true, "items.0.state: missing"},
+		{state, Exchange{Method: "POST", Path: "/orders", Replayed: response(200, `<html>`)}, true, "body is not JSON"},
+		{state, Exchange{Method: "GET", Path: "/orders", Replayed: response(200, `{}`)}, false, ""},
+		{latency, Exchange{Method: "GET", Path: "/", Replayed: response(200, ""), Latency: 150 * time.Millisecond}, true, "latency 150ms > 100ms"},
+		{latency, Exchange{Method: "GET", Path: "/", Replayed: response(200, ""), Latency: 50 * time.Millisecond}, true, ""},
+		{health, Exchange{Method: "GET", Path: "/health", Replayed: response(200, "degraded")}, true, "body does not match ^ok$"},
+	} {
+		if applies := tt.rule.Applies(&tt.exchange); applies != tt.applies {
+			t.Errorf("%d: expected applies %v", i, tt.applies)
+			continue
+		}
+		if !tt.applies {
+			continue
+		}
+		if failure := tt.rule.Check(&tt.exchange); failure != tt.failure {
+			t.Errorf("%d: expected failure %q, got %q", i, tt.failure, failure)
+		}
+	}
+}
+
+func TestChecker(t *testing.T) {
+	rules, err := Parse([]byte(`{"rules": [
+		{"name": "no server errors", "type": "status_not_5xx", "max_failure_rate": 0.5},
+		{"name": "fast", "type": "latency", "max_latency": "100ms"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewChecker(rules)
+	if c.NeedsOriginal() {
+		t.Error("rules do not compare with original responses")
+	}
+	c.Check(&Exchange{Method: "GET", Path: "/a", Replayed: response(200, ""), Latency: time.Millisecond})
+	c.Check(&Exchange{Method: "GET", Path: "/b", Replayed: response(500, ""), Latency: time.Millisecond})
+	if !c.Passed() {
+		t.Error("failure rate is within thresholds")
+	}
+	c.Check(&Exchange{Method: "GET", Path: "/c", Replayed: response(200, ""), Latency: time.Second})
+	if c.Passed() {
+		t.Error("slow response should fail")
+	}
+
+	results := c.Results()
+	if results[0].Requests != 3 || results[0].Failures != 1 || !results[0].Passed() || results[1].Failures != 1 || results[1].Passed() {
+		t.Errorf("unexpected results %+v", results)
+	}
+	var summary bytes.Buffer
+	if err := c.WriteSummary(&summary); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"no server errors: GET /b: status 500", "fast: GET /c: latency 1s > 100ms"} {
+		if !strings.Contains(summary.String(), expected) {
+			t.Errorf("summary should contain %q\n%s", expected, summary.String())
+		}
+	}
+}
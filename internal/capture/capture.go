@@ -1,18 +1,29 @@
 package capture
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"expvar"
 	"fmt"
+	"github.com/buger/goreplay/internal/dns"
+	"github.com/buger/goreplay/internal/grpc"
+	"github.com/buger/goreplay/internal/http2"
+	"github.com/buger/goreplay/internal/mysql"
+	"github.com/buger/goreplay/internal/postgres"
+	"github.com/buger/goreplay/internal/redis"
 	"github.com/buger/goreplay/internal/size"
 	"github.com/buger/goreplay/internal/tcp"
+	"github.com/buger/goreplay/internal/tlsdecrypt"
+	"github.com/buger/goreplay/internal/ws"
 	"github.com/buger/goreplay/proto"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -21,10 +32,6 @@ import (
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
-
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 )
 
 var stats *expvar.Map
@@ -67,6 +74,13 @@ type PcapOptions struct {
 	Stats           bool            `json:"input-raw-stats"`
 	AllowIncomplete bool            `json:"input-raw-allow-incomplete"`
 	IgnoreInterface []string        `json:"input-raw-ignore-interface"`
+	TLSKeyLog       string          `json:"input-raw-tls-keylog"`
+	Decap           Decapsulation   `json:"input-raw-decap"`
+	TunnelIDs       []int           `json:"input-raw-tunnel-id"`
+	ParserWorkers   int             `json:"input-raw-parser-workers"`
+	Sample          float64         `json:"input-raw-sample"`
+	SampleByClient  bool            `json:"input-raw-sample-by-client"`
+	StreamChunkSize size.Size       `json:"input-raw-stream-chunk-size"`
 	Transport       string
 }
 
@@ -83,8 +97,11 @@ type Listener struct {
 	Reading    chan bool // this channel is closed when the listener has started reading packets
 	messages   chan *tcp.Message
 
-	ports []uint16
-	host  string // pcap file name or interface (name, hardware addr, index or ip address)
+	ports  []uint16
+	host   string // pcap file name or interface (name, hardware addr, index or ip address)
+	keyLog *tlsdecrypt.KeyLog
+	pods   *podWatcher // pods of k8s:// host
+	netns  string      // network namespace file of netns:// or pid:// host
 
 	closeDone chan struct{}
 	quit      chan struct{}
@@ -145,8 +162,8 @@ func (eng *EngineType) String() (e string) {
 	return e
 }
 
-// NewListener creates and initialize a new Listener. if transport or/and engine are invalid/unsupported
-// is "tcp" and "pcap", are assumed. l.Engine and l.Transport can help to get the values used.
+// NewListener creates and initialize a new Listener. if engine is invalid/unsupported "pcap" is assumed,
+// the transport ("tcp" or "udp") is chosen by the protocol. l.Engine and l.Transport can help to get the values used.
 // if there is an error it will be associated with getting network interfaces
 func NewListener(host string, ports []uint16, config PcapOptions) (l *Listener, err error) {
 	l = &Listener{}
@@ -155,10 +172,14 @@ func NewListener(host string, ports []uint16, config PcapOptions) (l *Listener,
 	if l.host == "localhost" {
 		l.host = "127.0.0.1"
 	}
+	if path, ok := netnsPath(host); ok {
+		// all interfaces of the namespace
+		l.netns, l.host = path, ""
+	}
 	l.ports = ports
 
 	l.config = config
-	l.config.Transport = "tcp"
+	l.config.Transport = l.config.Protocol.Transport()
 	l.Handles = make(map[string]packetHandle)
 
 	l.closeDone = make(chan struct{})
@@ -166,8 +187,28 @@ func NewListener(host string, ports []uint16, config PcapOptions) (l *Listener,
 	l.Reading = make(chan bool)
 	l.messages = make(chan *tcp.Message, 10000)
 
+	if config.TLSKeyLog != "" {
+		switch config.Protocol {
+		case tcp.ProtocolBinary, tcp.ProtocolPostgres, tcp.ProtocolMySQL, tcp.ProtocolDNS:
+			return nil, fmt.Errorf("TLS decryption is not supported for %s protocol", config.Protocol.String())
+		}
+		if l.keyLog, err = tlsdecrypt.OpenKeyLog(config.TLSKeyLog); err != nil {
+			return nil, err
+		}
+	}
+
 	if strings.HasPrefix(l.host, "k8s://") {
-		l.config.BPFFilter = l.Filter(pcap.Interface{}, k8sIPs(l.host[6:])...)
+		client, err := k8sClient()
+		if err != nil {
+			return nil, err
+		}
+		if l.pods, err = newPodWatcher(client, l.host[6:], l.podsChanged); err != nil {
+			return nil, err
+		}
+		// the watcher may already report changes
+		l.Lock()
+		l.config.BPFFilter = l.Filter(pcap.Interface{}, l.pods.IPs()...)
+		l.Unlock()
 	}
 
 	switch config.Engine {
@@ -179,13 +220,25 @@ func NewListener(host string, ports []uint16, config PcapOptions) (l *Listener,
 		l.Activate = l.activateAFPacket
 	case EnginePcapFile:
 		l.Activate = l.activatePcapFile
-		return
 	case EngineVXLAN:
 		l.Activate = l.activateVxLanSocket
+	}
+	if l.netns != "" {
+		activate := l.Activate
+		l.Activate = func() error { return l.inNetns(activate) }
+	}
+	// handles are created with the filter which podsChanged updates
+	activate := l.Activate
+	l.Activate = func() error {
+		l.Lock()
+		defer l.Unlock()
+		return activate()
+	}
+	if config.Engine == EnginePcapFile || config.Engine == EngineVXLAN {
 		return
 	}
 
-	err = l.setInterfaces()
+	err = l.inNetns(l.setInterfaces)
 	if err != nil {
 		return nil, err
 	}
@@ -210,26 +263,11 @@ func (l *Listener) Listen(ctx context.Context) (err error) {
 				return
 			}
 
-			// Check for Pod IP changes
-			if strings.HasPrefix(l.host, "k8s://") {
-				newFilter := l.Filter(pcap.Interface{}, k8sIPs(l.host[6:])...)
-				if newFilter != l.config.BPFFilter {
-					fmt.Println("k8s pods configuration changed, new filter: ", newFilter)
-					for _, h := range l.Handles {
-						if _, ok := h.handler.(PcapSetFilter); ok {
-							h.handler.(PcapSetFilter).SetBPFFilter(newFilter)
-						}
-					}
-
-					l.config.BPFFilter = newFilter
-				}
-			}
-
 			var prevInterfaces []string
 			for _, in := range l.Interfaces {
 				prevInterfaces = append(prevInterfaces, in.Name)
 			}
-			l.setInterfaces()
+			l.inNetns(l.setInterfaces)
 
 			for _, in := range l.Interfaces {
 				var found bool
@@ -242,9 +280,9 @@ func (l *Listener) Listen(ctx context.Context) (err error) {
 
 				if !found {
 					fmt.Println("Found new interface:", in.Name)
-					l.Lock()
 					l.Activate()
 
+					l.Lock()
 					for key, handle := range l.Handles {
 						if key == in.Name {
 							fmt.Println("Activating capture on:", in.Name)
@@ -269,6 +307,9 @@ func (l *Listener) Listen(ctx context.Context) (err error) {
 	}
 
 	l.closed = true
+	if l.pods != nil {
+		l.pods.Close()
+	}
 	return
 }
 
@@ -284,78 +325,53 @@ func (l *Listener) ListenBackground(ctx context.Context) chan error {
 	return err
 }
 
-// Allowed format:
-//
-//	[namespace/]pod/[pod_name]
-//	[namespace/]deployment/[deployment_name]
-//	[namespace/]daemonset/[daemonset_name]
-//	[namespace/]labelSelector/[selector]
-//	[namespace/]fieldSelector/[selector]
-func k8sIPs(addr string) []string {
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		panic(err.Error())
-	}
-
-	// creates the clientset
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		panic(err.Error())
-	}
-
-	sections := strings.Split(addr, "/")
-
-	if len(sections) < 2 {
-		panic("Not supported k8s scheme. Allowed values: [namespace/]pod/[pod_name], [namespace/]deployment/[deployment_name], [namespace/]daemonset/[daemonset_name], [namespace/]label/[label-name]/[label-value]")
+// Pod returns the pod of the address when the host is a k8s:// address
+func (l *Listener) Pod(ip string) *Pod {
+	if l.pods == nil {
+		return nil
 	}
+	return l.pods.Pod(ip)
+}
 
-	// If no namespace passed, assume it is ALL
-	switch sections[0] {
-	case "pod", "deployment", "daemonset", "labelSelector", "fieldSelector":
-		sections = append([]string{""}, sections...)
-	}
-
-	namespace, selectorType, selectorValue := sections[0], sections[1], sections[2]
-
-	labelSelector := ""
-	fieldSelector := ""
-
-	switch selectorType {
-	case "pod":
-		fieldSelector = "metadata.name=" + selectorValue
-	case "deployment":
-		labelSelector = "app=" + selectorValue
-	case "daemonset":
-		labelSelector = "pod-template-generation=1,name=" + selectorValue
-	case "labelSelector":
-		labelSelector = selectorValue
-	case "fieldSelector":
-		fieldSelector = selectorValue
-	}
+// podsChanged applies the filter of the new addresses of pods to all handles
+func (l *Listener) podsChanged(ips []string) {
+	filter := l.Filter(pcap.Interface{}, ips...)
 
-	pods, err := clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: labelSelector, FieldSelector: fieldSelector})
-	if err != nil {
-		panic(err.Error())
+	l.Lock()
+	defer l.Unlock()
+	if filter == l.config.BPFFilter {
+		return
 	}
-
-	var podIPs []string
-	for _, pod := range pods.Items {
-		for _, podIP := range pod.Status.PodIPs {
-			podIPs = append(podIPs, podIP.IP)
+	log.Printf("k8s pods configuration changed, new filter: %s\n", filter)
+	for key, h := range l.Handles {
+		var err error
+		switch handler := h.handler.(type) {
+		case PcapSetFilter:
+			err = handler.SetBPFFilter(filter)
+		case interface{ SetBPFFilter(string, int) error }:
+			err = handler.SetBPFFilter(filter, 64<<10)
+		}
+		if err != nil {
+			log.Printf("can not update filter of '%s' interface: %s\n", key, err)
 		}
 	}
-	return podIPs
+	l.config.BPFFilter = filter
 }
 
+// noPacketsFilter matches no packets, as they are never empty. Unlike filters
+// which are always false, libpcap does not reject it when it is compiled.
+const noPacketsFilter = "less 0"
+
 // Filter returns automatic filter applied by goreplay
 // to a pcap handle of a specific interface
 func (l *Listener) Filter(ifi pcap.Interface, hosts ...string) (filter string) {
 	// https://www.tcpdump.org/manpages/pcap-filter.7.html
 
 	if len(hosts) == 0 {
-		// If k8s have not found any IPs
+		// If k8s have not found any IPs, nothing is captured until pods are
+		// scheduled. Without hosts the filter would match all of them.
 		if strings.HasPrefix(l.host, "k8s://") {
-			hosts = []string{}
+			return noPacketsFilter
 		} else {
 			hosts = []string{l.host}
 
@@ -365,6 +381,39 @@ func (l *Listener) Filter(ifi pcap.Interface, hosts ...string) (filter string) {
 		}
 	}
 
+	if l.config.Decap != 0 {
+		// mirrored packets are filtered after decapsulation, see decapFilter
+		filter = fmt.Sprintf("(%s)", l.config.Decap.filter())
+	} else {
+		filter = l.trafficFilter(hosts)
+	}
+
+	if l.config.VLAN {
+		if len(l.config.VLANVIDs) > 0 {
+			for _, vi := range l.config.VLANVIDs {
+				filter = fmt.Sprintf("vlan %d and ", vi) + filter
+			}
+		} else {
+			filter = "vlan and " + filter
+		}
+	}
+
+	return
+}
+
+// decapFilter returns the filter of decapsulated packets. Mirrored packets are
+// sent to other hosts, so addresses of interfaces are not used.
+func (l *Listener) decapFilter() string {
+	var hosts []string
+	if !listenAll(l.host) && net.ParseIP(l.host) != nil {
+		hosts = []string{l.host}
+	}
+	return l.trafficFilter(hosts)
+}
+
+// trafficFilter returns the filter of packets sent to the ports of the hosts,
+// and of their responses when they are tracked
+func (l *Listener) trafficFilter(hosts []string) (filter string) {
 	filter = portsFilter(l.config.Transport, "dst", l.ports)
 
 	if len(hosts) != 0 && !l.config.Promiscuous {
@@ -384,17 +433,6 @@ func (l *Listener) Filter(ifi pcap.Interface, hosts ...string) (filter string) {
 
 		filter = fmt.Sprintf("%s or %s", filter, responseFilter)
 	}
-
-	if l.config.VLAN {
-		if len(l.config.VLANVIDs) > 0 {
-			for _, vi := range l.config.VLANVIDs {
-				filter = fmt.Sprintf("vlan %d and ", vi) + filter
-			}
-		} else {
-			filter = "vlan and " + filter
-		}
-	}
-
 	return
 }
 
@@ -521,6 +559,359 @@ func http1EndHint(m *tcp.Message) bool {
 	return proto.HasFullPayload(m, m.PacketData()...) && (req || res)
 }
 
+// http1Stream is HTTP/1 state of a connection. The stream of each direction
+// is split into messages, so pipelined requests and responses sharing packets
+// become separate messages.
+type http1Stream struct {
+	started  bool
+	upgraded bool
+	bufs     [2][]byte
+	packets  [2][]*tcp.Packet
+	last     [2]time.Time // when data of each direction was last buffered
+	lost     [2]bool      // data of the direction was lost, wait for the next message
+	count    [2]uint32    // number of messages in each direction, pairs responses with requests
+	methods  []string     // methods of requests waiting for responses
+	ws       *wsStream    // the connection was upgraded to WebSocket
+
+	chunkSize int           // bodies of larger messages are streamed, see http1StreamingHint
+	bodies    [2]*http1Body // streamed message of each direction
+}
+
+// http1Body is the body of a message which is emitted in chunks, the
+// buffer of its direction holds only the part which was not emitted yet
+type http1Body struct {
+	id        uint32
+	chunk     uint32
+	remaining int  // left bytes of a Content-Length body
+	chunked   bool // Transfer-Encoding: chunked
+	scanner   proto.ChunkedScanner
+	scanned   int  // bytes of the buffer which belong to the body
+	events    bool // text/event-stream, chunks are emitted as soon as they come
+}
+
+// wsStream is WebSocket state of an upgraded HTTP/1 connection
+type wsStream struct {
+	upgradeID uint32 // the number of the upgrade request
+	seq       uint32
+	readers   [2]ws.Reader
+}
+
+// http1StreamHint splits HTTP/1 stream of a connection into messages
+func http1StreamHint(c *tcp.Conn, pckt *tcp.Packet, data []byte) {
+	http1State(c, 0).parse(c, pckt, data)
+}
+
+// http1StreamingHint is http1StreamHint which does not buffer messages larger
+// than chunkSize and server-sent events: their headers are emitted as soon as
+// they are complete and their bodies follow in chunks, see tcp.Conn.EmitChunk.
+func http1StreamingHint(chunkSize int) tcp.HintStream {
+	return func(c *tcp.Conn, pckt *tcp.Packet, data []byte) {
+		http1State(c, chunkSize).parse(c, pckt, data)
+	}
+}
+
+func http1State(c *tcp.Conn, chunkSize int) *http1Stream {
+	st, ok := c.ProtocolState().(*http1Stream)
+	if !ok {
+		st = &http1Stream{chunkSize: chunkSize}
+		c.SetProtocolState(st)
+	}
+	return st
+}
+
+func (st *http1Stream) parse(c *tcp.Conn, pckt *tcp.Packet, data []byte) {
+	if st.upgraded {
+		// the connection speaks other protocol after 101 Switching Protocols
+		if st.ws != nil {
+			dir := c.Dir(pckt)
+			st.buffer(dir, pckt, data)
+			st.websocketFrames(c, dir)
+		}
+		return
+	}
+
+	dir := c.Dir(pckt)
+	if !st.started {
+		st.started = true
+		if (dir == tcp.DirOutcoming && proto.HasRequestTitle(data)) || (dir == tcp.DirIncoming && proto.HasResponseTitle(data)) {
+			c.Swap()
+			dir = c.Dir(pckt)
+		}
+	}
+	i := dir - 1
+	if st.lost[i] {
+		if !proto.HasTitle(data) {
+			stats.Add("http1_skipped_data", 1)
+			return
+		}
+		st.lost[i] = false
+	}
+	if len(st.bufs[i]) == 0 && st.bodies[i] == nil && bytes.Contains(data, proto.CRLF) && !proto.HasTitle(data) {
+		// the capture started in the middle of a message, wait for the next one
+		stats.Add("http1_skipped_data", 1)
+		return
+	}
+	st.buffer(dir, pckt, data)
+
+	for len(st.bufs[i]) > 0 {
+		if st.bodies[i] != nil {
+			if !st.streamBody(c, dir) {
+				return
+			}
+			continue
+		}
+
+		buf := st.bufs[i]
+		var status []byte
+		var end int
+		if dir == tcp.DirOutcoming {
+			status = proto.Status(buf)
+			end = st.responseEndPos(buf, status)
+		} else {
+			end = proto.MessageEndPos(buf)
+		}
+		if end < 0 {
+			headersEnd := proto.MIMEHeadersEndPos(buf)
+			if headersEnd > 0 && !proto.HasTitle(buf) {
+				stats.Add("http1_invalid_messages", 1)
+				c.Broken = true
+			}
+			if headersEnd > 0 && st.startBody(c, dir, buf[:headersEnd]) {
+				continue
+			}
+			return
+		}
+
+		switch {
+		case dir == tcp.DirIncoming:
+			c.Emit(dir, st.next(dir, buf), withoutExpect(append([]byte(nil), buf[:end]...)), st.packets[i])
+		case len(status) != 3 || status[0] != '1' || string(status) == "101":
+			// interim responses do not have requests of their own
+			c.Emit(dir, st.next(dir, buf), append([]byte(nil), buf[:end]...), st.packets[i])
+		}
+		st.upgraded = string(status) == "101"
+		if st.upgraded && bytes.EqualFold(proto.Header(buf[:end], []byte("Upgrade")), []byte("websocket")) {
+			st.ws = &wsStream{upgradeID: st.count[i], seq: st.count[i]}
+			deflate, clientNoContext, serverNoContext := ws.Deflate(string(proto.Header(buf[:end], []byte("Sec-WebSocket-Extensions"))))
+			st.ws.readers[0] = ws.Reader{Deflate: deflate, NoContextTakeover: clientNoContext}
+			st.ws.readers[1] = ws.Reader{Deflate: deflate, NoContextTakeover: serverNoContext}
+		}
+
+		st.consume(dir, end)
+		if st.upgraded {
+			if st.ws != nil {
+				// frames which came with the handshake
+				st.websocketFrames(c, tcp.DirIncoming)
+				st.websocketFrames(c, tcp.DirOutcoming)
+			}
+			return
+		}
+	}
+}
+
+// next returns the number of the next message of the direction, buf is the
+// message. Responses get the number of the oldest request waiting for them.
+func (st *http1Stream) next(dir tcp.Dir, buf []byte) uint32 {
+	i := dir - 1
+	st.count[i]++
+	if dir == tcp.DirIncoming {
+		st.methods = append(st.methods, string(proto.Method(buf)))
+		return st.count[i]
+	}
+	if st.count[i] > st.count[0] {
+		// the request was sent before the capture started
+		st.count[0] = st.count[i]
+	}
+	if len(st.methods) > 0 {
+		st.methods = st.methods[1:]
+	}
+	return st.count[i]
+}
+
+// startBody emits headers of an incomplete message and starts streaming its
+// body if the message is large or is a stream of server-sent events. It
+// reports whether the body is streamed.
+func (st *http1Stream) startBody(c *tcp.Conn, dir tcp.Dir, headers []byte) bool {
+	i := dir - 1
+	if st.chunkSize <= 0 || c.Broken {
+		return false
+	}
+	body := new(http1Body)
+	if bytes.Contains(bytes.ToLower(proto.Header(headers, []byte("Transfer-Encoding"))), []byte("chunked")) {
+		body.chunked = true
+	} else if n, err := strconv.Atoi(string(proto.Header(headers, []byte("Content-Length")))); err == nil && n > 0 {
+		body.remaining = n
+	} else {
+		return false
+	}
+	if dir == tcp.DirOutcoming {
+		body.events = bytes.HasPrefix(bytes.ToLower(proto.Header(headers, []byte("Content-Type"))), []byte("text/event-stream"))
+	}
+	if !body.events && len(st.bufs[i]) < st.chunkSize {
+		return false
+	}
+
+	body.id = st.next(dir, headers)
+	body.chunk = 1
+	st.bodies[i] = body
+	stats.Add("http1_streamed_messages", 1)
+	st.emitChunk(c, dir, body, len(headers), true)
+	return true
+}
+
+// streamBody emits the buffered part of the streamed body once it is large
+// enough or complete. It reports whether the buffer has data of the next
+// message.
+func (st *http1Stream) streamBody(c *tcp.Conn, dir tcp.Dir) bool {
+	i := dir - 1
+	body := st.bodies[i]
+	rest := st.bufs[i][body.scanned:]
+	var n int
+	var done bool
+	if body.chunked {
+		var err error
+		if n, done, err = body.scanner.Scan(rest); err != nil {
+			stats.Add("http1_invalid_chunks", 1)
+			c.Broken = true
+			return false
+		}
+	} else {
+		if n = len(rest); n > body.remaining {
+			n = body.remaining
+		}
+		body.remaining -= n
+		done = body.remaining == 0
+	}
+	body.scanned += n
+
+	switch {
+	case done:
+		st.bodies[i] = nil
+		st.emitChunk(c, dir, body, body.scanned, false)
+		return len(st.bufs[i]) > 0
+	case body.scanned >= st.chunkSize || (body.events && body.scanned > 0):
+		st.emitChunk(c, dir, body, body.scanned, true)
+	}
+	return false
+}
+
+// emitChunk emits the next part of the streamed message of the direction,
+// it is the first n bytes of the buffer
+func (st *http1Stream) emitChunk(c *tcp.Conn, dir tcp.Dir, body *http1Body, n int, more bool) {
+	i := dir - 1
+	data := append([]byte(nil), st.bufs[i][:n]...)
+	if dir == tcp.DirIncoming && body.chunk == 1 {
+		data = withoutExpect(data)
+	}
+	c.EmitChunk(dir, body.id, body.chunk, more, data, st.packets[i])
+	body.chunk++
+	body.scanned = 0
+	st.consume(dir, n)
+}
+
+// websocketFrames emits WebSocket messages of the buffered data of the
+// direction, control frames other than Close are skipped
+func (st *http1Stream) websocketFrames(c *tcp.Conn, dir tcp.Dir) {
+	i := dir - 1
+	for !c.Broken && len(st.bufs[i]) > 0 {
+		opcode, msg, size, err := st.ws.readers[i].Next(st.bufs[i])
+		if err != nil {
+			stats.Add("websocket_invalid_conn", 1)
+			c.Broken = true
+			return
+		}
+		if size < 0 {
+			return
+		}
+		if opcode == ws.OpText || opcode == ws.OpBinary || opcode == ws.OpClose {
+			st.ws.seq++
+			c.EmitFrame(dir, st.ws.upgradeID, st.ws.seq, opcode, msg, st.packets[i])
+		}
+		st.consume(dir, size)
+	}
+}
+
+// buffer appends data of the packet to the buffer of the direction
+func (st *http1Stream) buffer(dir tcp.Dir, pckt *tcp.Packet, data []byte) {
+	i := dir - 1
+	st.bufs[i] = append(st.bufs[i], data...)
+	st.packets[i] = append(st.packets[i], pckt)
+	st.last[i] = time.Now()
+}
+
+// consume removes the first n bytes of the buffer of the direction, which
+// were emitted. The rest of the data came with the last packet, so it is the
+// first packet of the next message.
+func (st *http1Stream) consume(dir tcp.Dir, n int) {
+	i := dir - 1
+	st.bufs[i] = append(st.bufs[i][:0], st.bufs[i][n:]...)
+	if len(st.bufs[i]) == 0 {
+		st.packets[i] = nil
+	} else {
+		st.packets[i] = []*tcp.Packet{st.packets[i][len(st.packets[i])-1]}
+	}
+}
+
+// Expire drops partial messages which got no data since the deadline, like
+// messages of the Start and End hints after --input-raw-expire. Streamed
+// bodies are bounded by the chunk size and WebSocket frames cannot be
+// resynchronized, so they wait for the connection to expire.
+func (st *http1Stream) Expire(c *tcp.Conn, deadline time.Time) {
+	if st.upgraded {
+		return
+	}
+	for i := range st.bufs {
+		if len(st.bufs[i]) == 0 || st.bodies[i] != nil || st.last[i].After(deadline) {
+			continue
+		}
+		stats.Add("http1_expired_messages", 1)
+		stats.Add("http1_expired_bytes", int64(len(st.bufs[i])))
+		st.bufs[i], st.packets[i] = nil, nil
+	}
+}
+
+// withoutExpect removes Expect: 100-continue header of the request, the body
+// is replayed with the headers, like by tcp.Message.Data
+func withoutExpect(request []byte) []byte {
+	if bytes.EqualFold(proto.Header(request, []byte("Expect")), []byte("100-continue")) {
+		return proto.DeleteHeader(request, []byte("Expect"))
+	}
+	return request
+}
+
+// SkipGap drops the partial message of the direction whose data was lost,
+// data is skipped until the next message starts. Upgraded connections can not
+// be resynchronized.
+func (st *http1Stream) SkipGap(c *tcp.Conn, dir tcp.Dir) {
+	if st.upgraded {
+		c.Broken = true
+		return
+	}
+	i := dir - 1
+	if len(st.bufs[i]) > 0 || st.bodies[i] != nil {
+		stats.Add("http1_lost_messages", 1)
+	}
+	st.bufs[i], st.packets[i], st.bodies[i] = nil, nil, nil
+	st.lost[i] = true
+}
+
+// responseEndPos returns the end of the response to the oldest request
+// waiting for a response, or -1 if the response is not complete
+func (st *http1Stream) responseEndPos(buf, status []byte) int {
+	var method string
+	if len(st.methods) > 0 {
+		method = st.methods[0]
+	}
+	// https://www.rfc-editor.org/rfc/rfc9112#section-6.3
+	if method == http.MethodHead || (len(status) == 3 && (status[0] == '1' || string(status) == "204" || string(status) == "304")) {
+		if !proto.HasResponseTitle(buf) {
+			return -1
+		}
+		return proto.MIMEHeadersEndPos(buf)
+	}
+	return proto.MessageEndPos(buf)
+}
+
 func (l *Listener) readHandle(key string, hndl packetHandle) {
 	runtime.LockOSThread()
 
@@ -538,11 +929,52 @@ func (l *Listener) readHandle(key string, hndl packetHandle) {
 		}
 	}
 
-	messageParser := tcp.NewMessageParser(l.messages, l.ports, hndl.ips, l.config.Expire, l.config.AllowIncomplete)
+	ips := hndl.ips
+	var decap *decapsulator
+	if l.config.Decap != 0 {
+		var err error
+		if decap, err = newDecapsulator(l.config.Decap, l.config.TunnelIDs, l.decapFilter()); err != nil {
+			log.Printf("can not decapsulate packets of '%s' interface: %s\n", key, err)
+			return
+		}
+		// mirrored packets are sent to other hosts
+		ips = nil
+	}
+
+	messageParser := tcp.NewMessageParser(l.messages, l.ports, ips, l.config.Expire, l.config.AllowIncomplete)
+	defer messageParser.Close()
+	messageParser.Workers = l.config.ParserWorkers
+	if l.config.Sample > 0 && l.config.Sample < 100 {
+		messageParser.Sampler = tcp.NewSampler(l.config.Sample, l.config.SampleByClient)
+	}
 
-	if l.config.Protocol == tcp.ProtocolHTTP {
-		messageParser.Start = http1StartHint
-		messageParser.End = http1EndHint
+	switch l.config.Protocol {
+	case tcp.ProtocolHTTP:
+		if l.config.AllowIncomplete && l.keyLog == nil {
+			// messages with missing packets can not be split, group packets by Ack
+			messageParser.Start = http1StartHint
+			messageParser.End = http1EndHint
+		} else if l.config.StreamChunkSize > 0 {
+			messageParser.Stream = http1StreamingHint(int(l.config.StreamChunkSize))
+		} else {
+			messageParser.Stream = http1StreamHint
+		}
+	case tcp.ProtocolHTTP2:
+		messageParser.Stream = http2.StreamHint
+	case tcp.ProtocolGRPC:
+		messageParser.Stream = grpc.StreamHint
+	case tcp.ProtocolPostgres:
+		messageParser.Start = postgres.StartHint
+		messageParser.End = postgres.EndHint
+	case tcp.ProtocolMySQL:
+		messageParser.Stream = mysql.StreamHint
+	case tcp.ProtocolRedis:
+		messageParser.Stream = redis.StreamHint
+	case tcp.ProtocolDNS:
+		messageParser.Datagram = dns.DatagramHint
+	}
+	if l.keyLog != nil {
+		messageParser.Stream = tlsdecrypt.Hint(l.keyLog, messageParser.Stream)
 	}
 
 	timer := time.NewTicker(1 * time.Second)
@@ -563,16 +995,25 @@ func (l *Listener) readHandle(key string, hndl packetHandle) {
 		default:
 			data, ci, err := hndl.handler.ReadPacketData()
 			if err == nil {
+				if h, ok := hndl.handler.(*fileHandle); ok {
+					// interfaces of pcapng files can have different link types
+					lType, lSize := h.LinkType()
+					linkType, linkSize = int(lType), lSize
+				}
 				if l.config.TimestampType == "go" {
 					ci.Timestamp = time.Now()
 				}
 
-				messageParser.PacketHandler(&tcp.PcapPacket{
+				pckt := &tcp.PcapPacket{
 					Data:     data,
 					LType:    linkType,
 					LTypeLen: linkSize,
 					Ci:       &ci,
-				})
+				}
+				if decap != nil && !decap.Decap(pckt) {
+					continue
+				}
+				messageParser.PacketHandler(pckt)
 				continue
 			}
 			if enext, ok := err.(pcap.NextError); ok && enext == pcap.NextErrorTimeoutExpired {
@@ -586,6 +1027,8 @@ func (l *Listener) readHandle(key string, hndl packetHandle) {
 			}
 			if err == io.EOF || err == io.ErrClosedPipe {
 				log.Printf("stopped reading from %s interface with error %s\n", key, err)
+				// messages of the end of capture files are emitted
+				messageParser.Flush()
 				return
 			}
 
@@ -680,20 +1123,14 @@ func (l *Listener) activateRawSocket() error {
 }
 
 func (l *Listener) activatePcapFile() (err error) {
-	var handle *pcap.Handle
-	var e error
-	if handle, e = pcap.OpenOffline(l.host); e != nil {
-		return fmt.Errorf("open pcap file error: %q", e)
-	}
-
 	tmp := l.host
 	l.host = ""
 	l.config.BPFFilter = l.Filter(pcap.Interface{})
 	l.host = tmp
 
-	if e = handle.SetBPFFilter(l.config.BPFFilter); e != nil {
-		handle.Close()
-		return fmt.Errorf("BPF filter error: %q, filter: %s", e, l.config.BPFFilter)
+	handle, e := openFile(l.host, l.config.BPFFilter, l.config.VLAN)
+	if e != nil {
+		return fmt.Errorf("open pcap file error: %q, filter: %s", e, l.config.BPFFilter)
 	}
 
 	fmt.Println("BPF Filter:", l.config.BPFFilter)
@@ -1,7 +1,28 @@
 package capture
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"expvar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/buger/goreplay/internal/tcp"
+	"github.com/buger/goreplay/internal/ws"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestSetInterfaces(t *testing.T) {
@@ -20,3 +41,599 @@ func TestSetInterfaces(t *testing.T) {
 		t.Errorf("loopback nic index was not found")
 	}
 }
+
+// loopbackPacket builds loopback IPv4 packet between 127.0.0.1:40000 and 127.0.0.1:80
+func loopbackPacket(fromClient bool, seq uint32, payload string) *tcp.PcapPacket {
+	data := make([]byte, 4+20+20, 4+20+20+len(payload))
+	binary.BigEndian.PutUint32(data, uint32(layers.ProtocolFamilyIPv4))
+
+	ip := data[4:]
+	ip[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(ip[2:4], uint16(40+len(payload)))
+	ip[9] = uint8(layers.IPProtocolTCP)
+	copy(ip[12:16], []byte{127, 0, 0, 1})
+	copy(ip[16:20], []byte{127, 0, 0, 1})
+
+	t := ip[20:]
+	t[12] = 5 << 4
+	t[13] = 0x18 // PSH, ACK
+	if fromClient {
+		binary.BigEndian.PutUint16(t, 40000)
+		binary.BigEndian.PutUint16(t[2:], 80)
+	} else {
+		binary.BigEndian.PutUint16(t, 80)
+		binary.BigEndian.PutUint16(t[2:], 40000)
+	}
+	binary.BigEndian.PutUint32(t[4:], seq)
+	data = append(data, payload...)
+
+	return &tcp.PcapPacket{
+		Data:     data,
+		LType:    int(layers.LinkTypeLoop),
+		LTypeLen: 4,
+		Ci:       &gopacket.CaptureInfo{Length: len(data), CaptureLength: len(data), Timestamp: time.Now()},
+	}
+}
+
+func TestHTTP1StreamHint(t *testing.T) {
+	parser := tcp.NewMessageParser(nil, []uint16{80}, nil, time.Second, false)
+	parser.Stream = http1StreamHint
+
+	requests := "POST /a HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 2\r\n\r\nhiGET /b HTTP/1.1\r\n\r\n"
+	responses := "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\naHTTP/1.1 404 Not Found\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"
+	parser.PacketHandler(loopbackPacket(true, 1, requests[:30]))
+	parser.PacketHandler(loopbackPacket(true, 31, requests[30:]))
+	parser.PacketHandler(loopbackPacket(false, 1, responses))
+
+	// the body is replayed without waiting for 100 Continue
+	expected := []string{
+		"POST /a HTTP/1.1\r\nContent-Length: 2\r\n\r\nhi",
+		"GET /b HTTP/1.1\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na",
+		"HTTP/1.1 404 Not Found\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+	}
+	messages := readMessages(t, parser, expected)
+	if !bytes.Equal(messages[0].UUID(), messages[2].UUID()) || !bytes.Equal(messages[1].UUID(), messages[3].UUID()) ||
+		bytes.Equal(messages[0].UUID(), messages[1].UUID()) {
+		t.Error("responses should have ids of their requests")
+	}
+}
+
+// readMessages reads messages from the parser and compares their data
+func readMessages(t *testing.T, parser *tcp.MessageParser, expected []string) (messages []*tcp.Message) {
+	t.Helper()
+	for i := range expected {
+		ch := make(chan *tcp.Message, 1)
+		go func() { ch <- parser.Read() }()
+		select {
+		case m := <-ch:
+			messages = append(messages, m)
+			if string(m.Data()) != expected[i] {
+				t.Errorf("expected %q, got %q", expected[i], m.Data())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d messages, got %d", len(expected), i)
+		}
+	}
+	return
+}
+
+func TestHTTP1StreamHintPipelining(t *testing.T) {
+	parser := tcp.NewMessageParser(nil, []uint16{80}, nil, time.Second, false)
+	parser.Stream = http1StreamHint
+
+	// the capture started during the response to a previous request
+	parser.PacketHandler(loopbackPacket(false, 1, "HTTP/1.1 204 No Content\r\n\r\n"))
+	// the end of a request body sent before the capture started
+	parser.PacketHandler(loopbackPacket(true, 1, "=1&b=2\r\n"))
+	requests := "HEAD /a HTTP/1.1\r\n\r\nGET /b HTTP/1.1\r\n\r\nGET /c HTTP/1.1\r\n\r\n"
+	parser.PacketHandler(loopbackPacket(true, 9, requests))
+	responses := "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nHTTP/1.1 304 Not Modified\r\nContent-Length: 3\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nc"
+	parser.PacketHandler(loopbackPacket(false, 28, responses))
+
+	messages := readMessages(t, parser, []string{
+		"HTTP/1.1 204 No Content\r\n\r\n",
+		"HEAD /a HTTP/1.1\r\n\r\n",
+		"GET /b HTTP/1.1\r\n\r\n",
+		"GET /c HTTP/1.1\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n",
+		"HTTP/1.1 304 Not Modified\r\nContent-Length: 3\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nc",
+	})
+	for i := 1; i <= 3; i++ {
+		if !bytes.Equal(messages[i].UUID(), messages[i+3].UUID()) {
+			t.Errorf("request %d should be paired with its response", i)
+		}
+		if bytes.Equal(messages[i].UUID(), messages[0].UUID()) {
+			t.Errorf("request %d should not be paired with the response of a previous request", i)
+		}
+	}
+}
+
+func TestHTTP1StreamHintWebSocket(t *testing.T) {
+	parser := tcp.NewMessageParser(nil, []uint16{80}, nil, time.Second, false)
+	parser.Stream = http1StreamHint
+
+	upgrade := "GET /chat HTTP/1.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+	switching := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: s3pPLMBiTxaQ9kBVzKLiFa8axUg=\r\n\r\n"
+	// masked "hel" and "lo" fragments, a ping and a binary message of the client
+	clientFrames := "\x01\x83\x01\x02\x03\x04igo\x89\x80\x01\x02\x03\x04\x80\x82\x01\x02\x03\x04mm\x82\x81\x00\x00\x00\x00\x07"
+	parser.PacketHandler(loopbackPacket(true, 1, upgrade))
+	// the first message of the server comes with the handshake
+	parser.PacketHandler(loopbackPacket(false, 1, switching+"\x81\x02hi"))
+	parser.PacketHandler(loopbackPacket(true, uint32(1+len(upgrade)), clientFrames[:10]))
+	parser.PacketHandler(loopbackPacket(true, uint32(1+len(upgrade)+10), clientFrames[10:]))
+	parser.PacketHandler(loopbackPacket(false, uint32(1+len(switching)+4), "\x88\x02\x03\xe8"))
+
+	messages := readMessages(t, parser, []string{upgrade, switching, "hi", "hello", "\x07", "\x03\xe8"})
+	opcodes := []byte{0, 0, ws.OpText, ws.OpText, ws.OpBinary, ws.OpClose}
+	for i, m := range messages {
+		if m.Opcode != opcodes[i] {
+			t.Errorf("message %d: expected opcode %d, got %d", i, opcodes[i], m.Opcode)
+		}
+		if !bytes.Equal(m.UUID(), messages[0].UUID()) {
+			t.Errorf("message %d should have the id of the upgrade request", i)
+		}
+		if i > 2 && m.Seq <= messages[i-1].Seq {
+			t.Errorf("message %d: seq %d should follow %d", i, m.Seq, messages[i-1].Seq)
+		}
+	}
+}
+
+func TestHTTP1StreamingHint(t *testing.T) {
+	parser := tcp.NewMessageParser(nil, []uint16{80}, nil, time.Second, false)
+	parser.Stream = http1StreamingHint(64)
+
+	upload := "POST /up HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 100\r\n\r\n"
+	body := strings.Repeat("0123456789", 10)
+	events := "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nTransfer-Encoding: chunked\r\n\r\n"
+	parser.PacketHandler(loopbackPacket(true, 1, upload+body[:30]))
+	parser.PacketHandler(loopbackPacket(true, uint32(1+len(upload)+30), body[30:70]))
+	parser.PacketHandler(loopbackPacket(true, uint32(1+len(upload)+70), body[70:]+"GET /b HTTP/1.1\r\n\r\n"))
+	parser.PacketHandler(loopbackPacket(false, 1, events+"6\r\ndata:1\r\n"))
+	parser.PacketHandler(loopbackPacket(false, uint32(1+len(events)+11), "0\r\n\r\n"))
+
+	headers := "POST /up HTTP/1.1\r\nContent-Length: 100\r\n\r\n"
+	messages := readMessages(t, parser, []string{headers, body[:70], body[70:], "GET /b HTTP/1.1\r\n\r\n", events, "6\r\ndata:1\r\n", "0\r\n\r\n"})
+	chunks := []struct {
+		chunk uint32
+		more  bool
+	}{{1, true}, {2, true}, {3, false}, {0, false}, {1, true}, {2, true}, {3, false}}
+	for i, m := range messages {
+		if m.Chunk != chunks[i].chunk || m.More != chunks[i].more {
+			t.Errorf("message %d: expected chunk %d more %v, got %d %v", i, chunks[i].chunk, chunks[i].more, m.Chunk, m.More)
+		}
+		if i != 3 && !bytes.Equal(m.UUID(), messages[0].UUID()) {
+			t.Errorf("message %d should have the id of the upload", i)
+		}
+	}
+	if bytes.Equal(messages[3].UUID(), messages[0].UUID()) {
+		t.Error("the next request should have its own id")
+	}
+}
+
+func TestHTTP1StreamHintExpire(t *testing.T) {
+	parser := tcp.NewMessageParser(nil, []uint16{80}, nil, 100*time.Millisecond, false)
+	defer parser.Close()
+	parser.Stream = http1StreamHint
+
+	expired := expvarInt(stats, "http1_expired_messages")
+	// the client gave up sending the body
+	partial := "POST /a HTTP/1.1\r\nContent-Length: 10\r\n\r\nab"
+	parser.PacketHandler(loopbackPacket(true, 1, partial))
+	time.Sleep(300 * time.Millisecond)
+	parser.PacketHandler(loopbackPacket(true, uint32(1+len(partial)), "GET /b HTTP/1.1\r\n\r\n"))
+
+	readMessages(t, parser, []string{"GET /b HTTP/1.1\r\n\r\n"})
+	if expvarInt(stats, "http1_expired_messages") != expired+1 {
+		t.Error("the partial message should be counted as expired")
+	}
+}
+
+func TestHTTP1StreamHintGap(t *testing.T) {
+	parser := tcp.NewMessageParser(nil, []uint16{80}, nil, 100*time.Millisecond, false)
+	defer parser.Close()
+	parser.Stream = http1StreamHint
+
+	tcpStats := expvar.Get("tcp").(*expvar.Map)
+	gaps := expvarInt(tcpStats, "conn_lost_gap")
+	partial := "POST /a HTTP/1.1\r\nContent-Length: 10\r\n\r\nab"
+	seq := uint32(1 + len(partial))
+	parser.PacketHandler(loopbackPacket(true, 1, partial))
+	// "cdef" was not captured, the rest of the body and the next request
+	// wait for it until the message expiration time
+	parser.PacketHandler(loopbackPacket(true, seq+4, "ghij"))
+	parser.PacketHandler(loopbackPacket(true, seq+8, "GET /b HTTP/1.1\r\n\r\n"))
+
+	readMessages(t, parser, []string{"GET /b HTTP/1.1\r\n\r\n"})
+	if expvarInt(tcpStats, "conn_lost_gap") != gaps+1 {
+		t.Error("the gap should be counted as lost")
+	}
+}
+
+func expvarInt(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// tunnelPacket builds loopback IPv4 packet of the tunnel protocol
+func tunnelPacket(proto byte, payload []byte) *tcp.PcapPacket {
+	data := make([]byte, 4+20, 4+20+len(payload))
+	binary.BigEndian.PutUint32(data, uint32(layers.ProtocolFamilyIPv4))
+	ip := data[4:]
+	ip[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(payload)))
+	ip[9] = proto
+	copy(ip[12:16], []byte{192, 168, 0, 1})
+	copy(ip[16:20], []byte{192, 168, 0, 2})
+	data = append(data, payload...)
+	return &tcp.PcapPacket{
+		Data:     data,
+		LType:    int(layers.LinkTypeLoop),
+		LTypeLen: 4,
+		Ci:       &gopacket.CaptureInfo{Length: len(data), CaptureLength: len(data), Timestamp: time.Now()},
+	}
+}
+
+func TestDecap(t *testing.T) {
+	// the mirrored request, without the loopback header
+	inner := loopbackPacket(true, 1, "GET / HTTP/1.1\r\n\r\n").Data[4:]
+	// Ethernet frame with VLAN tag
+	frame := append(make([]byte, 12), 0x81, 0x00, 0x00, 0x05, 0x08, 0x00)
+	frame = append(frame, inner...)
+	udp := func(port uint16, payload []byte) []byte {
+		b := binary.BigEndian.AppendUint16(nil, 50000)
+		b = binary.BigEndian.AppendUint16(b, port)
+		b = binary.BigEndian.AppendUint16(b, uint16(8+len(payload)))
+		return append(append(b, 0, 0), payload...)
+	}
+	cat := func(parts ...[]byte) (b []byte) {
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return
+	}
+
+	tests := []struct {
+		name   string
+		decap  Decapsulation
+		ids    []int
+		packet *tcp.PcapPacket
+		ok     bool
+	}{
+		// GRE with key 7 carrying IP packet
+		{"gre", DecapGRE, nil, tunnelPacket(47, cat([]byte{0x20, 0, 0x08, 0}, []byte{0, 0, 0, 7}, inner)), true},
+		{"gre key", DecapGRE, []int{7}, tunnelPacket(47, cat([]byte{0x20, 0, 0x08, 0}, []byte{0, 0, 0, 7}, inner)), true},
+		{"gre other key", DecapGRE, []int{8}, tunnelPacket(47, cat([]byte{0x20, 0, 0x08, 0}, []byte{0, 0, 0, 7}, inner)), false},
+		{"gre ignored key", DecapGRE, []int{-7}, tunnelPacket(47, cat([]byte{0x20, 0, 0x08, 0}, []byte{0, 0, 0, 7}, inner)), false},
+		// GRE with checksum carrying Ethernet frame
+		{"gre bridging", DecapGRE, nil, tunnelPacket(47, cat([]byte{0x80, 0, 0x65, 0x58}, make([]byte, 4), frame)), true},
+		{"erspan disabled", DecapGRE, nil, tunnelPacket(47, cat([]byte{0x10, 0, 0x88, 0xbe}, make([]byte, 4), []byte{0x10, 0, 0x00, 0x03, 0, 0, 0, 0}, frame)), false},
+		// ERSPAN type II with session 3 and type I
+		{"erspan II", DecapERSPAN, []int{3}, tunnelPacket(47, cat([]byte{0x10, 0, 0x88, 0xbe}, make([]byte, 4), []byte{0x10, 0, 0x00, 0x03, 0, 0, 0, 0}, frame)), true},
+		{"erspan II other session", DecapERSPAN, []int{4}, tunnelPacket(47, cat([]byte{0x10, 0, 0x88, 0xbe}, make([]byte, 4), []byte{0x10, 0, 0x00, 0x03, 0, 0, 0, 0}, frame)), false},
+		{"erspan I", DecapERSPAN, nil, tunnelPacket(47, cat([]byte{0, 0, 0x88, 0xbe}, frame)), true},
+		// ERSPAN type III with platform specific subheader
+		{"erspan III", DecapERSPAN, []int{3}, tunnelPacket(47, cat([]byte{0x10, 0, 0x22, 0xeb}, make([]byte, 4), []byte{0x20, 0, 0x00, 0x03}, make([]byte, 7), []byte{0x01}, make([]byte, 8), frame)), true},
+		// Geneve with an option, carrying IP packet and Ethernet frame
+		{"geneve", DecapGeneve, []int{0x123456}, tunnelPacket(17, udp(6081, cat([]byte{0x01, 0, 0x08, 0x00, 0x12, 0x34, 0x56, 0}, make([]byte, 4), inner))), true},
+		{"geneve bridging", DecapGeneve, nil, tunnelPacket(17, udp(6081, cat([]byte{0, 0, 0x65, 0x58, 0, 0, 1, 0}, frame))), true},
+		{"geneve other port", DecapGeneve, nil, tunnelPacket(17, udp(6082, cat([]byte{0, 0, 0x65, 0x58, 0, 0, 1, 0}, frame))), false},
+		{"vxlan", DecapVXLAN | DecapGeneve, []int{-2}, tunnelPacket(17, udp(4789, cat([]byte{0x08, 0, 0, 0, 0, 0, 1, 0}, frame))), true},
+		{"vxlan ignored vni", DecapVXLAN, []int{-1}, tunnelPacket(17, udp(4789, cat([]byte{0x08, 0, 0, 0, 0, 0, 1, 0}, frame))), false},
+		{"not a tunnel", DecapGRE | DecapVXLAN, nil, loopbackPacket(true, 1, "GET / HTTP/1.1\r\n\r\n"), false},
+	}
+	for _, tt := range tests {
+		d, err := newDecapsulator(tt.decap, tt.ids, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok := d.Decap(tt.packet); ok != tt.ok {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.ok, ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		pckt, err := tcp.ParsePacket(tt.packet.Data, tt.packet.LType, tt.packet.LTypeLen, tt.packet.Ci, false)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if pckt.DstPort != 80 || string(pckt.Payload) != "GET / HTTP/1.1\r\n\r\n" {
+			t.Errorf("%s: wrong inner packet %s %q", tt.name, pckt.Dst(), pckt.Payload)
+		}
+	}
+}
+
+func TestDecapFilter(t *testing.T) {
+	l := &Listener{ports: []uint16{80}}
+	l.config.Transport = "tcp"
+	if err := l.config.Decap.Set("erspan,geneve"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.config.Decap.Set("gre"); err != nil || l.config.Decap.String() != "gre,erspan,geneve" {
+		t.Errorf("unexpected decapsulation %q %v", l.config.Decap.String(), err)
+	}
+	if err := l.config.Decap.Set("ipip"); err == nil {
+		t.Error("expected invalid decapsulation error")
+	}
+
+	if filter := l.Filter(pcap.Interface{}); filter != "(proto gre or udp dst port 6081)" {
+		t.Errorf("unexpected filter %q", filter)
+	}
+	if filter := l.decapFilter(); filter != "(tcp dst port 80)" {
+		t.Errorf("unexpected filter of decapsulated packets %q", filter)
+	}
+	l.host = "10.0.0.1"
+	if filter := l.decapFilter(); filter != "((tcp dst port 80) and (dst host 10.0.0.1))" {
+		t.Errorf("unexpected filter of decapsulated packets %q", filter)
+	}
+}
+
+// pcapng option codes
+const (
+	ngOptionComment = 1
+	ngOptionTSResol = 9
+)
+
+// ngBlock builds pcapng block
+func ngBlock(order binary.AppendByteOrder, typ uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	b := order.AppendUint32(nil, typ)
+	b = order.AppendUint32(b, uint32(12+len(body)))
+	b = append(b, body...)
+	return order.AppendUint32(b, uint32(12+len(body)))
+}
+
+// ngOption builds pcapng option
+func ngOption(order binary.AppendByteOrder, code uint16, value []byte) []byte {
+	b := order.AppendUint16(nil, code)
+	b = order.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func TestPcapngFile(t *testing.T) {
+	unknownBefore := expvarInt(stats, "pcapng_unknown_interface")
+	order := binary.BigEndian
+	var file bytes.Buffer
+	shb := order.AppendUint32(nil, ngByteOrderMagic)
+	shb = append(shb, 0, 1, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	file.Write(ngBlock(order, ngBlockSection, shb))
+
+	// ethernet interface with nanosecond timestamps
+	idb := append(order.AppendUint16(nil, uint16(layers.LinkTypeEthernet)), 0, 0, 0, 0, 0, 0)
+	idb = append(idb, ngOption(order, ngOptionTSResol, []byte{9})...)
+	file.Write(ngBlock(order, ngBlockInterface, idb))
+	// loopback interface with default microsecond timestamps
+	idb = append(order.AppendUint16(nil, uint16(layers.LinkTypeLoop)), 0, 0, 0, 0, 0, 0)
+	file.Write(ngBlock(order, ngBlockInterface, idb))
+	// name resolution block is skipped
+	file.Write(ngBlock(order, 4, make([]byte, 4)))
+
+	epb := func(iface uint32, ts uint64, data string, options ...[]byte) []byte {
+		b := order.AppendUint32(nil, iface)
+		b = order.AppendUint32(b, uint32(ts>>32))
+		b = order.AppendUint32(b, uint32(ts))
+		b = order.AppendUint32(b, uint32(len(data)))
+		b = order.AppendUint32(b, uint32(len(data)+10))
+		b = append(b, data...)
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+		for _, o := range options {
+			b = append(b, o...)
+		}
+		return ngBlock(order, ngBlockEnhancedPacket, b)
+	}
+	file.Write(epb(1, 1500000, "loop", ngOption(order, ngOptionComment, []byte("first")), ngOption(order, ngOptionComment, []byte("second"))))
+	// packets and statistics of interfaces which were not described are
+	// skipped, whatever their data looks like
+	unknown := string(order.AppendUint32(order.AppendUint32(nil, 36), 32))
+	file.Write(epb(2, 1, unknown, ngOption(order, ngOptionComment, []byte("skipped"))))
+	isb := func(iface uint32) []byte {
+		return ngBlock(order, ngBlockInterfaceStats, append(order.AppendUint32(nil, iface), make([]byte, 8)...))
+	}
+	file.Write(isb(3))
+	file.Write(isb(1))
+	file.Write(epb(0, 2000000001, "ether"))
+
+	// gzip compressed file
+	path := filepath.Join(t.TempDir(), "capture.pcapng.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write(file.Bytes())
+	gz.Close()
+	f.Close()
+
+	if !IsFile(path) {
+		t.Errorf("%s should be a capture file", path)
+	}
+	handle, err := openFile(path, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.(*fileHandle).Close()
+	h := handle.(*fileHandle)
+
+	expected := []struct {
+		data     string
+		ts       time.Time
+		linkType layers.LinkType
+		linkSize int
+	}{
+		{"loop", time.Unix(1, 500000000), layers.LinkTypeLoop, 4},
+		{"ether", time.Unix(2, 1), layers.LinkTypeEthernet, 14},
+	}
+	for _, e := range expected {
+		data, ci, err := h.ReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		linkType, linkSize := h.LinkType()
+		if string(data) != e.data || !ci.Timestamp.Equal(e.ts) || ci.Length != len(e.data)+10 ||
+			linkType != e.linkType || linkSize != e.linkSize {
+			t.Errorf("unexpected packet %q %v %v %d", data, ci, linkType, linkSize)
+		}
+	}
+	if _, _, err = h.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected end of file, got %v", err)
+	}
+	if n := expvarInt(stats, "pcapng_unknown_interface"); n-unknownBefore != 2 {
+		t.Errorf("blocks of unknown interfaces should be counted, got %d", n-unknownBefore)
+	}
+}
+
+func TestGzipPcapFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pcap.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	w := NewWriterNanos(gz)
+	w.WriteFileHeader(fileSnaplen, layers.LinkTypeRaw)
+	w.WritePacket(gopacket.CaptureInfo{Timestamp: time.Unix(1, 1), Length: 3, CaptureLength: 3}, []byte("raw"))
+	gz.Close()
+	f.Close()
+
+	handle, err := openFile(path, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := handle.(*fileHandle)
+	defer h.Close()
+	data, ci, err := h.ReadPacketData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linkType, _ := h.LinkType(); string(data) != "raw" || !ci.Timestamp.Equal(time.Unix(1, 1)) || linkType != layers.LinkTypeRaw {
+		t.Errorf("unexpected packet %q %v %v", data, ci, linkType)
+	}
+}
+
+// k8sPod builds a running pod with the address
+func k8sPod(name string, ip string, labels map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: labels},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIPs: []corev1.PodIP{{IP: ip}}},
+	}
+}
+
+func TestK8sSelector(t *testing.T) {
+	tests := []struct {
+		addr, namespace, labels, fields string
+	}{
+		{"pod/web-1", "", "", "metadata.name=web-1"},
+		{"prod/deployment/web", "prod", "app=web", ""},
+		{"daemonset/agent", "", "pod-template-generation=1,name=agent", ""},
+		{"prod/labelSelector/app.kubernetes.io/name=web", "prod", "app.kubernetes.io/name=web", ""},
+		{"fieldSelector/spec.nodeName=node-1", "", "", "spec.nodeName=node-1"},
+	}
+	for _, tt := range tests {
+		namespace, labels, fields, err := k8sSelector(tt.addr)
+		if err != nil || namespace != tt.namespace || labels != tt.labels || fields != tt.fields {
+			t.Errorf("%s: unexpected selector %q %q %q %v", tt.addr, namespace, labels, fields, err)
+		}
+	}
+	for _, addr := range []string{"web", "default/service/web"} {
+		if _, _, _, err := k8sSelector(addr); err == nil {
+			t.Errorf("%s: expected error", addr)
+		}
+	}
+}
+
+func TestPodWatcher(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		k8sPod("web-1", "10.0.0.1", map[string]string{"app": "web", "version": "1"}),
+		k8sPod("db-1", "10.0.0.2", map[string]string{"app": "db"}),
+	)
+	changes := make(chan []string, 10)
+	w, err := newPodWatcher(client, "default/deployment/web", func(ips []string) { changes <- ips })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	expect := func(ips ...string) {
+		t.Helper()
+		select {
+		case got := <-changes:
+			if strings.Join(got, ",") != strings.Join(ips, ",") {
+				t.Fatalf("expected addresses %q, got %q", ips, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("addresses %q were not reported", ips)
+		}
+	}
+	expect("10.0.0.1")
+	if pod := w.Pod("10.0.0.1"); pod == nil || pod.Name != "web-1" || pod.Labels["version"] != "1" {
+		t.Errorf("unexpected pod %+v", pod)
+	}
+	if w.Pod("10.0.0.2") != nil {
+		t.Error("pods of other deployments should not be captured")
+	}
+
+	ctx := context.Background()
+	pods := client.CoreV1().Pods("default")
+	// scaled up, and a pod of other deployment
+	if _, err := pods.Create(ctx, k8sPod("web-2", "10.0.0.3", map[string]string{"app": "web"}), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expect("10.0.0.1", "10.0.0.3")
+	if _, err := pods.Create(ctx, k8sPod("db-2", "10.0.0.4", map[string]string{"app": "db"}), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// rescheduled
+	if err := pods.Delete(ctx, "web-1", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expect("10.0.0.3")
+	failed := k8sPod("web-2", "10.0.0.3", map[string]string{"app": "web"})
+	failed.Status.Phase = corev1.PodFailed
+	if _, err := pods.UpdateStatus(ctx, failed, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expect()
+
+	l := &Listener{host: "k8s://default/deployment/web", ports: []uint16{80}, pods: w}
+	l.config.Transport = "tcp"
+	l.podsChanged([]string{"10.0.0.3"})
+	if l.config.BPFFilter != "((tcp dst port 80) and (dst host 10.0.0.3))" {
+		t.Errorf("unexpected filter %q", l.config.BPFFilter)
+	}
+	// no pods are selected anymore
+	l.podsChanged(nil)
+	if l.config.BPFFilter != noPacketsFilter {
+		t.Errorf("expected no packets to be captured, got filter %q", l.config.BPFFilter)
+	}
+}
+
+func TestNetnsPath(t *testing.T) {
+	tests := []struct {
+		host, path string
+	}{
+		{"netns:///var/run/netns/app", "/var/run/netns/app"},
+		{"netns://app", "/var/run/netns/app"},
+		{"pid://1234", "/proc/1234/ns/net"},
+		{"pid://app", ""},
+		{"netns://", ""},
+		{"127.0.0.1", ""},
+	}
+	for _, tt := range tests {
+		if path, ok := netnsPath(tt.host); path != tt.path || ok != (tt.path != "") {
+			t.Errorf("%s: expected %q, got %q", tt.host, tt.path, path)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/buger/goreplay/internal/tcp"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// Decapsulation is a set of tunnel protocols stripped from captured packets,
+// it is used to capture traffic of mirror sessions
+type Decapsulation uint8
+
+// Supported tunnels
+const (
+	DecapGRE Decapsulation = 1 << iota
+	DecapERSPAN
+	DecapGeneve
+	DecapVXLAN
+)
+
+// ports of UDP tunnels
+const (
+	genevePort = 6081
+	vxlanPort  = 4789
+)
+
+// protocol types of GRE and Geneve headers
+const (
+	etherTypeTEB      = 0x6558 // Transparent Ethernet Bridging
+	etherTypeERSPAN2  = 0x88be
+	etherTypeERSPAN3  = 0x22eb
+	etherTypeIPv4     = 0x0800
+	etherTypeIPv6     = 0x86dd
+	etherTypeVLAN     = 0x8100
+	etherTypeQinQ     = 0x88a8
+	ipProtocolGRE     = 47
+	ipProtocolUDP     = 17
+	greChecksumFlag   = 0x80
+	greKeyFlag        = 0x20
+	greSequenceFlag   = 0x10
+	erspan3SubHdrFlag = 0x01
+)
+
+var decapNames = []struct {
+	decap Decapsulation
+	name  string
+}{{DecapGRE, "gre"}, {DecapERSPAN, "erspan"}, {DecapGeneve, "geneve"}, {DecapVXLAN, "vxlan"}}
+
+// Set is here so that Decapsulation can implement flag.Var, it can be called
+// multiple times or with comma separated values
+func (d *Decapsulation) Set(v string) error {
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, n := range decapNames {
+			if n.name == name {
+				*d |= n.decap
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("invalid decapsulation %s", name)
+		}
+	}
+	return nil
+}
+
+func (d *Decapsulation) String() string {
+	var names []string
+	for _, n := range decapNames {
+		if *d&n.decap != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// filter returns BPF filter of packets of the tunnels
+func (d Decapsulation) filter() string {
+	var filters []string
+	if d&(DecapGRE|DecapERSPAN) != 0 {
+		filters = append(filters, "proto gre")
+	}
+	if d&DecapGeneve != 0 {
+		filters = append(filters, fmt.Sprintf("udp dst port %d", genevePort))
+	}
+	if d&DecapVXLAN != 0 {
+		filters = append(filters, fmt.Sprintf("udp dst port %d", vxlanPort))
+	}
+	return strings.Join(filters, " or ")
+}
+
+// tunnelIDAllowed reports whether packets of the tunnel (VNI, GRE key or
+// ERSPAN session) should be captured. Negative ids are ignored, positive ones
+// are the only captured.
+func tunnelIDAllowed(ids []int, id int) bool {
+	if len(ids) == 0 {
+		return true
+	}
+	allowed := false
+	for _, i := range ids {
+		if i > 0 && i == id {
+			return true
+		}
+		if i < 0 {
+			if -i == id {
+				return false
+			}
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+// decapsulator strips tunnel headers of mirrored packets and applies filter of
+// the listener to inner packets. Inner packets are IP packets, Ethernet headers
+// of mirrored frames are stripped with their VLAN tags.
+type decapsulator struct {
+	decap Decapsulation
+	ids   []int
+	bpf   *pcap.BPF
+}
+
+func newDecapsulator(decap Decapsulation, ids []int, filter string) (*decapsulator, error) {
+	d := &decapsulator{decap: decap, ids: ids}
+	if filter != "" {
+		var err error
+		if d.bpf, err = pcap.NewBPF(layers.LinkTypeRaw, fileSnaplen, filter); err != nil {
+			return nil, fmt.Errorf("decapsulated packets filter error: %q, filter: %s", err, filter)
+		}
+	}
+	return d, nil
+}
+
+// Decap replaces data of the packet by the inner packet, it reports whether
+// the packet is a tunneled packet which should be captured
+func (d *decapsulator) Decap(pckt *tcp.PcapPacket) bool {
+	if len(pckt.Data) < pckt.LTypeLen {
+		return false
+	}
+	data, ok := d.inner(pckt.Data[pckt.LTypeLen:])
+	if !ok {
+		stats.Add("decap_skipped", 1)
+		return false
+	}
+	if d.bpf != nil && !d.bpf.Matches(*pckt.Ci, data) {
+		return false
+	}
+	pckt.Data, pckt.LType, pckt.LTypeLen = data, int(layers.LinkTypeRaw), 0
+	return true
+}
+
+// inner returns IP packet carried by a tunnel packet, ip is the network layer
+// of the tunnel packet
+func (d *decapsulator) inner(ip []byte) ([]byte, bool) {
+	if len(ip) < 20 {
+		return nil, false
+	}
+	var proto byte
+	var hdrLen int
+	switch ip[0] >> 4 {
+	case 4:
+		proto, hdrLen = ip[9], int(ip[0]&0x0f)*4
+	case 6:
+		// extension headers are not expected before tunnel headers
+		proto, hdrLen = ip[6], 40
+	}
+	if hdrLen < 20 || len(ip) < hdrLen {
+		return nil, false
+	}
+	payload := ip[hdrLen:]
+
+	switch proto {
+	case ipProtocolGRE:
+		return d.gre(payload)
+	case ipProtocolUDP:
+		if len(payload) < 8 {
+			return nil, false
+		}
+		switch port := binary.BigEndian.Uint16(payload[2:4]); {
+		case port == genevePort && d.decap&DecapGeneve != 0:
+			return d.geneve(payload[8:])
+		case port == vxlanPort && d.decap&DecapVXLAN != 0:
+			return d.vxlan(payload[8:])
+		}
+	}
+	return nil, false
+}
+
+// gre strips GRE header (RFC 2784, RFC 2890), and ERSPAN header of type II
+// and III
+func (d *decapsulator) gre(data []byte) ([]byte, bool) {
+	if len(data) < 4 || data[1]&0x07 != 0 {
+		// only version 0 carries packets
+		return nil, false
+	}
+	flags := data[0]
+	protocol := binary.BigEndian.Uint16(data[2:4])
+	hdrLen := 4
+	if flags&greChecksumFlag != 0 {
+		hdrLen += 4
+	}
+	key := -1
+	if flags&greKeyFlag != 0 {
+		if len(data) < hdrLen+4 {
+			return nil, false
+		}
+		key = int(binary.BigEndian.Uint32(data[hdrLen:]))
+		hdrLen += 4
+	}
+	if flags&greSequenceFlag != 0 {
+		hdrLen += 4
+	}
+	if len(data) < hdrLen {
+		return nil, false
+	}
+	data = data[hdrLen:]
+
+	switch protocol {
+	case etherTypeERSPAN2, etherTypeERSPAN3:
+		if d.decap&DecapERSPAN == 0 {
+			return nil, false
+		}
+		if protocol == etherTypeERSPAN2 && flags&greSequenceFlag == 0 {
+			// type I has no ERSPAN header
+			return etherPayload(data)
+		}
+		hdrLen = 8
+		if protocol == etherTypeERSPAN3 {
+			hdrLen = 12
+			if len(data) >= hdrLen && data[11]&erspan3SubHdrFlag != 0 {
+				hdrLen += 8
+			}
+		}
+		if len(data) < hdrLen {
+			return nil, false
+		}
+		session := int(binary.BigEndian.Uint16(data[2:4]) & 0x03ff)
+		if !tunnelIDAllowed(d.ids, session) {
+			return nil, false
+		}
+		return etherPayload(data[hdrLen:])
+	}
+
+	if d.decap&DecapGRE == 0 || !tunnelIDAllowed(d.ids, key) {
+		return nil, false
+	}
+	return payloadOf(protocol, data)
+}
+
+// geneve strips Geneve header (RFC 8926)
+func (d *decapsulator) geneve(data []byte) ([]byte, bool) {
+	if len(data) < 8 || data[0]>>6 != 0 {
+		return nil, false
+	}
+	hdrLen := 8 + int(data[0]&0x3f)*4
+	if len(data) < hdrLen || !tunnelIDAllowed(d.ids, vni(data[4:7])) {
+		return nil, false
+	}
+	return payloadOf(binary.BigEndian.Uint16(data[2:4]), data[hdrLen:])
+}
+
+// vxlan strips VXLAN header (RFC 7348)
+func (d *decapsulator) vxlan(data []byte) ([]byte, bool) {
+	if len(data) < 8 || data[0]&0x08 == 0 {
+		return nil, false
+	}
+	if !tunnelIDAllowed(d.ids, vni(data[4:7])) {
+		return nil, false
+	}
+	return etherPayload(data[8:])
+}
+
+func vni(b []byte) int {
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+// payloadOf returns IP packet of a payload of the protocol type
+func payloadOf(protocol uint16, data []byte) ([]byte, bool) {
+	switch protocol {
+	case etherTypeTEB:
+		return etherPayload(data)
+	case etherTypeIPv4, etherTypeIPv6:
+		return data, true
+	}
+	return nil, false
+}
+
+// etherPayload returns IP packet of an Ethernet frame, VLAN tags are skipped
+func etherPayload(frame []byte) ([]byte, bool) {
+	offset := 12
+	for len(frame) >= offset+2 {
+		switch binary.BigEndian.Uint16(frame[offset:]) {
+		case etherTypeVLAN, etherTypeQinQ:
+			offset += 4
+		case etherTypeIPv4, etherTypeIPv6:
+			return frame[offset+2:], true
+		default:
+			return nil, false
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,163 @@
+package capture
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// fileSnaplen is used to compile BPF filters of capture files
+const fileSnaplen = 256 << 10
+
+// IsFile reports whether the host of input-raw is a capture file: pcap or
+// pcapng, optionally gzip compressed
+func IsFile(host string) bool {
+	host = strings.TrimSuffix(host, ".gz")
+	return strings.HasSuffix(host, "pcap") || strings.HasSuffix(host, "pcapng")
+}
+
+// packetFileReader reads packets of a capture file
+type packetFileReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	// LinkType returns the link type of the last packet
+	LinkType() layers.LinkType
+}
+
+// fileLink is a link type seen in a capture file
+type fileLink struct {
+	linkType layers.LinkType
+	size     int
+	known    bool
+	bpf      *pcap.BPF
+}
+
+// fileHandle reads pcapng and gzip compressed capture files, which are not
+// supported by libpcap. Interfaces of pcapng files can have different link
+// types, so BPF filters are compiled for every link type.
+type fileHandle struct {
+	files  []io.Closer
+	reader packetFileReader
+	filter string
+	vlan   bool
+	links  map[layers.LinkType]*fileLink
+	link   *fileLink // link of the last packet
+}
+
+// openFile opens a capture file, plain pcap files are read by libpcap
+func openFile(path, filter string, vlan bool) (gopacket.PacketDataSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	h := &fileHandle{files: []io.Closer{f}, filter: filter, vlan: vlan, links: make(map[layers.LinkType]*fileLink)}
+
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(4)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	compressed := magic[0] == 0x1f && magic[1] == 0x8b
+	if compressed {
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(r); err != nil {
+			f.Close()
+			return nil, err
+		}
+		h.files = append(h.files, gz)
+		r = bufio.NewReader(gz)
+		if magic, err = r.Peek(4); err != nil {
+			h.Close()
+			return nil, err
+		}
+	}
+
+	if binary.LittleEndian.Uint32(magic) == ngBlockSection {
+		h.reader, err = newNgReader(r)
+	} else if compressed {
+		h.reader, err = pcapgo.NewReader(r)
+	} else {
+		f.Close()
+		return openPcapFile(path, filter)
+	}
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+func openPcapFile(path, filter string) (*pcap.Handle, error) {
+	handle, err := pcap.OpenOffline(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = handle.SetBPFFilter(filter); err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return handle, nil
+}
+
+// ReadPacketData returns the next packet which matches the filter
+func (h *fileHandle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	for {
+		if data, ci, err = h.reader.ReadPacketData(); err != nil {
+			return
+		}
+		link, err := h.linkOf(h.reader.LinkType())
+		if err != nil {
+			return nil, ci, err
+		}
+		if !link.known {
+			stats.Add("unknown_link_type", 1)
+			continue
+		}
+		if link.bpf != nil && !link.bpf.Matches(ci, data) {
+			continue
+		}
+		h.link = link
+		return data, ci, nil
+	}
+}
+
+// LinkType returns the link type of the last packet and the size of its link
+// layer header
+func (h *fileHandle) LinkType() (layers.LinkType, int) {
+	return h.link.linkType, h.link.size
+}
+
+func (h *fileHandle) linkOf(linkType layers.LinkType) (*fileLink, error) {
+	if link, ok := h.links[linkType]; ok {
+		return link, nil
+	}
+	link := &fileLink{linkType: linkType}
+	link.size, link.known = pcapLinkTypeLength(int(linkType), h.vlan)
+	if link.known && h.filter != "" {
+		var err error
+		if link.bpf, err = pcap.NewBPF(linkType, fileSnaplen, h.filter); err != nil {
+			return nil, err
+		}
+	}
+	h.links[linkType] = link
+	return link, nil
+}
+
+// Close closes the file
+func (h *fileHandle) Close() error {
+	var err error
+	for i := len(h.files) - 1; i >= 0; i-- {
+		if e := h.files[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,201 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// k8sSyncTimeout is the maximum time to wait for the first list of pods
+const k8sSyncTimeout = 30 * time.Second
+
+// Pod is a pod selected by a k8s:// address, see Listener.Pod
+type Pod struct {
+	Namespace string
+	Name      string
+	Labels    map[string]string
+}
+
+// podWatcher keeps addresses of the pods selected by a k8s:// address up to
+// date, pods are watched by an informer so that rescheduled and new pods are
+// captured as well.
+type podWatcher struct {
+	sync.RWMutex
+	updates  sync.Mutex      // serializes updates so that onChange gets the last addresses
+	pods     map[string]*Pod // by IP
+	labels   labels.Selector
+	fields   fields.Selector
+	informer cache.SharedIndexInformer
+	stop     chan struct{}
+	onChange func(ips []string) // called with sorted addresses when they change
+}
+
+// k8sSelector parses a k8s:// address without the scheme. Allowed format:
+//
+//	[namespace/]pod/[pod_name]
+//	[namespace/]deployment/[deployment_name]
+//	[namespace/]daemonset/[daemonset_name]
+//	[namespace/]labelSelector/[selector]
+//	[namespace/]fieldSelector/[selector]
+func k8sSelector(addr string) (namespace, labelSelector, fieldSelector string, err error) {
+	sections := strings.SplitN(addr, "/", 3)
+
+	// If no namespace passed, assume it is ALL
+	switch sections[0] {
+	case "pod", "deployment", "daemonset", "labelSelector", "fieldSelector":
+		sections = append([]string{""}, strings.SplitN(addr, "/", 2)...)
+	}
+	if len(sections) < 3 {
+		return "", "", "", fmt.Errorf("not supported k8s scheme %q. Allowed values: [namespace/]pod/[pod_name], [namespace/]deployment/[deployment_name], [namespace/]daemonset/[daemonset_name], [namespace/]labelSelector/[selector], [namespace/]fieldSelector/[selector]", addr)
+	}
+
+	namespace, selectorType, selectorValue := sections[0], sections[1], sections[2]
+	switch selectorType {
+	case "pod":
+		fieldSelector = "metadata.name=" + selectorValue
+	case "deployment":
+		labelSelector = "app=" + selectorValue
+	case "daemonset":
+		labelSelector = "pod-template-generation=1,name=" + selectorValue
+	case "labelSelector":
+		labelSelector = selectorValue
+	case "fieldSelector":
+		fieldSelector = selectorValue
+	default:
+		return "", "", "", fmt.Errorf("not supported k8s selector %q", selectorType)
+	}
+	return
+}
+
+// k8sClient returns a client of the API server of the cluster goreplay runs in
+func k8sClient() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("k8s config error: %q", err)
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// newPodWatcher lists pods selected by the address and starts watching them
+func newPodWatcher(client kubernetes.Interface, addr string, onChange func(ips []string)) (w *podWatcher, err error) {
+	namespace, labelSelector, fieldSelector, err := k8sSelector(addr)
+	if err != nil {
+		return nil, err
+	}
+	w = &podWatcher{onChange: onChange, stop: make(chan struct{})}
+	if w.labels, err = labels.Parse(labelSelector); err != nil {
+		return nil, fmt.Errorf("k8s label selector error: %q", err)
+	}
+	if w.fields, err = fields.ParseSelector(fieldSelector); err != nil {
+		return nil, fmt.Errorf("k8s field selector error: %q", err)
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = labelSelector
+			o.FieldSelector = fieldSelector
+		}),
+	)
+	w.informer = factory.Core().V1().Pods().Informer()
+	w.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { w.update() },
+		UpdateFunc: func(interface{}, interface{}) { w.update() },
+		DeleteFunc: func(interface{}) { w.update() },
+	})
+	go w.informer.Run(w.stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), k8sSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(ctx.Done(), w.informer.HasSynced) {
+		close(w.stop)
+		return nil, fmt.Errorf("can not list k8s pods of %s", addr)
+	}
+	w.update()
+	return w, nil
+}
+
+// selected reports whether the pod serves traffic and matches the selectors,
+// watch events are checked again as not all API servers filter them
+func (w *podWatcher) selected(pod *corev1.Pod) bool {
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return false
+	}
+	return w.labels.Matches(labels.Set(pod.Labels)) && w.fields.Matches(fields.Set{
+		"metadata.name":      pod.Name,
+		"metadata.namespace": pod.Namespace,
+		"spec.nodeName":      pod.Spec.NodeName,
+		"status.phase":       string(pod.Status.Phase),
+	})
+}
+
+// update rebuilds addresses of the pods from the informer cache
+func (w *podWatcher) update() {
+	w.updates.Lock()
+	defer w.updates.Unlock()
+
+	pods := make(map[string]*Pod)
+	for _, obj := range w.informer.GetStore().List() {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok || !w.selected(pod) {
+			continue
+		}
+		p := &Pod{Namespace: pod.Namespace, Name: pod.Name, Labels: pod.Labels}
+		for _, ip := range pod.Status.PodIPs {
+			pods[ip.IP] = p
+		}
+	}
+
+	w.Lock()
+	changed := len(pods) != len(w.pods)
+	for ip := range pods {
+		if _, ok := w.pods[ip]; !ok {
+			changed = true
+		}
+	}
+	w.pods = pods
+	w.Unlock()
+
+	if changed {
+		stats.Add("k8s_pods_changed", 1)
+		if w.onChange != nil {
+			w.onChange(w.IPs())
+		}
+	}
+}
+
+// IPs returns sorted addresses of the pods
+func (w *podWatcher) IPs() []string {
+	w.RLock()
+	defer w.RUnlock()
+	ips := make([]string, 0, len(w.pods))
+	for ip := range w.pods {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// Pod returns the pod of the address
+func (w *podWatcher) Pod(ip string) *Pod {
+	w.RLock()
+	defer w.RUnlock()
+	return w.pods[ip]
+}
+
+// Close stops watching pods
+func (w *podWatcher) Close() {
+	close(w.stop)
+}
@@ -0,0 +1,41 @@
+package capture
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// netnsPath returns the network namespace file of netns:// and pid://
+// addresses, like netns:///var/run/netns/app, netns://app (a namespace of
+// "ip netns") or pid://1234 (the namespace of a process or a container)
+func netnsPath(host string) (path string, ok bool) {
+	switch {
+	case strings.HasPrefix(host, "netns://"):
+		path = host[len("netns://"):]
+		if path == "" {
+			return "", false
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join("/var/run/netns", path)
+		}
+		return path, true
+	case strings.HasPrefix(host, "pid://"):
+		pid, err := strconv.Atoi(host[len("pid://"):])
+		if err != nil || pid <= 0 {
+			return "", false
+		}
+		return "/proc/" + strconv.Itoa(pid) + "/ns/net", true
+	}
+	return "", false
+}
+
+// inNetns runs fn in the network namespace of the listener. Interfaces are
+// looked up and handles are opened in the namespace, handles keep capturing
+// its traffic when they are read by other threads.
+func (l *Listener) inNetns(fn func() error) error {
+	if l.netns == "" {
+		return fn()
+	}
+	return runInNetns(l.netns, fn)
+}
@@ -0,0 +1,32 @@
+//go:build linux
+
+package capture
+
+import (
+	"fmt"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// runInNetns runs fn on a thread moved to the network namespace of the file
+func runInNetns(path string, fn func() error) error {
+	ns, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("open network namespace %s error: %q", path, err)
+	}
+	defer unix.Close(ns)
+
+	done := make(chan error, 1)
+	go func() {
+		// the goroutine exits without unlocking the thread, so the thread is
+		// terminated instead of going back to the scheduler in the namespace
+		runtime.LockOSThread()
+		if err := unix.Setns(ns, unix.CLONE_NEWNET); err != nil {
+			done <- fmt.Errorf("enter network namespace %s error: %q", path, err)
+			return
+		}
+		done <- fn()
+	}()
+	return <-done
+}
@@ -0,0 +1,104 @@
+//go:build linux
+
+package capture
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestListenerNetns(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("network namespaces can be created only by root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("ip command is not found")
+	}
+	name := fmt.Sprintf("goreplay-test-%d", os.Getpid())
+	if out, err := exec.Command("ip", "netns", "add", name).CombinedOutput(); err != nil {
+		t.Skipf("can not create network namespace: %s", out)
+	}
+	defer exec.Command("ip", "netns", "del", name).Run()
+	if out, err := exec.Command("ip", "netns", "exec", name, "ip", "link", "set", "lo", "up").CombinedOutput(); err != nil {
+		t.Fatalf("can not set up loopback: %s", out)
+	}
+
+	l, err := NewListener("netns://"+name, []uint16{8080}, PcapOptions{Engine: EngineRawSocket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.netns != "/var/run/netns/"+name || l.host != "" {
+		t.Errorf("unexpected namespace %q of %q host", l.netns, l.host)
+	}
+
+	// the server of the namespace is not reachable from the test
+	var ln net.Listener
+	if err = l.inNetns(func() (err error) {
+		ln, err = net.Listen("tcp", "127.0.0.1:8080")
+		return
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if c, err := net.DialTimeout("tcp", "127.0.0.1:8080", time.Second); err == nil {
+		c.Close()
+		t.Fatal("the test should stay in its namespace")
+	}
+
+	if len(l.Interfaces) == 0 {
+		t.Skip("libpcap found no interfaces")
+	}
+	for _, ifi := range l.Interfaces {
+		if ifi.Name != "lo" {
+			t.Errorf("unexpected interface %s of the namespace", ifi.Name)
+		}
+	}
+	if err = l.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := l.ListenBackground(ctx)
+	<-l.Reading
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, 1024)
+		c.Read(buf)
+		io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	}()
+	if err = l.inNetns(func() error {
+		c, err := net.Dial("tcp", "127.0.0.1:8080")
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		_, err = io.WriteString(c, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		c.Read(make([]byte, 1024))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-l.Messages():
+		if !bytes.HasPrefix(m.Data(), []byte("GET / HTTP/1.1")) {
+			t.Errorf("unexpected message %q", m.Data())
+		}
+	case err := <-errCh:
+		t.Fatal(err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("traffic of the namespace was not captured")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package capture
+
+import "errors"
+
+func runInNetns(path string, fn func() error) error {
+	return errors.New("network namespaces are only available on linux")
+}
@@ -0,0 +1,137 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapng constants, see https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html
+const (
+	ngBlockSection         = 0x0A0D0D0A
+	ngBlockInterface       = 0x00000001
+	ngBlockPacket          = 0x00000002 // obsolete packet block
+	ngBlockSimplePacket    = 0x00000003
+	ngBlockInterfaceStats  = 0x00000005
+	ngBlockEnhancedPacket  = 0x00000006
+	ngByteOrderMagic       = 0x1A2B3C4D
+	ngMaxBlockLen          = 16 << 20
+	ngBlockHeaderLen       = 8
+	ngSectionHeaderLen     = ngBlockHeaderLen + 4
+	ngInterfaceIDHeaderLen = ngBlockHeaderLen + 4
+)
+
+// ngReader reads packets of pcapng files. Unlike libpcap, it reads files which
+// contain interfaces with different link types: the link type of the last
+// packet is returned by LinkType. Packets of interfaces which were not
+// described are skipped.
+type ngReader struct {
+	*pcapgo.NgReader
+	linkType layers.LinkType
+}
+
+// newNgReader reads the first section header of a pcapng file
+func newNgReader(r *bufio.Reader) (*ngReader, error) {
+	ng := new(ngReader)
+	var err error
+	blocks := &ngBlocks{r: r, order: binary.LittleEndian}
+	if ng.NgReader, err = pcapgo.NewNgReader(blocks, pcapgo.NgReaderOptions{WantMixedLinkType: true, SkipUnknownVersion: true}); err != nil {
+		return nil, err
+	}
+	return ng, nil
+}
+
+// LinkType returns the link type of the interface of the last packet
+func (ng *ngReader) LinkType() layers.LinkType {
+	return ng.linkType
+}
+
+// ReadPacketData returns the next packet, other blocks are skipped
+func (ng *ngReader) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	data, ci, err = ng.NgReader.ReadPacketData()
+	if err == nil && len(ci.AncillaryData) > 0 {
+		ng.linkType, _ = ci.AncillaryData[0].(layers.LinkType)
+	}
+	return
+}
+
+// ngBlocks passes blocks of a pcapng file to pcapgo.NgReader, except blocks
+// of interfaces which were not described in their section: NgReader can not
+// read past them.
+type ngBlocks struct {
+	r          *bufio.Reader
+	order      binary.ByteOrder
+	interfaces uint32 // described in the current section
+	block      []byte // the part of the current block which was not read
+}
+
+func (b *ngBlocks) Read(p []byte) (n int, err error) {
+	for len(b.block) == 0 {
+		if err = b.next(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, b.block)
+	b.block = b.block[n:]
+	return n, nil
+}
+
+// next reads the next block which is passed to NgReader
+func (b *ngBlocks) next() error {
+	header, err := b.r.Peek(ngBlockHeaderLen)
+	if err != nil {
+		if err == io.EOF && len(header) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	// the type of section headers does not depend on the byte order
+	if binary.LittleEndian.Uint32(header) == ngBlockSection {
+		if header, err = b.r.Peek(ngSectionHeaderLen); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		b.order = binary.LittleEndian
+		if binary.BigEndian.Uint32(header[8:]) == ngByteOrderMagic {
+			b.order = binary.BigEndian
+		}
+		b.interfaces = 0
+	}
+	typ, length := b.order.Uint32(header), b.order.Uint32(header[4:])
+	if length < ngBlockHeaderLen+4 || length%4 != 0 || length > ngMaxBlockLen {
+		return errors.New("pcapng: invalid block length")
+	}
+	block := make([]byte, length)
+	if _, err = io.ReadFull(b.r, block); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+
+	switch typ {
+	case ngBlockInterface:
+		b.interfaces++
+	case ngBlockPacket, ngBlockEnhancedPacket, ngBlockInterfaceStats:
+		if len(block) < ngInterfaceIDHeaderLen {
+			return errors.New("pcapng: invalid block length")
+		}
+		id := b.order.Uint32(block[ngBlockHeaderLen:])
+		if typ == ngBlockPacket {
+			// the obsolete block has 16 bits interface ID followed by drops count
+			id = uint32(b.order.Uint16(block[ngBlockHeaderLen:]))
+		}
+		if id >= b.interfaces {
+			stats.Add("pcapng_unknown_interface", 1)
+			return nil
+		}
+	case ngBlockSimplePacket:
+		if b.interfaces == 0 {
+			stats.Add("pcapng_unknown_interface", 1)
+			return nil
+		}
+	}
+	b.block = block
+	return nil
+}
@@ -65,23 +65,11 @@ func (v *vxlanHandle) reader() {
 }
 
 func (v *vxlanHandle) vniIsAllowed(packet gopacket.Packet) bool {
-	defaultState := false
 	if layer := packet.Layer(layers.LayerTypeVXLAN); layer != nil {
 		vxlan, _ := layer.(*layers.VXLAN)
-		for _, vn := range v.vnis {
-			if vn > 0 && int(vxlan.VNI) == vn {
-				return true
-			}
-
-			if vn < 0 {
-				if int(vxlan.VNI) == -vn {
-					return false
-				}
-				defaultState = true
-			}
-		}
+		return tunnelIDAllowed(v.vnis, int(vxlan.VNI))
 	}
-	return defaultState
+	return false
 }
 
 func (v *vxlanHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
@@ -0,0 +1,159 @@
+/*
+Package dns implements capturing and replaying of DNS queries over UDP.
+
+DatagramHint pairs every query with its answer by transaction ID, both get the
+same tcp message ID:
+
+	parser.Datagram = dns.DatagramHint
+
+Diff compares answers of two resolvers to the same query.
+*/
+package dns // import github.com/buger/goreplay/internal/dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/buger/goreplay/internal/tcp"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var stats *expvar.Map
+
+func init() {
+	stats = expvar.NewMap("dns")
+	stats.Init()
+}
+
+// headerLen is the length of DNS header
+const headerLen = 12
+
+// ErrInvalid is returned for data which is not a DNS message
+var ErrInvalid = errors.New("dns: invalid message")
+
+// DatagramHint is tcp.HintDatagram of DNS, queries are requests and answers
+// are responses, they are paired by transaction ID
+func DatagramHint(pckt *tcp.Packet) (key uint32, dir tcp.Dir, ok bool) {
+	if len(pckt.Payload) < headerLen {
+		stats.Add("invalid_datagram", 1)
+		return 0, tcp.DirUnknown, false
+	}
+	dir = tcp.DirIncoming
+	if pckt.Payload[2]&0x80 != 0 {
+		// QR bit is set in answers
+		dir = tcp.DirOutcoming
+	}
+	return uint32(ID(pckt.Payload)), dir, true
+}
+
+// ID returns the transaction ID of a message
+func ID(msg []byte) uint16 {
+	if len(msg) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(msg)
+}
+
+// SetID sets the transaction ID of a message
+func SetID(msg []byte, id uint16) {
+	if len(msg) >= 2 {
+		binary.BigEndian.PutUint16(msg, id)
+	}
+}
+
+// Question returns the first question of a message, like "example.com. A"
+func Question(msg []byte) string {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return ""
+	}
+	q, err := p.Question()
+	if err != nil {
+		return ""
+	}
+	return q.Name.String() + " " + typeName(q.Type)
+}
+
+// Diff describes differences of two answers to the same query, it is empty
+// if they have the same response code and records. TTLs and the order of
+// records are ignored.
+func Diff(a, b []byte) (string, error) {
+	var ma, mb dnsmessage.Message
+	if ma.Unpack(a) != nil || mb.Unpack(b) != nil {
+		return "", ErrInvalid
+	}
+	var diffs []string
+	if ma.RCode != mb.RCode {
+		diffs = append(diffs, fmt.Sprintf("rcode %s != %s", rcodeName(ma.RCode), rcodeName(mb.RCode)))
+	}
+	ra, rb := records(ma.Answers), records(mb.Answers)
+	if strings.Join(ra, "\n") != strings.Join(rb, "\n") {
+		diffs = append(diffs, fmt.Sprintf("answers [%s] != [%s]", strings.Join(ra, ", "), strings.Join(rb, ", ")))
+	}
+	return strings.Join(diffs, "; "), nil
+}
+
+// records returns sorted records without TTLs
+func records(rrs []dnsmessage.Resource) []string {
+	list := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		list = append(list, rr.Header.Name.String()+" "+typeName(rr.Header.Type)+" "+rdata(rr.Body))
+	}
+	sort.Strings(list)
+	return list
+}
+
+func typeName(t dnsmessage.Type) string {
+	return strings.TrimPrefix(t.String(), "Type")
+}
+
+func rcodeName(c dnsmessage.RCode) string {
+	switch c {
+	case dnsmessage.RCodeSuccess:
+		return "NOERROR"
+	case dnsmessage.RCodeFormatError:
+		return "FORMERR"
+	case dnsmessage.RCodeServerFailure:
+		return "SERVFAIL"
+	case dnsmessage.RCodeNameError:
+		return "NXDOMAIN"
+	case dnsmessage.RCodeNotImplemented:
+		return "NOTIMP"
+	case dnsmessage.RCodeRefused:
+		return "REFUSED"
+	}
+	return strconv.Itoa(int(c))
+}
+
+func rdata(body dnsmessage.ResourceBody) string {
+	switch r := body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(r.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(r.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return r.CNAME.String()
+	case *dnsmessage.NSResource:
+		return r.NS.String()
+	case *dnsmessage.PTRResource:
+		return r.PTR.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", r.Pref, r.MX)
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, r.Target)
+	case *dnsmessage.TXTResource:
+		return fmt.Sprintf("%q", r.TXT)
+	case *dnsmessage.SOAResource:
+		return fmt.Sprintf("%s %s %d", r.NS, r.MBox, r.Serial)
+	case nil:
+		return ""
+	}
+	return body.GoString()
+}
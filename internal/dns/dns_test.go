@@ -0,0 +1,166 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/internal/tcp"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// message builds a query for example.com, or an answer with A records
+func message(t *testing.T, id uint16, response bool, rcode dnsmessage.RCode, ttl uint32, ips ...string) []byte {
+	t.Helper()
+	name := dnsmessage.MustNewName("example.com.")
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, Response: response, RCode: rcode},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	for _, ip := range ips {
+		var a dnsmessage.AResource
+		copy(a.A[:], net.ParseIP(ip).To4())
+		m.Answers = append(m.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &a,
+		})
+	}
+	data, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// packet builds loopback IPv4 UDP packet
+func packet(fromClient bool, clientPort uint16, payload []byte) *tcp.PcapPacket {
+	data := make([]byte, 4+20+8, 4+20+8+len(payload))
+	binary.BigEndian.PutUint32(data, uint32(layers.ProtocolFamilyIPv4))
+
+	ip := data[4:]
+	ip[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(ip[2:4], uint16(28+len(payload)))
+	ip[9] = uint8(layers.IPProtocolUDP)
+	client, server := net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 53).To4()
+
+	u := ip[20:]
+	binary.BigEndian.PutUint16(u[4:], uint16(8+len(payload)))
+	if fromClient {
+		copy(ip[12:16], client)
+		copy(ip[16:20], server)
+		binary.BigEndian.PutUint16(u, clientPort)
+		binary.BigEndian.PutUint16(u[2:], 53)
+	} else {
+		copy(ip[12:16], server)
+		copy(ip[16:20], client)
+		binary.BigEndian.PutUint16(u, 53)
+		binary.BigEndian.PutUint16(u[2:], clientPort)
+	}
+	data = append(data, payload...)
+
+	return &tcp.PcapPacket{
+		Data:     data,
+		LType:    int(layers.LinkTypeLoop),
+		LTypeLen: 4,
+		Ci:       &gopacket.CaptureInfo{Length: len(data), CaptureLength: len(data), Timestamp: time.Now()},
+	}
+}
+
+func TestDatagramHint(t *testing.T) {
+	parser := tcp.NewMessageParser(nil, []uint16{53}, nil, time.Minute, false)
+	parser.Datagram = DatagramHint
+	// messages of different ports are emitted in order by a single worker
+	parser.Workers = 1
+
+	query1, query2 := message(t, 1, false, 0, 0), message(t, 2, false, 0, 0)
+	answer1, answer2 := message(t, 1, true, 0, 60, "10.1.1.1"), message(t, 2, true, 0, 60, "10.2.2.2")
+	// the same ID from other port is other query
+	query3, answer3 := message(t, 1, false, 0, 0), message(t, 1, true, dnsmessage.RCodeNameError, 0)
+
+	parser.PacketHandler(packet(true, 40000, query1))
+	parser.PacketHandler(packet(true, 40000, query2))
+	parser.PacketHandler(packet(true, 40001, query3))
+	parser.PacketHandler(packet(false, 40000, answer2))
+	parser.PacketHandler(packet(false, 40001, answer3))
+	parser.PacketHandler(packet(false, 40000, answer1))
+	// an answer to a query sent before the capture and a short datagram
+	parser.PacketHandler(packet(false, 40000, message(t, 7, true, 0, 60)))
+	parser.PacketHandler(packet(true, 40000, []byte("short")))
+
+	expected := [][]byte{query1, query2, query3, answer2, answer3, answer1}
+	var messages []*tcp.Message
+	for i, data := range expected {
+		select {
+		case m := <-parserMessages(parser):
+			if !bytes.Equal(m.Data(), data) {
+				t.Errorf("message %d: expected %x, got %x", i, data, m.Data())
+			}
+			messages = append(messages, m)
+		case <-time.After(time.Second):
+			t.Fatalf("message %d was not emitted", i)
+		}
+	}
+	for i, j := range []int{5, 3, 4} {
+		if !bytes.Equal(messages[i].UUID(), messages[j].UUID()) {
+			t.Errorf("query %d should be paired with its answer", i)
+		}
+	}
+	if bytes.Equal(messages[0].UUID(), messages[2].UUID()) {
+		t.Error("queries of different ports should not be paired")
+	}
+	var in tcp.Dir = tcp.DirIncoming
+	if messages[0].Direction != in || messages[3].Direction == in {
+		t.Error("wrong directions")
+	}
+	select {
+	case m := <-parserMessages(parser):
+		t.Errorf("unexpected message %x", m.Data())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// parserMessages reads the next message of the parser
+func parserMessages(parser *tcp.MessageParser) chan *tcp.Message {
+	ch := make(chan *tcp.Message, 1)
+	go func() { ch <- parser.Read() }()
+	return ch
+}
+
+func TestDiff(t *testing.T) {
+	original := message(t, 1, true, 0, 60, "10.0.0.1", "10.0.0.2")
+	tests := []struct {
+		replayed []byte
+		diff     string
+	}{
+		// TTLs and order are ignored
+		{message(t, 1, true, 0, 300, "10.0.0.2", "10.0.0.1"), ""},
+		{message(t, 1, true, 0, 60, "10.0.0.1"), "answers [example.com. A 10.0.0.1, example.com. A 10.0.0.2] != [example.com. A 10.0.0.1]"},
+		{message(t, 1, true, dnsmessage.RCodeNameError, 60), "rcode NOERROR != NXDOMAIN; answers [example.com. A 10.0.0.1, example.com. A 10.0.0.2] != []"},
+	}
+	for i, tt := range tests {
+		diff, err := Diff(original, tt.replayed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff != tt.diff {
+			t.Errorf("%d: expected %q, got %q", i, tt.diff, diff)
+		}
+	}
+	if _, err := Diff(original, []byte("invalid")); err != ErrInvalid {
+		t.Errorf("expected ErrInvalid, got %v", err)
+	}
+	if q := Question(original); q != "example.com. A" {
+		t.Errorf("wrong question %q", q)
+	}
+
+	SetID(original, 0xabcd)
+	if ID(original) != 0xabcd || !strings.HasPrefix(Question(original), "example.com.") {
+		t.Error("SetID should only change the ID")
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Package grpc implements capturing of gRPC calls on top of HTTP/2 reassembly.
+
+Only streams with "application/grpc" content type are emitted, bodies are
+checked to consist of complete length-prefixed messages. Trailers carrying
+grpc-status and grpc-message are kept, so the emitted HTTP/1.1 form of a
+response looks like:
+
+	HTTP/1.1 200 OK
+	Content-Type: application/grpc
+	Transfer-Encoding: chunked
+	Trailer: Grpc-Status, Grpc-Message
+*/
+package grpc // import github.com/buger/goreplay/internal/grpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"strings"
+
+	"github.com/buger/goreplay/internal/http2"
+	"github.com/buger/goreplay/internal/tcp"
+)
+
+var stats *expvar.Map
+
+func init() {
+	stats = expvar.NewMap("grpc")
+	stats.Init()
+}
+
+// MessagePrefixLen is the size of compressed flag and length of a message
+const MessagePrefixLen = 5
+
+// ErrShortMessage is returned when body ends in the middle of a message
+var ErrShortMessage = errors.New("grpc: short message")
+
+// Message is a single length-prefixed gRPC message
+type Message struct {
+	Compressed bool
+	Data       []byte
+}
+
+// ParseMessages splits body of a request or response into messages
+func ParseMessages(body []byte) (messages []Message, err error) {
+	for len(body) > 0 {
+		if len(body) < MessagePrefixLen {
+			return messages, ErrShortMessage
+		}
+		n := int(binary.BigEndian.Uint32(body[1:MessagePrefixLen]))
+		if len(body)-MessagePrefixLen < n {
+			return messages, ErrShortMessage
+		}
+		messages = append(messages, Message{
+			Compressed: body[0] == 1,
+			Data:       body[MessagePrefixLen : MessagePrefixLen+n],
+		})
+		body = body[MessagePrefixLen+n:]
+	}
+	return
+}
+
+// IsGRPC reports whether content type is one of gRPC content types, e.g
+// application/grpc or application/grpc+proto
+func IsGRPC(contentType string) bool {
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// Status returns grpc-status of a response, it is sent in trailers, or in
+// headers for responses without body (trailers-only)
+func Status(m *http2.Message) string {
+	if s := m.Trailer("grpc-status"); s != "" {
+		return s
+	}
+	return m.Header("grpc-status")
+}
+
+// StreamHint is a tcp.HintStream which emits gRPC calls of HTTP/2 connections
+func StreamHint(c *tcp.Conn, pckt *tcp.Packet, data []byte) {
+	st, ok := c.ProtocolState().(*http2.State)
+	if !ok {
+		st = http2.NewState()
+		st.OnStream = onStream
+		c.SetProtocolState(st)
+	}
+	st.Handle(c, pckt, data)
+}
+
+func onStream(c *tcp.Conn, s *http2.Stream, dir tcp.Dir, packets []*tcp.Packet) {
+	m := s.Response
+	if dir == tcp.DirIncoming {
+		m = s.Request
+	}
+	// request headers are known for both sides, except h2c upgrade request
+	contentType := s.Request.Header("content-type")
+	if contentType == "" {
+		contentType = m.Header("content-type")
+	}
+	if !IsGRPC(contentType) {
+		stats.Add("skipped_stream_count", 1)
+		return
+	}
+	if _, err := ParseMessages(m.Body); err != nil {
+		stats.Add("malformed_count", 1)
+	}
+
+	var data []byte
+	if dir == tcp.DirIncoming {
+		stats.Add("call_count", 1)
+		data = http2.RequestHTTP1(m)
+	} else {
+		if Status(m) != "0" {
+			stats.Add("error_count", 1)
+		}
+		data = http2.ResponseHTTP1(m)
+	}
+	c.Emit(dir, s.ID, data, packets)
+}
@@ -0,0 +1,86 @@
+package grpc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/internal/tcp"
+	"github.com/buger/goreplay/internal/tcp/tcptest"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestParseMessages(t *testing.T) {
+	messages, err := ParseMessages([]byte("\x00\x00\x00\x00\x02hi\x01\x00\x00\x00\x00"))
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d: %v", len(messages), err)
+	}
+	if messages[0].Compressed || string(messages[0].Data) != "hi" || !messages[1].Compressed || len(messages[1].Data) != 0 {
+		t.Errorf("unexpected messages %+v", messages)
+	}
+
+	if _, err = ParseMessages([]byte("\x00\x00\x00\x00\x05hi")); err != ErrShortMessage {
+		t.Errorf("expected short message error, got %v", err)
+	}
+}
+
+func writeHeaders(fr *http2.Framer, enc *hpack.Encoder, hb *bytes.Buffer, streamID uint32, end bool, fields ...string) {
+	hb.Reset()
+	for i := 0; i < len(fields); i += 2 {
+		enc.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	fr.WriteHeaders(http2.HeadersFrameParam{StreamID: streamID, BlockFragment: hb.Bytes(), EndStream: end, EndHeaders: true})
+}
+
+func TestStreamHint(t *testing.T) {
+	var client, server, chb, shb bytes.Buffer
+	cfr, sfr := http2.NewFramer(&client, nil), http2.NewFramer(&server, nil)
+	cenc, senc := hpack.NewEncoder(&chb), hpack.NewEncoder(&shb)
+
+	client.WriteString(http2.ClientPreface)
+	cfr.WriteSettings()
+	// not a gRPC call
+	writeHeaders(cfr, cenc, &chb, 1, true, ":method", "GET", ":scheme", "http", ":authority", "example.com", ":path", "/health")
+	writeHeaders(cfr, cenc, &chb, 3, false, ":method", "POST", ":scheme", "http", ":authority", "example.com", ":path", "/helloworld.Greeter/SayHello", "content-type", "application/grpc", "te", "trailers")
+	cfr.WriteData(3, true, []byte("\x00\x00\x00\x00\x03abc"))
+
+	sfr.WriteSettings()
+	writeHeaders(sfr, senc, &shb, 1, true, ":status", "200")
+	writeHeaders(sfr, senc, &shb, 3, false, ":status", "200", "content-type", "application/grpc")
+	sfr.WriteData(3, false, []byte("\x00\x00\x00\x00\x02ok"))
+	writeHeaders(sfr, senc, &shb, 3, true, "grpc-status", "0")
+
+	parser := tcp.NewMessageParser(nil, []uint16{50051}, nil, time.Second, false)
+	parser.Stream = StreamHint
+	parser.PacketHandler(tcptest.Packet(true, 50051, 1, 0, client.Bytes()))
+	parser.PacketHandler(tcptest.Packet(false, 50051, 1, 0, server.Bytes()))
+
+	ch := make(chan *tcp.Message, 3)
+	go func() {
+		for {
+			ch <- parser.Read()
+		}
+	}()
+	var messages []*tcp.Message
+	for len(messages) < 3 {
+		select {
+		case m := <-ch:
+			messages = append(messages, m)
+		case <-time.After(200 * time.Millisecond):
+			if len(messages) != 2 {
+				t.Fatalf("expected 2 messages, got %d", len(messages))
+			}
+			if req := string(messages[0].Data()); !strings.HasPrefix(req, "POST /helloworld.Greeter/SayHello HTTP/1.1\r\n") {
+				t.Errorf("unexpected request %q", req)
+			}
+			if resp := string(messages[1].Data()); !strings.HasSuffix(resp, "Trailer: Grpc-Status\r\n\r\n7\r\n\x00\x00\x00\x00\x02ok\r\n0\r\nGrpc-Status: 0\r\n\r\n") {
+				t.Errorf("unexpected response %q", resp)
+			}
+			return
+		}
+	}
+	t.Errorf("unexpected message %q", messages[2].Data())
+}
@@ -0,0 +1,18 @@
+/*
+Package http2 implements passive reassembly of HTTP/2 connections (h2c upgrade
+and prior-knowledge) captured by github.com/buger/goreplay/internal/capture.
+
+Frames of both directions of a connection are parsed, header blocks are decoded
+with HPACK, and every completed stream is emitted as a pair of tcp messages
+(request and response) sharing the same ID. Payloads are converted to HTTP/1.1
+wire form, so they can be handled by the proto package like any other HTTP traffic.
+
+example:
+
+	parser := tcp.NewMessageParser(messages, ports, ips, expire, allowIncomplete)
+	parser.Stream = http2.StreamHint
+
+Connections captured in the middle can not be decoded, because HPACK state of
+the connection is unknown, they are ignored.
+*/
+package http2 // import github.com/buger/goreplay/internal/http2
@@ -0,0 +1,148 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Preface is the connection preface every HTTP/2 client starts with
+var Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// FrameHeaderLen is the size of HTTP/2 frame header
+const FrameHeaderLen = 9
+
+// FrameType is a type of HTTP/2 frame, see https://httpwg.org/specs/rfc7540.html#FrameTypes
+type FrameType uint8
+
+// Frame types defined by RFC 7540
+const (
+	FrameData FrameType = iota
+	FrameHeaders
+	FramePriority
+	FrameRSTStream
+	FrameSettings
+	FramePushPromise
+	FramePing
+	FrameGoAway
+	FrameWindowUpdate
+	FrameContinuation
+)
+
+// Frame flags, meaning of a flag depends on frame type
+const (
+	FlagEndStream  = 0x1
+	FlagAck        = 0x1
+	FlagEndHeaders = 0x4
+	FlagPadded     = 0x8
+	FlagPriority   = 0x20
+)
+
+// SettingHeaderTableSize is the id of SETTINGS_HEADER_TABLE_SIZE parameter
+const SettingHeaderTableSize = 0x1
+
+// Frame is a parsed HTTP/2 frame, Payload references the parsed data
+type Frame struct {
+	Type     FrameType
+	Flags    uint8
+	StreamID uint32
+	Payload  []byte
+}
+
+// Has reports whether the frame has given flag set
+func (f *Frame) Has(flag uint8) bool {
+	return f.Flags&flag != 0
+}
+
+// ParseFrame parses a frame from the start of data, it returns n=0 if data
+// does not contain the whole frame yet.
+func ParseFrame(data []byte) (f Frame, n int) {
+	if len(data) < FrameHeaderLen {
+		return
+	}
+	length := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+	if len(data) < FrameHeaderLen+length {
+		return
+	}
+	f.Type = FrameType(data[3])
+	f.Flags = data[4]
+	f.StreamID = binary.BigEndian.Uint32(data[5:9]) & (1<<31 - 1)
+	f.Payload = data[FrameHeaderLen : FrameHeaderLen+length]
+
+	return f, FrameHeaderLen + length
+}
+
+// ValidFrameHeader reports whether data starts with something that looks like
+// a frame header. It is used to recognize HTTP/2 connections without preface.
+func ValidFrameHeader(data []byte) bool {
+	if len(data) < FrameHeaderLen {
+		return false
+	}
+	length := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+	typ := FrameType(data[3])
+	streamID := binary.BigEndian.Uint32(data[5:9])
+
+	if typ > FrameContinuation || streamID>>31 != 0 {
+		return false
+	}
+	switch typ {
+	case FrameSettings, FramePing, FrameGoAway:
+		return streamID == 0
+	case FrameData, FrameHeaders, FramePriority, FrameRSTStream, FramePushPromise, FrameContinuation:
+		return streamID != 0 && length <= 1<<14
+	}
+	return true
+}
+
+// HeaderBlock returns header block fragment of HEADERS, PUSH_PROMISE or
+// CONTINUATION frame, without padding and priority fields
+func (f *Frame) HeaderBlock() ([]byte, error) {
+	p, err := f.unpad()
+	if err != nil {
+		return nil, err
+	}
+	switch f.Type {
+	case FrameHeaders:
+		if f.Has(FlagPriority) {
+			if len(p) < 5 {
+				return nil, fmt.Errorf("http2: short HEADERS priority")
+			}
+			p = p[5:]
+		}
+	case FramePushPromise:
+		if len(p) < 4 {
+			return nil, fmt.Errorf("http2: short PUSH_PROMISE")
+		}
+		p = p[4:]
+	}
+	return p, nil
+}
+
+// Data returns payload of DATA frame without padding
+func (f *Frame) Data() ([]byte, error) {
+	return f.unpad()
+}
+
+func (f *Frame) unpad() ([]byte, error) {
+	p := f.Payload
+	if f.Type == FrameContinuation || !f.Has(FlagPadded) {
+		return p, nil
+	}
+	if len(p) < 1 {
+		return nil, fmt.Errorf("http2: short padded frame")
+	}
+	padLen := int(p[0])
+	if padLen >= len(p) {
+		return nil, fmt.Errorf("http2: invalid padding")
+	}
+	return p[1 : len(p)-padLen], nil
+}
+
+// Settings calls fn for every parameter of SETTINGS frame
+func (f *Frame) Settings(fn func(id uint16, value uint32)) {
+	if f.Has(FlagAck) {
+		return
+	}
+	for p := f.Payload; len(p) >= 6; p = p[6:] {
+		fn(binary.BigEndian.Uint16(p), binary.BigEndian.Uint32(p[2:]))
+	}
+}
@@ -0,0 +1,465 @@
+package http2
+
+import (
+	"bytes"
+	"expvar"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/buger/goreplay/internal/tcp"
+	"github.com/buger/goreplay/proto"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+var stats *expvar.Map
+
+func init() {
+	stats = expvar.NewMap("http2")
+	stats.Init()
+}
+
+// maxBufferedLen limits unparsed data of a connection direction, frames can
+// not be bigger than 16mb
+const maxBufferedLen = FrameHeaderLen + 1<<24
+
+// Message is a request or response of a single stream
+type Message struct {
+	Headers  []hpack.HeaderField
+	Trailers []hpack.HeaderField
+	Body     []byte
+
+	headersDone bool
+	packets     []*tcp.Packet
+}
+
+// Header returns value of the first header with given (lowercase) name
+func (m *Message) Header(name string) string {
+	for _, f := range m.Headers {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Trailer returns value of the first trailer with given (lowercase) name
+func (m *Message) Trailer(name string) string {
+	for _, f := range m.Trailers {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+func (m *Message) addPackets(packets []*tcp.Packet) {
+	for _, p := range packets {
+		if n := len(m.packets); n == 0 || m.packets[n-1] != p {
+			m.packets = append(m.packets, p)
+		}
+	}
+}
+
+// Stream is the state of a single HTTP/2 stream
+type Stream struct {
+	ID       uint32
+	Request  *Message
+	Response *Message
+	done     [2]bool
+}
+
+func (s *Stream) message(dir tcp.Dir) *Message {
+	if dir == tcp.DirIncoming {
+		return s.Request
+	}
+	return s.Response
+}
+
+// side is parsing state of one direction of a connection
+type side struct {
+	buf     []byte
+	packets []*tcp.Packet // packets holding bytes in buf
+	synced  bool          // we are at frame boundary
+	decoder *hpack.Decoder
+
+	// header block being assembled from HEADERS/PUSH_PROMISE and CONTINUATION
+	block       []byte
+	blockStream uint32
+	blockFlags  uint8
+	blockPush   bool
+}
+
+// State is HTTP/2 state of a tcp connection
+type State struct {
+	started bool
+	sides   [2]side
+	streams map[uint32]*Stream
+
+	// OnStream when set is called for every completed message, instead of
+	// emitting its HTTP/1.1 representation
+	OnStream func(c *tcp.Conn, s *Stream, dir tcp.Dir, packets []*tcp.Packet)
+}
+
+// NewState returns new HTTP/2 state of a connection
+func NewState() *State {
+	st := &State{streams: make(map[uint32]*Stream)}
+	for i := range st.sides {
+		st.sides[i].decoder = hpack.NewDecoder(4096, nil)
+	}
+	return st
+}
+
+// StreamHint is a tcp.HintStream which reassembles HTTP/2 connections
+func StreamHint(c *tcp.Conn, pckt *tcp.Packet, data []byte) {
+	st, ok := c.ProtocolState().(*State)
+	if !ok {
+		st = NewState()
+		c.SetProtocolState(st)
+	}
+	st.Handle(c, pckt, data)
+}
+
+// Handle consumes next in order data of a connection
+func (st *State) Handle(c *tcp.Conn, pckt *tcp.Packet, data []byte) {
+	dir := c.Dir(pckt)
+
+	// The client could be mistaken for the server, e.g reading pcap file without known ports
+	if !st.started {
+		st.started = true
+		if (dir == tcp.DirOutcoming && (bytes.HasPrefix(data, Preface) || proto.HasRequestTitle(data))) ||
+			(dir == tcp.DirIncoming && proto.HasResponseTitle(data)) {
+			c.Swap()
+			dir = c.Dir(pckt)
+		}
+	}
+	sd := &st.sides[dir-1]
+
+	if len(sd.buf)+len(data) > maxBufferedLen {
+		c.Broken = true
+		return
+	}
+	sd.buf = append(sd.buf, data...)
+	sd.packets = append(sd.packets, pckt)
+
+	if !sd.synced && !st.sync(c, dir, sd) {
+		return
+	}
+
+	var n int
+	for !c.Broken {
+		f, size := ParseFrame(sd.buf[n:])
+		if size == 0 {
+			break
+		}
+		n += size
+		st.frame(c, dir, sd, &f)
+	}
+
+	sd.consume(n)
+}
+
+// consume removes n parsed bytes from the buffer
+func (sd *side) consume(n int) {
+	if n == 0 {
+		return
+	}
+	rest := len(sd.buf) - n
+	sd.buf = append(sd.buf[:0], sd.buf[n:]...)
+	if rest == 0 {
+		sd.packets = sd.packets[:0]
+		return
+	}
+	// keep only packets holding the remaining bytes
+	var size int
+	i := len(sd.packets)
+	for i > 0 && size < rest {
+		i--
+		size += len(sd.packets[i].Payload)
+	}
+	sd.packets = append(sd.packets[:0], sd.packets[i:]...)
+}
+
+// sync skips connection preface and h2c upgrade, it returns true when data
+// is at frame boundary
+func (st *State) sync(c *tcp.Conn, dir tcp.Dir, sd *side) bool {
+	buf := sd.buf
+	switch {
+	case dir == tcp.DirIncoming && len(buf) < len(Preface) && bytes.HasPrefix(Preface, buf):
+		return false
+	case dir == tcp.DirIncoming && bytes.HasPrefix(buf, Preface):
+		sd.synced = true
+		sd.consume(len(Preface))
+		return true
+	case dir == tcp.DirIncoming && proto.HasRequestTitle(buf):
+		if !strings.EqualFold(string(proto.Header(buf, []byte("Upgrade"))), "h2c") {
+			// plain HTTP/1 connection
+			c.Broken = true
+			return false
+		}
+		end := proto.MIMEHeadersEndPos(buf)
+		if end < 0 {
+			return false
+		}
+		bodyLen, _ := strconv.Atoi(string(proto.Header(buf, []byte("Content-Length"))))
+		if end += bodyLen; len(buf) < end {
+			return false
+		}
+		// The upgrade request is the request of stream 1
+		stats.Add("h2c_upgrade_count", 1)
+		req := proto.DeleteHeader(copyBytes(buf[:end]), []byte("Upgrade"))
+		req = proto.DeleteHeader(req, []byte("HTTP2-Settings"))
+		c.Emit(dir, 1, req, sd.packets)
+		st.stream(1).done[0] = true
+		sd.consume(end)
+		// the preface follows
+		return st.sync(c, dir, sd)
+	case dir == tcp.DirOutcoming && proto.HasResponseTitle(buf):
+		if !bytes.Equal(proto.Status(buf), []byte("101")) {
+			c.Broken = true
+			return false
+		}
+		end := proto.MIMEHeadersEndPos(buf)
+		if end < 0 {
+			return false
+		}
+		sd.synced = true
+		sd.consume(end)
+		return true
+	case len(buf) < FrameHeaderLen:
+		return false
+	case ValidFrameHeader(buf):
+		if dir == tcp.DirIncoming {
+			// captured in the middle of the connection, try our best
+			stats.Add("unsynced_conn_count", 1)
+		}
+		sd.synced = true
+		return true
+	}
+
+	c.Broken = true
+	return false
+}
+
+func (st *State) stream(id uint32) *Stream {
+	s, ok := st.streams[id]
+	if !ok {
+		s = &Stream{ID: id, Request: new(Message), Response: new(Message)}
+		// server initiated streams have only one side
+		s.done[0] = id%2 == 0
+		st.streams[id] = s
+	}
+	return s
+}
+
+func (st *State) frame(c *tcp.Conn, dir tcp.Dir, sd *side, f *Frame) {
+	if sd.block != nil && f.Type != FrameContinuation {
+		// CONTINUATION must follow immediately
+		c.Broken = true
+		return
+	}
+
+	switch f.Type {
+	case FrameSettings:
+		f.Settings(func(id uint16, value uint32) {
+			if id == SettingHeaderTableSize {
+				// limits encoder of the peer
+				st.sides[2-dir].decoder.SetAllowedMaxDynamicTableSize(value)
+			}
+		})
+	case FrameHeaders, FramePushPromise, FrameContinuation:
+		block, err := f.HeaderBlock()
+		if err != nil {
+			c.Broken = true
+			return
+		}
+		if f.Type != FrameContinuation {
+			sd.blockStream = f.StreamID
+			sd.blockFlags = f.Flags
+			sd.blockPush = f.Type == FramePushPromise
+		} else if f.StreamID != sd.blockStream {
+			c.Broken = true
+			return
+		}
+		sd.block = append(sd.block, block...)
+		if sd.blockStream != 0 && len(sd.packets) > 0 && !sd.blockPush {
+			st.stream(sd.blockStream).message(dir).addPackets(sd.packets)
+		}
+		if f.Has(FlagEndHeaders) {
+			st.headers(c, dir, sd)
+		}
+	case FrameData:
+		if f.StreamID == 0 {
+			return
+		}
+		data, err := f.Data()
+		if err != nil {
+			c.Broken = true
+			return
+		}
+		s := st.stream(f.StreamID)
+		m := s.message(dir)
+		m.Body = append(m.Body, data...)
+		m.addPackets(sd.packets)
+		if f.Has(FlagEndStream) {
+			st.end(c, s, dir)
+		}
+	case FrameRSTStream:
+		delete(st.streams, f.StreamID)
+	}
+}
+
+func (st *State) headers(c *tcp.Conn, dir tcp.Dir, sd *side) {
+	block, id, flags, push := sd.block, sd.blockStream, sd.blockFlags, sd.blockPush
+	sd.block = nil
+
+	// header blocks must be always decoded to keep HPACK state in sync
+	fields, err := sd.decoder.DecodeFull(block)
+	if err != nil {
+		stats.Add("hpack_error", 1)
+		c.Broken = true
+		return
+	}
+	if push || id == 0 {
+		// server push is not replayable
+		return
+	}
+
+	s := st.stream(id)
+	m := s.message(dir)
+	switch {
+	case !m.headersDone:
+		status := pseudo(fields, ":status")
+		if len(status) == 3 && status[0] == '1' && flags&FlagEndStream == 0 {
+			// informational response, wait for the final one
+			return
+		}
+		m.Headers = fields
+		m.headersDone = true
+	default:
+		m.Trailers = fields
+	}
+
+	if flags&FlagEndStream != 0 {
+		st.end(c, s, dir)
+	}
+}
+
+// end handles the end of one side of the stream
+func (st *State) end(c *tcp.Conn, s *Stream, dir tcp.Dir) {
+	m := s.message(dir)
+	s.done[dir-1] = true
+	if s.done[0] && s.done[1] {
+		delete(st.streams, s.ID)
+	}
+	// responses of server initiated streams have no request
+	if s.ID%2 == 0 || !m.headersDone {
+		return
+	}
+
+	stats.Add("message_count", 1)
+	if st.OnStream != nil {
+		st.OnStream(c, s, dir, m.packets)
+		return
+	}
+
+	var data []byte
+	if dir == tcp.DirIncoming {
+		data = RequestHTTP1(m)
+	} else {
+		data = ResponseHTTP1(m)
+	}
+	c.Emit(dir, s.ID, data, m.packets)
+}
+
+func pseudo(fields []hpack.HeaderField, name string) string {
+	for _, f := range fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// RequestHTTP1 converts HTTP/2 request to HTTP/1.1 wire format
+func RequestHTTP1(m *Message) []byte {
+	var buf bytes.Buffer
+	method := pseudo(m.Headers, ":method")
+	path := pseudo(m.Headers, ":path")
+	authority := pseudo(m.Headers, ":authority")
+	if method == http.MethodConnect || path == "" {
+		path = authority
+	}
+
+	buf.WriteString(method + " " + path + " HTTP/1.1\r\n")
+	if authority != "" && m.Header("host") == "" {
+		buf.WriteString("Host: " + authority + "\r\n")
+	}
+	writeHTTP1(&buf, m)
+	return buf.Bytes()
+}
+
+// ResponseHTTP1 converts HTTP/2 response to HTTP/1.1 wire format
+func ResponseHTTP1(m *Message) []byte {
+	var buf bytes.Buffer
+	status := pseudo(m.Headers, ":status")
+	code, _ := strconv.Atoi(status)
+	text := http.StatusText(code)
+	if text == "" {
+		text = "status code " + status
+	}
+
+	buf.WriteString("HTTP/1.1 " + status + " " + text + "\r\n")
+	writeHTTP1(&buf, m)
+	return buf.Bytes()
+}
+
+func writeHTTP1(buf *bytes.Buffer, m *Message) {
+	chunked := len(m.Trailers) > 0
+	hasLength := false
+	for _, f := range m.Headers {
+		if f.IsPseudo() {
+			continue
+		}
+		switch f.Name {
+		case "content-length":
+			if chunked {
+				continue
+			}
+			hasLength = true
+		case "connection", "transfer-encoding", "keep-alive", "upgrade", "trailer":
+			continue
+		}
+		buf.WriteString(http.CanonicalHeaderKey(f.Name) + ": " + f.Value + "\r\n")
+	}
+
+	if chunked {
+		names := make([]string, 0, len(m.Trailers))
+		for _, f := range m.Trailers {
+			names = append(names, http.CanonicalHeaderKey(f.Name))
+		}
+		buf.WriteString("Transfer-Encoding: chunked\r\nTrailer: " + strings.Join(names, ", ") + "\r\n\r\n")
+		if len(m.Body) > 0 {
+			buf.WriteString(strconv.FormatInt(int64(len(m.Body)), 16) + "\r\n")
+			buf.Write(m.Body)
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString("0\r\n")
+		for _, f := range m.Trailers {
+			buf.WriteString(http.CanonicalHeaderKey(f.Name) + ": " + f.Value + "\r\n")
+		}
+		buf.WriteString("\r\n")
+		return
+	}
+
+	if !hasLength && len(m.Body) > 0 {
+		buf.WriteString("Content-Length: " + strconv.Itoa(len(m.Body)) + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(m.Body)
+}
+
+func copyBytes(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
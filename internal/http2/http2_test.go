@@ -0,0 +1,179 @@
+package http2
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/internal/tcp"
+	"github.com/buger/goreplay/internal/tcp/tcptest"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// split splits stream into packets of given size
+func split(fromClient bool, stream []byte, size int) (packets []*tcp.PcapPacket) {
+	for i := 0; i < len(stream); i += size {
+		end := i + size
+		if end > len(stream) {
+			end = len(stream)
+		}
+		packets = append(packets, tcptest.Packet(fromClient, 8080, uint32(1000+i), 0, stream[i:end]))
+	}
+	return
+}
+
+type endpoint struct {
+	buf bytes.Buffer
+	fr  *http2.Framer
+	hb  bytes.Buffer
+	enc *hpack.Encoder
+}
+
+func newEndpoint() *endpoint {
+	e := new(endpoint)
+	e.fr = http2.NewFramer(&e.buf, nil)
+	e.enc = hpack.NewEncoder(&e.hb)
+	return e
+}
+
+func (e *endpoint) headers(streamID uint32, end bool, fields ...string) {
+	e.hb.Reset()
+	for i := 0; i < len(fields); i += 2 {
+		e.enc.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	e.fr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      streamID,
+		BlockFragment: e.hb.Bytes(),
+		EndStream:     end,
+		EndHeaders:    true,
+	})
+}
+
+func newParser() *tcp.MessageParser {
+	parser := tcp.NewMessageParser(nil, []uint16{8080}, nil, time.Second, false)
+	parser.Stream = StreamHint
+	return parser
+}
+
+func readMessages(t *testing.T, parser *tcp.MessageParser, n int) (messages []*tcp.Message) {
+	ch := make(chan *tcp.Message, n)
+	go func() {
+		for i := 0; i < n; i++ {
+			ch <- parser.Read()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		select {
+		case m := <-ch:
+			messages = append(messages, m)
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d messages, got %d", n, i)
+		}
+	}
+	return
+}
+
+func TestHTTP2PriorKnowledge(t *testing.T) {
+	client, server := newEndpoint(), newEndpoint()
+
+	client.buf.Write(Preface)
+	client.fr.WriteSettings()
+	client.headers(1, true, ":method", "GET", ":scheme", "http", ":authority", "example.com", ":path", "/a", "user-agent", "gor")
+	client.headers(3, false, ":method", "POST", ":scheme", "http", ":authority", "example.com", ":path", "/b")
+	client.fr.WriteData(3, true, []byte("hello"))
+
+	server.fr.WriteSettings()
+	server.headers(3, false, ":status", "201")
+	server.headers(1, false, ":status", "200", "content-type", "text/plain")
+	server.fr.WriteData(1, true, []byte("first"))
+	server.fr.WriteData(3, true, []byte("second"))
+
+	parser := newParser()
+	for _, p := range split(true, client.buf.Bytes(), 7) {
+		parser.PacketHandler(p)
+	}
+	for _, p := range split(false, server.buf.Bytes(), 11) {
+		parser.PacketHandler(p)
+	}
+
+	messages := readMessages(t, parser, 4)
+	byID := make(map[string][]*tcp.Message)
+	for _, m := range messages {
+		byID[string(m.UUID())] = append(byID[string(m.UUID())], m)
+	}
+	if len(byID) != 2 {
+		t.Fatalf("expected 2 streams, got %d", len(byID))
+	}
+
+	expected := map[string]string{
+		"GET /a HTTP/1.1\r\nHost: example.com\r\nUser-Agent: gor\r\n\r\n":         "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\nfirst",
+		"POST /b HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello": "HTTP/1.1 201 Created\r\nContent-Length: 6\r\n\r\nsecond",
+	}
+	for _, pair := range byID {
+		if len(pair) != 2 || pair[0].Direction != tcp.DirIncoming || pair[1].Direction != tcp.DirOutcoming {
+			t.Fatalf("expected request and response with the same id")
+		}
+		req, resp := string(pair[0].Data()), string(pair[1].Data())
+		if expected[req] != resp {
+			t.Errorf("unexpected pair\n%q\n%q", req, resp)
+		}
+	}
+}
+
+func TestHTTP2UpgradeAndTrailers(t *testing.T) {
+	client, server := newEndpoint(), newEndpoint()
+
+	client.buf.WriteString("GET /upgrade HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n")
+	client.buf.Write(Preface)
+	client.fr.WriteSettings()
+
+	switching := "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"
+	server.buf.WriteString(switching)
+	server.fr.WriteSettings()
+	server.headers(1, false, ":status", "100")
+	server.headers(1, false, ":status", "200")
+	server.fr.WriteData(1, false, []byte("body"))
+	server.headers(1, true, "grpc-status", "0")
+
+	// The server packets are captured first and ports are unknown
+	parser := tcp.NewMessageParser(nil, nil, nil, time.Second, false)
+	parser.Stream = StreamHint
+	serverPackets := split(false, server.buf.Bytes(), len(switching))
+	parser.PacketHandler(serverPackets[0])
+	for _, p := range split(true, client.buf.Bytes(), 1000) {
+		parser.PacketHandler(p)
+	}
+	for _, p := range serverPackets[1:] {
+		parser.PacketHandler(p)
+	}
+
+	messages := readMessages(t, parser, 2)
+	if !bytes.Equal(messages[0].UUID(), messages[1].UUID()) {
+		t.Error("request and response should have same id")
+	}
+	req := string(messages[0].Data())
+	if !strings.HasPrefix(req, "GET /upgrade HTTP/1.1\r\n") || strings.Contains(req, "Upgrade: h2c") {
+		t.Errorf("unexpected request %q", req)
+	}
+	resp := string(messages[1].Data())
+	if resp != "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: Grpc-Status\r\n\r\n4\r\nbody\r\n0\r\nGrpc-Status: 0\r\n\r\n" {
+		t.Errorf("unexpected response %q", resp)
+	}
+}
+
+func TestHTTP2IgnoresHTTP1(t *testing.T) {
+	parser := newParser()
+	parser.PacketHandler(tcptest.Packet(true, 8080, 1, 0, []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")))
+	parser.PacketHandler(tcptest.Packet(false, 8080, 1, 0, []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")))
+
+	ch := make(chan *tcp.Message, 1)
+	go func() { ch <- parser.Read() }()
+	select {
+	case m := <-ch:
+		t.Errorf("unexpected message %q", m.Data())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,248 @@
+// Package httpdiff compares HTTP responses to the same request, like the
+// captured response and the response of the replay target
+package httpdiff
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalid is returned for data which is not an HTTP response
+var ErrInvalid = errors.New("invalid HTTP response")
+
+// maxDiffs limits differences reported for a pair of responses
+const maxDiffs = 20
+
+// maxValueLen limits values quoted in differences
+const maxValueLen = 64
+
+// Response is a parsed HTTP response, its body is decoded
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Parse parses an HTTP response, chunked and gzip bodies are decoded and
+// truncated bodies are kept as they are
+func Parse(data []byte) (*Response, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), nil)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		if r, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+			if decoded, err := io.ReadAll(r); err == nil || errors.Is(err, io.ErrUnexpectedEOF) {
+				body = decoded
+			}
+		}
+	}
+	return &Response{resp.StatusCode, resp.Header, body}, nil
+}
+
+// Comparator compares status, selected headers and bodies of responses.
+// JSON bodies are compared field by field, other bodies byte by byte.
+type Comparator struct {
+	headers []string
+	ignore  [][]string
+	regexps []*regexp.Regexp
+}
+
+// New returns Comparator of the headers. ignore are fields of JSON bodies
+// which are not compared, like `data.items.*.updated_at`: keys and array
+// indexes are separated by dots and `*` matches any of them. Matches of
+// ignoreRegexps are removed from other bodies before they are compared.
+func New(headers, ignore, ignoreRegexps []string) (*Comparator, error) {
+	c := &Comparator{headers: headers}
+	for _, path := range ignore {
+		c.ignore = append(c.ignore, strings.Split(path, "."))
+	}
+	for _, expr := range ignoreRegexps {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignore regexp %q: %v", expr, err)
+		}
+		c.regexps = append(c.regexps, re)
+	}
+	return c, nil
+}
+
+// Diff describes differences of the responses, it is empty if they are the
+// same
+func (c *Comparator) Diff(original, replayed []byte) ([]string, error) {
+	a, err := Parse(original)
+	if err != nil {
+		return nil, err
+	}
+	b, err := Parse(replayed)
+	if err != nil {
+		return nil, err
+	}
+	return c.DiffResponses(a, b), nil
+}
+
+// DiffResponses is Diff of parsed responses
+func (c *Comparator) DiffResponses(a, b *Response) (diffs []string) {
+	if a.Status != b.Status {
+		diffs = append(diffs, fmt.Sprintf("status %d != %d", a.Status, b.Status))
+	}
+	for _, name := range c.headers {
+		va, vb := strings.Join(a.Header.Values(name), ", "), strings.Join(b.Header.Values(name), ", ")
+		if va != vb {
+			diffs = append(diffs, fmt.Sprintf("header %s: %q != %q", http.CanonicalHeaderKey(name), va, vb))
+		}
+	}
+
+	if ja, jb, ok := jsonBodies(a, b); ok {
+		c.jsonDiff(nil, ja, jb, &diffs)
+	} else if diff := c.textDiff(a.Body, b.Body); diff != "" {
+		diffs = append(diffs, diff)
+	}
+	if len(diffs) > maxDiffs {
+		diffs = append(diffs[:maxDiffs], fmt.Sprintf("and %d more", len(diffs)-maxDiffs))
+	}
+	return diffs
+}
+
+// jsonBodies decodes bodies of the responses if both are JSON
+func jsonBodies(a, b *Response) (ja, jb interface{}, ok bool) {
+	if !isJSON(a) || !isJSON(b) {
+		return nil, nil, false
+	}
+	if decode(a.Body, &ja) != nil || decode(b.Body, &jb) != nil {
+		return nil, nil, false
+	}
+	return ja, jb, true
+}
+
+func isJSON(r *Response) bool {
+	if strings.Contains(r.Header.Get("Content-Type"), "json") {
+		return true
+	}
+	body := bytes.TrimSpace(r.Body)
+	return len(body) > 0 && (body[0] == '{' || body[0] == '[')
+}
+
+func decode(data []byte, v *interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// ignored reports whether the field is matched by an ignore rule
+func (c *Comparator) ignored(path []string) bool {
+	for _, rule := range c.ignore {
+		if len(rule) != len(path) {
+			continue
+		}
+		match := true
+		for i := range rule {
+			if rule[i] != "*" && rule[i] != path[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonDiff appends differences of the JSON values at the path, paths of
+// differences have the syntax of ignore rules
+func (c *Comparator) jsonDiff(path []string, a, b interface{}, diffs *[]string) {
+	if c.ignored(path) || len(*diffs) > maxDiffs {
+		return
+	}
+	name := "body"
+	if len(path) > 0 {
+		name = "body " + strings.Join(path, ".")
+	}
+
+	switch va := a.(type) {
+	case map[string]interface{}:
+		vb, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(va)+len(vb))
+		for k := range va {
+			keys = append(keys, k)
+		}
+		for k := range vb {
+			if _, ok := va[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := append(path[:len(path):len(path)], k)
+			ea, oka := va[k]
+			eb, okb := vb[k]
+			switch {
+			case c.ignored(p):
+			case !okb:
+				*diffs = append(*diffs, fmt.Sprintf("body %s: missing", strings.Join(p, ".")))
+			case !oka:
+				*diffs = append(*diffs, fmt.Sprintf("body %s: added", strings.Join(p, ".")))
+			default:
+				c.jsonDiff(p, ea, eb, diffs)
+			}
+		}
+		return
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		if len(va) != len(vb) {
+			*diffs = append(*diffs, fmt.Sprintf("%s: length %d != %d", name, len(va), len(vb)))
+		}
+		for i := 0; i < len(va) && i < len(vb); i++ {
+			c.jsonDiff(append(path[:len(path):len(path)], strconv.Itoa(i)), va[i], vb[i], diffs)
+		}
+		return
+	default:
+		if a == b {
+			return
+		}
+	}
+	*diffs = append(*diffs, fmt.Sprintf("%s: %s != %s", name, jsonValue(a), jsonValue(b)))
+}
+
+func jsonValue(v interface{}) string {
+	data, _ := json.Marshal(v)
+	if len(data) > maxValueLen {
+		return string(data[:maxValueLen]) + "..."
+	}
+	return string(data)
+}
+
+// textDiff compares bodies without matches of ignore regexps
+func (c *Comparator) textDiff(a, b []byte) string {
+	for _, re := range c.regexps {
+		a, b = re.ReplaceAll(a, nil), re.ReplaceAll(b, nil)
+	}
+	if bytes.Equal(a, b) {
+		return ""
+	}
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return fmt.Sprintf("body differs at byte %d, length %d != %d", i, len(a), len(b))
+}
@@ -0,0 +1,78 @@
+package httpdiff
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// response builds a response with the body
+func response(status int, contentType, body string) []byte {
+	return []byte(fmt.Sprintf("HTTP/1.1 %d OK\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n%s", status, contentType, len(body), body))
+}
+
+func TestDiff(t *testing.T) {
+	c, err := New([]string{"content-type"}, []string{"meta.request_id", "items.*.updated"}, []string{`\d{2}:\d{2}:\d{2}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := response(200, "application/json", `{"items":[{"id":1,"updated":"10:00"},{"id":2,"updated":"10:01"}],"meta":{"request_id":"a","total":2}}`)
+	tests := []struct {
+		replayed []byte
+		diffs    []string
+	}{
+		// ignored fields, keys order and spaces
+		{response(200, "application/json", `{"meta":{"total":2,"request_id":"b"}, "items":[{"updated":"11:00","id":1},{"id":2,"updated":"11:01"}]}`), nil},
+		{response(500, "text/plain", "oops"), []string{`status 200 != 500`, `header Content-Type: "application/json" != "text/plain"`, "body differs at byte 0, length 101 != 4"}},
+		{response(200, "application/json", `{"items":[{"id":1,"updated":"10:00"}],"meta":{"total":"2","next":3}}`), []string{
+			"body items: length 2 != 1",
+			"body meta.next: added",
+			`body meta.total: 2 != "2"`,
+		}},
+	}
+	for i, tt := range tests {
+		diffs, err := c.Diff(original, tt.replayed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(diffs, tt.diffs) {
+			t.Errorf("%d: expected %q, got %q", i, tt.diffs, diffs)
+		}
+	}
+
+	// ignore regexps apply to text bodies
+	diffs, _ := c.Diff(response(200, "text/html", "<p>at 10:00:00</p>"), response(200, "text/html", "<p>at 11:30:00</p>"))
+	if len(diffs) != 0 {
+		t.Errorf("expected no differences, got %q", diffs)
+	}
+	if _, err := c.Diff(original, []byte("invalid")); err != ErrInvalid {
+		t.Errorf("expected ErrInvalid, got %v", err)
+	}
+	if _, err := New(nil, nil, []string{"("}); err == nil {
+		t.Error("expected invalid regexp error")
+	}
+}
+
+func TestParse(t *testing.T) {
+	var body bytes.Buffer
+	w := gzip.NewWriter(&body)
+	w.Write([]byte(`{"a":1}`))
+	w.Close()
+
+	data := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n\r\n%x\r\n%s\r\n0\r\n\r\n", body.Len(), body.Bytes())
+	resp, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != 200 || string(resp.Body) != `{"a":1}` {
+		t.Errorf("unexpected response %d %q", resp.Status, resp.Body)
+	}
+
+	// a body truncated by the capture
+	resp, err = Parse([]byte("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhello"))
+	if err != nil || string(resp.Body) != "hello" {
+		t.Errorf("expected the truncated body, got %v %v", resp, err)
+	}
+}
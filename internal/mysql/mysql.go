@@ -0,0 +1,349 @@
+/*
+Package mysql implements capturing and replaying of MySQL client/server protocol.
+
+StreamHint reassembles MySQL packets (3-byte length and sequence id) of both
+directions of a connection and emits every command and its response as a pair
+of tcp messages sharing the same ID:
+
+	parser.Stream = mysql.StreamHint
+
+The end of a response is found by the command it answers: result sets of
+COM_QUERY and COM_STMT_EXECUTE end with EOF or OK packet, responses of
+COM_STMT_PREPARE end after parameter and column definitions. The handshake and
+authentication exchanges are not emitted, they can not be replayed.
+Connections using TLS or compression are ignored.
+
+Conn is a minimal client used to replay captured commands.
+*/
+package mysql // import github.com/buger/goreplay/internal/mysql
+
+import (
+	"encoding/binary"
+	"expvar"
+)
+
+var stats *expvar.Map
+
+func init() {
+	stats = expvar.NewMap("mysql")
+	stats.Init()
+}
+
+// HeaderLen is the size of packet header: payload length and sequence id
+const HeaderLen = 4
+
+// MaxPayloadLen is the longest payload of a single packet, longer payloads are
+// split into several packets
+const MaxPayloadLen = 1<<24 - 1
+
+// commands
+const (
+	ComQuit             = 0x01
+	ComInitDB           = 0x02
+	ComQuery            = 0x03
+	ComFieldList        = 0x04
+	ComChangeUser       = 0x11
+	ComBinlogDump       = 0x12
+	ComStmtPrepare      = 0x16
+	ComStmtExecute      = 0x17
+	ComStmtSendLongData = 0x18
+	ComStmtClose        = 0x19
+	ComStmtReset        = 0x1a
+	ComStmtFetch        = 0x1c
+	ComBinlogDumpGTID   = 0x1e
+)
+
+// first bytes of response packets
+const (
+	PacketOK          = 0x00
+	PacketAuthMore    = 0x01
+	PacketLocalInFile = 0xfb
+	PacketEOF         = 0xfe // also AuthSwitchRequest and OK packet ending result sets
+	PacketErr         = 0xff
+)
+
+// capability flags
+const (
+	ClientLongPassword     = 0x00000001
+	ClientConnectWithDB    = 0x00000008
+	ClientCompress         = 0x00000020
+	ClientProtocol41       = 0x00000200
+	ClientSSL              = 0x00000800
+	ClientTransactions     = 0x00002000
+	ClientSecureConnection = 0x00008000
+	ClientMultiStatements  = 0x00010000
+	ClientMultiResults     = 0x00020000
+	ClientPSMultiResults   = 0x00040000
+	ClientPluginAuth       = 0x00080000
+	ClientPluginAuthLenenc = 0x00200000
+	ClientDeprecateEOF     = 0x01000000
+	ClientZstdCompression  = 0x04000000
+)
+
+// server status flags
+const (
+	StatusCursorExists      = 0x0040
+	StatusMoreResultsExists = 0x0008
+)
+
+// eofMode tells whether the server sends EOF packets after column definitions,
+// it is known from the handshake or from earlier result sets
+type eofMode int8
+
+const (
+	eofUnknown eofMode = iota
+	eofSent
+	eofDeprecated
+)
+
+// NextPacket returns the bounds of the first logical packet of data: payloads
+// of MaxPayloadLen are continued by the next packet. head is the payload of
+// the first packet, length is the total length of payloads and size is the
+// number of bytes including headers, it is -1 if the packet is not complete.
+func NextPacket(data []byte) (head []byte, length, size int) {
+	for {
+		if len(data)-size < HeaderLen {
+			return nil, 0, -1
+		}
+		n := int(data[size]) | int(data[size+1])<<8 | int(data[size+2])<<16
+		if len(data)-size-HeaderLen < n {
+			return nil, 0, -1
+		}
+		if head == nil {
+			head = data[size+HeaderLen : size+HeaderLen+n]
+		}
+		length += n
+		size += HeaderLen + n
+		if n < MaxPayloadLen {
+			return head, length, size
+		}
+	}
+}
+
+// isEOF reports whether the packet is EOF packet sent after column definitions
+func isEOF(head []byte, length int) bool {
+	return len(head) > 0 && head[0] == PacketEOF && length == 5
+}
+
+// isTerminator reports whether the packet ends rows of a result set: EOF
+// packet or OK packet with 0xfe header. Rows starting with 0xfe have a value
+// longer than a single packet.
+func isTerminator(head []byte, length int) bool {
+	return len(head) > 0 && head[0] == PacketEOF && length < MaxPayloadLen
+}
+
+// terminatorStatus returns server status flags of EOF or OK packet
+func terminatorStatus(head []byte) uint16 {
+	if len(head) == 5 && head[0] == PacketEOF {
+		return binary.LittleEndian.Uint16(head[3:])
+	}
+	// OK packet: header, affected rows, last insert id, status flags
+	p := head[1:]
+	for i := 0; i < 2; i++ {
+		n := lenencSize(p)
+		if n == 0 || n > len(p) {
+			return 0
+		}
+		p = p[n:]
+	}
+	if len(p) < 2 {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(p)
+}
+
+// lenencSize returns the size of length-encoded integer
+func lenencSize(p []byte) int {
+	if len(p) == 0 {
+		return 0
+	}
+	switch p[0] {
+	case 0xfc:
+		return 3
+	case 0xfd:
+		return 4
+	case 0xfe:
+		return 9
+	}
+	return 1
+}
+
+// lenencInt decodes length-encoded integer
+func lenencInt(p []byte) (uint64, bool) {
+	n := lenencSize(p)
+	if n == 0 || n > len(p) {
+		return 0, false
+	}
+	var v uint64
+	if n == 1 {
+		return uint64(p[0]), true
+	}
+	for i := n - 1; i >= 1; i-- {
+		v = v<<8 | uint64(p[i])
+	}
+	return v, true
+}
+
+// response states
+const (
+	respFirst = iota
+	respColumns
+	respColumnsEnd
+	respRows
+	respParams
+	respParamsEnd
+	respPrepColumns
+	respPrepColumnsEnd
+	respDefinitions
+)
+
+// response finds the end of a response to a command
+type response struct {
+	cmd     byte
+	eof     *eofMode
+	state   int
+	n       int // definitions left
+	columns int // columns of a prepared statement
+}
+
+// HasResponse reports whether the server responds to the command
+func HasResponse(cmd byte) bool {
+	switch cmd {
+	case ComQuit, ComStmtClose, ComStmtSendLongData:
+		return false
+	}
+	return true
+}
+
+// packet handles the next packet of the response, it returns true if the
+// response is complete
+func (r *response) packet(head []byte, length int) bool {
+	if len(head) == 0 {
+		return r.state == respFirst
+	}
+	switch r.state {
+	case respFirst:
+		switch {
+		case head[0] == PacketErr:
+			return true
+		case r.cmd == ComStmtFetch:
+			r.state = respRows
+			return r.row(head, length)
+		case r.cmd == ComFieldList:
+			r.state = respDefinitions
+			return r.packet(head, length)
+		case r.cmd == ComStmtPrepare && head[0] == PacketOK && length >= 12:
+			r.columns = int(binary.LittleEndian.Uint16(head[5:]))
+			r.n = int(binary.LittleEndian.Uint16(head[7:]))
+			switch {
+			case r.n > 0:
+				r.state = respParams
+			case r.columns > 0:
+				r.n, r.state = r.columns, respPrepColumns
+			default:
+				return true
+			}
+			return false
+		case r.cmd != ComQuery && r.cmd != ComStmtExecute:
+			return true
+		case head[0] == PacketOK:
+			return terminatorStatus(head)&StatusMoreResultsExists == 0
+		case head[0] == PacketLocalInFile:
+			// the client sends the file, then the server responds with OK
+			return true
+		}
+		columns, ok := lenencInt(head)
+		if !ok || columns == 0 {
+			return true
+		}
+		r.n, r.state = int(columns), respColumns
+	case respColumns, respParams, respPrepColumns:
+		if r.n--; r.n > 0 {
+			return false
+		}
+		r.state++
+		if r.state == respPrepColumnsEnd && *r.eof == eofDeprecated {
+			return true
+		}
+		if r.state == respParamsEnd && *r.eof == eofDeprecated {
+			if r.columns == 0 {
+				return true
+			}
+			r.n, r.state = r.columns, respPrepColumns
+		}
+	case respColumnsEnd:
+		if isEOF(head, length) {
+			*r.eof = eofSent
+			if r.cmd == ComStmtExecute && terminatorStatus(head)&StatusCursorExists != 0 {
+				// rows are read by COM_STMT_FETCH
+				return true
+			}
+			r.state = respRows
+			return false
+		}
+		*r.eof = eofDeprecated
+		r.state = respRows
+		return r.row(head, length)
+	case respRows:
+		return r.row(head, length)
+	case respParamsEnd, respPrepColumnsEnd:
+		if isEOF(head, length) {
+			*r.eof = eofSent
+		} else {
+			// the mode was not known, the packet belongs to the next section
+			// or to the next response
+			*r.eof = eofDeprecated
+		}
+		if r.state == respPrepColumnsEnd || r.columns == 0 {
+			return true
+		}
+		r.n, r.state = r.columns, respPrepColumns
+		if *r.eof == eofDeprecated {
+			return r.packet(head, length)
+		}
+	case respDefinitions:
+		return head[0] == PacketErr || isTerminator(head, length)
+	}
+	return false
+}
+
+// row handles a row or the end of a result set
+func (r *response) row(head []byte, length int) bool {
+	switch {
+	case head[0] == PacketErr:
+		return true
+	case isTerminator(head, length):
+		if terminatorStatus(head)&StatusMoreResultsExists != 0 {
+			r.state = respFirst
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// PrepareID returns the statement id of a response to COM_STMT_PREPARE
+func PrepareID(resp []byte) (uint32, bool) {
+	head, length, _ := NextPacket(resp)
+	if len(head) < 5 || head[0] != PacketOK || length < 12 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(head[1:]), true
+}
+
+// StatementID returns the statement id of commands using prepared statements
+func StatementID(cmd []byte) (uint32, bool) {
+	if len(cmd) < HeaderLen+5 {
+		return 0, false
+	}
+	switch cmd[HeaderLen] {
+	case ComStmtExecute, ComStmtSendLongData, ComStmtClose, ComStmtReset, ComStmtFetch:
+		return binary.LittleEndian.Uint32(cmd[HeaderLen+1:]), true
+	}
+	return 0, false
+}
+
+// SetStatementID replaces the statement id of the command
+func SetStatementID(cmd []byte, id uint32) {
+	binary.LittleEndian.PutUint32(cmd[HeaderLen+1:], id)
+}
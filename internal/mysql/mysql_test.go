@@ -0,0 +1,176 @@
+package mysql
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/internal/tcp"
+	"github.com/buger/goreplay/internal/tcp/tcptest"
+)
+
+// packets encodes payloads as packets with increasing sequence ids
+func packets(payloads ...string) (data []byte) {
+	for i, p := range payloads {
+		data = append(data, byte(len(p)), byte(len(p)>>8), byte(len(p)>>16), byte(i))
+		data = append(data, p...)
+	}
+	return
+}
+
+func greeting(caps uint32) string {
+	g := "\x0a8.0.36\x00\x01\x00\x00\x00abcdefgh\x00"
+	g += string(binary.LittleEndian.AppendUint16(nil, uint16(caps)))
+	g += "\x2d\x02\x00"
+	g += string(binary.LittleEndian.AppendUint16(nil, uint16(caps>>16)))
+	g += "\x15" + string(make([]byte, 10)) + "ijklmnopqrst\x00mysql_native_password\x00"
+	return g
+}
+
+func handshakeResponse(caps uint32) string {
+	r := string(binary.LittleEndian.AppendUint32(nil, caps))
+	r += "\x00\x00\x00\x01\x2d" + string(make([]byte, 23))
+	return r + "app\x00\x14" + string(make([]byte, 20)) + "mysql_native_password\x00"
+}
+
+const (
+	column = "\x03def\x00\x01t\x01t\x01a\x01a\x0c\x2d\x00\xfc\x00\x00\x00\xfd\x00\x00\x00\x00\x00"
+	eof    = "\xfe\x00\x00\x02\x00"
+	ok     = "\x00\x00\x00\x02\x00\x00\x00"
+	okEOF  = "\xfe\x00\x00\x02\x00\x00\x00"
+)
+
+type chunk struct {
+	fromClient bool
+	data       []byte
+}
+
+func parse(t *testing.T, chunks []chunk, expected []chunk) {
+	t.Helper()
+	messages := make(chan *tcp.Message, 20)
+	parser := tcp.NewMessageParser(messages, []uint16{3306}, nil, time.Minute, false)
+	parser.Stream = StreamHint
+
+	seq := [2]uint32{1000, 5000}
+	for _, ch := range chunks {
+		i := 0
+		if !ch.fromClient {
+			i = 1
+		}
+		// split data into small packets to check reassembly of MySQL packets
+		for data := ch.data; len(data) > 0; {
+			size := 7
+			if size > len(data) {
+				size = len(data)
+			}
+			parser.PacketHandler(tcptest.Packet(ch.fromClient, 3306, seq[i], 0, data[:size]))
+			seq[i] += uint32(size)
+			data = data[size:]
+		}
+	}
+
+	var commands uint32
+	for i, exp := range expected {
+		select {
+		case m := <-messages:
+			var dir tcp.Dir = tcp.DirOutcoming
+			if exp.fromClient {
+				dir = tcp.DirIncoming
+				commands++
+			}
+			if m.Direction != dir || string(m.Data()) != string(exp.data) {
+				t.Errorf("message %d: expected %d %q, got %d %q", i, dir, exp.data, m.Direction, m.Data())
+			}
+			if m.Seq != commands {
+				t.Errorf("message %d: expected seq %d, got %d", i, commands, m.Seq)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d was not emitted", i)
+		}
+	}
+	select {
+	case m := <-messages:
+		t.Errorf("unexpected message %q", m.Data())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStreamHint(t *testing.T) {
+	caps := uint32(ClientProtocol41 | ClientSecureConnection | ClientPluginAuth | ClientDeprecateEOF)
+	query := packets("\x03select a from t")
+	result := packets("\x01", column, eof, "\x011", "\x012", eof)
+	prepare := packets("\x16select a from t where a = ?")
+	prepared := packets("\x00\x07\x00\x00\x00\x01\x00\x01\x00\x00\x00\x00", column, eof, column, eof)
+	execute := packets("\x17\x07\x00\x00\x00\x00\x01\x00\x00\x00\x00\x01\x03\x00\x01\x00\x00\x00")
+	executed := packets("\x01", column, eof, "\x00\x00\x01\x00\x00\x00", eof)
+	closeStmt := packets("\x19\x07\x00\x00\x00")
+	multi := packets("\x03select 1; select 2")
+	multiResult := packets("\x01", column, "\xfe\x00\x00\x0a\x00", "\x011", "\xfe\x00\x00\x0a\x00", "\x01", column, eof, "\x012", eof)
+	bad := packets("\x03select oops")
+	badResult := packets("\xff\x48\x04#42S22Unknown column 'oops'")
+
+	parse(t, []chunk{
+		{false, packets(greeting(caps &^ ClientDeprecateEOF))},
+		{true, append([]byte{}, packets("", handshakeResponse(caps))[4:]...)},
+		{false, append([]byte{}, packets("", "", ok)[8:]...)},
+		{true, query},
+		{false, result},
+		{true, prepare},
+		{false, prepared},
+		{true, execute},
+		{false, executed},
+		{true, closeStmt},
+		{true, multi},
+		{false, multiResult},
+		{true, bad},
+		{false, badResult},
+	}, []chunk{
+		{true, query}, {false, result},
+		{true, prepare}, {false, prepared},
+		{true, execute}, {false, executed},
+		{true, closeStmt},
+		{true, multi}, {false, multiResult},
+		{true, bad}, {false, badResult},
+	})
+}
+
+func TestStreamHintDeprecateEOF(t *testing.T) {
+	// the capture started after the handshake, the mode is detected from the
+	// first result set
+	query := packets("\x03select a from t")
+	result := packets("\x01", column, "\x011", okEOF)
+	empty := packets("\x01", column, okEOF)
+	prepare := packets("\x16select ?")
+	prepared := packets("\x00\x01\x00\x00\x00\x01\x00\x01\x00\x00\x00\x00", column, column)
+
+	parse(t, []chunk{
+		{false, packets("\x011", okEOF)}, // the end of a response to an earlier query
+		{true, query},
+		{false, result},
+		{true, query},
+		{false, empty},
+		{true, prepare},
+		{false, prepared},
+		{true, query},
+		{false, result},
+	}, []chunk{
+		{true, query}, {false, result},
+		{true, query}, {false, empty},
+		{true, prepare}, {false, prepared},
+		{true, query}, {false, result},
+	})
+}
+
+func TestNextPacket(t *testing.T) {
+	long := make([]byte, HeaderLen+MaxPayloadLen)
+	long[0], long[1], long[2] = 0xff, 0xff, 0xff
+	data := append(long, packets("\x00\x01")...)
+
+	if _, _, size := NextPacket(data[:len(data)-1]); size != -1 {
+		t.Errorf("expected incomplete packet, got %d", size)
+	}
+	head, length, size := NextPacket(data)
+	if len(head) != MaxPayloadLen || length != MaxPayloadLen+2 || size != len(data) {
+		t.Errorf("wrong packet bounds %d %d %d", len(head), length, size)
+	}
+}
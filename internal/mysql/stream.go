@@ -0,0 +1,191 @@
+package mysql
+
+import (
+	"encoding/binary"
+
+	"github.com/buger/goreplay/internal/tcp"
+)
+
+// phases of a connection
+const (
+	phaseUnknown   = iota // the capture started in the middle of the connection
+	phaseHandshake        // the server sent the initial handshake
+	phaseAuth             // the client sent the handshake response or COM_CHANGE_USER
+	phaseCommand
+)
+
+// pending is a command waiting for the response
+type pending struct {
+	id   uint32
+	resp response
+}
+
+// stream is MySQL state of a connection
+type stream struct {
+	started    bool
+	phase      int
+	serverCaps uint32
+	eof        eofMode
+	bufs       [2][]byte
+	off        [2]int // the size of complete packets of the current message
+	packets    [2][]*tcp.Packet
+	count      uint32
+	pending    []*pending
+	inFile     bool // the client sends a file requested by LOAD DATA LOCAL INFILE
+}
+
+// StreamHint splits MySQL connection into commands and responses
+func StreamHint(c *tcp.Conn, pckt *tcp.Packet, data []byte) {
+	st, ok := c.ProtocolState().(*stream)
+	if !ok {
+		st = new(stream)
+		c.SetProtocolState(st)
+	}
+
+	dir := c.Dir(pckt)
+	if !st.started {
+		st.started = true
+		if dir == tcp.DirIncoming && isGreeting(data) {
+			// the server speaks first
+			c.Swap()
+			dir = c.Dir(pckt)
+		}
+	}
+	i := dir - 1
+	st.bufs[i] = append(st.bufs[i], data...)
+	st.packets[i] = append(st.packets[i], pckt)
+
+	for !c.Broken {
+		start := st.off[i]
+		head, length, size := NextPacket(st.bufs[i][start:])
+		if size < 0 {
+			return
+		}
+		st.off[i] += size
+		if dir == tcp.DirIncoming {
+			st.client(c, head, length, st.bufs[i][start+3])
+		} else {
+			st.server(c, head, length)
+		}
+	}
+}
+
+func isGreeting(data []byte) bool {
+	return len(data) > HeaderLen+1 && data[3] == 0 && data[HeaderLen] == 10
+}
+
+// done removes the current message from the buffer, and emits it if id is set
+func (st *stream) done(c *tcp.Conn, dir tcp.Dir, id uint32) {
+	i := dir - 1
+	if id != 0 {
+		c.Emit(dir, id, append([]byte(nil), st.bufs[i][:st.off[i]]...), st.packets[i])
+	}
+	st.bufs[i] = append(st.bufs[i][:0], st.bufs[i][st.off[i]:]...)
+	st.off[i] = 0
+	if len(st.bufs[i]) == 0 {
+		st.packets[i] = nil
+	} else {
+		// the rest of the data came with the last packet
+		st.packets[i] = st.packets[i][len(st.packets[i])-1:]
+	}
+}
+
+func (st *stream) client(c *tcp.Conn, head []byte, length int, seq byte) {
+	switch {
+	case st.inFile:
+		// the file ends with an empty packet
+		if length > 0 {
+			return
+		}
+		st.inFile = false
+		st.count++
+		st.pending = append(st.pending, &pending{id: st.count, resp: response{eof: &st.eof}})
+		st.done(c, tcp.DirIncoming, st.count)
+	case st.phase == phaseHandshake && length >= 32:
+		caps := binary.LittleEndian.Uint32(head)
+		switch {
+		case caps&ClientSSL != 0:
+			stats.Add("tls_conn_count", 1)
+			c.Broken = true
+		case caps&(ClientCompress|ClientZstdCompression) != 0:
+			stats.Add("compressed_conn_count", 1)
+			c.Broken = true
+		}
+		if caps&st.serverCaps&ClientDeprecateEOF != 0 {
+			st.eof = eofDeprecated
+		} else {
+			st.eof = eofSent
+		}
+		st.phase = phaseAuth
+		st.done(c, tcp.DirIncoming, 0)
+	case seq != 0 || len(head) == 0 || st.phase == phaseHandshake || st.phase == phaseAuth:
+		// authentication data
+		st.done(c, tcp.DirIncoming, 0)
+	default:
+		st.phase = phaseCommand
+		switch cmd := head[0]; cmd {
+		case ComBinlogDump, ComBinlogDumpGTID:
+			// the server streams replication events
+			c.Broken = true
+		case ComChangeUser:
+			st.phase = phaseAuth
+			st.done(c, tcp.DirIncoming, 0)
+		default:
+			st.count++
+			if HasResponse(cmd) {
+				st.pending = append(st.pending, &pending{id: st.count, resp: response{cmd: cmd, eof: &st.eof}})
+			}
+			st.done(c, tcp.DirIncoming, st.count)
+		}
+	}
+}
+
+func (st *stream) server(c *tcp.Conn, head []byte, length int) {
+	switch {
+	case st.phase == phaseUnknown && isGreeting(st.bufs[1]):
+		st.phase = phaseHandshake
+		st.serverCaps = greetingCaps(head)
+		st.done(c, tcp.DirOutcoming, 0)
+	case st.phase == phaseAuth:
+		if len(head) > 0 && (head[0] == PacketOK || head[0] == PacketErr) {
+			st.phase = phaseCommand
+		}
+		st.done(c, tcp.DirOutcoming, 0)
+	case len(st.pending) == 0:
+		// the response to a command sent before the capture started
+		stats.Add("skipped_packet_count", 1)
+		st.done(c, tcp.DirOutcoming, 0)
+	default:
+		p := st.pending[0]
+		first := p.resp.state == respFirst
+		if !p.resp.packet(head, length) {
+			return
+		}
+		st.pending = st.pending[1:]
+		if first && len(head) > 0 && head[0] == PacketLocalInFile && p.resp.cmd == ComQuery {
+			st.inFile = true
+		}
+		st.done(c, tcp.DirOutcoming, p.id)
+	}
+}
+
+// greetingCaps returns capabilities of the server from the initial handshake
+func greetingCaps(greeting []byte) uint32 {
+	// protocol version, server version, connection id, auth-plugin-data-part-1, filler
+	p := greeting[1:]
+	for i, b := range p {
+		if b == 0 {
+			p = p[i+1:]
+			break
+		}
+	}
+	if len(p) < 4+8+1+2 {
+		return 0
+	}
+	p = p[4+8+1:]
+	caps := uint32(binary.LittleEndian.Uint16(p))
+	if len(p) >= 2+1+2+2 {
+		caps |= uint32(binary.LittleEndian.Uint16(p[5:])) << 16
+	}
+	return caps
+}
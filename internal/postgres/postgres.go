@@ -0,0 +1,304 @@
+/*
+Package postgres implements capturing and replaying of PostgreSQL frontend/backend
+protocol (version 3).
+
+StartHint and EndHint split captured connections into messages for
+tcp.MessageParser: a request ends with a message which makes the server
+respond, like Query or Sync, a response ends with ReadyForQuery. Startup,
+SSLRequest and authentication exchanges are split the same way, so the whole
+session is captured:
+
+	parser.Start = postgres.StartHint
+	parser.End = postgres.EndHint
+
+Conn is a minimal client used to replay captured frontend messages.
+*/
+package postgres // import github.com/buger/goreplay/internal/postgres
+
+import (
+	"bytes"
+	"encoding/binary"
+	"expvar"
+
+	"github.com/buger/goreplay/internal/tcp"
+)
+
+var stats *expvar.Map
+
+func init() {
+	stats = expvar.NewMap("postgres")
+	stats.Init()
+}
+
+// codes of untyped frontend messages, sent in place of the protocol version
+const (
+	ProtocolVersion = 3 << 16
+	CancelRequest   = 1234<<16 | 5678
+	SSLRequest      = 1234<<16 | 5679
+	GSSENCRequest   = 1234<<16 | 5680
+)
+
+// frontend message types
+const (
+	TypeBind         = 'B'
+	TypeClose        = 'C'
+	TypeCopyData     = 'd'
+	TypeCopyDone     = 'c'
+	TypeCopyFail     = 'f'
+	TypeDescribe     = 'D'
+	TypeExecute      = 'E'
+	TypeFlush        = 'H'
+	TypeFunctionCall = 'F'
+	TypeParse        = 'P'
+	TypePassword     = 'p' // also SASL and GSSAPI responses
+	TypeQuery        = 'Q'
+	TypeSync         = 'S'
+	TypeTerminate    = 'X'
+)
+
+// backend message types
+const (
+	TypeAuthentication       = 'R'
+	TypeBackendKeyData       = 'K'
+	TypeBindComplete         = '2'
+	TypeCloseComplete        = '3'
+	TypeCommandComplete      = 'C'
+	TypeCopyBothResponse     = 'W'
+	TypeCopyInResponse       = 'G'
+	TypeCopyOutResponse      = 'H'
+	TypeDataRow              = 'D'
+	TypeEmptyQueryResponse   = 'I'
+	TypeErrorResponse        = 'E'
+	TypeFunctionCallResponse = 'V'
+	TypeNegotiateVersion     = 'v'
+	TypeNoData               = 'n'
+	TypeNoticeResponse       = 'N'
+	TypeNotification         = 'A'
+	TypeParameterDescription = 't'
+	TypeParameterStatus      = 'S'
+	TypeParseComplete        = '1'
+	TypePortalSuspended      = 's'
+	TypeReadyForQuery        = 'Z'
+	TypeRowDescription       = 'T'
+)
+
+// authentication request codes
+const (
+	AuthOK                = 0
+	AuthCleartextPassword = 3
+	AuthMD5Password       = 5
+	AuthSASL              = 10
+	AuthSASLContinue      = 11
+	AuthSASLFinal         = 12
+)
+
+// MaxMessageLen limits the length of a single message, longer messages are
+// treated as garbage
+const MaxMessageLen = 1 << 30
+
+// IsStartup reports whether data starts with an untyped message: startup,
+// SSLRequest, GSSENCRequest or CancelRequest. Typed messages never start with
+// zero byte, while lengths of untyped ones are far below 16MB.
+func IsStartup(data []byte) bool {
+	if len(data) < 8 || data[0] != 0 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(data[4:]) {
+	case ProtocolVersion, CancelRequest, SSLRequest, GSSENCRequest:
+		return true
+	}
+	return false
+}
+
+// StartHint detects frontend and backend messages, it is used when the
+// direction of a connection is unknown, e.g reading pcap files without ports
+func StartHint(pckt *tcp.Packet) (isRequest, isResponse bool) {
+	data := pckt.Payload
+	if IsStartup(data) {
+		return true, false
+	}
+	if len(data) < 5 || binary.BigEndian.Uint32(data[1:]) < 4 {
+		return false, false
+	}
+	// only types which are not shared by frontend and backend messages
+	switch data[0] {
+	case TypeQuery, TypeParse, TypeBind, TypeFunctionCall, TypePassword, TypeTerminate:
+		return true, false
+	case TypeAuthentication, TypeBackendKeyData, TypeReadyForQuery, TypeRowDescription,
+		TypeParseComplete, TypeBindComplete, TypeCloseComplete, TypeParameterDescription,
+		TypeNoData, TypeEmptyQueryResponse, TypeNotification, TypeFunctionCallResponse:
+		return false, true
+	}
+	return false, false
+}
+
+// endState is the progress of EndHint over a message, so packets are walked
+// only once
+type endState struct {
+	first *tcp.Packet // the state is reset if a packet is inserted before it
+	cur   cursor
+	async bool // all messages are sent by the backend on its own
+}
+
+// EndHint reports whether the message ends with a message after which the
+// other side is expected to respond
+func EndHint(m *tcp.Message) bool {
+	if m.MissingChunk() {
+		return false
+	}
+	packets := m.Packets()
+	dir := m.Direction
+	if dir == tcp.DirUnknown {
+		if in, out := StartHint(packets[0]); in {
+			dir = tcp.DirIncoming
+		} else if out {
+			dir = tcp.DirOutcoming
+		} else {
+			return false
+		}
+	}
+
+	data := packets[0].Payload
+	if dir == tcp.DirIncoming && IsStartup(data) {
+		return m.Length >= int(binary.BigEndian.Uint32(data))
+	}
+	if dir == tcp.DirOutcoming && m.Length == 1 {
+		// the answer to SSLRequest or GSSENCRequest
+		switch data[0] {
+		case 'S', 'N', 'G':
+			return true
+		}
+	}
+
+	st, ok := m.ProtocolState().(*endState)
+	if !ok || st.first != packets[0] {
+		st = &endState{first: packets[0], async: dir == tcp.DirOutcoming}
+		m.SetProtocolState(st)
+	}
+	st.cur.data = m.PacketData()
+
+	var header [5 + 64]byte
+	for {
+		n := st.cur.peek(header[:])
+		if n < 5 {
+			return false
+		}
+		typ, length := header[0], int(binary.BigEndian.Uint32(header[1:]))
+		if length < 4 || length > MaxMessageLen {
+			stats.Add("invalid_message", 1)
+			return false
+		}
+		if !st.cur.skip(1 + length) {
+			return false
+		}
+		body := header[5:n]
+		if len(body) > length-4 {
+			body = body[:length-4]
+		}
+		var end bool
+		if dir == tcp.DirIncoming {
+			end = frontendEnd(typ)
+		} else {
+			st.async = st.async && (typ == TypeNotification || typ == TypeNoticeResponse || typ == TypeParameterStatus)
+			end = backendEnd(typ, body)
+		}
+		// pipelined messages are answered after the last one
+		if st.cur.left() == 0 {
+			return end || st.async
+		}
+	}
+}
+
+func frontendEnd(typ byte) bool {
+	switch typ {
+	case TypeQuery, TypeSync, TypeFlush, TypeFunctionCall, TypePassword,
+		TypeCopyDone, TypeCopyFail, TypeTerminate:
+		return true
+	}
+	return false
+}
+
+func backendEnd(typ byte, body []byte) bool {
+	switch typ {
+	case TypeReadyForQuery, TypeCopyInResponse, TypeCopyBothResponse:
+		return true
+	case TypeAuthentication:
+		// the server waits for a password or SASL response
+		if len(body) < 4 {
+			return false
+		}
+		code := binary.BigEndian.Uint32(body)
+		return code != AuthOK && code != AuthSASLFinal
+	case TypeErrorResponse:
+		// the server closes the connection after fatal errors
+		return isFatal(body)
+	}
+	return false
+}
+
+// isFatal checks the severity fields of ErrorResponse, the localized severity
+// comes first and the non-localized one follows it since PostgreSQL 9.6
+func isFatal(fields []byte) bool {
+	for len(fields) > 1 && fields[0] != 0 {
+		end := bytes.IndexByte(fields[1:], 0)
+		if end < 0 {
+			return false
+		}
+		if code, value := fields[0], string(fields[1:1+end]); (code == 'S' || code == 'V') && (value == "FATAL" || value == "PANIC") {
+			return true
+		}
+		fields = fields[2+end:]
+	}
+	return false
+}
+
+// cursor walks messages split across packets
+type cursor struct {
+	data [][]byte
+	i    int // current packet
+	pos  int // position in the current packet
+}
+
+// peek copies data at the cursor to p, it returns the number of copied bytes
+func (c *cursor) peek(p []byte) (n int) {
+	i, pos := c.i, c.pos
+	for n < len(p) && i < len(c.data) {
+		m := copy(p[n:], c.data[i][pos:])
+		n += m
+		pos += m
+		if pos == len(c.data[i]) {
+			i, pos = i+1, 0
+		}
+	}
+	return n
+}
+
+// skip advances the cursor by n bytes, it does not move if there is not
+// enough data
+func (c *cursor) skip(n int) bool {
+	i, pos := c.i, c.pos
+	for n > 0 {
+		if i >= len(c.data) {
+			return false
+		}
+		m := len(c.data[i]) - pos
+		if m > n {
+			m = n
+		}
+		n -= m
+		pos += m
+		if pos == len(c.data[i]) {
+			i, pos = i+1, 0
+		}
+	}
+	c.i, c.pos = i, pos
+	return true
+}
+
+// left returns the number of bytes after the cursor
+func (c *cursor) left() (n int) {
+	for i := c.i; i < len(c.data); i++ {
+		n += len(c.data[i])
+	}
+	return n - c.pos
+}
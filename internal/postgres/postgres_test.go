@@ -0,0 +1,145 @@
+package postgres
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/internal/tcp"
+	"github.com/buger/goreplay/internal/tcp/tcptest"
+)
+
+func message(typ byte, body string) []byte {
+	return appendMessage(nil, typ, []byte(body))
+}
+
+func startupMessage() []byte {
+	msg := []byte{0, 0, 0, 0, 0, 3, 0, 0}
+	msg = append(appendString(appendString(msg, "user"), "app"), 0)
+	binary.BigEndian.PutUint32(msg, uint32(len(msg)))
+	return msg
+}
+
+func join(messages ...[]byte) (data []byte) {
+	for _, m := range messages {
+		data = append(data, m...)
+	}
+	return
+}
+
+func TestHints(t *testing.T) {
+	authMD5 := message(TypeAuthentication, "\x00\x00\x00\x05salt")
+	authOK := join(
+		message(TypeAuthentication, "\x00\x00\x00\x00"),
+		message(TypeParameterStatus, "server_version\x0016.0\x00"),
+		message(TypeBackendKeyData, "\x00\x00\x00\x01\x00\x00\x00\x02"),
+		message(TypeReadyForQuery, "I"),
+	)
+	extended := join(
+		message(TypeParse, "\x00select $1\x00\x00\x00"),
+		message(TypeBind, "\x00\x00\x00\x00\x00\x01\x00\x00\x00\x011\x00\x00"),
+		message(TypeDescribe, "P\x00"),
+		message(TypeExecute, "\x00\x00\x00\x00\x00"),
+		message(TypeSync, ""),
+	)
+	results := join(
+		message(TypeParseComplete, ""),
+		message(TypeBindComplete, ""),
+		message(TypeRowDescription, "\x00\x01?column?\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x19\xff\xff\xff\xff\xff\xff\x00\x00"),
+		message(TypeDataRow, "\x00\x01\x00\x00\x00\x011"),
+		message(TypeCommandComplete, "SELECT 1\x00"),
+		message(TypeReadyForQuery, "I"),
+	)
+	query := message(TypeQuery, "select oops\x00")
+	queryError := join(
+		message(TypeErrorResponse, "SERROR\x00VERROR\x00C42703\x00Mcolumn \"oops\" does not exist\x00\x00"),
+		message(TypeReadyForQuery, "I"),
+	)
+
+	// chunks are split into packets in the middle of messages and headers
+	chunks := []struct {
+		fromClient bool
+		packets    [][]byte
+	}{
+		{true, [][]byte{startupMessage()}},
+		{false, [][]byte{authMD5}},
+		{true, [][]byte{message(TypePassword, "md5abc\x00")}},
+		{false, [][]byte{authOK[:20], authOK[20:]}},
+		{true, [][]byte{extended[:3], extended[3:30], extended[30:]}},
+		{false, [][]byte{results[:len(results)-3], results[len(results)-3:]}},
+		{true, [][]byte{query}},
+		{false, [][]byte{queryError}},
+	}
+	expected := [][]byte{startupMessage(), authMD5, message(TypePassword, "md5abc\x00"), authOK, extended, results, query, queryError}
+
+	messages := make(chan *tcp.Message, 10)
+	parser := tcp.NewMessageParser(messages, []uint16{5432}, nil, time.Minute, false)
+	parser.Start = StartHint
+	parser.End = EndHint
+
+	seq := [2]uint32{1000, 5000}
+	for _, ch := range chunks {
+		i := 0
+		if !ch.fromClient {
+			i = 1
+		}
+		for _, p := range ch.packets {
+			parser.PacketHandler(tcptest.Packet(ch.fromClient, 5432, seq[i], seq[1-i], p))
+			seq[i] += uint32(len(p))
+		}
+	}
+
+	for i, data := range expected {
+		select {
+		case m := <-messages:
+			if string(m.Data()) != string(data) {
+				t.Errorf("message %d: expected %q, got %q", i, data, m.Data())
+			}
+			if expected := tcp.Dir(i%2 + 1); m.Direction != expected {
+				t.Errorf("message %d: expected direction %d, got %d", i, expected, m.Direction)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d was not emitted", i)
+		}
+	}
+}
+
+func TestEndHintIncomplete(t *testing.T) {
+	parse := message(TypeParse, "\x00select 1\x00\x00\x00")
+	tests := []struct {
+		name       string
+		fromClient bool
+		data       []byte
+		end        bool
+	}{
+		{"parse without sync", true, parse, false},
+		{"sync", true, join(parse, message(TypeSync, "")), true},
+		{"short header", true, join(parse, []byte{TypeSync, 0, 0}), false},
+		{"results without ReadyForQuery", false, message(TypeCommandComplete, "SELECT 1\x00"), false},
+		{"copy in", false, message(TypeCopyInResponse, "\x00\x00\x00"), true},
+		{"fatal error", false, message(TypeErrorResponse, "SFATAL\x00VFATAL\x00C28P01\x00Mpassword authentication failed\x00\x00"), true},
+		{"localized fatal error", false, message(TypeErrorResponse, "SSCHWERWIEGEND\x00VFATAL\x00C28P01\x00\x00"), true},
+		{"notification", false, message(TypeNotification, "\x00\x00\x00\x01channel\x00payload\x00"), true},
+		{"ssl answer", false, []byte("S"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := make(chan *tcp.Message, 1)
+			parser := tcp.NewMessageParser(messages, []uint16{5432}, nil, time.Minute, false)
+			parser.Start = StartHint
+			parser.End = EndHint
+			parser.PacketHandler(tcptest.Packet(tt.fromClient, 5432, 1000, 5000, tt.data))
+
+			select {
+			case <-messages:
+				if !tt.end {
+					t.Error("unexpected message")
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.end {
+					t.Error("expected message to be emitted")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Package redis implements capturing and replaying of Redis serialization
+protocol (RESP2 and RESP3).
+
+StreamHint reassembles both directions of a connection and emits every command
+and its reply as a pair of tcp messages sharing the same ID, pipelined commands
+are split exactly by their framing:
+
+	parser.Stream = redis.StreamHint
+
+Replies are matched to commands by their order. Push messages of RESP3 are
+skipped, connections switching to Pub/Sub or MONITOR mode are ignored.
+
+Conn is a minimal client used to replay captured commands.
+*/
+package redis // import github.com/buger/goreplay/internal/redis
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"strconv"
+)
+
+var stats *expvar.Map
+
+func init() {
+	stats = expvar.NewMap("redis")
+	stats.Init()
+}
+
+// MaxBulkLen is the longest bulk string accepted by Redis
+const MaxBulkLen = 512 << 20
+
+// ErrInvalid is returned for data not following RESP
+var ErrInvalid = errors.New("redis: invalid protocol data")
+
+// Next returns the size of the first complete value of data, it is -1 if the
+// value is not complete. Inline commands, lines of space separated arguments,
+// are accepted when inline is set.
+func Next(data []byte, inline bool) (size int, err error) {
+	for remaining := 1; remaining > 0; remaining-- {
+		if len(data) <= size {
+			return -1, nil
+		}
+		typ := data[size]
+		end := bytes.IndexByte(data[size:], '\n')
+		if end < 0 {
+			if len(data)-size > MaxBulkLen {
+				return 0, ErrInvalid
+			}
+			return -1, nil
+		}
+		line := bytes.TrimSuffix(data[size+1:size+end], []byte{'\r'})
+		size += end + 1
+
+		switch typ {
+		case '+', '-', ':', '_', ',', '#', '(':
+		case '$', '!', '=':
+			n, err := length(line)
+			if err != nil {
+				return 0, err
+			}
+			if n < 0 {
+				continue
+			}
+			if n > MaxBulkLen {
+				return 0, ErrInvalid
+			}
+			if len(data)-size < n+2 {
+				return -1, nil
+			}
+			if data[size+n] != '\r' || data[size+n+1] != '\n' {
+				return 0, ErrInvalid
+			}
+			size += n + 2
+		case '*', '~', '>', '%', '|':
+			n, err := length(line)
+			if err != nil {
+				return 0, err
+			}
+			switch typ {
+			case '%':
+				n *= 2
+			case '|':
+				// attributes precede the value they describe
+				n = n*2 + 1
+			}
+			if n > 0 {
+				remaining += n
+			}
+		default:
+			// an inline command is a single line
+			if !inline {
+				return 0, ErrInvalid
+			}
+		}
+		inline = false
+	}
+	return size, nil
+}
+
+func length(line []byte) (int, error) {
+	n, err := strconv.Atoi(string(line))
+	if err != nil || n < -1 {
+		return 0, ErrInvalid
+	}
+	return n, nil
+}
+
+// Args returns arguments of a command, it is nil if data is not a complete
+// command. Inline commands are split by spaces.
+func Args(data []byte) (args [][]byte) {
+	size, err := Next(data, true)
+	if err != nil || size < 0 {
+		return nil
+	}
+	if data[0] != '*' {
+		return bytes.Fields(data[:size])
+	}
+	end := bytes.IndexByte(data, '\n')
+	n, _ := length(bytes.TrimSuffix(data[1:end], []byte{'\r'}))
+	p := data[end+1:]
+	for i := 0; i < n; i++ {
+		if len(p) == 0 || p[0] != '$' {
+			return nil
+		}
+		end = bytes.IndexByte(p, '\n')
+		l, _ := length(bytes.TrimSuffix(p[1:end], []byte{'\r'}))
+		if l < 0 {
+			return nil
+		}
+		args = append(args, p[end+1:end+1+l])
+		p = p[end+1+l+2:]
+	}
+	return args
+}
+
+// Name returns the upper case name of a command
+func Name(args [][]byte) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return string(bytes.ToUpper(args[0]))
+}
+
+// commands without keys, the first argument is not a key
+var keyless = map[string]bool{
+	"AUTH": true, "HELLO": true, "PING": true, "ECHO": true, "SELECT": true, "QUIT": true, "RESET": true,
+	"MULTI": true, "EXEC": true, "DISCARD": true, "UNWATCH": true,
+	"INFO": true, "CLIENT": true, "CONFIG": true, "COMMAND": true, "CLUSTER": true, "SCRIPT": true,
+	"FUNCTION": true, "ACL": true, "DBSIZE": true, "FLUSHDB": true, "FLUSHALL": true, "SCAN": true,
+	"RANDOMKEY": true, "TIME": true, "LASTSAVE": true, "SAVE": true, "BGSAVE": true, "BGREWRITEAOF": true,
+	"SLOWLOG": true, "LATENCY": true, "WAIT": true, "WAITAOF": true, "SWAPDB": true, "KEYS": true,
+	"PUBLISH": true, "SPUBLISH": true, "PUBSUB": true, "SUBSCRIBE": true, "PSUBSCRIBE": true,
+	"SSUBSCRIBE": true, "UNSUBSCRIBE": true, "PUNSUBSCRIBE": true, "SUNSUBSCRIBE": true, "MONITOR": true,
+	"READONLY": true, "READWRITE": true, "ROLE": true, "SHUTDOWN": true, "DEBUG": true, "MODULE": true,
+}
+
+// Key returns the first key of a command, it is nil for commands without keys
+func Key(args [][]byte) []byte {
+	name := Name(args)
+	if keyless[name] {
+		return nil
+	}
+	pos := 1
+	switch name {
+	case "EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO", "FCALL", "FCALL_RO":
+		// script, number of keys, keys
+		if len(args) < 3 || string(args[2]) == "0" {
+			return nil
+		}
+		pos = 3
+	case "OBJECT", "MEMORY", "XINFO", "BITOP", "ZUNION", "ZINTER", "ZDIFF", "SINTERCARD", "ZINTERCARD",
+		"LMPOP", "ZMPOP":
+		// a subcommand or the number of keys comes first
+		pos = 2
+	case "BLMPOP", "BZMPOP":
+		pos = 3
+	case "XREAD", "XREADGROUP":
+		pos = 0
+		for i, arg := range args {
+			if string(bytes.ToUpper(arg)) == "STREAMS" {
+				pos = i + 1
+				break
+			}
+		}
+	}
+	if pos == 0 || pos >= len(args) {
+		return nil
+	}
+	return args[pos]
+}
+
+// Replies tracks CLIENT REPLY mode of a connection, which lets clients turn
+// off replies of the server
+type Replies struct {
+	off  bool
+	skip bool
+}
+
+// Expect reports whether the server replies to the command
+func (r *Replies) Expect(args [][]byte) bool {
+	skip := r.skip
+	r.skip = false
+	if Name(args) == "CLIENT" && len(args) > 2 && string(bytes.ToUpper(args[1])) == "REPLY" {
+		switch string(bytes.ToUpper(args[2])) {
+		case "ON":
+			r.off = false
+			return true
+		case "OFF":
+			r.off = true
+		case "SKIP":
+			r.skip = !r.off
+		}
+		return false
+	}
+	return !r.off && !skip
+}
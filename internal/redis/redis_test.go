@@ -0,0 +1,202 @@
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/internal/tcp"
+	"github.com/buger/goreplay/internal/tcp/tcptest"
+)
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		data   string
+		inline bool
+		size   int
+		err    bool
+	}{
+		{"+OK\r\n", false, 5, false},
+		{"-ERR unknown\r\n+OK\r\n", false, 14, false},
+		{":1000\r\n", false, 7, false},
+		{"$5\r\nhello\r\n", false, 11, false},
+		{"$5\r\nhel", false, -1, false},
+		{"$-1\r\n", false, 5, false},
+		{"*-1\r\n", false, 5, false},
+		{"*0\r\n", false, 4, false},
+		{"*2\r\n$3\r\nGET\r\n$1\r\nk\r\n*1\r\n", false, 20, false},
+		{"*2\r\n$3\r\nGET\r\n", false, -1, false},
+		{"*2\r\n*1\r\n:1\r\n$-1\r\n", false, 17, false},
+		// RESP3
+		{"_\r\n", false, 3, false},
+		{",1.5\r\n", false, 6, false},
+		{"#t\r\n", false, 4, false},
+		{"(3492890328409238509324850943850943825024385\r\n", false, 46, false},
+		{"!21\r\nSYNTAX invalid syntax\r\n", false, 28, false},
+		{"=15\r\ntxt:Some string\r\n", false, 22, false},
+		{"%2\r\n+first\r\n:1\r\n+second\r\n:2\r\n", false, 29, false},
+		{"%2\r\n+first\r\n:1\r\n+second\r\n", false, -1, false},
+		{"~2\r\n+a\r\n+b\r\n", false, 12, false},
+		{">3\r\n+message\r\n+ch\r\n+hi\r\n", false, 24, false},
+		{"|1\r\n+key-popularity\r\n%1\r\n$1\r\na\r\n,0.19\r\n*1\r\n:2\r\n", false, 47, false},
+		{"|1\r\n+key-popularity\r\n%1\r\n$1\r\na\r\n,0.19\r\n", false, -1, false},
+		// inline commands
+		{"PING\r\n*1\r\n", true, 6, false},
+		{"GET key\n", true, 8, false},
+		{"PING", true, -1, false},
+		{"PING\r\n", false, 0, true},
+		{"$x\r\n", false, 0, true},
+		{"$2\r\nabc\r\n", false, 0, true},
+		{"*-2\r\n", false, 0, true},
+	}
+	for _, tt := range tests {
+		size, err := Next([]byte(tt.data), tt.inline)
+		if (err != nil) != tt.err || size != tt.size && !tt.err {
+			t.Errorf("%q: expected %d %v, got %d %v", tt.data, tt.size, tt.err, size, err)
+		}
+	}
+}
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		cmd string
+		key string
+	}{
+		{"*2\r\n$3\r\nget\r\n$4\r\nuser\r\n", "user"},
+		{"hgetall user:1\r\n", "user:1"},
+		{"*1\r\n$4\r\nPING\r\n", ""},
+		{"*3\r\n$6\r\nSELECT\r\n$1\r\n1\r\n$1\r\nx\r\n", ""},
+		{"*4\r\n$4\r\nEVAL\r\n$8\r\nreturn 1\r\n$1\r\n1\r\n$3\r\nkey\r\n", "key"},
+		{"*3\r\n$4\r\nEVAL\r\n$8\r\nreturn 1\r\n$1\r\n0\r\n", ""},
+		{"XREAD COUNT 2 STREAMS events 0\r\n", "events"},
+		{"OBJECT ENCODING counter\r\n", "counter"},
+	}
+	for _, tt := range tests {
+		args := Args([]byte(tt.cmd))
+		if args == nil {
+			t.Errorf("%q: expected a command", tt.cmd)
+			continue
+		}
+		if key := Key(args); string(key) != tt.key {
+			t.Errorf("%q: expected key %q, got %q", tt.cmd, tt.key, key)
+		}
+	}
+	if Name(Args([]byte("*2\r\n$3\r\nget\r\n$4\r\nuser\r\n"))) != "GET" {
+		t.Error("command name should be upper case")
+	}
+}
+
+type chunk struct {
+	fromClient bool
+	data       string
+}
+
+type emitted struct {
+	fromClient bool
+	seq        uint32
+	data       string
+}
+
+func parse(t *testing.T, chunks []chunk, expected []emitted) {
+	t.Helper()
+	messages := make(chan *tcp.Message, 20)
+	parser := tcp.NewMessageParser(messages, []uint16{6379}, nil, time.Minute, false)
+	parser.Stream = StreamHint
+
+	seq := [2]uint32{1000, 5000}
+	for _, ch := range chunks {
+		i := 0
+		if !ch.fromClient {
+			i = 1
+		}
+		// split data into small packets to check reassembly of values
+		for data := ch.data; len(data) > 0; {
+			size := 5
+			if size > len(data) {
+				size = len(data)
+			}
+			parser.PacketHandler(tcptest.Packet(ch.fromClient, 6379, seq[i], 0, []byte(data[:size])))
+			seq[i] += uint32(size)
+			data = data[size:]
+		}
+	}
+
+	for i, exp := range expected {
+		select {
+		case m := <-messages:
+			var dir tcp.Dir = tcp.DirOutcoming
+			if exp.fromClient {
+				dir = tcp.DirIncoming
+			}
+			if m.Direction != dir || m.Seq != exp.seq || string(m.Data()) != exp.data {
+				t.Errorf("message %d: expected %d %d %q, got %d %d %q", i, dir, exp.seq, exp.data, m.Direction, m.Seq, m.Data())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d was not emitted", i)
+		}
+	}
+	select {
+	case m := <-messages:
+		t.Errorf("unexpected message %q", m.Data())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStreamHint(t *testing.T) {
+	set := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\nvalue\r\n"
+	get := "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"
+	hello := "*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n"
+	replyOff := "*3\r\n$6\r\nCLIENT\r\n$5\r\nREPLY\r\n$3\r\nOFF\r\n"
+	replyOn := "*3\r\n$6\r\nCLIENT\r\n$5\r\nREPLY\r\n$2\r\nON\r\n"
+
+	parse(t, []chunk{
+		{false, "$5\r\nolder\r\n"}, // the reply to a command sent before the capture
+		{true, set + get + "\r\nPING\r\n"},
+		{false, "+OK\r\n$5\r\nvalue\r\n+PONG\r\n"},
+		{true, hello},
+		{false, "%1\r\n$6\r\nserver\r\n$5\r\nredis\r\n"},
+		{false, ">2\r\n$10\r\ninvalidate\r\n*1\r\n$1\r\nk\r\n"},
+		{true, replyOff + set + replyOn},
+		{false, "+OK\r\n"},
+		{true, get},
+		{false, "$5\r\nvalue\r\n"},
+	}, []emitted{
+		{true, 1, set}, {true, 2, get}, {true, 3, "PING\r\n"},
+		{false, 1, "+OK\r\n"}, {false, 2, "$5\r\nvalue\r\n"}, {false, 3, "+PONG\r\n"},
+		{true, 4, hello}, {false, 4, "%1\r\n$6\r\nserver\r\n$5\r\nredis\r\n"},
+		{true, 5, replyOff}, {true, 6, set}, {true, 7, replyOn}, {false, 7, "+OK\r\n"},
+		{true, 8, get}, {false, 8, "$5\r\nvalue\r\n"},
+	})
+}
+
+func TestStreamHintSubscribe(t *testing.T) {
+	get := "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"
+	subscribe := "*2\r\n$9\r\nSUBSCRIBE\r\n$2\r\nch\r\n"
+
+	parse(t, []chunk{
+		{true, get},
+		{false, "$-1\r\n"},
+		{true, subscribe},
+		{false, "*3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n"},
+		{false, "*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n"},
+	}, []emitted{
+		{true, 1, get}, {false, 1, "$-1\r\n"},
+	})
+}
+
+func TestReplies(t *testing.T) {
+	var r Replies
+	expect := func(cmd string, expected bool) {
+		t.Helper()
+		if r.Expect(Args([]byte(cmd))) != expected {
+			t.Errorf("%q: expected reply %v", cmd, expected)
+		}
+	}
+	expect("GET k\r\n", true)
+	expect("CLIENT REPLY SKIP\r\n", false)
+	expect("GET k\r\n", false)
+	expect("GET k\r\n", true)
+	expect("CLIENT REPLY OFF\r\n", false)
+	expect("GET k\r\n", false)
+	expect("CLIENT REPLY ON\r\n", true)
+	expect("GET k\r\n", true)
+}
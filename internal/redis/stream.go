@@ -0,0 +1,97 @@
+package redis
+
+import (
+	"github.com/buger/goreplay/internal/tcp"
+)
+
+// stream is Redis state of a connection
+type stream struct {
+	bufs    [2][]byte
+	packets [2][]*tcp.Packet
+	count   uint32
+	pending []uint32 // commands waiting for replies
+	replies Replies
+}
+
+// StreamHint splits Redis connection into commands and replies
+func StreamHint(c *tcp.Conn, pckt *tcp.Packet, data []byte) {
+	st, ok := c.ProtocolState().(*stream)
+	if !ok {
+		st = new(stream)
+		c.SetProtocolState(st)
+	}
+
+	dir := c.Dir(pckt)
+	i := dir - 1
+	st.bufs[i] = append(st.bufs[i], data...)
+	st.packets[i] = append(st.packets[i], pckt)
+
+	for !c.Broken && len(st.bufs[i]) > 0 {
+		size, err := Next(st.bufs[i], dir == tcp.DirIncoming)
+		if err != nil {
+			stats.Add("invalid_conn_count", 1)
+			c.Broken = true
+			return
+		}
+		if size < 0 {
+			return
+		}
+		if dir == tcp.DirIncoming {
+			st.client(c, size)
+		} else {
+			st.server(c, size)
+		}
+	}
+}
+
+// done removes the first size bytes from the buffer, and emits them if id is set
+func (st *stream) done(c *tcp.Conn, dir tcp.Dir, size int, id uint32) {
+	i := dir - 1
+	if id != 0 {
+		c.Emit(dir, id, append([]byte(nil), st.bufs[i][:size]...), st.packets[i])
+	}
+	st.bufs[i] = append(st.bufs[i][:0], st.bufs[i][size:]...)
+	if len(st.bufs[i]) == 0 {
+		st.packets[i] = nil
+	} else {
+		// the rest of the data came with the last packet
+		st.packets[i] = st.packets[i][len(st.packets[i])-1:]
+	}
+}
+
+func (st *stream) client(c *tcp.Conn, size int) {
+	args := Args(st.bufs[0][:size])
+	switch Name(args) {
+	case "":
+		// an empty inline command is ignored by the server
+		st.done(c, tcp.DirIncoming, size, 0)
+		return
+	case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE", "MONITOR", "SYNC", "PSYNC":
+		// the server streams messages which are not replies to commands
+		stats.Add("pubsub_conn_count", 1)
+		c.Broken = true
+		return
+	}
+	st.count++
+	if st.replies.Expect(args) {
+		st.pending = append(st.pending, st.count)
+	}
+	st.done(c, tcp.DirIncoming, size, st.count)
+}
+
+func (st *stream) server(c *tcp.Conn, size int) {
+	switch {
+	case st.bufs[1][0] == '>':
+		// out of band push message of RESP3
+		stats.Add("push_count", 1)
+		st.done(c, tcp.DirOutcoming, size, 0)
+	case len(st.pending) == 0:
+		// the reply to a command sent before the capture started
+		stats.Add("skipped_reply_count", 1)
+		st.done(c, tcp.DirOutcoming, size, 0)
+	default:
+		id := st.pending[0]
+		st.pending = st.pending[1:]
+		st.done(c, tcp.DirOutcoming, size, id)
+	}
+}
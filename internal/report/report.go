@@ -0,0 +1,379 @@
+// Package report aggregates latencies and statuses of original and replayed
+// responses by endpoint, to compare the replay target with the captured
+// service
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// bucketsPerOctave is the number of histogram buckets per power of two, so
+// percentiles are precise to about 20%
+const bucketsPerOctave = 4
+
+// histogramBuckets cover latencies from 1µs to about an hour
+const histogramBuckets = 32*bucketsPerOctave + 1
+
+// Histogram counts latencies in exponential buckets
+type Histogram struct {
+	counts [histogramBuckets]uint64
+	n      uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+// Add counts the latency
+func (h *Histogram) Add(d time.Duration) {
+	i := 0
+	if us := float64(d) / float64(time.Microsecond); us > 1 {
+		i = int(math.Ceil(math.Log2(us) * bucketsPerOctave))
+		if i >= histogramBuckets {
+			i = histogramBuckets - 1
+		}
+	}
+	h.counts[i]++
+	h.n++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// bound returns the upper bound of the bucket
+func bound(i int) time.Duration {
+	return time.Duration(math.Exp2(float64(i)/bucketsPerOctave) * float64(time.Microsecond))
+}
+
+// Percentile returns the latency which p percent of latencies do not exceed
+func (h *Histogram) Percentile(p float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(float64(h.n) * p / 100))
+	var seen uint64
+	for i, c := range h.counts {
+		if seen += c; seen >= rank && c > 0 {
+			if b := bound(i); b < h.max {
+				return b
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+// Mean returns the average latency
+func (h *Histogram) Mean() time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.n)
+}
+
+// Sample is a request with its original and replayed responses, status is 0
+// if there was no response
+type Sample struct {
+	Method, Path                     string
+	OriginalStatus, ReplayedStatus   int
+	OriginalLatency, ReplayedLatency time.Duration
+}
+
+// side is what is known about responses of the original service or of the
+// replay target for an endpoint
+type side struct {
+	latency  Histogram
+	statuses map[int]uint64
+	errors   uint64
+}
+
+func (s *side) add(status int, latency time.Duration) {
+	s.statuses[status]++
+	if status == 0 || status >= 500 {
+		s.errors++
+	}
+	if status != 0 {
+		s.latency.Add(latency)
+	}
+}
+
+type endpoint struct {
+	requests         uint64
+	original         side
+	replayed         side
+	statusMismatches uint64
+}
+
+// Report aggregates samples by endpoint, the method and the normalized path
+// of their requests. It is safe for concurrent use.
+type Report struct {
+	mu        sync.Mutex
+	patterns  [][]string
+	endpoints map[string]*endpoint
+	started   time.Time
+}
+
+// New returns an empty report. Paths matching one of patterns, like
+// `/users/*/orders`, are grouped under it: `*` matches a path segment.
+// Other paths are normalized by Normalize.
+func New(patterns []string) *Report {
+	r := &Report{endpoints: make(map[string]*endpoint), started: time.Now()}
+	for _, p := range patterns {
+		r.patterns = append(r.patterns, strings.Split(strings.Trim(p, "/"), "/"))
+	}
+	return r
+}
+
+// Add adds the sample to its endpoint
+func (r *Report) Add(s Sample) {
+	name := s.Method + " " + r.endpoint(s.Path)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.endpoints[name]
+	if !ok {
+		e = &endpoint{}
+		e.original.statuses = make(map[int]uint64)
+		e.replayed.statuses = make(map[int]uint64)
+		r.endpoints[name] = e
+	}
+	e.requests++
+	e.original.add(s.OriginalStatus, s.OriginalLatency)
+	e.replayed.add(s.ReplayedStatus, s.ReplayedLatency)
+	if s.OriginalStatus != s.ReplayedStatus {
+		e.statusMismatches++
+	}
+}
+
+// endpoint returns the pattern matching the path or the normalized path
+func (r *Report) endpoint(path string) string {
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, p := range r.patterns {
+		if len(p) != len(segments) {
+			continue
+		}
+		match := true
+		for i := range p {
+			if p[i] != "*" && p[i] != segments[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return "/" + strings.Join(p, "/")
+		}
+	}
+	return Normalize(path)
+}
+
+// Normalize replaces segments of the path which look like IDs by `:id`:
+// numbers, UUIDs and long hexadecimal strings. The query is removed.
+func Normalize(path string) string {
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if isID(s) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isID(s string) bool {
+	if s == "" {
+		return false
+	}
+	if _, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return true
+	}
+	hex := strings.ReplaceAll(s, "-", "")
+	if len(hex) < 16 || (len(hex) != len(s) && len(s) != 36) {
+		return false
+	}
+	digits := false
+	for _, c := range hex {
+		switch {
+		case c >= '0' && c <= '9':
+			digits = true
+		case c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+		default:
+			return false
+		}
+	}
+	// long words of a-f letters are not IDs
+	return digits
+}
+
+// Bucket is a histogram bucket, latencies up to LE milliseconds
+type Bucket struct {
+	LE    float64 `json:"le_ms"`
+	Count uint64  `json:"count"`
+}
+
+// Side summarizes responses of the original service or of the replay target
+type Side struct {
+	Responses uint64            `json:"responses"`
+	Mean      float64           `json:"mean_ms"`
+	P50       float64           `json:"p50_ms"`
+	P90       float64           `json:"p90_ms"`
+	P95       float64           `json:"p95_ms"`
+	P99       float64           `json:"p99_ms"`
+	Max       float64           `json:"max_ms"`
+	Errors    uint64            `json:"errors"`
+	ErrorRate float64           `json:"error_rate"`
+	Statuses  map[string]uint64 `json:"statuses"`
+	Histogram []Bucket          `json:"histogram"`
+}
+
+// Endpoint summarizes an endpoint
+type Endpoint struct {
+	Endpoint         string `json:"endpoint"`
+	Requests         uint64 `json:"requests"`
+	Original         Side   `json:"original"`
+	Replayed         Side   `json:"replayed"`
+	StatusMismatches uint64 `json:"status_mismatches"`
+}
+
+// Summary is the content of the report
+type Summary struct {
+	Started   time.Time  `json:"started"`
+	Finished  time.Time  `json:"finished"`
+	Endpoints []Endpoint `json:"endpoints"`
+}
+
+func ms(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Millisecond)*1000) / 1000
+}
+
+func summarize(s *side, requests uint64) Side {
+	h := &s.latency
+	sum := Side{
+		Responses: h.n,
+		Mean:      ms(h.Mean()),
+		P50:       ms(h.Percentile(50)),
+		P90:       ms(h.Percentile(90)),
+		P95:       ms(h.Percentile(95)),
+		P99:       ms(h.Percentile(99)),
+		Max:       ms(h.max),
+		Errors:    s.errors,
+		Statuses:  make(map[string]uint64),
+	}
+	if requests > 0 {
+		sum.ErrorRate = float64(s.errors) / float64(requests)
+	}
+	for status, n := range s.statuses {
+		name := strconv.Itoa(status)
+		if status == 0 {
+			name = "none"
+		}
+		sum.Statuses[name] = n
+	}
+	for i, c := range h.counts {
+		if c > 0 {
+			sum.Histogram = append(sum.Histogram, Bucket{ms(bound(i)), c})
+		}
+	}
+	return sum
+}
+
+// Summary returns endpoints sorted by the number of requests
+func (r *Report) Summary() *Summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := &Summary{Started: r.started, Finished: time.Now()}
+	for name, e := range r.endpoints {
+		s.Endpoints = append(s.Endpoints, Endpoint{
+			Endpoint:         name,
+			Requests:         e.requests,
+			Original:         summarize(&e.original, e.requests),
+			Replayed:         summarize(&e.replayed, e.requests),
+			StatusMismatches: e.statusMismatches,
+		})
+	}
+	sort.Slice(s.Endpoints, func(i, j int) bool {
+		if s.Endpoints[i].Requests != s.Endpoints[j].Requests {
+			return s.Endpoints[i].Requests > s.Endpoints[j].Requests
+		}
+		return s.Endpoints[i].Endpoint < s.Endpoints[j].Endpoint
+	})
+	return s
+}
+
+// WriteTable writes the summary as a text table
+func (s *Summary) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "ENDPOINT\tREQUESTS\tP50 ORIG\tP50 REPLAY\tP95 ORIG\tP95 REPLAY\tP99 ORIG\tP99 REPLAY\tERR% ORIG\tERR% REPLAY\tSTATUS DIFF\t")
+	for _, e := range s.Endpoints {
+		fmt.Fprintf(tw, "%s\t%d\t%.1fms\t%.1fms\t%.1fms\t%.1fms\t%.1fms\t%.1fms\t%.1f\t%.1f\t%d\t\n",
+			e.Endpoint, e.Requests,
+			e.Original.P50, e.Replayed.P50, e.Original.P95, e.Replayed.P95, e.Original.P99, e.Replayed.P99,
+			e.Original.ErrorRate*100, e.Replayed.ErrorRate*100, e.StatusMismatches)
+	}
+	return tw.Flush()
+}
+
+// WriteJSON writes the summary as JSON
+func (s *Summary) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// WriteHTML writes the summary as an HTML page
+func (s *Summary) WriteHTML(w io.Writer) error {
+	return htmlTemplate.Execute(w, s)
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent": func(f float64) string { return fmt.Sprintf("%.1f%%", f*100) },
+	"delta": func(a, b float64) string {
+		if a == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%+.0f%%", (b-a)/a*100)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>GoReplay latency report</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+</style>
+</head>
+<body>
+<h1>GoReplay latency report</h1>
+<p>{{.Started.Format "2006-01-02 15:04:05"}} - {{.Finished.Format "2006-01-02 15:04:05"}}</p>
+<table>
+<tr><th rowspan="2">Endpoint</th><th rowspan="2">Requests</th><th colspan="3">p50, ms</th><th colspan="3">p95, ms</th><th colspan="3">p99, ms</th><th colspan="2">Errors</th><th colspan="2">Statuses</th></tr>
+<tr><th>original</th><th>replay</th><th>delta</th><th>original</th><th>replay</th><th>delta</th><th>original</th><th>replay</th><th>delta</th><th>original</th><th>replay</th><th>original</th><th>replay</th></tr>
+{{range .Endpoints}}<tr>
+<td>{{.Endpoint}}</td><td>{{.Requests}}</td>
+<td>{{.Original.P50}}</td><td>{{.Replayed.P50}}</td><td>{{delta .Original.P50 .Replayed.P50}}</td>
+<td>{{.Original.P95}}</td><td>{{.Replayed.P95}}</td><td>{{delta .Original.P95 .Replayed.P95}}</td>
+<td>{{.Original.P99}}</td><td>{{.Replayed.P99}}</td><td>{{delta .Original.P99 .Replayed.P99}}</td>
+<td>{{percent .Original.ErrorRate}}</td><td>{{percent .Replayed.ErrorRate}}</td>
+<td>{{range $status, $n := .Original.Statuses}}{{$status}}: {{$n}} {{end}}</td>
+<td>{{range $status, $n := .Replayed.Statuses}}{{$status}}: {{$n}} {{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,93 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	var h Histogram
+	for i := 1; i <= 100; i++ {
+		h.Add(time.Duration(i) * time.Millisecond)
+	}
+	for _, tt := range []struct {
+		p        float64
+		expected time.Duration
+	}{{50, 50 * time.Millisecond}, {95, 95 * time.Millisecond}, {100, 100 * time.Millisecond}} {
+		got := h.Percentile(tt.p)
+		if got < tt.expected || float64(got) > float64(tt.expected)*1.2 {
+			t.Errorf("p%v: expected about %v, got %v", tt.p, tt.expected, got)
+		}
+	}
+	if h.Mean() != 50500*time.Microsecond {
+		t.Errorf("wrong mean %v", h.Mean())
+	}
+	var empty Histogram
+	if empty.Percentile(99) != 0 {
+		t.Error("empty histogram should have no percentiles")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/users/42/orders?page=2":                             "/users/:id/orders",
+		"/orders/3f2b8c1e-4a5d-4c2b-9e7f-1a2b3c4d5e6f":        "/orders/:id",
+		"/blobs/9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b": "/blobs/:id",
+		"/static/facade/deadbeefcafebabe/app.js":              "/static/facade/deadbeefcafebabe/app.js",
+		"/":                                                   "/",
+	} {
+		if got := Normalize(path); got != expected {
+			t.Errorf("%s: expected %s, got %s", path, expected, got)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	r := New([]string{"/products/*"})
+	for i := 0; i < 10; i++ {
+		r.Add(Sample{"GET", "/products/shoes", 200, 200, 10 * time.Millisecond, 20 * time.Millisecond})
+	}
+	r.Add(Sample{"POST", "/checkout/7", 201, 500, 100 * time.Millisecond, time.Second})
+	// the replay target did not answer
+	r.Add(Sample{"POST", "/checkout/8?retry=1", 201, 0, 100 * time.Millisecond, 0})
+
+	s := r.Summary()
+	if len(s.Endpoints) != 2 {
+		t.Fatalf("expected 2 endpoints, got %+v", s.Endpoints)
+	}
+	products, checkout := s.Endpoints[0], s.Endpoints[1]
+	if products.Endpoint != "GET /products/*" || products.Requests != 10 || products.StatusMismatches != 0 {
+		t.Errorf("unexpected endpoint %+v", products)
+	}
+	if products.Original.P95 > 12 || products.Replayed.P95 < 20 {
+		t.Errorf("wrong latencies %v %v", products.Original.P95, products.Replayed.P95)
+	}
+	if checkout.Endpoint != "POST /checkout/:id" || checkout.StatusMismatches != 2 || checkout.Replayed.Errors != 2 ||
+		checkout.Replayed.ErrorRate != 1 || checkout.Original.ErrorRate != 0 || checkout.Replayed.Responses != 1 {
+		t.Errorf("unexpected endpoint %+v", checkout)
+	}
+	if checkout.Replayed.Statuses["500"] != 1 || checkout.Replayed.Statuses["none"] != 1 {
+		t.Errorf("wrong statuses %v", checkout.Replayed.Statuses)
+	}
+
+	var table, page, data bytes.Buffer
+	if err := s.WriteTable(&table); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(table.String()), "\n"); len(lines) != 3 || !strings.Contains(lines[1], "GET /products/*") {
+		t.Errorf("unexpected table\n%s", table.String())
+	}
+	if err := s.WriteHTML(&page); err != nil || !strings.Contains(page.String(), "<td>POST /checkout/:id</td>") {
+		t.Errorf("unexpected page %v\n%s", err, page.String())
+	}
+	if err := s.WriteJSON(&data); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Summary
+	if err := json.Unmarshal(data.Bytes(), &decoded); err != nil || len(decoded.Endpoints) != 2 || len(decoded.Endpoints[0].Replayed.Histogram) == 0 {
+		t.Errorf("unexpected JSON %v\n%s", err, data.String())
+	}
+}
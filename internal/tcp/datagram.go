@@ -0,0 +1,72 @@
+package tcp
+
+import "time"
+
+// datagramID identifies a request sent over UDP, which waits for a response
+type datagramID struct {
+	ConnID
+	key uint32
+}
+
+type pendingDatagram struct {
+	seq  uint32
+	sent time.Time
+}
+
+// processDatagram emits a UDP datagram as a message. Requests are numbered on
+// their flow like messages of a connection, a response gets the number and the
+// ID of the request with the same key. Responses to requests which were not
+// captured are skipped.
+func (shard *parserShard) processDatagram(pckt *Packet) {
+	key, dir, ok := shard.parser.Datagram(pckt)
+	if !ok {
+		stats.Add("datagram_skipped", 1)
+		return
+	}
+
+	conn := pckt.ConnID()
+	s, ok := shard.seqs[conn]
+	if !ok {
+		s = new(connSeq)
+		shard.seqs[conn] = s
+	}
+	id := datagramID{conn, key}
+
+	var seq uint32
+	if dir == DirIncoming {
+		s.n++
+		seq = s.n
+		// a retransmitted request replaces the previous one
+		shard.datagrams[id] = &pendingDatagram{seq, pckt.Timestamp}
+	} else {
+		d, ok := shard.datagrams[id]
+		if !ok {
+			stats.Add("datagram_unmatched", 1)
+			return
+		}
+		delete(shard.datagrams, id)
+		seq = d.seq
+	}
+	s.last = pckt.Timestamp
+
+	flow := pckt.Flow()
+	client, server := flow.Src, flow.Dst
+	if dir != DirIncoming {
+		client, server = server, client
+	}
+
+	m := new(Message)
+	m.parser = shard.parser
+	m.packets = []*Packet{pckt}
+	m.uuid = streamUUID(client, server, seq)
+	m.Seq = seq
+	m.Direction = dir
+	m.Length = len(pckt.Payload)
+	m.LostData = int(pckt.Lost)
+	m.SrcAddr = pckt.SrcIP.String()
+	m.DstAddr = pckt.DstIP.String()
+	m.Start = pckt.Timestamp
+	m.End = pckt.Timestamp
+
+	shard.emit(m)
+}
@@ -0,0 +1,40 @@
+package tcp
+
+// Sampler keeps a part of captured connections. The decision depends only on
+// the connection, or on the client address, so all packets of a connection in
+// both directions are kept or skipped together, before they are reassembled.
+type Sampler struct {
+	threshold uint64 // connections with smaller hashes are kept
+	byClient  bool
+}
+
+// NewSampler returns a sampler keeping percent of connections, or percent of
+// clients with all their connections when byClient is set
+func NewSampler(percent float64, byClient bool) *Sampler {
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	return &Sampler{threshold: uint64(percent / 100 * (1 << 32)), byClient: byClient}
+}
+
+// Keep reports whether the packet belongs to a sampled connection
+func (s *Sampler) Keep(pckt *Packet) bool {
+	id := pckt.ConnID()
+	if s.byClient {
+		switch pckt.Direction {
+		case DirIncoming:
+			id = ConnID{Src: newEndpoint(pckt.SrcIP, 0)}
+		case DirOutcoming:
+			id = ConnID{Src: newEndpoint(pckt.DstIP, 0)}
+		default:
+			// the client is unknown, keep connections between the same hosts
+			id.Src.Port, id.Dst.Port = 0, 0
+		}
+	}
+	// Fibonacci hashing, so that sampled connections are spread between
+	// workers of MessageParser which use the low bits of the hash
+	return uint64(id.hash()*2654435769) < s.threshold
+}
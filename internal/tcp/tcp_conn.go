@@ -0,0 +1,291 @@
+package tcp
+
+import (
+	"net"
+	"time"
+)
+
+// maxPendingPackets is the maximum number of out of order packets buffered per
+// direction of a connection, before the gap is considered lost. Gaps which are
+// not filled in the message expiration time are lost too.
+const maxPendingPackets = 1024
+
+// HintStream hints the parser to reassemble whole tcp connections as continuous
+// byte streams instead of grouping packets by their Ack, see MessageParser.Stream.
+// It is called for every packet in Seq order, data is the part of the packet
+// payload which was not seen before. Protocol parsers should call Conn.Emit
+// for every message they recognize.
+type HintStream func(c *Conn, pckt *Packet, data []byte)
+
+// StreamExpirer is implemented by protocol states which buffer partial
+// messages, see Conn.SetProtocolState. The parser calls Expire periodically
+// with the time before which buffered data is expired.
+type StreamExpirer interface {
+	Expire(c *Conn, deadline time.Time)
+}
+
+// StreamGapSkipper is implemented by protocol states which can continue
+// parsing a direction of the connection after its data was lost. SkipGap is
+// called before the data which follows the gap is passed to the Stream hint.
+type StreamGapSkipper interface {
+	SkipGap(c *Conn, dir Dir)
+}
+
+// connDir holds reassembly state of one direction of a connection
+type connDir struct {
+	started bool
+	next    uint32
+	pending []*Packet
+	gap     time.Time // when the first packet after the gap was buffered
+}
+
+// Conn is the representation of a tcp connection reassembled by MessageParser
+// when the Stream hint is set. SrcIP and SrcPort always belong to the client.
+type Conn struct {
+	SrcIP, DstIP     net.IP
+	SrcPort, DstPort uint16
+	Start, End       time.Time
+	Broken           bool // protocol parser gave up on this connection
+
+	id       ConnID
+	dirs     [2]connDir
+	shard    *parserShard
+	feedback interface{}
+}
+
+func newConn(shard *parserShard, pckt *Packet) *Conn {
+	c := new(Conn)
+	c.shard = shard
+	c.id = pckt.ConnID()
+	c.Start = pckt.Timestamp
+	c.End = pckt.Timestamp
+
+	// Only the client opens a connection with SYN, otherwise trust the port based direction
+	if pckt.Direction == DirOutcoming || (pckt.SYN && pckt.ACK) {
+		c.SrcIP, c.SrcPort = pckt.DstIP, pckt.DstPort
+		c.DstIP, c.DstPort = pckt.SrcIP, pckt.SrcPort
+	} else {
+		c.SrcIP, c.SrcPort = pckt.SrcIP, pckt.SrcPort
+		c.DstIP, c.DstPort = pckt.DstIP, pckt.DstPort
+	}
+
+	return c
+}
+
+// Dir returns the direction of the packet relative to this connection
+func (c *Conn) Dir(pckt *Packet) Dir {
+	if pckt.SrcPort == c.SrcPort && pckt.SrcIP.Equal(c.SrcIP) {
+		return DirIncoming
+	}
+	return DirOutcoming
+}
+
+// Swap exchanges client and server sides of the connection, it can be used
+// by protocol parsers that recognize the client only by the content
+func (c *Conn) Swap() {
+	c.SrcIP, c.DstIP = c.DstIP, c.SrcIP
+	c.SrcPort, c.DstPort = c.DstPort, c.SrcPort
+	c.dirs[0], c.dirs[1] = c.dirs[1], c.dirs[0]
+}
+
+// SetProtocolState set feedback/data that can be used later by Stream hint
+func (c *Conn) SetProtocolState(feedback interface{}) {
+	c.feedback = feedback
+}
+
+// ProtocolState returns feedback associated to this connection
+func (c *Conn) ProtocolState() interface{} {
+	return c.feedback
+}
+
+// UUID returns the ID shared by all messages with the given stream id
+// (e.g HTTP/2 stream) of this connection.
+func (c *Conn) UUID(streamID uint32) []byte {
+	return streamUUID(newEndpoint(c.SrcIP, c.SrcPort), newEndpoint(c.DstIP, c.DstPort), streamID)
+}
+
+// Emit sends a message recognized by protocol parser, packets are the
+// packets which carried the message, data is its (possibly converted) payload.
+// streamID is also used as the number of the message on the connection.
+func (c *Conn) Emit(dir Dir, streamID uint32, data []byte, packets []*Packet) {
+	c.emit(dir, c.UUID(streamID), streamID, 0, data, packets)
+}
+
+// EmitFrame sends a message of a connection which switched to other protocol
+// with HTTP Upgrade, like a WebSocket message. Messages share the ID of the
+// upgrade request, seq orders them and opcode tells their type.
+func (c *Conn) EmitFrame(dir Dir, upgradeID, seq uint32, opcode byte, data []byte, packets []*Packet) {
+	c.emit(dir, c.UUID(upgradeID), seq, opcode, data, packets)
+}
+
+// EmitChunk sends a part of a message which is streamed instead of being
+// buffered whole, like a long-lived or a large body. All parts share the ID of
+// the message, chunk numbers them from 1 and more tells whether other parts
+// follow.
+func (c *Conn) EmitChunk(dir Dir, streamID, chunk uint32, more bool, data []byte, packets []*Packet) {
+	if m := c.message(dir, c.UUID(streamID), streamID, 0, data, packets); m != nil {
+		m.Chunk, m.More = chunk, more
+		c.shard.emit(m)
+	}
+}
+
+func (c *Conn) emit(dir Dir, uuid []byte, seq uint32, opcode byte, data []byte, packets []*Packet) {
+	if m := c.message(dir, uuid, seq, opcode, data, packets); m != nil {
+		c.shard.emit(m)
+	}
+}
+
+func (c *Conn) message(dir Dir, uuid []byte, seq uint32, opcode byte, data []byte, packets []*Packet) *Message {
+	if len(packets) == 0 {
+		return nil
+	}
+	m := new(Message)
+	m.parser = c.shard.parser
+	m.packets = packets
+	m.data = data
+	m.uuid = uuid
+	m.Seq = seq
+	m.Opcode = opcode
+	m.Direction = dir
+	m.Length = len(data)
+	m.SrcAddr = packets[0].SrcIP.String()
+	m.DstAddr = packets[0].DstIP.String()
+	m.Start = packets[0].Timestamp
+	for _, p := range packets {
+		m.LostData += int(p.Lost)
+		if p.Timestamp.After(m.End) {
+			m.End = p.Timestamp
+		}
+	}
+	return m
+}
+
+func (shard *parserShard) processConnPacket(pckt *Packet) {
+	id := pckt.ConnID()
+	c, ok := shard.conns[id]
+	if !ok {
+		if pckt.RST || (pckt.FIN && len(pckt.Payload) == 0) {
+			return
+		}
+		c = newConn(shard, pckt)
+		shard.conns[id] = c
+	}
+
+	if pckt.Timestamp.After(c.End) {
+		c.End = pckt.Timestamp
+	}
+
+	if c.Broken {
+		// the protocol parser gave up on the connection
+		stats.Add("conn_broken_bytes", int64(len(pckt.Payload)))
+	} else {
+		c.reassemble(pckt)
+		if c.Broken {
+			stats.Add("conn_broken_count", 1)
+		}
+	}
+
+	if pckt.RST || pckt.FIN {
+		delete(shard.conns, id)
+	}
+}
+
+// reassemble passes packet payloads to the Stream hint in Seq order
+func (c *Conn) reassemble(pckt *Packet) {
+	dir := c.Dir(pckt)
+	d := &c.dirs[dir-1]
+
+	if pckt.SYN {
+		d.started = true
+		d.next = pckt.Seq + 1
+		return
+	}
+	if len(pckt.Payload) == 0 {
+		return
+	}
+	if !d.started {
+		d.started = true
+		d.next = pckt.Seq
+	}
+
+	if seqDiff(pckt.Seq, d.next) > 0 {
+		if len(d.pending) == 0 {
+			d.gap = time.Now()
+		}
+		d.addPending(pckt)
+		if len(d.pending) > maxPendingPackets {
+			// The gap will never be filled, skip it
+			c.skipGap(dir)
+		}
+		return
+	}
+	c.deliver(d, pckt)
+	c.deliverPending(d)
+}
+
+// expireGaps skips gaps which were not filled since the deadline
+func (c *Conn) expireGaps(deadline time.Time) {
+	for i := range c.dirs {
+		if len(c.dirs[i].pending) > 0 && c.dirs[i].gap.Before(deadline) && !c.Broken {
+			c.skipGap(Dir(i + 1))
+		}
+	}
+}
+
+// skipGap gives up waiting for the lost data of the direction and passes the
+// buffered data which follows it
+func (c *Conn) skipGap(dir Dir) {
+	d := &c.dirs[dir-1]
+	stats.Add("conn_lost_gap", 1)
+	if s, ok := c.feedback.(StreamGapSkipper); ok {
+		s.SkipGap(c, dir)
+	}
+	d.next = d.pending[0].Seq
+	c.deliverPending(d)
+}
+
+// deliverPending passes buffered packets which follow the delivered data
+func (c *Conn) deliverPending(d *connDir) {
+	n := len(d.pending)
+	for len(d.pending) > 0 && seqDiff(d.pending[0].Seq, d.next) <= 0 {
+		p := d.pending[0]
+		d.pending = d.pending[1:]
+		c.deliver(d, p)
+	}
+	if len(d.pending) > 0 && len(d.pending) < n {
+		// other gap follows
+		d.gap = time.Now()
+	}
+}
+
+func (c *Conn) deliver(d *connDir, pckt *Packet) {
+	end := pckt.Seq + uint32(len(pckt.Payload))
+	if seqDiff(end, d.next) <= 0 {
+		// retransmission of already seen data
+		return
+	}
+	data := pckt.Payload[d.next-pckt.Seq:]
+	d.next = end
+
+	if !c.Broken {
+		c.shard.parser.Stream(c, pckt, data)
+	}
+}
+
+func (d *connDir) addPending(pckt *Packet) {
+	i := len(d.pending)
+	for i > 0 && seqDiff(d.pending[i-1].Seq, pckt.Seq) > 0 {
+		i--
+	}
+	if i > 0 && d.pending[i-1].Seq == pckt.Seq {
+		return
+	}
+	d.pending = append(d.pending, nil)
+	copy(d.pending[i+1:], d.pending[i:])
+	d.pending[i] = pckt
+}
+
+// seqDiff compares sequence numbers, taking wraparound into account
+func seqDiff(a, b uint32) int32 {
+	return int32(a - b)
+}
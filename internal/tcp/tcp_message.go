@@ -1,13 +1,14 @@
 package tcp
 
 import (
-	"encoding/binary"
-	"encoding/hex"
 	"fmt"
 	"github.com/buger/goreplay/proto"
 	"net"
 	"reflect"
+	"runtime"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -20,6 +21,18 @@ const (
 	ProtocolHTTP TCPProtocol = iota
 	// ProtocolBinary ...
 	ProtocolBinary
+	// ProtocolHTTP2 ...
+	ProtocolHTTP2
+	// ProtocolGRPC ...
+	ProtocolGRPC
+	// ProtocolPostgres ...
+	ProtocolPostgres
+	// ProtocolMySQL ...
+	ProtocolMySQL
+	// ProtocolRedis ...
+	ProtocolRedis
+	// ProtocolDNS ...
+	ProtocolDNS
 )
 
 // Set is here so that TCPProtocol can implement flag.Var
@@ -29,6 +42,18 @@ func (protocol *TCPProtocol) Set(v string) error {
 		*protocol = ProtocolHTTP
 	case "binary":
 		*protocol = ProtocolBinary
+	case "http2":
+		*protocol = ProtocolHTTP2
+	case "grpc":
+		*protocol = ProtocolGRPC
+	case "postgres":
+		*protocol = ProtocolPostgres
+	case "mysql":
+		*protocol = ProtocolMySQL
+	case "redis":
+		*protocol = ProtocolRedis
+	case "dns":
+		*protocol = ProtocolDNS
 	default:
 		return fmt.Errorf("unsupported protocol %s", v)
 	}
@@ -41,11 +66,31 @@ func (protocol *TCPProtocol) String() string {
 		return "binary"
 	case ProtocolHTTP:
 		return "http"
+	case ProtocolHTTP2:
+		return "http2"
+	case ProtocolGRPC:
+		return "grpc"
+	case ProtocolPostgres:
+		return "postgres"
+	case ProtocolMySQL:
+		return "mysql"
+	case ProtocolRedis:
+		return "redis"
+	case ProtocolDNS:
+		return "dns"
 	default:
 		return ""
 	}
 }
 
+// Transport returns the transport layer protocol of the protocol, "tcp" or "udp"
+func (protocol *TCPProtocol) Transport() string {
+	if *protocol == ProtocolDNS {
+		return "udp"
+	}
+	return "tcp"
+}
+
 // Stats every message carry its own stats object
 type Stats struct {
 	LostData  int
@@ -66,36 +111,47 @@ type Message struct {
 	parser           *MessageParser
 	feedback         interface{}
 	continueAdjusted bool
+	data             []byte // payload assembled by Stream hint
+	uuid             []byte
 	Stats
+
+	// Seq is the number of the message on its connection, responses have
+	// the number of their requests
+	Seq uint32
+	// Opcode is the type of messages sent by Conn.EmitFrame, it is 0 for
+	// other messages
+	Opcode byte
+	// Chunk is the number of a part of a message streamed by Conn.EmitChunk,
+	// the first part (1) has the headers. It is 0 for whole messages.
+	Chunk uint32
+	// More is true if other parts of the streamed message follow this one
+	More bool
 }
 
 // UUID returns the UUID of a TCP request and its response.
 func (m *Message) UUID() []byte {
-	var streamID uint64
+	if m.uuid != nil {
+		return m.uuid
+	}
+
 	pckt := m.packets[0]
 
 	// check if response or request have generated the ID before.
+	flow := pckt.Flow()
 	if m.Direction == DirIncoming {
-		streamID = uint64(pckt.SrcPort)<<48 | uint64(pckt.DstPort)<<32 |
-			uint64(ip2int(pckt.SrcIP))
-	} else {
-		streamID = uint64(pckt.DstPort)<<48 | uint64(pckt.SrcPort)<<32 |
-			uint64(ip2int(pckt.DstIP))
+		return streamUUID(flow.Src, flow.Dst, pckt.Ack)
 	}
+	return streamUUID(flow.Dst, flow.Src, pckt.Seq)
+}
 
-	id := make([]byte, 12)
-	binary.BigEndian.PutUint64(id, streamID)
-
+// ConnUUID returns the ID of the connection of the message, it is the same for
+// all messages of the connection and it is the prefix of their UUID.
+func (m *Message) ConnUUID() []byte {
+	flow := m.packets[0].Flow()
 	if m.Direction == DirIncoming {
-		binary.BigEndian.PutUint32(id[8:], pckt.Ack)
-	} else {
-		binary.BigEndian.PutUint32(id[8:], pckt.Seq)
+		return connUUID(flow.Src, flow.Dst)
 	}
-
-	uuidHex := make([]byte, 24)
-	hex.Encode(uuidHex[:], id[:])
-
-	return uuidHex
+	return connUUID(flow.Dst, flow.Src)
 }
 
 func (m *Message) add(packet *Packet) bool {
@@ -161,6 +217,10 @@ func (m *Message) PacketData() [][]byte {
 
 // Data returns data in this message
 func (m *Message) Data() []byte {
+	if m.data != nil {
+		return m.data
+	}
+
 	packetData := m.PacketData()
 	tmp := packetData[0]
 
@@ -204,23 +264,57 @@ type HintEnd func(*Message) bool
 // when set, it will be called after checking SYN flag
 type HintStart func(*Packet) (IsRequest, IsOutgoing bool)
 
+// HintDatagram hints the parser to handle UDP datagrams, see MessageParser.Datagram.
+// key pairs a request with its response on the same flow, like transaction ID
+// of DNS, ok is false for datagrams which should be skipped.
+type HintDatagram func(*Packet) (key uint32, dir Dir, ok bool)
+
 // MessageParser holds data of all tcp messages in progress(still receiving/sending packets).
-// message is identified by its source port and dst port, and last 4bytes of src IP.
+// message is identified by its source and destination addresses and ports, and the Ack number.
+//
+// Packets are distributed by their connection between workers, every worker
+// reassembles messages of its connections on its own goroutine. Requests and
+// responses of a connection are always handled by the same worker, messages of
+// different connections can be emitted out of capture order.
 type MessageParser struct {
-	m map[uint64]*Message
-
 	messageExpire  time.Duration // the maximum time to wait for the final packet, minimum is 100ms
 	allowIncompete bool
 	End            HintEnd
 	Start          HintStart
-	ticker         *time.Ticker
-	messages       chan *Message
-	packets        chan *PcapPacket
-	close          chan struct{} // to signal that we are able to close
-	ports          []uint16
-	ips            []net.IP
+	Stream         HintStream
+	Datagram       HintDatagram // every UDP datagram is a message, TCP packets are skipped
+	Sampler        *Sampler     // connections which are not sampled are skipped before reassembly
+	// Workers is the number of goroutines reassembling messages, like hints it
+	// must be set before the first packet. By default it is the number of CPUs.
+	Workers  int
+	shards   []*parserShard
+	start    sync.Once
+	wg       sync.WaitGroup
+	messages chan *Message
+	close    chan struct{} // closed to stop the workers
+	ports    []uint16
+	ips      []net.IP
+}
+
+// parserShard holds messages and connections of the flows assigned to one
+// worker of MessageParser
+type parserShard struct {
+	parser *MessageParser
+	m      map[MessageID]*Message
+	conns  map[ConnID]*Conn
+	seqs   map[ConnID]*connSeq // numbers of messages grouped by Ack
+
+	datagrams map[datagramID]*pendingDatagram // requests waiting for responses
+
+	ticker  *time.Ticker
+	packets chan *Packet
+	flush   chan chan struct{} // requests to process queued packets
+	pending int64              // number of messages in progress, set by the timer
 }
 
+// packetQueueSize is the number of parsed packets buffered per worker
+const packetQueueSize = 10000
+
 // NewMessageParser returns a new instance of message parser
 func NewMessageParser(messages chan *Message, ports []uint16, ips []net.IP, messageExpire time.Duration, allowIncompete bool) (parser *MessageParser) {
 	parser = new(MessageParser)
@@ -232,60 +326,107 @@ func NewMessageParser(messages chan *Message, ports []uint16, ips []net.IP, mess
 
 	parser.allowIncompete = allowIncompete
 
-	parser.packets = make(chan *PcapPacket, 10000)
-
 	if messages == nil {
 		messages = make(chan *Message, 1000)
 	}
 	parser.messages = messages
-
-	parser.m = make(map[uint64]*Message)
-	parser.ticker = time.NewTicker(time.Millisecond * 100)
-	parser.close = make(chan struct{}, 1)
+	parser.close = make(chan struct{})
 
 	parser.ports = ports
 	parser.ips = ips
 
-	go parser.wait()
 	return parser
 }
 
-var packetLen int
+// startWorkers starts the workers once hints and the number of workers are known
+func (parser *MessageParser) startWorkers() {
+	n := parser.Workers
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	parser.shards = make([]*parserShard, n)
+	for i := range parser.shards {
+		shard := new(parserShard)
+		shard.parser = parser
+		shard.m = make(map[MessageID]*Message)
+		shard.conns = make(map[ConnID]*Conn)
+		shard.seqs = make(map[ConnID]*connSeq)
+		shard.datagrams = make(map[datagramID]*pendingDatagram)
+		shard.ticker = time.NewTicker(time.Millisecond * 100)
+		shard.packets = make(chan *Packet, packetQueueSize)
+		shard.flush = make(chan chan struct{})
+		parser.shards[i] = shard
+
+		parser.wg.Add(1)
+		go shard.wait()
+	}
+}
+
+// shard returns the worker of the connection, or nil if the parser was
+// closed before it started
+func (parser *MessageParser) shard(id ConnID) *parserShard {
+	parser.start.Do(parser.startWorkers)
+	if len(parser.shards) == 0 {
+		return nil
+	}
+	return parser.shards[id.hash()%uint32(len(parser.shards))]
+}
 
-// Packet returns packet handler
+// PacketHandler parses the packet and queues it to the worker of its connection
 func (parser *MessageParser) PacketHandler(packet *PcapPacket) {
-	packetLen++
-	parser.packets <- packet
+	pckt := parser.parsePacket(packet)
+	if pckt == nil {
+		return
+	}
+	if parser.Sampler != nil && !parser.Sampler.Keep(pckt) {
+		stats.Add("sampled_out_packets", 1)
+		stats.Add("sampled_out_bytes", int64(len(pckt.Payload)))
+		return
+	}
+	shard := parser.shard(pckt.ConnID())
+	if shard == nil {
+		return
+	}
+	select {
+	case shard.packets <- pckt:
+	case <-parser.close:
+	}
 }
 
-func (parser *MessageParser) wait() {
-	var (
-		now time.Time
-	)
+func (shard *parserShard) wait() {
+	defer shard.parser.wg.Done()
 	for {
 		select {
-		case pckt := <-parser.packets:
-			parser.processPacket(parser.parsePacket(pckt))
-		case now = <-parser.ticker.C:
-			parser.timer(now)
-		case <-parser.close:
-			parser.ticker.Stop()
-			// parser.Close should wait for this function to return
-			parser.close <- struct{}{}
+		case pckt := <-shard.packets:
+			shard.processPacket(pckt)
+		case now := <-shard.ticker.C:
+			shard.timer(now)
+		case done := <-shard.flush:
+			for len(shard.packets) > 0 {
+				shard.processPacket(<-shard.packets)
+			}
+			// messages which are still in progress expire
+			shard.timer(time.Now().Add(shard.parser.messageExpire + connExpire))
+			close(done)
+		case <-shard.parser.close:
+			shard.ticker.Stop()
 			return
-			// default:
 		}
 	}
 }
 
 func (parser *MessageParser) parsePacket(pcapPkt *PcapPacket) *Packet {
-	pckt, err := ParsePacket(pcapPkt.Data, pcapPkt.LType, pcapPkt.LTypeLen, pcapPkt.Ci, false)
+	// connection streams need every byte and SYN/FIN packets
+	pckt, err := ParsePacket(pcapPkt.Data, pcapPkt.LType, pcapPkt.LTypeLen, pcapPkt.Ci, parser.Stream != nil)
 	if err != nil {
 		if _, empty := err.(EmptyPacket); !empty {
 			stats.Add("packet_error", 1)
 		}
 		return nil
 	}
+	if pckt.UDP != (parser.Datagram != nil) {
+		return nil
+	}
 
 	for _, p := range parser.ports {
 		if pckt.DstPort == p && containsOrEmpty(pckt.DstIP, parser.ips) {
@@ -312,14 +453,30 @@ func containsOrEmpty(element net.IP, ipList []net.IP) bool {
 	return false
 }
 
+// processPacket processes the packet on the calling goroutine instead of the
+// worker of its connection
 func (parser *MessageParser) processPacket(pckt *Packet) {
 	if pckt == nil {
 		return
 	}
+	parser.shard(pckt.ConnID()).processPacket(pckt)
+}
+
+func (shard *parserShard) processPacket(pckt *Packet) {
+	parser := shard.parser
+	if parser.Datagram != nil {
+		shard.processDatagram(pckt)
+		return
+	}
+
+	// Multiplexing protocols need the whole connection, not a single message
+	if parser.Stream != nil {
+		shard.processConnPacket(pckt)
+		return
+	}
 
-	// Trying to build unique hash, but there is small chance of collision
-	// No matter if it is request or response, all packets in the same message have same
-	m, ok := parser.m[pckt.MessageID()]
+	// No matter if it is request or response, all packets in the same message have same ID
+	m, ok := shard.m[pckt.MessageID()]
 	switch {
 	case ok:
 		if m.Direction == DirUnknown {
@@ -331,7 +488,7 @@ func (parser *MessageParser) processPacket(pckt *Packet) {
 				}
 			}
 		}
-		parser.addPacket(m, pckt)
+		shard.addPacket(m, pckt)
 		return
 	case pckt.Direction == DirUnknown && parser.Start != nil:
 		if in, out := parser.Start(pckt); in || out {
@@ -348,51 +505,56 @@ func (parser *MessageParser) processPacket(pckt *Packet) {
 	m.SrcAddr = pckt.SrcIP.String()
 	m.DstAddr = pckt.DstIP.String()
 
-	parser.m[pckt.MessageID()] = m
+	shard.m[pckt.MessageID()] = m
 
 	m.Start = pckt.Timestamp
 	m.parser = parser
-	parser.addPacket(m, pckt)
+	shard.addPacket(m, pckt)
 }
 
-func (parser *MessageParser) addPacket(m *Message, pckt *Packet) bool {
+func (shard *parserShard) addPacket(m *Message, pckt *Packet) bool {
 	if !m.add(pckt) {
 		return false
 	}
 
 	// If we are using protocol parsing, like HTTP, depend on its parsing func.
 	// For the binary procols wait for message to expire
-	if parser.End != nil {
-		if parser.End(m) {
-			parser.Emit(m)
+	if shard.parser.End != nil {
+		if shard.parser.End(m) {
+			shard.emit(m)
 			return true
 		}
 
-		parser.Fix100Continue(m)
+		shard.fix100Continue(m)
 	}
 
 	return true
 }
 
+// Fix100Continue merges the request sent after "100 Continue" response with
+// its headers, it must be called by the worker of the connection, e.g. in a hint
 func (parser *MessageParser) Fix100Continue(m *Message) {
+	parser.shard(m.packets[0].ConnID()).fix100Continue(m)
+}
+
+func (shard *parserShard) fix100Continue(m *Message) {
 	// Only adjust a message once
 	if state, ok := m.feedback.(*proto.HTTPState); ok && state.Continue100 && !m.continueAdjusted {
 		// Shift Ack by given offset
 		// Size of "HTTP/1.1 100 Continue\r\n\r\n" message
 		for _, p := range m.packets {
-			p.messageID = 0
 			p.Ack += 25
 		}
 
 		// If next section was aready approved and received, merge messages
-		if next, found := parser.m[m.packets[0].MessageID()]; found {
+		if next, found := shard.m[m.packets[0].MessageID()]; found {
 			for _, p := range next.packets {
-				parser.addPacket(m, p)
+				shard.addPacket(m, p)
 			}
 		}
 
 		// Re-add (or override) again with new message and ID
-		parser.m[m.packets[0].MessageID()] = m
+		shard.m[m.packets[0].MessageID()] = m
 		m.continueAdjusted = true
 	}
 }
@@ -402,42 +564,131 @@ func (parser *MessageParser) Read() *Message {
 	return m
 }
 
+// Emit sends the message to the reader of the parser, it must be called by the
+// worker of the connection, e.g. in a hint
 func (parser *MessageParser) Emit(m *Message) {
+	parser.shard(m.packets[0].ConnID()).emit(m)
+}
+
+func (shard *parserShard) emit(m *Message) {
 	stats.Add("message_count", 1)
 
-	delete(parser.m, m.packets[0].MessageID())
+	if id := m.packets[0].MessageID(); shard.m[id] == m {
+		delete(shard.m, id)
+	}
+	if shard.parser.Stream == nil && shard.parser.Datagram == nil {
+		shard.sequence(m)
+	}
+
+	select {
+	case shard.parser.messages <- m:
+	case <-shard.parser.close:
+	}
+}
 
-	parser.messages <- m
+// connSeq numbers messages of a connection which are not reassembled by the
+// Stream hint
+type connSeq struct {
+	n    uint32
+	last time.Time
+}
+
+// sequence sets the number of the message on its connection, responses get
+// the number of the last request
+func (shard *parserShard) sequence(m *Message) {
+	id := m.packets[0].ConnID()
+	s, ok := shard.seqs[id]
+	if !ok {
+		s = new(connSeq)
+		shard.seqs[id] = s
+	}
+	if m.Direction == DirIncoming {
+		s.n++
+	}
+	s.last = m.End
+	m.Seq = s.n
 }
 
 func GetUnexportedField(field reflect.Value) interface{} {
 	return reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().Interface()
 }
 
-var failMsg int
+// connExpire is the idle time after which a connection tracked by the Stream
+// hint is forgotten. Protocols like HTTP/2 keep compression state for the
+// whole life of a connection, so it is much bigger than message expiration.
+const connExpire = 5 * time.Minute
 
-func (parser *MessageParser) timer(now time.Time) {
-	packetLen = 0
+func (shard *parserShard) timer(now time.Time) {
+	parser := shard.parser
+	atomic.StoreInt64(&shard.pending, int64(len(shard.m)))
 
-	packetQueueLen.Set(int64(len(parser.packets)))
-	messageQueueLen.Set(int64(len(parser.m)))
+	// queue lengths are reported for all workers of the parser
+	var packets, messages int64
+	for _, s := range parser.shards {
+		packets += int64(len(s.packets))
+		messages += atomic.LoadInt64(&s.pending)
+	}
+	packetQueueLen.Set(packets)
+	messageQueueLen.Set(messages)
 
-	for _, m := range parser.m {
+	for _, m := range shard.m {
 		if now.Sub(m.End) > parser.messageExpire {
 			m.TimedOut = true
 			stats.Add("message_timeout_count", 1)
-			failMsg++
 			if parser.End == nil || parser.allowIncompete {
-				parser.Emit(m)
+				shard.emit(m)
 			}
 
-			delete(parser.m, m.packets[0].MessageID())
+			delete(shard.m, m.packets[0].MessageID())
+		}
+	}
+
+	deadline := now.Add(-parser.messageExpire)
+	for id, c := range shard.conns {
+		if e, ok := c.feedback.(StreamExpirer); ok && !c.Broken {
+			e.Expire(c, deadline)
+		}
+		c.expireGaps(deadline)
+		if now.Sub(c.End) > connExpire {
+			stats.Add("conn_timeout_count", 1)
+			delete(shard.conns, id)
+		}
+	}
+
+	for id, s := range shard.seqs {
+		if now.Sub(s.last) > connExpire {
+			delete(shard.seqs, id)
+		}
+	}
+
+	for id, d := range shard.datagrams {
+		if now.Sub(d.sent) > parser.messageExpire {
+			stats.Add("datagram_timeout_count", 1)
+			delete(shard.datagrams, id)
+		}
+	}
+}
+
+// Flush processes packets queued so far and emits messages in progress as if
+// they expired, like at the end of a capture file. No packets may be handled
+// while it runs.
+func (parser *MessageParser) Flush() {
+	parser.start.Do(parser.startWorkers)
+	for _, shard := range parser.shards {
+		done := make(chan struct{})
+		select {
+		case shard.flush <- done:
+			<-done
+		case <-parser.close:
+			return
 		}
 	}
 }
 
+// Close stops the workers, packets which were not processed yet are dropped
 func (parser *MessageParser) Close() error {
-	parser.close <- struct{}{}
-	<-parser.close // wait for timer to be closed!
+	parser.start.Do(func() {})
+	close(parser.close)
+	parser.wg.Wait()
 	return nil
 }
@@ -1,7 +1,9 @@
 package tcp
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"expvar"
 	"fmt"
 	"net"
@@ -58,18 +60,19 @@ function.
 */
 type Packet struct {
 	Direction          Dir
-	messageID          uint64
 	SrcIP, DstIP       net.IP
 	Version            uint8
 	SrcPort, DstPort   uint16
 	Ack, Seq           uint32
 	ACK, SYN, FIN, RST bool
+	UDP                bool // the packet is a UDP datagram, it has no Seq, Ack and flags
 	Lost               uint32
 	Retry              int
 	CaptureLength      int
 	Timestamp          time.Time
 	Payload            []byte
 	buf                []byte
+	raw                []byte // network layer packet
 
 	created time.Time
 	gc      bool
@@ -94,7 +97,6 @@ func ParsePacket(data []byte, lType, lTypeLen int, ci *gopacket.CaptureInfo, all
 
 func (pckt *Packet) parse(data []byte, lType, lTypeLen int, cp *gopacket.CaptureInfo, allowEmpty bool) error {
 	pckt.Retry = 0
-	pckt.messageID = 0
 	pckt.buf = pckt.buf[:]
 
 	// TODO: check resolution
@@ -124,11 +126,18 @@ func (pckt *Packet) parse(data []byte, lType, lTypeLen int, cp *gopacket.Capture
 		if len(ldata) < ihl {
 			return ErrHdrLength("IPv4 opts")
 		}
+		// strip ethernet padding, total length is 0 for segmentation offloaded packets
+		if totalLen := int(binary.BigEndian.Uint16(ldata[2:4])); totalLen >= ihl && totalLen < len(ldata) {
+			ldata = ldata[:totalLen]
+		}
 		netLayer = ldata[:ihl]
 	} else if ldata[0]>>4 == 6 {
 		if len(ldata) < 40 {
 			return ErrHdrLength("IPv6")
 		}
+		if payloadLen := int(binary.BigEndian.Uint16(ldata[4:6])); payloadLen > 0 && 40+payloadLen < len(ldata) {
+			ldata = ldata[:40+payloadLen]
+		}
 		proto = ldata[6]
 		totalLen := 40
 		for ipv6ExtensionHdr(proto) {
@@ -150,6 +159,10 @@ func (pckt *Packet) parse(data []byte, lType, lTypeLen int, cp *gopacket.Capture
 	} else {
 		return ErrHdrExpected("IPv4 or IPv6")
 	}
+	pckt.raw = ldata
+	if proto == 17 {
+		return pckt.parseUDP(netLayer, ldata[len(netLayer):], cp, allowEmpty)
+	}
 	if proto != 6 {
 		return ErrHdrExpected("TCP")
 	}
@@ -182,17 +195,7 @@ func (pckt *Packet) parse(data []byte, lType, lTypeLen int, cp *gopacket.Capture
 		return EmptyPacket("")
 	}
 
-	if (netLayer[0] >> 4) == 4 {
-		// IPv4 header
-		pckt.Version = 4
-		pckt.SrcIP = netLayer[12:16]
-		pckt.DstIP = netLayer[16:20]
-	} else {
-		// IPv6 header
-		pckt.Version = 6
-		pckt.SrcIP = netLayer[8:24]
-		pckt.DstIP = netLayer[24:40]
-	}
+	pckt.setIPs(netLayer)
 
 	transLayer = ndata[:dOf]
 
@@ -212,14 +215,153 @@ func (pckt *Packet) parse(data []byte, lType, lTypeLen int, cp *gopacket.Capture
 	return nil
 }
 
-func (pckt *Packet) MessageID() uint64 {
-	if pckt.messageID == 0 {
-		// All packets in the same message will share the same ID
-		pckt.messageID = uint64(pckt.SrcPort)<<48 | uint64(pckt.DstPort)<<32 |
-			(uint64(ip2int(pckt.SrcIP)) + uint64(ip2int(pckt.DstIP)) + uint64(pckt.Ack))
+// parseUDP parses UDP header of a datagram, fragmented datagrams are not
+// reassembled
+func (pckt *Packet) parseUDP(netLayer, ndata []byte, cp *gopacket.CaptureInfo, allowEmpty bool) error {
+	if len(ndata) < 8 {
+		return ErrHdrLength("UDP")
+	}
+	if udpLen := int(binary.BigEndian.Uint16(ndata[4:6])); udpLen >= 8 && udpLen < len(ndata) {
+		ndata = ndata[:udpLen]
+	}
+	if !allowEmpty && len(ndata) == 8 {
+		return EmptyPacket("")
+	}
+
+	pckt.UDP = true
+	pckt.setIPs(netLayer)
+	pckt.CaptureLength = cp.CaptureLength
+	pckt.SrcPort = binary.BigEndian.Uint16(ndata[0:2])
+	pckt.DstPort = binary.BigEndian.Uint16(ndata[2:4])
+	pckt.Lost = uint32(cp.Length - cp.CaptureLength)
+	pckt.Payload = ndata[8:]
+
+	return nil
+}
+
+func (pckt *Packet) setIPs(netLayer []byte) {
+	if (netLayer[0] >> 4) == 4 {
+		// IPv4 header
+		pckt.Version = 4
+		pckt.SrcIP = netLayer[12:16]
+		pckt.DstIP = netLayer[16:20]
+	} else {
+		// IPv6 header
+		pckt.Version = 6
+		pckt.SrcIP = netLayer[8:24]
+		pckt.DstIP = netLayer[24:40]
+	}
+}
+
+// Endpoint is an address and a port of one side of a tcp connection. IPv4
+// addresses are kept in IPv6-mapped form, so endpoints of both families are
+// compared by all 128 bits of the address.
+type Endpoint struct {
+	IP   [16]byte
+	Port uint16
+}
+
+func newEndpoint(ip net.IP, port uint16) (e Endpoint) {
+	if len(ip) == net.IPv4len {
+		e.IP[10], e.IP[11] = 0xff, 0xff
+		copy(e.IP[12:], ip)
+	} else {
+		copy(e.IP[:], ip)
+	}
+	e.Port = port
+	return
+}
+
+// less orders endpoints, it is used to build ConnID
+func (e Endpoint) less(o Endpoint) bool {
+	if c := bytes.Compare(e.IP[:], o.IP[:]); c != 0 {
+		return c < 0
+	}
+	return e.Port < o.Port
+}
+
+// appendTo appends the address (4 bytes for IPv4) and the port to b
+func (e Endpoint) appendTo(b []byte) []byte {
+	ip := net.IP(e.IP[:])
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	b = append(b, ip...)
+	return binary.BigEndian.AppendUint16(b, e.Port)
+}
+
+// FlowID identifies one direction of a tcp connection
+type FlowID struct {
+	Src, Dst Endpoint
+}
+
+// ConnID identifies a tcp connection, it is the same for both directions
+type ConnID FlowID
+
+// hash distributes connections between workers of MessageParser, it mixes
+// the addresses 8 bytes at a time like FNV-1a does bytes
+func (id ConnID) hash() uint32 {
+	const prime = 1099511628211
+	h := uint64(14695981039346656037) ^ (uint64(id.Src.Port)<<16 | uint64(id.Dst.Port))
+	for _, ip := range [2][16]byte{id.Src.IP, id.Dst.IP} {
+		h = (h ^ binary.LittleEndian.Uint64(ip[:8])) * prime
+		h = (h ^ binary.LittleEndian.Uint64(ip[8:])) * prime
+	}
+	return uint32(h ^ h>>32)
+}
+
+// MessageID identifies a message, all packets of a message are sent in the same
+// direction and acknowledge the same sequence number
+type MessageID struct {
+	FlowID
+	Ack uint32
+}
+
+// Flow returns the ID of the direction of the connection of the packet
+func (pckt *Packet) Flow() FlowID {
+	return FlowID{newEndpoint(pckt.SrcIP, pckt.SrcPort), newEndpoint(pckt.DstIP, pckt.DstPort)}
+}
+
+// MessageID returns the ID of the message of the packet
+func (pckt *Packet) MessageID() MessageID {
+	// All packets in the same message will share the same ID
+	return MessageID{pckt.Flow(), pckt.Ack}
+}
+
+// ConnID returns the ID of the tcp connection of the packet, it is the same
+// for both directions of the connection
+func (pckt *Packet) ConnID() ConnID {
+	flow := pckt.Flow()
+	if flow.Dst.less(flow.Src) {
+		flow.Src, flow.Dst = flow.Dst, flow.Src
 	}
+	return ConnID(flow)
+}
+
+// connUUID returns hex encoded ID of a connection from the client to the server
+func connUUID(client, server Endpoint) []byte {
+	id := make([]byte, 0, 2*(16+2))
+	id = client.appendTo(id)
+	id = server.appendTo(id)
 
-	return pckt.messageID
+	uuidHex := make([]byte, hex.EncodedLen(len(id)))
+	hex.Encode(uuidHex, id)
+	return uuidHex
+}
+
+// streamUUID returns hex encoded ID of a stream of a connection from the
+// client to the server, e.g. a request and its response. It starts with the
+// connection ID, it is 32 characters long for IPv4 and 80 for IPv6 connections.
+func streamUUID(client, server Endpoint, streamID uint32) []byte {
+	var stream [4]byte
+	binary.BigEndian.PutUint32(stream[:], streamID)
+	return append(connUUID(client, server), hex.EncodeToString(stream[:])...)
+}
+
+// Raw returns the network layer packet (IP and TCP headers and the payload) as
+// it was captured, link layer headers of different interfaces may differ.
+func (pckt *Packet) Raw() []byte {
+	return pckt.raw
 }
 
 // Src returns the source socket of a packet
@@ -271,14 +413,3 @@ func ipv6ExtensionHdr(b byte) bool {
 	// TODO: support all extension headers
 	return b == 0 || b == 43 || b == 44
 }
-
-func ip2int(ip net.IP) uint32 {
-	if len(ip) == 0 {
-		return 0
-	}
-
-	if len(ip) == 16 {
-		return binary.BigEndian.Uint32(ip[12:16])
-	}
-	return binary.BigEndian.Uint32(ip)
-}
@@ -3,9 +3,13 @@ package tcp
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"github.com/buger/goreplay/proto"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
 
-	// "runtime"
 	"testing"
 	"time"
 
@@ -106,6 +110,12 @@ func TestRequestResponseMapping(t *testing.T) {
 	assert.Equal(t, messages[2].UUID(), messages[3].UUID())
 
 	assert.NotEqual(t, messages[0].UUID(), messages[2].UUID())
+
+	for i, m := range messages {
+		assert.Equal(t, uint32(i/2+1), m.Seq)
+		assert.True(t, bytes.HasPrefix(m.UUID(), m.ConnUUID()))
+		assert.Equal(t, messages[0].ConnUUID(), m.ConnUUID())
+	}
 }
 
 func TestMessageParserWithHint(t *testing.T) {
@@ -231,6 +241,57 @@ func TestMessageTimeoutReached(t *testing.T) {
 	}
 }
 
+func TestMessageParserIPv6Collision(t *testing.T) {
+	// the last 4 bytes of the client addresses are the same
+	client1 := net.ParseIP("2001:db8::1:c0a8:1")
+	client2 := net.ParseIP("2001:db8::2:c0a8:1")
+	server := net.ParseIP("2001:db8::80")
+
+	var packets []*Packet
+	for _, client := range []net.IP{client1, client2} {
+		packets = append(packets,
+			&Packet{SrcIP: client, DstIP: server, SrcPort: 60000, DstPort: 80, Ack: 1, Seq: 1, Direction: DirIncoming, Timestamp: time.Unix(1, 0), Payload: []byte("GET / HTTP/1.1\r\n")},
+			&Packet{SrcIP: server, DstIP: client, SrcPort: 80, DstPort: 60000, Ack: 36, Seq: 1, Direction: DirOutcoming, Timestamp: time.Unix(3, 0), Payload: []byte("HTTP/1.1 200 OK\r\n")},
+		)
+	}
+	// interleave packets of both connections
+	packets = append(packets,
+		&Packet{SrcIP: client2, DstIP: server, SrcPort: 60000, DstPort: 80, Ack: 1, Seq: 17, Direction: DirIncoming, Timestamp: time.Unix(2, 0), Payload: []byte("Host: two\r\n\r\n")},
+		&Packet{SrcIP: client1, DstIP: server, SrcPort: 60000, DstPort: 80, Ack: 1, Seq: 17, Direction: DirIncoming, Timestamp: time.Unix(2, 0), Payload: []byte("Host: one\r\n\r\n")},
+		&Packet{SrcIP: server, DstIP: client1, SrcPort: 80, DstPort: 60000, Ack: 36, Seq: 18, Direction: DirOutcoming, Timestamp: time.Unix(4, 0), Payload: []byte("Content-Length: 3\r\n\r\none")},
+		&Packet{SrcIP: server, DstIP: client2, SrcPort: 80, DstPort: 60000, Ack: 36, Seq: 18, Direction: DirOutcoming, Timestamp: time.Unix(4, 0), Payload: []byte("Content-Length: 3\r\n\r\ntwo")},
+	)
+
+	if packets[0].ConnID() == packets[2].ConnID() || packets[0].ConnID() != packets[1].ConnID() {
+		t.Error("connections should be identified by full addresses")
+	}
+
+	parser := NewMessageParser(nil, nil, nil, time.Second, false)
+	parser.Start = func(pckt *Packet) (bool, bool) {
+		return proto.HasRequestTitle(pckt.Payload), proto.HasResponseTitle(pckt.Payload)
+	}
+	parser.End = func(m *Message) bool {
+		return proto.HasFullPayload(m, m.PacketData()...)
+	}
+	for _, packet := range packets {
+		parser.processPacket(packet)
+	}
+
+	byID := make(map[string][]string)
+	for i := 0; i < 4; i++ {
+		m := parser.Read()
+		byID[string(m.UUID())] = append(byID[string(m.UUID())], string(m.Data()))
+	}
+	if len(byID) != 2 {
+		t.Fatalf("expected 2 pairs, got %q", byID)
+	}
+	for _, pair := range byID {
+		if len(pair) != 2 || !strings.HasSuffix(pair[0], "Host: "+pair[1][len(pair[1])-3:]+"\r\n\r\n") {
+			t.Errorf("request and response of different clients are paired: %q", pair)
+		}
+	}
+}
+
 func BenchmarkMessageUUID(b *testing.B) {
 	packets := GetPackets(true, 1, 5, nil)
 
@@ -313,3 +374,401 @@ func BenchmarkNewAndParsePacket(b *testing.B) {
 		ParsePacket(data, int(layers.LinkTypeLoop), 4, &gopacket.CaptureInfo{}, true)
 	}
 }
+
+func TestMessageParserStreamReassembly(t *testing.T) {
+	var got []byte
+	var dirs []Dir
+	parser := NewMessageParser(nil, []uint16{80}, nil, time.Second, false)
+	parser.Stream = func(c *Conn, pckt *Packet, data []byte) {
+		got = append(got, data...)
+		dirs = append(dirs, c.Dir(pckt))
+		if bytes.HasSuffix(got, []byte("!")) {
+			c.Emit(c.Dir(pckt), 7, got, []*Packet{pckt})
+		}
+	}
+
+	packets := []*Packet{
+		{SrcPort: 60000, DstPort: 80, Seq: 1, SYN: true, Direction: DirIncoming, Timestamp: time.Unix(1, 0)},
+		{SrcPort: 60000, DstPort: 80, Seq: 8, Direction: DirIncoming, Timestamp: time.Unix(2, 0), Payload: []byte("world")},
+		{SrcPort: 60000, DstPort: 80, Seq: 2, Direction: DirIncoming, Timestamp: time.Unix(3, 0), Payload: []byte("hello ")},
+		// retransmission overlapping already delivered data
+		{SrcPort: 60000, DstPort: 80, Seq: 5, Direction: DirIncoming, Timestamp: time.Unix(4, 0), Payload: []byte("lo world!")},
+	}
+	for _, p := range packets {
+		parser.processPacket(p)
+	}
+
+	m := parser.Read()
+	if string(m.Data()) != "hello world!" {
+		t.Errorf("expected %q to equal %q", m.Data(), "hello world!")
+	}
+	if m.Direction != DirIncoming {
+		t.Error("expected incoming message")
+	}
+	for _, d := range dirs {
+		if d != DirIncoming {
+			t.Error("expected all data to be incoming")
+		}
+	}
+}
+
+// gapState records gaps of the connection
+type gapState struct {
+	gaps []Dir
+}
+
+func (st *gapState) SkipGap(c *Conn, dir Dir) {
+	st.gaps = append(st.gaps, dir)
+}
+
+func TestMessageParserStreamGap(t *testing.T) {
+	var got []byte
+	st := new(gapState)
+	parser := NewMessageParser(nil, []uint16{80}, nil, time.Second, false)
+	parser.Stream = func(c *Conn, pckt *Packet, data []byte) {
+		c.SetProtocolState(st)
+		got = append(got, data...)
+		if bytes.HasSuffix(got, []byte("!")) {
+			c.Emit(c.Dir(pckt), 7, got, []*Packet{pckt})
+		}
+	}
+
+	packets := []*Packet{
+		{SrcPort: 60000, DstPort: 80, Seq: 1, Direction: DirIncoming, Timestamp: time.Now(), Payload: []byte("hello ")},
+		// "lost " was not captured
+		{SrcPort: 60000, DstPort: 80, Seq: 12, Direction: DirIncoming, Timestamp: time.Now(), Payload: []byte("world!")},
+	}
+	for _, p := range packets {
+		parser.processPacket(p)
+	}
+	shard := parser.shard(packets[0].ConnID())
+	shard.timer(time.Now())
+	if len(parser.messages) != 0 || len(st.gaps) != 0 {
+		t.Fatal("the gap should be waited for until the message expiration time")
+	}
+
+	shard.timer(time.Now().Add(2 * time.Second))
+	m := parser.Read()
+	if string(m.Data()) != "hello world!" {
+		t.Errorf("expected %q to equal %q", m.Data(), "hello world!")
+	}
+	if len(st.gaps) != 1 || st.gaps[0] != DirIncoming {
+		t.Errorf("expected the gap of incoming data, got %v", st.gaps)
+	}
+}
+
+func TestParsePacketUDP(t *testing.T) {
+	payload := []byte("query")
+	data := make([]byte, 4+20+8, 4+20+8+len(payload)+3)
+	binary.BigEndian.PutUint32(data, uint32(layers.ProtocolFamilyIPv4))
+	ip := data[4:]
+	ip[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+8+len(payload)))
+	ip[9] = uint8(layers.IPProtocolUDP)
+	copy(ip[12:16], []byte{10, 0, 0, 1})
+	copy(ip[16:20], []byte{10, 0, 0, 2})
+	udp := ip[20:]
+	binary.BigEndian.PutUint16(udp, 40000)
+	binary.BigEndian.PutUint16(udp[2:], 53)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	// ethernet padding after the datagram
+	data = append(append(data, payload...), 0, 0, 0)
+
+	ci := &gopacket.CaptureInfo{Length: len(data), CaptureLength: len(data), Timestamp: time.Now()}
+	pckt, err := ParsePacket(data, int(layers.LinkTypeLoop), 4, ci, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pckt.UDP || pckt.SrcPort != 40000 || pckt.DstPort != 53 || string(pckt.Payload) != "query" {
+		t.Errorf("wrong datagram %+v", pckt)
+	}
+	if pckt.Src() != "10.0.0.1:40000" || pckt.Dst() != "10.0.0.2:53" {
+		t.Errorf("wrong addresses %s %s", pckt.Src(), pckt.Dst())
+	}
+
+	// TCP parsers skip datagrams
+	parser := NewMessageParser(nil, []uint16{53}, nil, time.Second, false)
+	if parser.parsePacket(&PcapPacket{Data: data, LType: int(layers.LinkTypeLoop), LTypeLen: 4, Ci: ci}) != nil {
+		t.Error("datagram should be skipped without Datagram hint")
+	}
+}
+
+func TestMessageParserDatagram(t *testing.T) {
+	parser := NewMessageParser(nil, []uint16{53}, nil, time.Second, false)
+	// the first byte is the key, the second tells if it is a response
+	parser.Datagram = func(pckt *Packet) (uint32, Dir, bool) {
+		if len(pckt.Payload) < 2 {
+			return 0, DirUnknown, false
+		}
+		if pckt.Payload[1] == 'r' {
+			return uint32(pckt.Payload[0]), DirOutcoming, true
+		}
+		return uint32(pckt.Payload[0]), DirIncoming, true
+	}
+
+	client := net.IPv4(10, 0, 0, 1).To4()
+	server := net.IPv4(10, 0, 0, 2).To4()
+	datagram := func(payload string) *Packet {
+		if strings.HasSuffix(payload, "r") {
+			return &Packet{UDP: true, SrcIP: server, DstIP: client, SrcPort: 53, DstPort: 40000, Timestamp: time.Now(), Payload: []byte(payload)}
+		}
+		return &Packet{UDP: true, SrcIP: client, DstIP: server, SrcPort: 40000, DstPort: 53, Timestamp: time.Now(), Payload: []byte(payload)}
+	}
+	for _, payload := range []string{"1q", "2q", "3r", "2r", "1r", "x"} {
+		parser.processPacket(datagram(payload))
+	}
+
+	var messages []*Message
+	for i := 0; i < 4; i++ {
+		messages = append(messages, parser.Read())
+	}
+	if string(messages[2].Data()) != "2r" || string(messages[3].Data()) != "1r" {
+		t.Fatalf("unexpected responses %q %q", messages[2].Data(), messages[3].Data())
+	}
+	if !bytes.Equal(messages[0].UUID(), messages[3].UUID()) || !bytes.Equal(messages[1].UUID(), messages[2].UUID()) ||
+		bytes.Equal(messages[0].UUID(), messages[1].UUID()) {
+		t.Error("responses should have ids of their requests")
+	}
+	if messages[0].Seq != 1 || messages[1].Seq != 2 || messages[3].Seq != 1 || messages[2].Direction != DirOutcoming {
+		t.Errorf("wrong sequence numbers %d %d %d", messages[0].Seq, messages[1].Seq, messages[3].Seq)
+	}
+	if !bytes.Equal(messages[0].ConnUUID(), messages[3].ConnUUID()) {
+		t.Error("request and response should share the connection id")
+	}
+	select {
+	case m := <-parser.messages:
+		t.Errorf("unexpected message %q", m.Data())
+	default:
+	}
+}
+
+// connPackets builds a request with a body of size bytes and its response on
+// the connection of the client port
+func connPackets(clientPort uint16, size int) []*PcapPacket {
+	request := []byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: " + strconv.Itoa(size) + "\r\n\r\n" + strings.Repeat("a", size))
+	response := []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	build := func(fromClient bool, seq, ack uint32, payload []byte) *PcapPacket {
+		data := append(generateHeader(fromClient, seq, uint16(len(payload))), payload...)
+		tcp := data[4+24:]
+		if fromClient {
+			binary.BigEndian.PutUint16(tcp, clientPort)
+		} else {
+			binary.BigEndian.PutUint16(tcp[2:], clientPort)
+		}
+		binary.BigEndian.PutUint32(tcp[8:], ack)
+		ci := &gopacket.CaptureInfo{Length: len(data), CaptureLength: len(data), Timestamp: time.Now()}
+		return &PcapPacket{Data: data, LType: int(layers.LinkTypeLoop), LTypeLen: 4, Ci: ci}
+	}
+	return []*PcapPacket{
+		build(true, 1, 1, request),
+		build(false, 1, 1+uint32(len(request)), response),
+	}
+}
+
+// newHTTPParser returns a parser grouping HTTP messages by Ack
+func newHTTPParser(workers int) *MessageParser {
+	parser := NewMessageParser(nil, []uint16{8000}, nil, time.Second, false)
+	parser.Workers = workers
+	parser.Start = func(pckt *Packet) (bool, bool) {
+		return proto.HasRequestTitle(pckt.Payload), proto.HasResponseTitle(pckt.Payload)
+	}
+	parser.End = func(m *Message) bool {
+		return proto.HasFullPayload(m, m.PacketData()...)
+	}
+	return parser
+}
+
+func TestMessageParserWorkers(t *testing.T) {
+	parser := newHTTPParser(4)
+	defer parser.Close()
+
+	const conns = 100
+	for port := uint16(1); port <= conns; port++ {
+		for _, p := range connPackets(port, int(port)) {
+			parser.PacketHandler(p)
+		}
+	}
+
+	pairs := make(map[string][]*Message)
+	for i := 0; i < 2*conns; i++ {
+		select {
+		case m := <-parser.messages:
+			pairs[string(m.UUID())] = append(pairs[string(m.UUID())], m)
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d messages, got %d", 2*conns, i)
+		}
+	}
+	if len(pairs) != conns {
+		t.Fatalf("expected %d pairs, got %d", conns, len(pairs))
+	}
+	for _, pair := range pairs {
+		if len(pair) != 2 || pair[0].Direction != DirIncoming || pair[1].Direction != DirOutcoming {
+			t.Fatal("the response should follow its request")
+		}
+		if pair[0].Seq != 1 || pair[1].Seq != 1 || !bytes.Equal(pair[0].ConnUUID(), pair[1].ConnUUID()) {
+			t.Errorf("wrong pair %d %d", pair[0].Seq, pair[1].Seq)
+		}
+	}
+}
+
+func TestMessageParserFlushClose(t *testing.T) {
+	parser := newHTTPParser(2)
+	// messages are emitted only when they expire
+	parser.End = nil
+	for _, p := range connPackets(1, 10) {
+		parser.PacketHandler(p)
+	}
+	parser.Flush()
+	if len(parser.messages) != 2 {
+		t.Errorf("expected 2 flushed messages, got %d", len(parser.messages))
+	}
+	parser.Close()
+	// packets after Close are dropped
+	for i := 0; i < packetQueueSize+1; i++ {
+		parser.PacketHandler(connPackets(2, 10)[0])
+	}
+
+	// closed before the first packet
+	parser = newHTTPParser(2)
+	parser.Close()
+	parser.PacketHandler(connPackets(1, 10)[0])
+	parser.Flush()
+	// messages are not read anymore
+	parser = newHTTPParser(1)
+	parser.messages = make(chan *Message)
+	for _, p := range connPackets(1, 10) {
+		parser.PacketHandler(p)
+	}
+	time.Sleep(50 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		parser.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("Close should not wait for the reader of messages")
+	}
+}
+
+func BenchmarkMessageParserWorkers(b *testing.B) {
+	const conns = 256
+	var packets []*PcapPacket
+	for port := uint16(1); port <= conns; port++ {
+		packets = append(packets, connPackets(port, 4096)...)
+	}
+
+	workers := []int{1, 2, 4}
+	if n := runtime.NumCPU(); n > 4 {
+		workers = append(workers, n)
+	}
+	for _, n := range workers {
+		b.Run(fmt.Sprintf("workers=%d", n), func(b *testing.B) {
+			parser := newHTTPParser(n)
+			defer parser.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, p := range packets {
+					parser.PacketHandler(p)
+				}
+				for range packets {
+					parser.Read()
+				}
+			}
+			b.ReportMetric(float64(len(packets)), "packets/op")
+		})
+	}
+}
+
+func BenchmarkConnIDHash(b *testing.B) {
+	pckt := GetPackets(true, 1, 1, nil)[0]
+	var h uint32
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h += pckt.ConnID().hash()
+	}
+	_ = h
+}
+
+func TestSampler(t *testing.T) {
+	packet := func(client net.IP, clientPort uint16, request bool) *Packet {
+		server := net.IPv4(10, 1, 0, 1).To4()
+		if request {
+			return &Packet{SrcIP: client, DstIP: server, SrcPort: clientPort, DstPort: 80, Direction: DirIncoming}
+		}
+		return &Packet{SrcIP: server, DstIP: client, SrcPort: 80, DstPort: clientPort, Direction: DirOutcoming}
+	}
+
+	sampler := NewSampler(10, false)
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		client := net.IPv4(10, 0, byte(i>>8), byte(i)).To4()
+		port := uint16(30000 + i%1000)
+		keep := sampler.Keep(packet(client, port, true))
+		if keep != sampler.Keep(packet(client, port, false)) {
+			t.Fatal("both directions of a connection should be sampled together")
+		}
+		if keep {
+			kept++
+		}
+	}
+	if kept < 800 || kept > 1200 {
+		t.Errorf("expected about 1000 sampled connections, got %d", kept)
+	}
+
+	byClient := NewSampler(50, true)
+	for i := 0; i < 100; i++ {
+		client := net.IPv4(10, 0, 0, byte(i)).To4()
+		keep := byClient.Keep(packet(client, 40000, true))
+		for port := uint16(40001); port < 40010; port++ {
+			if byClient.Keep(packet(client, port, true)) != keep || byClient.Keep(packet(client, port, false)) != keep {
+				t.Fatal("connections of a client should be sampled together")
+			}
+		}
+	}
+
+	if NewSampler(0, false).Keep(packet(net.IPv4(10, 0, 0, 1), 1, true)) || !NewSampler(100, false).Keep(packet(net.IPv4(10, 0, 0, 1), 1, true)) {
+		t.Error("0% should skip and 100% should keep all connections")
+	}
+}
+
+func TestMessageParserSampler(t *testing.T) {
+	parser := newHTTPParser(1)
+	defer parser.Close()
+	parser.Sampler = NewSampler(50, false)
+
+	expected := 0
+	for port := uint16(1); port <= 100; port++ {
+		packets := connPackets(port, 10)
+		if parser.Sampler.Keep(parser.parsePacket(packets[0])) {
+			expected += 2
+		}
+		for _, p := range packets {
+			parser.PacketHandler(p)
+		}
+	}
+	if expected == 0 || expected == 200 {
+		t.Fatalf("unexpected sample of %d messages", expected)
+	}
+
+	pairs := make(map[string]int)
+	for i := 0; i < expected; i++ {
+		select {
+		case m := <-parser.messages:
+			pairs[string(m.UUID())]++
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d messages, got %d", expected, i)
+		}
+	}
+	for id, n := range pairs {
+		if n != 2 {
+			t.Errorf("request and response of %s should be sampled together", id)
+		}
+	}
+	select {
+	case m := <-parser.messages:
+		t.Errorf("unexpected message %q", m.Data())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,58 @@
+// Package tcptest builds tcp packets for tests of the protocol parsers.
+package tcptest
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/buger/goreplay/internal/tcp"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ClientPort is the source port of the packets sent by the client
+const ClientPort = 40000
+
+var (
+	ClientIP = net.IPv4(10, 0, 0, 1).To4()
+	ServerIP = net.IPv4(10, 0, 0, 2).To4()
+)
+
+// Packet builds loopback IPv4 packet between ClientIP:ClientPort and
+// ServerIP:port
+func Packet(fromClient bool, port uint16, seq, ack uint32, payload []byte) *tcp.PcapPacket {
+	data := make([]byte, 4+20+20, 4+20+20+len(payload))
+	binary.BigEndian.PutUint32(data, uint32(layers.ProtocolFamilyIPv4))
+
+	ip := data[4:]
+	ip[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(ip[2:4], uint16(40+len(payload)))
+	ip[9] = uint8(layers.IPProtocolTCP)
+
+	t := ip[20:]
+	t[12] = 5 << 4
+	t[13] = 0x18 // PSH, ACK
+	if fromClient {
+		copy(ip[12:16], ClientIP)
+		copy(ip[16:20], ServerIP)
+		binary.BigEndian.PutUint16(t, ClientPort)
+		binary.BigEndian.PutUint16(t[2:], port)
+	} else {
+		copy(ip[12:16], ServerIP)
+		copy(ip[16:20], ClientIP)
+		binary.BigEndian.PutUint16(t, port)
+		binary.BigEndian.PutUint16(t[2:], ClientPort)
+	}
+	binary.BigEndian.PutUint32(t[4:], seq)
+	binary.BigEndian.PutUint32(t[8:], ack)
+	data = append(data, payload...)
+
+	return &tcp.PcapPacket{
+		Data:     data,
+		LType:    int(layers.LinkTypeLoop),
+		LTypeLen: 4,
+		Ci:       &gopacket.CaptureInfo{Length: len(data), CaptureLength: len(data), Timestamp: time.Now()},
+	}
+}
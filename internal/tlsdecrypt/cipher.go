@@ -0,0 +1,195 @@
+package tlsdecrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+var errShortRecord = errors.New("tls: short encrypted record")
+
+// suite describes AEAD cipher suite
+type suite struct {
+	keyLen int
+	ivLen  int // fixed part of nonce
+	hash   func() hash.Hash
+	chacha bool
+}
+
+// suites are the supported cipher suites, CBC suites are not supported
+var suites = map[uint16]*suite{
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:               {16, 4, sha256.New, false},
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:               {32, 4, sha512.New384, false},
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:         {16, 4, sha256.New, false},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:       {16, 4, sha256.New, false},
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:         {32, 4, sha512.New384, false},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:       {32, 4, sha512.New384, false},
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:   {32, 12, sha256.New, true},
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256: {32, 12, sha256.New, true},
+	tls.TLS_AES_128_GCM_SHA256:                        {16, 12, sha256.New, false},
+	tls.TLS_AES_256_GCM_SHA384:                        {32, 12, sha512.New384, false},
+	tls.TLS_CHACHA20_POLY1305_SHA256:                  {32, 12, sha256.New, true},
+}
+
+func (s *suite) aead(key []byte) (cipher.AEAD, error) {
+	if s.chacha {
+		return chacha20poly1305.New(key)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// recordCipher decrypts records of one direction of a connection
+type recordCipher struct {
+	suite         *suite
+	aead          cipher.AEAD
+	iv            []byte
+	seq           uint64
+	tls13         bool
+	explicitNonce bool   // TLS 1.2 AES-GCM records carry 8 bytes of the nonce
+	secret        []byte // TLS 1.3 traffic secret
+}
+
+// newCipher12 returns cipher of TLS 1.2 connection
+func newCipher12(s *suite, key, iv []byte) (*recordCipher, error) {
+	aead, err := s.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	return &recordCipher{suite: s, aead: aead, iv: iv, explicitNonce: !s.chacha}, nil
+}
+
+// newCipher13 returns cipher of TLS 1.3 connection using the traffic secret
+func newCipher13(s *suite, secret []byte) (*recordCipher, error) {
+	aead, err := s.aead(expandLabel(s.hash, secret, "key", s.keyLen))
+	if err != nil {
+		return nil, err
+	}
+	return &recordCipher{
+		suite:  s,
+		aead:   aead,
+		iv:     expandLabel(s.hash, secret, "iv", s.ivLen),
+		tls13:  true,
+		secret: secret,
+	}, nil
+}
+
+// update switches to the next traffic secret after KeyUpdate message
+func (rc *recordCipher) update() (*recordCipher, error) {
+	return newCipher13(rc.suite, expandLabel(rc.suite.hash, rc.secret, "traffic upd", rc.suite.hash().Size()))
+}
+
+// open decrypts a record (including its header), it returns the plaintext and
+// its content type
+func (rc *recordCipher) open(record []byte) (plain []byte, typ uint8, err error) {
+	header, payload := record[:recordHeaderLen], record[recordHeaderLen:]
+	typ = header[0]
+
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], rc.seq)
+
+	var nonce []byte
+	if rc.explicitNonce {
+		if len(payload) < 8 {
+			return nil, 0, errShortRecord
+		}
+		nonce = append(rc.iv[:len(rc.iv):len(rc.iv)], payload[:8]...)
+		payload = payload[8:]
+	} else {
+		nonce = append([]byte(nil), rc.iv...)
+		for i, b := range seq {
+			nonce[len(nonce)-8+i] ^= b
+		}
+	}
+	if len(payload) < rc.aead.Overhead() {
+		return nil, 0, errShortRecord
+	}
+
+	additionalData := header
+	if !rc.tls13 {
+		additionalData = make([]byte, 0, 13)
+		additionalData = append(additionalData, seq[:]...)
+		additionalData = append(additionalData, header[:3]...)
+		additionalData = binary.BigEndian.AppendUint16(additionalData, uint16(len(payload)-rc.aead.Overhead()))
+	}
+
+	plain, err = rc.aead.Open(nil, nonce, payload, additionalData)
+	if err != nil {
+		return nil, 0, err
+	}
+	rc.seq++
+
+	if rc.tls13 {
+		// the content type follows the content, then zero padding
+		i := len(plain) - 1
+		for i >= 0 && plain[i] == 0 {
+			i--
+		}
+		if i < 0 {
+			return nil, 0, errShortRecord
+		}
+		typ = plain[i]
+		plain = plain[:i]
+	}
+	return
+}
+
+// expandLabel is HKDF-Expand-Label function of TLS 1.3, with empty context
+func expandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+
+	out := make([]byte, length)
+	io.ReadFull(hkdf.Expand(h, secret, info), out)
+	return out
+}
+
+// prf12 is the pseudorandom function of TLS 1.2
+func prf12(h func() hash.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	labelAndSeed := append([]byte(label), seed...)
+	out := make([]byte, 0, length+h().Size())
+
+	mac := hmac.New(h, secret)
+	mac.Write(labelAndSeed)
+	a := mac.Sum(nil)
+	for len(out) < length {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(labelAndSeed)
+		out = mac.Sum(out)
+
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return out[:length]
+}
+
+// keys12 derives keys of TLS 1.2 connection from the master secret
+func keys12(s *suite, masterSecret, clientRandom, serverRandom []byte) (clientKey, serverKey, clientIV, serverIV []byte) {
+	seed := append(append([]byte(nil), serverRandom...), clientRandom...)
+	block := prf12(s.hash, masterSecret, "key expansion", seed, 2*s.keyLen+2*s.ivLen)
+
+	clientKey, block = block[:s.keyLen], block[s.keyLen:]
+	serverKey, block = block[:s.keyLen], block[s.keyLen:]
+	clientIV, block = block[:s.ivLen], block[s.ivLen:]
+	serverIV = block[:s.ivLen]
+	return
+}
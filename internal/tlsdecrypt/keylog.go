@@ -0,0 +1,154 @@
+package tlsdecrypt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Labels of NSS key log file lines, see
+// https://firefox-source-docs.mozilla.org/security/nss/legacy/key_log_format/index.html
+const (
+	LabelTLS12           = "CLIENT_RANDOM"
+	LabelClientHandshake = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	LabelServerHandshake = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	LabelClientTraffic   = "CLIENT_TRAFFIC_SECRET_0"
+	LabelServerTraffic   = "SERVER_TRAFFIC_SECRET_0"
+)
+
+const (
+	// maxKeyLogLineLen is used to skip garbage, valid lines are much shorter
+	maxKeyLogLineLen = 1024
+	// keyLogReloadInterval is the minimum time between reads of the file
+	keyLogReloadInterval = 100 * time.Millisecond
+	// keyLogMaxAge is the time after which secrets of sessions which were
+	// not seen in the capture are forgotten
+	keyLogMaxAge = 10 * time.Minute
+)
+
+// KeyLog holds secrets read from NSS key log file, as written by SSLKEYLOGFILE
+// of browsers and curl, or tls.Config.KeyLogWriter. Applications keep appending
+// to the file, new lines are read from the last offset whenever a secret is
+// not known yet, at most every keyLogReloadInterval.
+type KeyLog struct {
+	sync.Mutex
+	path    string
+	offset  int64
+	loaded  time.Time
+	pruned  time.Time
+	secrets map[string]*keyLogSession // by client random
+}
+
+// keyLogSession holds secrets of a TLS session by their label
+type keyLogSession struct {
+	secrets map[string][]byte
+	added   time.Time
+}
+
+// OpenKeyLog reads key log file at path
+func OpenKeyLog(path string) (*KeyLog, error) {
+	k := &KeyLog{path: path, secrets: make(map[string]*keyLogSession)}
+	return k, k.load()
+}
+
+// Secret returns the secret with given label of the session identified by
+// client random, or nil if it was not logged.
+func (k *KeyLog) Secret(clientRandom []byte, label string) []byte {
+	k.Lock()
+	defer k.Unlock()
+
+	if secret := k.secret(clientRandom, label); secret != nil {
+		return secret
+	}
+	if time.Since(k.loaded) < keyLogReloadInterval {
+		return nil
+	}
+	if err := k.load(); err != nil {
+		stats.Add("keylog_error", 1)
+		return nil
+	}
+	return k.secret(clientRandom, label)
+}
+
+func (k *KeyLog) secret(clientRandom []byte, label string) []byte {
+	if session, ok := k.secrets[string(clientRandom)]; ok {
+		return session.secrets[label]
+	}
+	return nil
+}
+
+// Forget removes secrets of a session which are no longer needed
+func (k *KeyLog) Forget(clientRandom []byte) {
+	k.Lock()
+	delete(k.secrets, string(clientRandom))
+	k.Unlock()
+}
+
+// load reads lines appended since the previous load and forgets old secrets
+func (k *KeyLog) load() error {
+	k.loaded = time.Now()
+	if k.loaded.Sub(k.pruned) > keyLogMaxAge/10 {
+		k.pruned = k.loaded
+		for random, session := range k.secrets {
+			if k.loaded.Sub(session.added) > keyLogMaxAge {
+				stats.Add("keylog_expired", 1)
+				delete(k.secrets, random)
+			}
+		}
+	}
+
+	f, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < k.offset {
+		// the file was truncated
+		k.offset = 0
+	}
+	if _, err = f.Seek(k.offset, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	// the last line may be still being written
+	n := bytes.LastIndexByte(data, '\n') + 1
+	k.parse(data[:n])
+	k.offset += int64(n)
+	return nil
+}
+
+func (k *KeyLog) parse(data []byte) {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		fields := bytes.Fields(line)
+		if len(line) > maxKeyLogLineLen || len(fields) != 3 || fields[0][0] == '#' {
+			continue
+		}
+		random, err := hex.DecodeString(string(fields[1]))
+		if err != nil {
+			continue
+		}
+		secret, err := hex.DecodeString(string(fields[2]))
+		if err != nil {
+			continue
+		}
+
+		session, ok := k.secrets[string(random)]
+		if !ok {
+			session = &keyLogSession{secrets: make(map[string][]byte), added: k.loaded}
+			k.secrets[string(random)] = session
+		}
+		session.secrets[string(fields[0])] = secret
+	}
+}
@@ -0,0 +1,414 @@
+/*
+Package tlsdecrypt decrypts TLS connections reassembled by tcp.MessageParser,
+using secrets from NSS key log file (SSLKEYLOGFILE).
+
+TLS 1.2 and TLS 1.3 connections using AES-GCM or ChaCha20-Poly1305 cipher
+suites are supported. Decrypted application data is passed to another stream
+hint, so any stream based protocol parser can be used on top of it:
+
+	keys, err := tlsdecrypt.OpenKeyLog(os.Getenv("SSLKEYLOGFILE"))
+	parser.Stream = tlsdecrypt.Hint(keys, http2.StreamHint)
+
+Connections which do not start with TLS handshake are passed as is.
+*/
+package tlsdecrypt // import github.com/buger/goreplay/internal/tlsdecrypt
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"expvar"
+	"time"
+
+	"github.com/buger/goreplay/internal/tcp"
+)
+
+var stats *expvar.Map
+
+func init() {
+	stats = expvar.NewMap("tls")
+	stats.Init()
+}
+
+// record content types
+const (
+	recordChangeCipherSpec = 20
+	recordHandshake        = 22
+	recordApplicationData  = 23
+)
+
+// handshake message types
+const (
+	typeClientHello = 1
+	typeServerHello = 2
+	typeFinished    = 20
+	typeKeyUpdate   = 24
+)
+
+const (
+	recordHeaderLen       = 5
+	maxRecordLen          = 1<<14 + 2048
+	maxBufferedLen        = 1 << 20
+	extensionSupportedVer = 43
+)
+
+// helloRetryRequest is the random of ServerHello which is in fact HelloRetryRequest
+var helloRetryRequest = []byte{
+	0xCF, 0x21, 0xAD, 0x74, 0xE5, 0x9A, 0x61, 0x11, 0xBE, 0x1D, 0x8C, 0x02, 0x1E, 0x65, 0xB8, 0x91,
+	0xC2, 0xA2, 0x11, 0x16, 0x7A, 0xBB, 0x8C, 0x5E, 0x07, 0x9E, 0x09, 0xE2, 0xC8, 0xA8, 0x33, 0x9C,
+}
+
+// secretWait is how long records wait for secrets which were not logged yet,
+// applications can write the key log after the handshake messages were sent
+const secretWait = 2 * time.Second
+
+// side is decryption state of one direction of a connection
+type side struct {
+	buf     []byte
+	pckt    *tcp.Packet // the last packet of this side
+	hs      []byte      // incomplete handshake message
+	cipher  *recordCipher
+	app     bool // TLS 1.3 cipher uses application traffic secret
+	pending bool // TLS 1.3 application traffic secret was not logged yet
+}
+
+// state is TLS state of a connection
+type state struct {
+	keys  *KeyLog
+	next  tcp.HintStream
+	inner interface{} // protocol state of the next hint
+
+	started      bool
+	plain        bool // not a TLS connection
+	clientRandom []byte
+	serverRandom []byte
+	version      uint16
+	suite        *suite
+	sides        [2]side
+	missing      time.Time // when a secret was first missing from the key log
+}
+
+// Hint returns tcp.HintStream which decrypts TLS connections and passes the
+// decrypted application data to next
+func Hint(keys *KeyLog, next tcp.HintStream) tcp.HintStream {
+	return func(c *tcp.Conn, pckt *tcp.Packet, data []byte) {
+		st, ok := c.ProtocolState().(*state)
+		if !ok {
+			st = &state{keys: keys, next: next}
+			c.SetProtocolState(st)
+		}
+		st.handle(c, pckt, data)
+	}
+}
+
+// deliver passes plaintext to the next hint, which keeps its own protocol state
+func (st *state) deliver(c *tcp.Conn, pckt *tcp.Packet, data []byte) {
+	c.SetProtocolState(st.inner)
+	st.next(c, pckt, data)
+	st.inner = c.ProtocolState()
+	c.SetProtocolState(st)
+}
+
+func (st *state) handle(c *tcp.Conn, pckt *tcp.Packet, data []byte) {
+	dir := c.Dir(pckt)
+
+	if !st.started {
+		st.started = true
+		if len(data) <= recordHeaderLen || data[0] != recordHandshake || data[1] != 3 {
+			st.plain = true
+		} else if (dir == tcp.DirOutcoming && data[recordHeaderLen] == typeClientHello) ||
+			(dir == tcp.DirIncoming && data[recordHeaderLen] == typeServerHello) {
+			// The client could be mistaken for the server, e.g reading pcap file without known ports
+			c.Swap()
+			dir = c.Dir(pckt)
+		}
+	}
+	if st.plain {
+		st.deliver(c, pckt, data)
+		return
+	}
+
+	sd := &st.sides[dir-1]
+	if len(sd.buf)+len(data) > maxBufferedLen {
+		stats.Add("buffer_overflow", 1)
+		c.Broken = true
+		return
+	}
+	sd.buf = append(sd.buf, data...)
+	sd.pckt = pckt
+
+	st.process(c, dir, sd)
+	// records of the other side could wait for this handshake
+	if other := &st.sides[2-dir]; len(other.buf) > 0 {
+		st.process(c, 3-dir, other)
+	}
+}
+
+// Expire retries records which wait for secrets, and lets the next hint
+// expire its buffered data
+func (st *state) Expire(c *tcp.Conn, deadline time.Time) {
+	if !st.missing.IsZero() {
+		st.process(c, tcp.DirIncoming, &st.sides[0])
+		st.process(c, tcp.DirOutcoming, &st.sides[1])
+	}
+	if inner, ok := st.inner.(tcp.StreamExpirer); ok && !c.Broken {
+		c.SetProtocolState(st.inner)
+		inner.Expire(c, deadline)
+		st.inner = c.ProtocolState()
+		c.SetProtocolState(st)
+	}
+}
+
+// process handles all complete records buffered by a side
+func (st *state) process(c *tcp.Conn, dir tcp.Dir, sd *side) {
+	var n int
+	for !c.Broken && len(sd.buf)-n >= recordHeaderLen {
+		length := int(binary.BigEndian.Uint16(sd.buf[n+3:]))
+		if sd.buf[n+1] != 3 || length > maxRecordLen {
+			stats.Add("invalid_record", 1)
+			c.Broken = true
+			return
+		}
+		if len(sd.buf)-n < recordHeaderLen+length {
+			break
+		}
+		if !st.record(c, sd.pckt, dir, sd, sd.buf[n:n+recordHeaderLen+length]) {
+			// wait for the handshake of the other side
+			break
+		}
+		n += recordHeaderLen + length
+	}
+	sd.buf = append(sd.buf[:0], sd.buf[n:]...)
+}
+
+// record handles a single record, it returns false if the record can not be
+// handled yet
+func (st *state) record(c *tcp.Conn, pckt *tcp.Packet, dir tcp.Dir, sd *side, record []byte) bool {
+	typ := record[0]
+
+	switch {
+	case typ == recordChangeCipherSpec:
+		if st.version == tls.VersionTLS13 {
+			// middlebox compatibility mode
+			return true
+		}
+		if st.suite == nil {
+			return false
+		}
+		// wait for the secret if it was not logged yet
+		return st.keys12(c, dir, sd) || c.Broken
+	case sd.cipher == nil && typ == recordApplicationData && st.version == tls.VersionTLS13 && st.suite != nil:
+		// the handshake secret was not logged in time for ServerHello
+		if st.keys13(c, dir, sd, false); sd.cipher == nil {
+			return c.Broken
+		}
+	case sd.pending:
+		// the application secret was not logged in time for Finished
+		st.keys13(c, dir, sd, true)
+		if sd.pending = !sd.app; sd.pending {
+			return c.Broken
+		}
+	}
+
+	switch {
+	case sd.cipher == nil && typ == recordHandshake:
+		if dir == tcp.DirOutcoming && st.clientRandom == nil {
+			// ServerHello was captured before ClientHello
+			return false
+		}
+		st.handshake(c, dir, sd, record[recordHeaderLen:])
+		return true
+	case sd.cipher == nil && typ == recordApplicationData:
+		return false
+	case sd.cipher == nil:
+		return true
+	}
+
+	plain, typ, err := sd.cipher.open(record)
+	if err != nil {
+		stats.Add("decrypt_error", 1)
+		c.Broken = true
+		return true
+	}
+
+	switch typ {
+	case recordApplicationData:
+		stats.Add("record_count", 1)
+		if len(plain) > 0 {
+			st.deliver(c, pckt, plain)
+		}
+	case recordHandshake:
+		st.handshake(c, dir, sd, plain)
+	}
+	return true
+}
+
+// handshake handles handshake messages, which can span multiple records
+func (st *state) handshake(c *tcp.Conn, dir tcp.Dir, sd *side, data []byte) {
+	sd.hs = append(sd.hs, data...)
+	for !c.Broken && len(sd.hs) >= 4 {
+		length := int(sd.hs[1])<<16 | int(sd.hs[2])<<8 | int(sd.hs[3])
+		if len(sd.hs) < 4+length {
+			return
+		}
+		typ, body := sd.hs[0], sd.hs[4:4+length]
+		sd.hs = sd.hs[4+length:]
+
+		switch typ {
+		case typeClientHello:
+			if dir == tcp.DirIncoming && len(body) >= 34 {
+				st.clientRandom = append([]byte(nil), body[2:34]...)
+			}
+		case typeServerHello:
+			if dir == tcp.DirOutcoming {
+				st.serverHello(c, body)
+			}
+		case typeFinished:
+			if st.version == tls.VersionTLS13 && !sd.app {
+				// records which follow wait for the secret if it is missing
+				st.keys13(c, dir, sd, true)
+				sd.pending = !sd.app
+			}
+		case typeKeyUpdate:
+			if sd.app {
+				var err error
+				if sd.cipher, err = sd.cipher.update(); err != nil {
+					c.Broken = true
+				}
+			}
+		}
+	}
+	if len(sd.hs) == 0 {
+		sd.hs = nil
+	}
+}
+
+func (st *state) serverHello(c *tcp.Conn, body []byte) {
+	// legacy_version, random, legacy_session_id, cipher_suite, legacy_compression_method, extensions
+	if len(body) < 35 {
+		c.Broken = true
+		return
+	}
+	random := body[2:34]
+	if bytes.Equal(random, helloRetryRequest) {
+		// the client will send another ClientHello
+		return
+	}
+	version := binary.BigEndian.Uint16(body)
+	p := body[34:]
+	if len(p) < 1+int(p[0])+3 {
+		c.Broken = true
+		return
+	}
+	p = p[1+int(p[0]):]
+	suiteID := binary.BigEndian.Uint16(p)
+	p = p[3:]
+
+	if len(p) >= 2 {
+		extensions := p[2:]
+		if n := int(binary.BigEndian.Uint16(p)); n < len(extensions) {
+			extensions = extensions[:n]
+		}
+		for len(extensions) >= 4 {
+			typ := binary.BigEndian.Uint16(extensions)
+			n := int(binary.BigEndian.Uint16(extensions[2:]))
+			if len(extensions) < 4+n {
+				break
+			}
+			if typ == extensionSupportedVer && n == 2 {
+				version = binary.BigEndian.Uint16(extensions[4:])
+			}
+			extensions = extensions[4+n:]
+		}
+	}
+
+	st.version = version
+	st.serverRandom = append([]byte(nil), random...)
+	if st.suite = suites[suiteID]; st.suite == nil {
+		stats.Add("unsupported_cipher_suite", 1)
+		c.Broken = true
+		return
+	}
+
+	if version == tls.VersionTLS13 {
+		// all following handshake messages are encrypted
+		st.keys13(c, tcp.DirIncoming, &st.sides[0], false)
+		st.keys13(c, tcp.DirOutcoming, &st.sides[1], false)
+	}
+}
+
+// secret returns a secret of the connection from key log. A missing secret
+// breaks the connection only if it was not logged for secretWait.
+func (st *state) secret(c *tcp.Conn, label string) []byte {
+	if st.clientRandom == nil {
+		c.Broken = true
+		return nil
+	}
+	secret := st.keys.Secret(st.clientRandom, label)
+	now := time.Now()
+	switch {
+	case secret != nil:
+		st.missing = time.Time{}
+	case st.missing.IsZero():
+		stats.Add("delayed_secret", 1)
+		st.missing = now
+	case now.Sub(st.missing) > secretWait:
+		stats.Add("missing_secret", 1)
+		c.Broken = true
+	}
+	return secret
+}
+
+// keys12 sets the cipher of a side of TLS 1.2 connection after
+// ChangeCipherSpec, it reports whether the cipher was set
+func (st *state) keys12(c *tcp.Conn, dir tcp.Dir, sd *side) bool {
+	masterSecret := st.secret(c, LabelTLS12)
+	if masterSecret == nil {
+		return false
+	}
+	clientKey, serverKey, clientIV, serverIV := keys12(st.suite, masterSecret, st.clientRandom, st.serverRandom)
+
+	var err error
+	if dir == tcp.DirIncoming {
+		sd.cipher, err = newCipher12(st.suite, clientKey, clientIV)
+	} else {
+		sd.cipher, err = newCipher12(st.suite, serverKey, serverIV)
+	}
+	if err != nil {
+		c.Broken = true
+		return false
+	}
+	if st.sides[0].cipher != nil && st.sides[1].cipher != nil {
+		st.keys.Forget(st.clientRandom)
+	}
+	return true
+}
+
+// keys13 sets the handshake or application cipher of a side of TLS 1.3 connection
+func (st *state) keys13(c *tcp.Conn, dir tcp.Dir, sd *side, app bool) {
+	var label string
+	switch {
+	case dir == tcp.DirIncoming && app:
+		label = LabelClientTraffic
+	case dir == tcp.DirIncoming:
+		label = LabelClientHandshake
+	case app:
+		label = LabelServerTraffic
+	default:
+		label = LabelServerHandshake
+	}
+	secret := st.secret(c, label)
+	if secret == nil {
+		return
+	}
+
+	var err error
+	if sd.cipher, err = newCipher13(st.suite, secret); err != nil {
+		c.Broken = true
+		return
+	}
+	sd.app = app
+	if st.sides[0].app && st.sides[1].app {
+		st.keys.Forget(st.clientRandom)
+	}
+}
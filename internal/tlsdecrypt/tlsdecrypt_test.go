@@ -0,0 +1,255 @@
+package tlsdecrypt
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/internal/tcp"
+	"github.com/buger/goreplay/internal/tcp/tcptest"
+)
+
+// chunk is data written by one side of a connection
+type chunk struct {
+	fromClient bool
+	data       []byte
+}
+
+// recorder logs writes of both sides of connections in order
+type recorder struct {
+	sync.Mutex
+	chunks []chunk
+}
+
+type recordedConn struct {
+	net.Conn
+	fromClient bool
+	r          *recorder
+}
+
+func (c *recordedConn) Write(b []byte) (int, error) {
+	c.r.Lock()
+	c.r.chunks = append(c.r.chunks, chunk{c.fromClient, append([]byte(nil), b...)})
+	c.r.Unlock()
+	return c.Conn.Write(b)
+}
+
+func certificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// exchange makes a request over TLS connection, secrets are written to keyLog
+func exchange(t *testing.T, config *tls.Config, keyLog io.Writer, request, response string) []chunk {
+	rec := new(recorder)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	serverConfig := config.Clone()
+	serverConfig.Certificates = []tls.Certificate{certificate(t)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		server := tls.Server(&recordedConn{conn, false, rec}, serverConfig)
+		defer server.Close()
+		buf := make([]byte, len(request))
+		if _, err = io.ReadFull(server, buf); err == nil {
+			server.Write([]byte(response))
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig := config.Clone()
+	clientConfig.InsecureSkipVerify = true
+	clientConfig.KeyLogWriter = keyLog
+	client := tls.Client(&recordedConn{conn, true, rec}, clientConfig)
+	if _, err = client.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(response))
+	if _, err = io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	<-done
+
+	rec.Lock()
+	defer rec.Unlock()
+	return rec.chunks
+}
+
+// decrypt feeds chunks to the parser and waits for n bytes of decrypted data
+func decrypt(chunks []chunk, keys *KeyLog, ports []uint16, n int) (request, response string) {
+	var mu sync.Mutex
+	parser := tcp.NewMessageParser(nil, ports, nil, time.Second, false)
+	parser.Stream = Hint(keys, func(c *tcp.Conn, pckt *tcp.Packet, data []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		if c.Dir(pckt) == tcp.DirIncoming {
+			request += string(data)
+		} else {
+			response += string(data)
+		}
+	})
+
+	seq := [2]uint32{1000, 5000}
+	for _, ch := range chunks {
+		i := 0
+		if !ch.fromClient {
+			i = 1
+		}
+		// split writes into packets
+		for len(ch.data) > 0 {
+			size := 1400
+			if size > len(ch.data) {
+				size = len(ch.data)
+			}
+			parser.PacketHandler(tcptest.Packet(ch.fromClient, 443, seq[i], 0, ch.data[:size]))
+			seq[i] += uint32(size)
+			ch.data = ch.data[size:]
+		}
+	}
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		done := len(request)+len(response) >= n
+		mu.Unlock()
+		if done {
+			break
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return request, response
+}
+
+func TestDecrypt(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *tls.Config
+	}{
+		{"TLS 1.3", &tls.Config{MinVersion: tls.VersionTLS13}},
+		{"TLS 1.2 AES-GCM", &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}}},
+		{"TLS 1.2 ChaCha20", &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}}},
+	}
+
+	request := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	response := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys.log")
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			// the key log is opened before the connection, like during a live capture
+			keys, err := OpenKeyLog(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunks := exchange(t, tt.config, f, request, response)
+
+			req, resp := decrypt(chunks, keys, []uint16{443}, len(request)+len(response))
+			if req != request || resp != response {
+				t.Errorf("unexpected decrypted data\n%q\n%q", req, resp)
+			}
+		})
+	}
+}
+
+func TestDecryptUnknownDirection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.log")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	chunks := exchange(t, &tls.Config{}, f, "ping", "pong")
+	keys, err := OpenKeyLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ports are unknown, and the server response is captured first
+	chunks = append(chunks[1:2:2], append(chunks[:1:1], chunks[2:]...)...)
+	if req, resp := decrypt(chunks, keys, nil, 8); req != "ping" || resp != "pong" {
+		t.Errorf("unexpected decrypted data %q %q", req, resp)
+	}
+}
+
+func TestPlainConnection(t *testing.T) {
+	keys := &KeyLog{secrets: make(map[string]*keyLogSession)}
+	chunks := []chunk{{true, []byte("GET / HTTP/1.1\r\n\r\n")}}
+	if req, _ := decrypt(chunks, keys, []uint16{443}, 18); req != "GET / HTTP/1.1\r\n\r\n" {
+		t.Errorf("expected plain data to be passed, got %q", req)
+	}
+}
+
+func TestDecryptDelayedKeyLog(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *tls.Config
+	}{
+		{"TLS 1.3", &tls.Config{MinVersion: tls.VersionTLS13}},
+		{"TLS 1.2", &tls.Config{MaxVersion: tls.VersionTLS12}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logged bytes.Buffer
+			chunks := exchange(t, tt.config, &logged, "ping", "pong")
+
+			path := filepath.Join(t.TempDir(), "keys.log")
+			if err := os.WriteFile(path, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+			keys, err := OpenKeyLog(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the application writes the key log after the handshake was captured
+			timer := time.AfterFunc(300*time.Millisecond, func() { os.WriteFile(path, logged.Bytes(), 0600) })
+			defer timer.Stop()
+
+			if req, resp := decrypt(chunks, keys, []uint16{443}, 8); req != "ping" || resp != "pong" {
+				t.Errorf("unexpected decrypted data %q %q", req, resp)
+			}
+		})
+	}
+}
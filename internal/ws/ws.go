@@ -0,0 +1,191 @@
+/*
+Package ws parses WebSocket frames (RFC 6455) of captured connections.
+
+Reader assembles messages of one direction of a connection: payloads are
+unmasked, fragmented messages are joined and messages compressed with
+permessage-deflate extension (RFC 7692) are decompressed.
+*/
+package ws // import github.com/buger/goreplay/internal/ws
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// opcodes
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xa
+)
+
+// MaxMessageLen is the longest message accepted by Reader
+const MaxMessageLen = 64 << 20
+
+// ErrInvalid is returned for data not following the protocol
+var ErrInvalid = errors.New("ws: invalid frame")
+
+// windowSize is the size of LZ77 window of deflate
+const windowSize = 1 << 15
+
+// Frame is a parsed WebSocket frame
+type Frame struct {
+	Fin     bool
+	RSV1    bool // the message is compressed
+	Opcode  byte
+	Payload []byte // unmasked payload
+}
+
+// ParseFrame parses the first frame of data, size is -1 if the frame is not
+// complete
+func ParseFrame(data []byte) (f Frame, size int, err error) {
+	if len(data) < 2 {
+		return f, -1, nil
+	}
+	f.Fin = data[0]&0x80 != 0
+	f.RSV1 = data[0]&0x40 != 0
+	f.Opcode = data[0] & 0x0f
+	masked := data[1]&0x80 != 0
+
+	size = 2
+	length := uint64(data[1] & 0x7f)
+	switch length {
+	case 126:
+		if len(data) < size+2 {
+			return f, -1, nil
+		}
+		length = uint64(binary.BigEndian.Uint16(data[size:]))
+		size += 2
+	case 127:
+		if len(data) < size+8 {
+			return f, -1, nil
+		}
+		length = binary.BigEndian.Uint64(data[size:])
+		size += 8
+	}
+	if length > MaxMessageLen {
+		return f, 0, ErrInvalid
+	}
+	if f.Opcode >= OpClose && (!f.Fin || length > 125) {
+		return f, 0, ErrInvalid
+	}
+
+	var mask []byte
+	if masked {
+		if len(data) < size+4 {
+			return f, -1, nil
+		}
+		mask = data[size : size+4]
+		size += 4
+	}
+	if uint64(len(data)-size) < length {
+		return f, -1, nil
+	}
+	f.Payload = append([]byte(nil), data[size:size+int(length)]...)
+	for i := range mask {
+		for j := i; j < len(f.Payload); j += 4 {
+			f.Payload[j] ^= mask[i]
+		}
+	}
+	return f, size + int(length), nil
+}
+
+// Reader assembles messages of one direction of a connection
+type Reader struct {
+	Deflate           bool // permessage-deflate was negotiated
+	NoContextTakeover bool // the compressor is reset after every message
+
+	opcode     byte // opcode of the fragmented message
+	compressed bool
+	buf        []byte
+	window     []byte // recent decompressed data, the dictionary of the next message
+}
+
+// Next parses the first frame of data, size is -1 if the frame is not
+// complete. msg is set when the frame completes a message, control frames are
+// returned as they come.
+func (r *Reader) Next(data []byte) (opcode byte, msg []byte, size int, err error) {
+	f, size, err := ParseFrame(data)
+	if err != nil || size < 0 {
+		return 0, nil, size, err
+	}
+	if f.Opcode >= OpClose {
+		return f.Opcode, f.Payload, size, nil
+	}
+
+	switch {
+	case f.Opcode == OpContinuation && r.opcode == 0, f.Opcode != OpContinuation && r.opcode != 0:
+		return 0, nil, 0, ErrInvalid
+	case f.Opcode != OpContinuation:
+		r.opcode = f.Opcode
+		r.compressed = f.RSV1 && r.Deflate
+	}
+	if len(r.buf)+len(f.Payload) > MaxMessageLen {
+		return 0, nil, 0, ErrInvalid
+	}
+	r.buf = append(r.buf, f.Payload...)
+	if !f.Fin {
+		return 0, nil, size, nil
+	}
+
+	opcode, msg = r.opcode, r.buf
+	r.opcode, r.buf = 0, nil
+	if r.compressed {
+		if msg, err = r.inflate(msg); err != nil {
+			return 0, nil, 0, err
+		}
+	}
+	return opcode, msg, size, nil
+}
+
+// inflate decompresses a message, compressed messages end with an empty
+// stored block, which is removed by the sender
+func (r *Reader) inflate(data []byte) ([]byte, error) {
+	// the removed block and a final block, so the reader ends without error
+	src := io.MultiReader(bytes.NewReader(data), strings.NewReader("\x00\x00\xff\xff\x01\x00\x00\xff\xff"))
+	fr := flate.NewReaderDict(src, r.window)
+	defer fr.Close()
+	msg, err := io.ReadAll(io.LimitReader(fr, MaxMessageLen+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) > MaxMessageLen {
+		return nil, ErrInvalid
+	}
+	if !r.NoContextTakeover {
+		r.window = append(r.window, msg...)
+		if len(r.window) > windowSize {
+			r.window = append(r.window[:0], r.window[len(r.window)-windowSize:]...)
+		}
+	}
+	return msg, nil
+}
+
+// Deflate parses Sec-WebSocket-Extensions header of a handshake response, it
+// reports whether permessage-deflate was accepted and whether client and
+// server reset their compressors after every message
+func Deflate(extensions string) (ok, clientNoContext, serverNoContext bool) {
+	for _, ext := range strings.Split(extensions, ",") {
+		params := strings.Split(ext, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" {
+			continue
+		}
+		for _, p := range params[1:] {
+			switch strings.TrimSpace(p) {
+			case "client_no_context_takeover":
+				clientNoContext = true
+			case "server_no_context_takeover":
+				serverNoContext = true
+			}
+		}
+		return true, clientNoContext, serverNoContext
+	}
+	return false, false, false
+}
@@ -0,0 +1,177 @@
+package ws
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"testing"
+)
+
+// frame builds a frame, the payload is masked when mask is set
+func frame(fin, rsv1 bool, opcode byte, mask []byte, payload []byte) []byte {
+	b := []byte{opcode, 0}
+	if fin {
+		b[0] |= 0x80
+	}
+	if rsv1 {
+		b[0] |= 0x40
+	}
+	switch {
+	case len(payload) < 126:
+		b[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		b[1] = 126
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	default:
+		b[1] = 127
+		b = binary.BigEndian.AppendUint64(b, uint64(len(payload)))
+	}
+	if mask == nil {
+		return append(b, payload...)
+	}
+	b[1] |= 0x80
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+func TestParseFrame(t *testing.T) {
+	mask := []byte{1, 2, 3, 4}
+	long := bytes.Repeat([]byte("a"), 300)
+	tests := []struct {
+		data    []byte
+		opcode  byte
+		payload []byte
+		size    int
+		err     bool
+	}{
+		{frame(true, false, OpText, nil, []byte("hi")), OpText, []byte("hi"), 4, false},
+		{frame(true, false, OpText, mask, []byte("hello")), OpText, []byte("hello"), 11, false},
+		{frame(true, false, OpBinary, mask, long), OpBinary, long, 308, false},
+		{frame(true, false, OpBinary, mask, long)[:100], 0, nil, -1, false},
+		{frame(true, false, OpText, mask, []byte("hello"))[:3], 0, nil, -1, false},
+		{[]byte{0x81}, 0, nil, -1, false},
+		{frame(true, false, OpClose, nil, []byte{3, 232}), OpClose, []byte{3, 232}, 4, false},
+		// control frames can't be fragmented or longer than 125 bytes
+		{frame(false, false, OpPing, nil, nil), 0, nil, 0, true},
+		{frame(true, false, OpPing, nil, long), 0, nil, 0, true},
+		{[]byte{0x82, 127, 0xff, 0, 0, 0, 0, 0, 0, 0}, 0, nil, 0, true},
+	}
+	for i, tt := range tests {
+		f, size, err := ParseFrame(tt.data)
+		if (err != nil) != tt.err || size != tt.size && !tt.err {
+			t.Errorf("%d: expected size %d and error %v, got %d %v", i, tt.size, tt.err, size, err)
+			continue
+		}
+		if size > 0 && (f.Opcode != tt.opcode || !bytes.Equal(f.Payload, tt.payload)) {
+			t.Errorf("%d: expected %d %q, got %d %q", i, tt.opcode, tt.payload, f.Opcode, f.Payload)
+		}
+	}
+}
+
+type message struct {
+	opcode byte
+	data   string
+}
+
+func read(t *testing.T, r *Reader, data []byte, expected []message) {
+	t.Helper()
+	var got []message
+	for len(data) > 0 {
+		opcode, msg, size, err := r.Next(data)
+		if err != nil || size < 0 {
+			t.Fatalf("unexpected size %d and error %v", size, err)
+		}
+		if opcode != 0 {
+			got = append(got, message{opcode, string(msg)})
+		}
+		data = data[size:]
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Errorf("message %d: expected %q, got %q", i, expected[i], got[i])
+		}
+	}
+}
+
+func TestReaderFragmentation(t *testing.T) {
+	mask := []byte{0xa, 0xb, 0xc, 0xd}
+	var data []byte
+	data = append(data, frame(false, false, OpText, mask, []byte("hel"))...)
+	// control frames may come between fragments
+	data = append(data, frame(true, false, OpPing, mask, []byte("ping"))...)
+	data = append(data, frame(false, false, OpContinuation, mask, []byte("lo "))...)
+	data = append(data, frame(true, false, OpContinuation, mask, []byte("world"))...)
+	data = append(data, frame(true, false, OpText, mask, nil)...)
+	data = append(data, frame(true, false, OpClose, mask, nil)...)
+
+	var r Reader
+	read(t, &r, data, []message{{OpPing, "ping"}, {OpText, "hello world"}, {OpText, ""}, {OpClose, ""}})
+
+	if _, _, _, err := r.Next(frame(true, false, OpContinuation, nil, []byte("a"))); err != ErrInvalid {
+		t.Error("continuation without the first fragment should be invalid")
+	}
+	r.Next(frame(false, false, OpText, nil, []byte("a")))
+	if _, _, _, err := r.Next(frame(true, false, OpBinary, nil, []byte("b"))); err != ErrInvalid {
+		t.Error("a new message in the middle of a fragmented one should be invalid")
+	}
+}
+
+// compress compresses messages like permessage-deflate, with one compressor
+// for all messages when takeover is set
+func compress(t *testing.T, takeover bool, messages ...string) (frames []byte) {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	for _, msg := range messages {
+		if !takeover {
+			w.Reset(&buf)
+		}
+		w.Write([]byte(msg))
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		payload := bytes.TrimSuffix(buf.Bytes(), []byte{0, 0, 0xff, 0xff})
+		frames = append(frames, frame(true, true, OpText, nil, payload)...)
+		buf.Reset()
+	}
+	return
+}
+
+func TestReaderDeflate(t *testing.T) {
+	messages := []string{"hello hello hello", "hello hello hello world", "other"}
+	expected := []message{{OpText, messages[0]}, {OpText, messages[1]}, {OpText, messages[2]}}
+
+	r := Reader{Deflate: true}
+	read(t, &r, compress(t, true, messages...), expected)
+
+	r = Reader{Deflate: true, NoContextTakeover: true}
+	read(t, &r, compress(t, false, messages...), expected)
+
+	// not compressed messages are allowed as well
+	r = Reader{Deflate: true}
+	read(t, &r, frame(true, false, OpText, nil, []byte("plain")), []message{{OpText, "plain"}})
+}
+
+func TestDeflate(t *testing.T) {
+	tests := []struct {
+		extensions                   string
+		ok, clientNoCtx, serverNoCtx bool
+	}{
+		{"", false, false, false},
+		{"x-webkit-deflate-frame", false, false, false},
+		{"permessage-deflate", true, false, false},
+		{"permessage-deflate; client_no_context_takeover; server_max_window_bits=15", true, true, false},
+		{"foo, permessage-deflate;server_no_context_takeover", true, false, true},
+	}
+	for _, tt := range tests {
+		ok, c, s := Deflate(tt.extensions)
+		if ok != tt.ok || c != tt.clientNoCtx || s != tt.serverNoCtx {
+			t.Errorf("%q: expected %v %v %v, got %v %v %v", tt.extensions, tt.ok, tt.clientNoCtx, tt.serverNoCtx, ok, c, s)
+		}
+	}
+}
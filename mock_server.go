@@ -0,0 +1,355 @@
+package goreplay
+
+import (
+	"bufio"
+	"bytes"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MockServerConfig struct for holding mock server configuration
+type MockServerConfig struct {
+	// keys of requests which select the recorded response: method, path,
+	// query:<name>, header:<name> and body
+	Match   []string `json:"mock-server-match"`
+	Latency bool     `json:"mock-server-latency"`
+}
+
+// MockServer answers requests with recorded responses. The recorded request
+// must have the same method and path if they are keys, the response of the
+// request matching most of the other keys is served. Responses of the same
+// request are served in turn.
+type MockServer struct {
+	config  *MockServerConfig
+	method  bool
+	path    bool
+	query   []string
+	headers []string
+	body    bool
+	stats   *expvar.Map
+
+	mu      sync.Mutex
+	entries map[string][]*mockEntry
+	count   int
+}
+
+// mockEntry is a recorded request with its response
+type mockEntry struct {
+	query    url.Values
+	header   http.Header
+	bodyHash uint64
+
+	status         int
+	responseHeader http.Header
+	body           []byte
+	delay          time.Duration
+	served         int
+}
+
+// mockRecord is a recorded request or response
+type mockRecord struct {
+	data            []byte
+	timing, latency int64
+}
+
+// NewMockServer constructor for MockServer, responses are added with Load
+func NewMockServer(config *MockServerConfig) (*MockServer, error) {
+	s := &MockServer{config: config, entries: make(map[string][]*mockEntry)}
+	match := config.Match
+	if len(match) == 0 {
+		match = []string{"method", "path"}
+	}
+	for _, key := range match {
+		switch {
+		case key == "method":
+			s.method = true
+		case key == "path":
+			s.path = true
+		case key == "body":
+			s.body = true
+		case strings.HasPrefix(key, "query:") && len(key) > 6:
+			s.query = append(s.query, key[6:])
+		case strings.HasPrefix(key, "header:") && len(key) > 7:
+			s.headers = append(s.headers, key[7:])
+		default:
+			return nil, fmt.Errorf("unknown match key %q", key)
+		}
+	}
+	if s.stats, _ = expvar.Get("mock-server").(*expvar.Map); s.stats == nil {
+		s.stats = expvar.NewMap("mock-server")
+	}
+	return s, nil
+}
+
+// Load indexes request and response pairs of the recordings, paths can be
+// patterns like for --input-file. Streamed messages are skipped.
+func (s *MockServer) Load(paths ...string) error {
+	requests := make(map[string]mockRecord)
+	responses := make(map[string]mockRecord)
+	for _, pattern := range paths {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("no files match pattern %s", pattern)
+		}
+		for _, path := range matches {
+			if err := readRecords(path, func(meta, data []byte) {
+				if chunk, _ := payloadChunk(meta); chunk != 0 {
+					return
+				}
+				fields := payloadMeta(meta)
+				if len(fields) < 4 {
+					return
+				}
+				r := mockRecord{data: data}
+				r.timing, _ = strconv.ParseInt(string(fields[2]), 10, 64)
+				r.latency, _ = strconv.ParseInt(string(fields[3]), 10, 64)
+				switch meta[0] {
+				case RequestPayload:
+					requests[string(fields[1])] = r
+				case ResponsePayload:
+					responses[string(fields[1])] = r
+				}
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(requests))
+	for id := range requests {
+		if _, ok := responses[id]; ok {
+			ids = append(ids, id)
+		}
+	}
+	// responses of the same request are served in order of recording
+	sort.Slice(ids, func(i, j int) bool { return requests[ids[i]].timing < requests[ids[j]].timing })
+	for _, id := range ids {
+		if err := s.add(requests[id], responses[id]); err != nil {
+			Debug(1, fmt.Sprintf("[MOCK-SERVER] skipping recorded request %s: %s", id, err))
+		}
+	}
+	return nil
+}
+
+// readRecords calls fn with meta and data of every record of a file written
+// by --output-file, in order of the file
+func readRecords(path string, fn func(meta, data []byte)) error {
+	file, reader, err := openFile(path)
+	if err != nil {
+		return fmt.Errorf("can not read %s: %v", path, err)
+	}
+	defer file.Close()
+
+	records := fileRecords{reader: reader}
+	for {
+		record, err := records.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("can not read %s: %v", path, err)
+		}
+		meta, data := payloadMetaWithBody(record)
+		if len(meta) == 0 {
+			continue
+		}
+		fn(meta, data)
+	}
+}
+
+// add indexes the recorded request and its response
+func (s *MockServer) add(req, resp mockRecord) error {
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(req.data)))
+	if err != nil {
+		return err
+	}
+	body, _ := io.ReadAll(r.Body)
+	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp.data)), r)
+	if err != nil {
+		return err
+	}
+	// truncated bodies are served as they were recorded
+	respBody, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+
+	header := response.Header.Clone()
+	for _, name := range []string{"Connection", "Content-Length", "Keep-Alive", "Transfer-Encoding"} {
+		header.Del(name)
+	}
+	if length, ok := response.Header["Content-Length"]; ok && !bodyAllowed(r.Method, response.StatusCode) {
+		// the length of the body which the response does not have
+		header["Content-Length"] = length
+	}
+	e := &mockEntry{
+		query:          r.URL.Query(),
+		header:         r.Header,
+		bodyHash:       bodyHash(body),
+		status:         response.StatusCode,
+		responseHeader: header,
+		body:           respBody,
+	}
+	// from the end of the request to the end of the response
+	if reqLatency := req.latency; reqLatency > 0 {
+		req.timing += reqLatency
+	}
+	if delay := resp.timing + resp.latency - req.timing; delay > 0 {
+		e.delay = time.Duration(delay)
+	}
+
+	key := s.key(r)
+	s.mu.Lock()
+	s.entries[key] = append(s.entries[key], e)
+	s.count++
+	s.mu.Unlock()
+	s.stats.Add("recorded", 1)
+	return nil
+}
+
+// Len returns the number of recorded responses
+func (s *MockServer) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// key returns the index key of the request, of method and path if they are
+// match keys
+func (s *MockServer) key(r *http.Request) string {
+	var key string
+	if s.method {
+		key = r.Method
+	}
+	if s.path {
+		key += " " + r.URL.Path
+	}
+	return key
+}
+
+// bodyAllowed reports whether the response to a request of the method has
+// a body, responses to HEAD requests and 304 responses only have its length
+func bodyAllowed(method string, status int) bool {
+	return method != http.MethodHead && status != http.StatusNotModified
+}
+
+// writeNotModified writes a 304 response with the header to the hijacked
+// connection and closes it
+func writeNotModified(hj http.Hijacker, header http.Header) {
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	header = header.Clone()
+	header.Set("Connection", "close")
+	if header.Get("Date") == "" {
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	fmt.Fprintf(buf, "HTTP/1.1 %d %s\r\n", http.StatusNotModified, http.StatusText(http.StatusNotModified))
+	header.Write(buf)
+	buf.WriteString("\r\n")
+	buf.Flush()
+}
+
+func bodyHash(body []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(body)
+	return h.Sum64()
+}
+
+// match returns the best matching entry for the request
+func (s *MockServer) match(r *http.Request, body []byte) *mockEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var best *mockEntry
+	bestScore := -1
+	query := r.URL.Query()
+	hash := bodyHash(body)
+	for _, e := range s.entries[s.key(r)] {
+		score := 0
+		for _, name := range s.query {
+			if strings.Join(e.query[name], ",") == strings.Join(query[name], ",") {
+				score++
+			}
+		}
+		for _, name := range s.headers {
+			if e.header.Get(name) == r.Header.Get(name) {
+				score++
+			}
+		}
+		if s.body && e.bodyHash == hash {
+			score++
+		}
+		// entries are in order of recording, the least served one is next
+		if score > bestScore || (score == bestScore && e.served < best.served) {
+			best, bestScore = e, score
+		}
+	}
+	if best != nil {
+		best.served++
+	}
+	return best
+}
+
+// ServeHTTP answers the request with the best matching recorded response,
+// or 404 if no recorded request has the same method and path
+func (s *MockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body []byte
+	if s.body {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	e := s.match(r, body)
+	if e == nil {
+		s.stats.Add("misses", 1)
+		Debug(1, "[MOCK-SERVER] no recorded response for", r.Method, r.URL.String())
+		http.Error(w, "no recorded response", http.StatusNotFound)
+		return
+	}
+	s.stats.Add("hits", 1)
+
+	if s.config.Latency && e.delay > 0 {
+		timer := time.NewTimer(e.delay)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return
+		}
+	}
+	if _, ok := e.responseHeader["Content-Length"]; ok && e.status == http.StatusNotModified {
+		// net/http removes Content-Length of 304 responses
+		if hj, ok := w.(http.Hijacker); ok {
+			writeNotModified(hj, e.responseHeader)
+			return
+		}
+	}
+	for name, values := range e.responseHeader {
+		w.Header()[name] = values
+	}
+	if _, ok := e.responseHeader["Content-Type"]; !ok {
+		// do not sniff it
+		w.Header()["Content-Type"] = nil
+	}
+	if _, ok := e.responseHeader["Content-Length"]; !ok || bodyAllowed(r.Method, e.status) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(e.body)))
+	}
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
@@ -0,0 +1,165 @@
+package goreplay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeRecording(t *testing.T, exchanges [][2]string) string {
+	var buf bytes.Buffer
+	for i, e := range exchanges {
+		id := uuid()
+		start := int64(i) * int64(time.Second)
+		buf.Write(payloadHeader(RequestPayload, id, start, int64(time.Millisecond)))
+		buf.WriteString(e[0] + payloadSeparator)
+		buf.Write(payloadHeader(ResponsePayload, id, start+int64(50*time.Millisecond), int64(10*time.Millisecond)))
+		buf.WriteString(e[1] + payloadSeparator)
+	}
+	path := filepath.Join(t.TempDir(), "requests.gor")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMockServer(t *testing.T) {
+	path := writeRecording(t, [][2]string{
+		{"GET /items?page=1 HTTP/1.1\r\nHost: api\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\npage1"},
+		{"GET /items?page=2 HTTP/1.1\r\nHost: api\r\n\r\n", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\npage2\r\n0\r\n\r\n"},
+		{"POST /orders HTTP/1.1\r\nHost: api\r\nContent-Length: 1\r\n\r\na", "HTTP/1.1 201 Created\r\nX-Order: a\r\nContent-Length: 0\r\n\r\n"},
+		{"POST /orders HTTP/1.1\r\nHost: api\r\nContent-Length: 1\r\n\r\nb", "HTTP/1.1 409 Conflict\r\nContent-Length: 0\r\n\r\n"},
+		{"GET /counter HTTP/1.1\r\nHost: api\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n1"},
+		{"GET /counter HTTP/1.1\r\nHost: api\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n2"},
+	})
+
+	mock, err := NewMockServer(&MockServerConfig{Match: []string{"method", "path", "query:page", "body"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mock.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if mock.Len() != 6 {
+		t.Fatalf("expected 6 recorded responses, got %d", mock.Len())
+	}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	for _, tt := range []struct {
+		method, path, body string
+		status             int
+		response, header   string
+	}{
+		{"GET", "/items?page=2", "", 200, "page2", ""},
+		{"GET", "/items?page=1", "", 200, "page1", ""},
+		{"POST", "/orders", "b", 409, "", ""},
+		{"POST", "/orders", "a", 201, "", "a"},
+		{"GET", "/counter", "", 200, "1", ""},
+		{"GET", "/counter", "", 200, "2", ""},
+		{"GET", "/counter", "", 200, "1", ""},
+		{"GET", "/missing", "", 404, "no recorded response\n", ""},
+		{"DELETE", "/orders", "", 404, "no recorded response\n", ""},
+	} {
+		req, _ := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader(tt.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || string(body) != tt.response || resp.Header.Get("X-Order") != tt.header {
+			t.Errorf("%s %s: unexpected response %d %q %v", tt.method, tt.path, resp.StatusCode, body, resp.Header)
+		}
+	}
+
+	if _, err := NewMockServer(&MockServerConfig{Match: []string{"cookie"}}); err == nil {
+		t.Error("expected error for unknown match key")
+	}
+}
+
+func TestMockServerLatency(t *testing.T) {
+	path := writeRecording(t, [][2]string{
+		{"GET / HTTP/1.1\r\nHost: api\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"},
+	})
+	mock, _ := NewMockServer(&MockServerConfig{Latency: true})
+	if err := mock.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	start := time.Now()
+	mock.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	// the response ended 59ms after the request
+	if elapsed := time.Since(start); w.Code != 200 || elapsed < 59*time.Millisecond {
+		t.Errorf("expected delayed response, got %d after %s", w.Code, elapsed)
+	}
+}
+
+func TestMockServerCompressed(t *testing.T) {
+	data, err := os.ReadFile(writeRecording(t, [][2]string{
+		{"GET / HTTP/1.1\r\nHost: api\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"},
+		{"GET /two HTTP/1.1\r\nHost: api\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "requests.gor.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gzip.NewWriter(f)
+	w.Write(data)
+	w.Close()
+	f.Close()
+
+	mock, _ := NewMockServer(&MockServerConfig{})
+	if err := mock.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if mock.Len() != 2 {
+		t.Fatalf("expected 2 recorded responses, got %d", mock.Len())
+	}
+}
+
+func TestMockServerContentLength(t *testing.T) {
+	path := writeRecording(t, [][2]string{
+		{"HEAD /file HTTP/1.1\r\nHost: api\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 1024\r\n\r\n"},
+		{"GET /cached HTTP/1.1\r\nHost: api\r\n\r\n", "HTTP/1.1 304 Not Modified\r\nContent-Length: 512\r\n\r\n"},
+		{"GET /file HTTP/1.1\r\nHost: api\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nfile"},
+	})
+	mock, _ := NewMockServer(&MockServerConfig{})
+	if err := mock.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	for _, tt := range []struct {
+		method, path string
+		status       int
+		length       string
+	}{
+		{"HEAD", "/file", 200, "1024"},
+		{"GET", "/cached", 304, "512"},
+		{"GET", "/file", 200, "4"},
+	} {
+		req, _ := http.NewRequest(tt.method, server.URL+tt.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || resp.Header.Get("Content-Length") != tt.length {
+			t.Errorf("%s %s: expected recorded length %s, got %d %v", tt.method, tt.path, tt.length, resp.StatusCode, resp.Header)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package goreplay
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/goreplay/internal/assertion"
+	"github.com/buger/goreplay/internal/httpdiff"
+	"github.com/buger/goreplay/proto"
+)
+
+// AssertOutputConfig struct for holding replay assertion configuration
+type AssertOutputConfig struct {
+	Timeout    time.Duration `json:"replay-assert-timeout"`
+	MaxPending int           `json:"replay-assert-max-pending"`
+}
+
+// AssertOutput plugin checks replayed responses against the rules of a file.
+// The summary is printed on exit, Failed reports whether the thresholds of
+// the rules were exceeded. It needs --output-http-track-response.
+type AssertOutput struct {
+	path      string
+	config    *AssertOutputConfig
+	checker   *assertion.Checker
+	exchanges *replayExchanges
+	stdout    io.Writer
+
+	checked, dropped uint64
+	failed           int32
+}
+
+// NewAssertOutput constructor for AssertOutput, path is the rules file
+func NewAssertOutput(path string, config *AssertOutputConfig) PluginWriter {
+	o := new(AssertOutput)
+	newConfig := *config
+	if newConfig.Timeout < time.Millisecond*100 {
+		newConfig.Timeout = 30 * time.Second
+	}
+	if newConfig.MaxPending <= 0 {
+		newConfig.MaxPending = 10000
+	}
+	o.config = &newConfig
+	o.path = path
+	o.stdout = os.Stdout
+
+	rules, err := assertion.Load(path)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("[REPLAY-ASSERT] rules file %s: %s", path, err))
+	}
+	o.checker = assertion.NewChecker(rules)
+	o.exchanges = newReplayExchanges(o.config.Timeout, o.config.MaxPending, o.check, o.expire)
+	o.exchanges.optionalOriginal = !o.checker.NeedsOriginal()
+	return o
+}
+
+// PluginWrite writes message to this plugin
+func (o *AssertOutput) PluginWrite(msg *Message) (n int, err error) {
+	if !o.exchanges.add(msg) {
+		atomic.AddUint64(&o.dropped, 1)
+	}
+	return len(msg.Data) + len(msg.Meta), nil
+}
+
+// check checks the exchange against the rules
+func (o *AssertOutput) check(e *replayExchange) {
+	exchange := &assertion.Exchange{Latency: time.Duration(e.replayedLatency)}
+	if e.request != nil {
+		exchange.Method = string(proto.Method(e.request))
+		exchange.Path = string(proto.Path(e.request))
+	}
+	if e.original != nil {
+		exchange.Original, _ = httpdiff.Parse(e.original)
+	}
+	if e.replayed != nil {
+		exchange.Replayed, _ = httpdiff.Parse(e.replayed)
+	}
+	atomic.AddUint64(&o.checked, 1)
+	o.checker.Check(exchange)
+}
+
+// expire checks requests which the replay target did not answer in time, or
+// which did not get the original response
+func (o *AssertOutput) expire(e *replayExchange) {
+	// late original response of a checked request
+	if e.request == nil && e.replayed == nil {
+		return
+	}
+	o.check(e)
+}
+
+// Failed reports whether the rules failed, it is known after Close
+func (o *AssertOutput) Failed() bool {
+	return atomic.LoadInt32(&o.failed) == 1
+}
+
+func (o *AssertOutput) String() string {
+	return "Replay assertions: " + o.path
+}
+
+// Close checks replayed responses which are still waiting for the original
+// one and prints the summary. Requests without replayed response are not
+// checked, they may be still in flight.
+func (o *AssertOutput) Close() error {
+	o.exchanges.close()
+	var unanswered int
+	for _, e := range o.exchanges.drain() {
+		if e.replayed == nil {
+			unanswered++
+			continue
+		}
+		o.check(e)
+	}
+
+	passed := o.checker.Passed()
+	if atomic.LoadUint64(&o.checked) == 0 {
+		fmt.Fprintln(o.stdout, "No replayed responses were checked, is --output-http-track-response set?")
+		passed = false
+	}
+	if !passed {
+		atomic.StoreInt32(&o.failed, 1)
+	}
+	if unanswered > 0 {
+		fmt.Fprintf(o.stdout, "%d requests without response on exit were not checked\n", unanswered)
+	}
+	if dropped := atomic.LoadUint64(&o.dropped); dropped > 0 {
+		fmt.Fprintf(o.stdout, "%d requests were not checked, more than %d were pending\n", dropped, o.config.MaxPending)
+	}
+	if err := o.checker.WriteSummary(o.stdout); err != nil {
+		return err
+	}
+	if !passed {
+		fmt.Fprintln(o.stdout, "FAIL")
+		return fmt.Errorf("replay assertions of %s failed", o.path)
+	}
+	fmt.Fprintln(o.stdout, "PASS")
+	return nil
+}
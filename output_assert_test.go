@@ -0,0 +1,90 @@
+package goreplay
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAssertOutput(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+
+	rules := filepath.Join(t.TempDir(), "rules.json")
+	err := os.WriteFile(rules, []byte(`{"rules": [
+		{"name": "no server errors", "type": "status_not_5xx"},
+		{"name": "healthy", "type": "json_path_equals", "path": "^/health", "json_path": "status", "value": "ok"}
+	]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		paths  []string
+		failed bool
+	}{
+		{[]string{"/health", "/users/1"}, false},
+		{[]string{"/health", "/broken"}, true},
+	} {
+		wg := new(sync.WaitGroup)
+		input := NewTestInput()
+		httpOutput := NewHTTPOutput(server.URL, &HTTPOutputConfig{TrackResponses: true})
+		assertOutput := NewAssertOutput(rules, &AssertOutputConfig{}).(*AssertOutput)
+		var summary bytes.Buffer
+		assertOutput.stdout = &summary
+		output := NewTestOutput(func(msg *Message) {
+			if msg.Meta[0] == ReplayedResponsePayload {
+				wg.Done()
+			}
+		})
+
+		plugins := &InOutPlugins{
+			Inputs:  []PluginReader{input, httpOutput},
+			Outputs: []PluginWriter{httpOutput, assertOutput, output},
+		}
+		plugins.All = append(plugins.All, input, httpOutput, assertOutput, output)
+
+		emitter := NewEmitter()
+		go emitter.Start(plugins, Settings.Middleware)
+		for _, path := range tt.paths {
+			wg.Add(1)
+			input.EmitBytes([]byte("GET " + path + " HTTP/1.1\r\nHost: www.w3.org\r\n\r\n"))
+		}
+		wg.Wait()
+		emitter.Close()
+
+		if assertOutput.Failed() != tt.failed {
+			t.Errorf("%v: expected failed %v\n%s", tt.paths, tt.failed, summary.String())
+		}
+		if tt.failed && !strings.Contains(summary.String(), "no server errors: GET /broken: status 502") {
+			t.Errorf("summary should contain the failure\n%s", summary.String())
+		}
+	}
+}
+
+func TestAssertOutputNoResponses(t *testing.T) {
+	rules := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(rules, []byte(`{"rules": [{"type": "status_not_5xx"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	o := NewAssertOutput(rules, &AssertOutputConfig{}).(*AssertOutput)
+	var summary bytes.Buffer
+	o.stdout = &summary
+	o.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, uuid(), 1, -1), Data: []byte("GET / HTTP/1.1\r\n\r\n")})
+	o.Close()
+	if !o.Failed() || !strings.Contains(summary.String(), "1 requests without response on exit") {
+		t.Errorf("run without replayed responses should fail\n%s", summary.String())
+	}
+}
@@ -0,0 +1,154 @@
+package goreplay
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/internal/httpdiff"
+	"github.com/buger/goreplay/proto"
+)
+
+// DiffOutputConfig struct for holding response diff output configuration
+type DiffOutputConfig struct {
+	Timeout       time.Duration `json:"output-diff-timeout"`
+	MaxPending    int           `json:"output-diff-max-pending"`
+	Headers       []string      `json:"output-diff-header"`
+	Ignore        []string      `json:"output-diff-ignore"`
+	IgnoreRegexps []string      `json:"output-diff-ignore-regexp"`
+}
+
+// DiffOutput plugin compares captured responses with responses of the replay
+// target and writes differences to a JSON lines report. It needs both
+// --input-raw-track-response (or a recording with responses) and
+// --output-http-track-response.
+type DiffOutput struct {
+	path       string
+	config     *DiffOutputConfig
+	comparator *httpdiff.Comparator
+	exchanges  *replayExchanges
+	stats      *expvar.Map
+
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// diffReport is a line of the report
+type diffReport struct {
+	ID             string   `json:"id"`
+	Time           string   `json:"time"`
+	Method         string   `json:"method,omitempty"`
+	Path           string   `json:"path,omitempty"`
+	OriginalStatus int      `json:"original_status"`
+	ReplayedStatus int      `json:"replayed_status"`
+	Diffs          []string `json:"diffs"`
+}
+
+// NewDiffOutput constructor for DiffOutput, path is the file of the report
+func NewDiffOutput(path string, config *DiffOutputConfig) PluginWriter {
+	o := new(DiffOutput)
+	newConfig := *config
+	if newConfig.Timeout < time.Millisecond*100 {
+		newConfig.Timeout = 30 * time.Second
+	}
+	if newConfig.MaxPending <= 0 {
+		newConfig.MaxPending = 10000
+	}
+	o.config = &newConfig
+	o.path = path
+
+	var err error
+	if o.comparator, err = httpdiff.New(o.config.Headers, o.config.Ignore, o.config.IgnoreRegexps); err != nil {
+		log.Fatal(fmt.Sprintf("[OUTPUT-DIFF] %s", err))
+	}
+	if o.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660); err != nil {
+		log.Fatal(fmt.Sprintf("[OUTPUT-DIFF] report file error[%q]", err))
+	}
+	o.enc = json.NewEncoder(o.file)
+
+	name := "diff-output-" + path
+	if o.stats, _ = expvar.Get(name).(*expvar.Map); o.stats == nil {
+		o.stats = expvar.NewMap(name)
+	}
+	o.exchanges = newReplayExchanges(o.config.Timeout, o.config.MaxPending, o.compare, o.expire)
+	return o
+}
+
+// PluginWrite writes message to this plugin, requests and both responses are
+// kept until they can be compared
+func (o *DiffOutput) PluginWrite(msg *Message) (n int, err error) {
+	if !o.exchanges.add(msg) {
+		o.stats.Add("dropped", 1)
+	}
+	return len(msg.Data) + len(msg.Meta), nil
+}
+
+// compare reports differences of responses of the exchange
+func (o *DiffOutput) compare(e *replayExchange) {
+	original, err := httpdiff.Parse(e.original)
+	if err != nil {
+		o.stats.Add("invalid", 1)
+		return
+	}
+	replayed, err := httpdiff.Parse(e.replayed)
+	if err != nil {
+		o.stats.Add("invalid", 1)
+		return
+	}
+	o.stats.Add("compared", 1)
+	diffs := o.comparator.DiffResponses(original, replayed)
+	if len(diffs) == 0 {
+		o.stats.Add("same", 1)
+		return
+	}
+	o.stats.Add("different", 1)
+	if original.Status != replayed.Status {
+		o.stats.Add("different_status", 1)
+	}
+
+	o.report(&diffReport{
+		ID:             e.id,
+		Time:           time.Now().Format(time.RFC3339),
+		Method:         string(proto.Method(e.request)),
+		Path:           string(proto.Path(e.request)),
+		OriginalStatus: original.Status,
+		ReplayedStatus: replayed.Status,
+		Diffs:          diffs,
+	})
+}
+
+// expire counts exchanges without one of the responses
+func (o *DiffOutput) expire(e *replayExchange) {
+	switch {
+	case e.original == nil && e.replayed == nil:
+	case e.original == nil:
+		o.stats.Add("no_original", 1)
+	default:
+		o.stats.Add("no_replayed", 1)
+	}
+}
+
+func (o *DiffOutput) report(r *diffReport) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.enc.Encode(r); err != nil {
+		Debug(1, fmt.Sprintf("[DIFF-OUTPUT] error when writing report: %q", err))
+	}
+}
+
+func (o *DiffOutput) String() string {
+	return "Diff output: " + o.path
+}
+
+// Close stops comparing responses and closes the report
+func (o *DiffOutput) Close() error {
+	o.exchanges.close()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.file.Close()
+}
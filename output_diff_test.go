@@ -0,0 +1,69 @@
+package goreplay
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "diff.jsonl")
+	output := NewDiffOutput(path, &DiffOutputConfig{Timeout: 200 * time.Millisecond, Ignore: []string{"request_id"}})
+	o := output.(*DiffOutput)
+
+	exchanges := []struct {
+		request, original, replayed string
+	}{
+		{"GET /same HTTP/1.1\r\n\r\n", `{"a":1,"request_id":"x"}`, `{"a":1,"request_id":"y"}`},
+		{"POST /checkout HTTP/1.1\r\nContent-Length: 0\r\n\r\n", `{"a":1}`, `{"a":2}`},
+		// the replay target did not answer
+		{"GET /slow HTTP/1.1\r\n\r\n", `{}`, ""},
+	}
+	for i, e := range exchanges {
+		id := uuid()
+		status := "200 OK"
+		if i == 1 {
+			status = "201 Created"
+		}
+		output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, id, 1, -1), Data: []byte(e.request)})
+		output.PluginWrite(&Message{Meta: payloadHeader(ResponsePayload, id, 1, 10), Data: []byte("HTTP/1.1 " + status + "\r\nContent-Type: application/json\r\n\r\n" + e.original)})
+		if e.replayed != "" {
+			output.PluginWrite(&Message{Meta: payloadHeader(ReplayedResponsePayload, id, 1, 20), Data: []byte("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\n\r\n" + e.replayed)})
+		}
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	o.Close()
+	for name, expected := range map[string]int64{"compared": 2, "same": 1, "different": 1, "different_status": 1, "no_replayed": 1} {
+		if v, _ := o.stats.Get(name).(interface{ Value() int64 }); v == nil || v.Value() != expected {
+			t.Errorf("expected %s %d, got %v", name, expected, o.stats.Get(name))
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var reports []diffReport
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r diffReport
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		reports = append(reports, r)
+	}
+	if len(reports) != 1 {
+		t.Fatalf("expected a report of the different response, got %v", reports)
+	}
+	r := reports[0]
+	if r.Method != "POST" || r.Path != "/checkout" || r.OriginalStatus != 201 || r.ReplayedStatus != 200 ||
+		!reflect.DeepEqual(r.Diffs, []string{"status 201 != 200", "body a: 1 != 2"}) {
+		t.Errorf("unexpected report %+v", r)
+	}
+}
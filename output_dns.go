@@ -0,0 +1,267 @@
+package goreplay
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/internal/dns"
+)
+
+// DNSOutputConfig struct for holding DNS output configuration
+type DNSOutputConfig struct {
+	TrackResponses bool          `json:"output-dns-track-response"`
+	Timeout        time.Duration `json:"output-dns-timeout"`
+}
+
+// DNSOutput plugin replays captured DNS queries to a resolver over UDP. When
+// answers are captured as well (--input-raw-track-response) they are compared
+// with answers of the resolver and differences are reported.
+type DNSOutput struct {
+	address   string
+	config    *DNSOutputConfig
+	conn      *net.UDPConn
+	responses chan *response
+	stats     *expvar.Map
+	stop      chan bool // Channel used only to indicate goroutine should shutdown
+
+	mu       sync.Mutex
+	nextID   uint16
+	inflight map[uint16]*dnsQuery  // queries sent to the resolver by their new IDs
+	answers  map[string]*dnsAnswer // answers to compare by message ID
+}
+
+// dnsQuery is a query waiting for an answer of the resolver
+type dnsQuery struct {
+	uuid []byte
+	id   uint16 // the captured transaction ID
+	sent time.Time
+}
+
+// dnsAnswer pairs the captured answer to a query and the one of the resolver
+type dnsAnswer struct {
+	original, replayed []byte
+	noAnswer           bool // the resolver did not answer
+	created            time.Time
+}
+
+// NewDNSOutput constructor for DNSOutput, address is the resolver like
+// 10.0.0.53 or 10.0.0.53:5353
+func NewDNSOutput(address string, config *DNSOutputConfig) PluginReadWriter {
+	o := new(DNSOutput)
+	newConfig := *config
+	if newConfig.Timeout < time.Millisecond*100 {
+		newConfig.Timeout = 5 * time.Second
+	}
+	o.config = &newConfig
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "53")
+	}
+	o.address = address
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("[OUTPUT-DNS] resolve DNS output address error[%q]", err))
+	}
+	if o.conn, err = net.DialUDP("udp", nil, addr); err != nil {
+		log.Fatal(fmt.Sprintf("[OUTPUT-DNS] DNS output connection error[%q]", err))
+	}
+
+	name := "dns-output-" + address
+	if o.stats, _ = expvar.Get(name).(*expvar.Map); o.stats == nil {
+		o.stats = expvar.NewMap(name)
+	}
+
+	o.stop = make(chan bool)
+	o.inflight = make(map[uint16]*dnsQuery)
+	o.answers = make(map[string]*dnsAnswer)
+	if o.config.TrackResponses {
+		o.responses = make(chan *response, 1000)
+	}
+
+	go o.receive()
+	go o.expire()
+	return o
+}
+
+// PluginWrite writes message to this plugin, queries are sent to the resolver
+// and captured answers are kept for comparison
+func (o *DNSOutput) PluginWrite(msg *Message) (n int, err error) {
+	if len(msg.Data) < 12 {
+		return len(msg.Data), nil
+	}
+	uuid := string(payloadID(msg.Meta))
+
+	switch msg.Meta[0] {
+	case RequestPayload:
+		query := append([]byte(nil), msg.Data...)
+
+		o.mu.Lock()
+		if len(o.inflight) > 1<<16-1 {
+			o.mu.Unlock()
+			o.stats.Add("dropped", 1)
+			return len(msg.Data), nil
+		}
+		// queries of all clients share the connection, IDs must be unique
+		for {
+			o.nextID++
+			if _, ok := o.inflight[o.nextID]; !ok {
+				break
+			}
+		}
+		o.inflight[o.nextID] = &dnsQuery{[]byte(uuid), dns.ID(query), time.Now()}
+		dns.SetID(query, o.nextID)
+		if _, ok := o.answers[uuid]; !ok {
+			o.answers[uuid] = &dnsAnswer{created: time.Now()}
+		}
+		o.mu.Unlock()
+
+		if _, err = o.conn.Write(query); err != nil {
+			Debug(1, fmt.Sprintf("[DNS-OUTPUT] error when sending: %q", err))
+			return 0, err
+		}
+		o.stats.Add("queries", 1)
+	case ResponsePayload:
+		o.mu.Lock()
+		a, ok := o.answers[uuid]
+		if !ok {
+			a = &dnsAnswer{created: time.Now()}
+			o.answers[uuid] = a
+		}
+		a.original = msg.Data
+		o.compare(uuid, a)
+		o.mu.Unlock()
+	}
+	return len(msg.Data) + len(msg.Meta), nil
+}
+
+// receive reads answers of the resolver
+func (o *DNSOutput) receive() {
+	buf := make([]byte, 1<<16)
+	for {
+		n, err := o.conn.Read(buf)
+		if err != nil {
+			select {
+			case <-o.stop:
+				return
+			default:
+			}
+			Debug(1, fmt.Sprintf("[DNS-OUTPUT] error when reading: %q", err))
+			continue
+		}
+		stop := time.Now()
+		data := append([]byte(nil), buf[:n]...)
+
+		o.mu.Lock()
+		q, ok := o.inflight[dns.ID(data)]
+		if !ok {
+			// the answer came after the timeout
+			o.mu.Unlock()
+			continue
+		}
+		delete(o.inflight, dns.ID(data))
+		dns.SetID(data, q.id)
+		if a, ok := o.answers[string(q.uuid)]; ok {
+			a.replayed = data
+			o.compare(string(q.uuid), a)
+		}
+		o.mu.Unlock()
+
+		if o.config.TrackResponses {
+			select {
+			case <-o.stop:
+				return
+			case o.responses <- &response{data, q.uuid, q.sent.UnixNano(), stop.UnixNano() - q.sent.UnixNano()}:
+			}
+		}
+	}
+}
+
+// compare reports differences of the answers once both are known, it must be
+// called with o.mu held
+func (o *DNSOutput) compare(uuid string, a *dnsAnswer) {
+	if a.original == nil || a.replayed == nil && !a.noAnswer {
+		return
+	}
+	delete(o.answers, uuid)
+
+	if a.noAnswer {
+		o.stats.Add("different", 1)
+		log.Printf("[DNS-OUTPUT] %s: no answer from %s\n", dns.Question(a.original), o.address)
+		return
+	}
+	diff, err := dns.Diff(a.original, a.replayed)
+	switch {
+	case err != nil:
+		o.stats.Add("invalid", 1)
+	case diff != "":
+		o.stats.Add("different", 1)
+		log.Printf("[DNS-OUTPUT] %s: %s\n", dns.Question(a.original), diff)
+	default:
+		o.stats.Add("same", 1)
+	}
+}
+
+// expire forgets queries which were not answered in time and answers which
+// were not paired
+func (o *DNSOutput) expire() {
+	ticker := time.NewTicker(o.config.Timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.stop:
+			return
+		case now := <-ticker.C:
+			o.mu.Lock()
+			for id, q := range o.inflight {
+				if now.Sub(q.sent) < o.config.Timeout {
+					continue
+				}
+				delete(o.inflight, id)
+				o.stats.Add("timeout", 1)
+				if a, ok := o.answers[string(q.uuid)]; ok {
+					a.noAnswer = true
+					o.compare(string(q.uuid), a)
+				}
+			}
+			for uuid, a := range o.answers {
+				if now.Sub(a.created) > 2*o.config.Timeout {
+					delete(o.answers, uuid)
+				}
+			}
+			o.mu.Unlock()
+		}
+	}
+}
+
+// PluginRead reads message from this plugin
+func (o *DNSOutput) PluginRead() (*Message, error) {
+	if !o.config.TrackResponses {
+		return nil, ErrorStopped
+	}
+	var resp *response
+	var msg Message
+	select {
+	case <-o.stop:
+		return nil, ErrorStopped
+	case resp = <-o.responses:
+		msg.Data = resp.payload
+	}
+
+	msg.Meta = payloadHeader(ReplayedResponsePayload, resp.uuid, resp.startedAt, resp.roundTripTime)
+
+	return &msg, nil
+}
+
+func (o *DNSOutput) String() string {
+	return "DNS output: " + o.address
+}
+
+// Close closes the data channel so that data
+func (o *DNSOutput) Close() error {
+	close(o.stop)
+	return o.conn.Close()
+}
@@ -0,0 +1,112 @@
+package goreplay
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsMessage builds a query or an answer for name with A records
+func dnsMessage(t *testing.T, id uint16, name string, response bool, ips ...string) []byte {
+	t.Helper()
+	n := dnsmessage.MustNewName(name)
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, Response: response},
+		Questions: []dnsmessage.Question{{Name: n, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	for _, ip := range ips {
+		var a dnsmessage.AResource
+		copy(a.A[:], net.ParseIP(ip).To4())
+		m.Answers = append(m.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: n, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 30},
+			Body:   &a,
+		})
+	}
+	data, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDNSOutput(t *testing.T) {
+	// the resolver answers 10.0.0.9 to everything but silent.example.
+	resolver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := resolver.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var m dnsmessage.Message
+			if m.Unpack(buf[:n]) != nil || m.Questions[0].Name.String() == "silent.example." {
+				continue
+			}
+			resolver.WriteToUDP(dnsMessage(t, m.ID, m.Questions[0].Name.String(), true, "10.0.0.9"), addr)
+		}
+	}()
+
+	output := NewDNSOutput(resolver.LocalAddr().String(), &DNSOutputConfig{TrackResponses: true, Timeout: 200 * time.Millisecond})
+	o := output.(*DNSOutput)
+	defer o.Close()
+
+	queries := []struct {
+		name   string
+		answer string
+	}{
+		{"same.example.", "10.0.0.9"},
+		{"other.example.", "10.0.0.1"},
+		{"silent.example.", "10.0.0.9"},
+	}
+	ids := make(map[string]string)
+	for i, q := range queries {
+		id := uuid()
+		ids[string(id)] = q.name
+		// all queries have the same ID, like queries of different clients
+		output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, id, 1, 0), Data: dnsMessage(t, 100, q.name, false)})
+		if i != 0 {
+			output.PluginWrite(&Message{Meta: payloadHeader(ResponsePayload, id, 1, 0), Data: dnsMessage(t, 100, q.name, true, q.answer)})
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		done := make(chan *Message)
+		go func() {
+			msg, _ := output.PluginRead()
+			done <- msg
+		}()
+		select {
+		case msg := <-done:
+			name, ok := ids[string(payloadID(msg.Meta))]
+			if msg.Meta[0] != ReplayedResponsePayload || !ok {
+				t.Fatalf("wrong meta %q", msg.Meta)
+			}
+			var m dnsmessage.Message
+			if err := m.Unpack(msg.Data); err != nil || m.ID != 100 || m.Questions[0].Name.String() != name {
+				t.Errorf("%s: wrong answer %v %v", name, m, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no response")
+		}
+	}
+	// the captured answer of the first query comes after the replayed one
+	for id, name := range ids {
+		if name == "same.example." {
+			output.PluginWrite(&Message{Meta: payloadHeader(ResponsePayload, []byte(id), 1, 0), Data: dnsMessage(t, 100, name, true, "10.0.0.9")})
+		}
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	for name, expected := range map[string]int64{"queries": 3, "same": 1, "different": 2, "timeout": 1} {
+		if v, _ := o.stats.Get(name).(interface{ Value() int64 }); v == nil || v.Value() != expected {
+			t.Errorf("expected %s %d, got %v", name, expected, o.stats.Get(name))
+		}
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"compress/gzip"
 	"errors"
 	"fmt"
+	"github.com/buger/goreplay/internal/capture"
 	"github.com/buger/goreplay/internal/size"
+	"github.com/buger/goreplay/internal/tcp"
 	"io"
 	"log"
 	"math/rand"
@@ -17,8 +19,24 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 )
 
+// pcapSnaplen is the snapshot length written to pcap file headers
+const pcapSnaplen = 262144
+
+// pcapMaxFlows bounds the number of flows whose last written packet is kept
+const pcapMaxFlows = 64 * 1024
+
+// pcapPacket identifies a written packet without keeping it in memory,
+// retransmissions have a different timestamp
+type pcapPacket struct {
+	seq uint32
+	ts  time.Time
+}
+
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 var instanceID string
 
@@ -72,6 +90,11 @@ type FileOutput struct {
 	closed          bool
 	currentFileSize int
 	totalFileSize   size.Size
+	pcap            bool // write captured packets instead of payloads
+	pcapWriter      *capture.Writer
+	// last written packet of each flow: consecutive messages of a flow share
+	// the packet which ends one message and starts the next
+	pcapLast map[tcp.FlowID]pcapPacket
 
 	config *FileOutputConfig
 }
@@ -209,8 +232,21 @@ func (o *FileOutput) updateName() {
 	o.Unlock()
 }
 
+// NewPcapOutput constructor for FileOutput which writes captured packets of
+// messages in pcap format, instead of payloads
+func NewPcapOutput(pathTemplate string, config *FileOutputConfig) *FileOutput {
+	o := NewFileOutput(pathTemplate, config)
+	o.pcap = true
+	return o
+}
+
 // PluginWrite writes message to this plugin
 func (o *FileOutput) PluginWrite(msg *Message) (n int, err error) {
+	if o.pcap && len(msg.packets) == 0 {
+		// not captured by input-raw
+		return 0, nil
+	}
+
 	if o.requestPerFile {
 		o.Lock()
 		meta := payloadMeta(msg.Meta)
@@ -239,15 +275,28 @@ func (o *FileOutput) PluginWrite(msg *Message) (n int, err error) {
 			log.Fatal(o, "Cannot open file %q. Error: %s", o.currentName, err)
 		}
 
+		if o.pcap {
+			// packets of all interfaces are written without link layer headers
+			o.pcapWriter = capture.NewWriterNanos(o.writer)
+			o.pcapLast = make(map[tcp.FlowID]pcapPacket)
+			if err = o.pcapWriter.WriteFileHeader(pcapSnaplen, layers.LinkTypeRaw); err != nil {
+				return 0, err
+			}
+		}
+
 		o.QueueLength = 0
 	}
 
-	var nn int
-	n, err = o.writer.Write(msg.Meta)
-	nn, err = o.writer.Write(msg.Data)
-	n += nn
-	nn, err = o.writer.Write(payloadSeparatorAsBytes)
-	n += nn
+	if o.pcap {
+		n, err = o.writePackets(msg)
+	} else {
+		var nn int
+		n, err = o.writer.Write(msg.Meta)
+		nn, err = o.writer.Write(msg.Data)
+		n += nn
+		nn, err = o.writer.Write(payloadSeparatorAsBytes)
+		n += nn
+	}
 
 	o.totalFileSize += size.Size(n)
 	o.currentFileSize += n
@@ -260,6 +309,32 @@ func (o *FileOutput) PluginWrite(msg *Message) (n int, err error) {
 	return n, err
 }
 
+func (o *FileOutput) writePackets(msg *Message) (n int, err error) {
+	for _, p := range msg.packets {
+		flow, id := p.Flow(), pcapPacket{p.Seq, p.Timestamp}
+		if o.pcapLast[flow] == id {
+			continue
+		}
+		if len(o.pcapLast) >= pcapMaxFlows {
+			o.pcapLast = make(map[tcp.FlowID]pcapPacket)
+		}
+		o.pcapLast[flow] = id
+
+		raw := p.Raw()
+		ci := gopacket.CaptureInfo{
+			Timestamp:     p.Timestamp,
+			CaptureLength: len(raw),
+			Length:        len(raw) + int(p.Lost),
+		}
+		if err = o.pcapWriter.WritePacket(ci, raw); err != nil {
+			return
+		}
+		// packet header and data
+		n += 16 + len(raw)
+	}
+	return
+}
+
 func (o *FileOutput) flush() {
 	// Don't exit on panic
 	defer func() {
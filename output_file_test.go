@@ -1,8 +1,10 @@
 package goreplay
 
 import (
+	"encoding/binary"
 	"fmt"
 	"github.com/buger/goreplay/internal/size"
+	"github.com/buger/goreplay/internal/tcp"
 	"math/rand"
 	"os"
 	"reflect"
@@ -11,6 +13,10 @@ import (
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
 )
 
 func TestFileOutput(t *testing.T) {
@@ -329,3 +335,104 @@ func TestFileOutputAppendSizeLimitOverflow(t *testing.T) {
 	os.Remove(name1)
 	os.Remove(name3)
 }
+
+func TestPcapOutput(t *testing.T) {
+	name := fmt.Sprintf("/tmp/%d.pcap", rand.Int63())
+	output := NewPcapOutput(name, &FileOutputConfig{Append: true, FlushInterval: time.Minute})
+
+	packets := []*tcp.Packet{
+		pcapTestPacket(t, 0, "GET / HTTP/1.1\r\n"),
+		pcapTestPacket(t, 1, "Host: localhost\r\n\r\n"),
+	}
+
+	// messages which were not captured by input-raw are skipped
+	output.PluginWrite(&Message{Meta: []byte("1 1 1\r\n"), Data: []byte("test")})
+	output.PluginWrite(&Message{Meta: []byte("1 2 1\r\n"), Data: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), packets: packets})
+	output.Close()
+	defer os.Remove(name)
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.LinkType() != layers.LinkTypeRaw {
+		t.Errorf("expected raw link type, got %v", r.LinkType())
+	}
+	for i, pckt := range packets {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(data, pckt.Raw()) || !ci.Timestamp.Equal(pckt.Timestamp) {
+			t.Errorf("packet %d does not match: %v %v", i, data, ci)
+		}
+	}
+	if _, _, err = r.ReadPacketData(); err == nil {
+		t.Error("expected only captured packets to be written")
+	}
+}
+
+func TestPcapOutputSharedPacket(t *testing.T) {
+	name := fmt.Sprintf("/tmp/%d.pcap", rand.Int63())
+	output := NewPcapOutput(name, &FileOutputConfig{Append: true, FlushInterval: time.Minute})
+
+	// the first segment ends the first request and starts the second one
+	packets := []*tcp.Packet{
+		pcapTestPacket(t, 0, "GET /a HTTP/1.1\r\n\r\nGET /b HTTP/1.1\r\n"),
+		pcapTestPacket(t, 1, "\r\n"),
+	}
+	output.PluginWrite(&Message{Meta: []byte("1 1 1\r\n"), Data: []byte("GET /a HTTP/1.1\r\n\r\n"), packets: packets[:1]})
+	output.PluginWrite(&Message{Meta: []byte("1 2 1\r\n"), Data: []byte("GET /b HTTP/1.1\r\n\r\n"), packets: packets})
+	output.Close()
+	defer os.Remove(name)
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, pckt := range packets {
+		data, _, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(data, pckt.Raw()) {
+			t.Errorf("packet %d does not match: %v", i, data)
+		}
+	}
+	if _, _, err = r.ReadPacketData(); err == nil {
+		t.Error("expected shared packet to be written once")
+	}
+}
+
+// pcapTestPacket returns the i-th loopback IPv4 packet of a connection
+func pcapTestPacket(t *testing.T, i int, payload string) *tcp.Packet {
+	data := make([]byte, 4+20+20, 4+20+20+len(payload))
+	binary.BigEndian.PutUint32(data, uint32(layers.ProtocolFamilyIPv4))
+	ip := data[4:]
+	ip[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(ip[2:], uint16(40+len(payload)))
+	ip[9] = uint8(layers.IPProtocolTCP)
+	copy(ip[12:], []byte{127, 0, 0, 1, 127, 0, 0, 1})
+	binary.BigEndian.PutUint16(ip[20:], 40000)
+	binary.BigEndian.PutUint16(ip[22:], 80)
+	binary.BigEndian.PutUint32(ip[24:], uint32(1000+i*64))
+	ip[32] = 5 << 4
+	data = append(data, payload...)
+
+	ci := &gopacket.CaptureInfo{Timestamp: time.Unix(1, int64(i)), Length: len(data), CaptureLength: len(data)}
+	pckt, err := tcp.ParsePacket(data, int(layers.LinkTypeLoop), 4, ci, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pckt
+}
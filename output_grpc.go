@@ -0,0 +1,243 @@
+package goreplay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buger/goreplay/internal/http2"
+
+	xhttp2 "golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// GRPCOutputConfig struct for holding grpc output configuration
+type GRPCOutputConfig struct {
+	TrackResponses bool          `json:"output-grpc-track-response"`
+	Workers        int           `json:"output-grpc-workers"`
+	Timeout        time.Duration `json:"output-grpc-timeout"`
+	SkipVerify     bool          `json:"output-grpc-skip-verify"`
+	url            *url.URL
+}
+
+// GRPCOutput plugin replays captured gRPC calls to the target over HTTP/2.
+// All workers share a single client, calls are multiplexed as HTTP/2 streams.
+type GRPCOutput struct {
+	config    *GRPCOutputConfig
+	client    *GRPCClient
+	queue     chan *Message
+	responses chan *response
+	stop      chan bool // Channel used only to indicate goroutine should shutdown
+}
+
+// NewGRPCOutput constructor for GRPCOutput
+// Initialize workers
+func NewGRPCOutput(address string, config *GRPCOutputConfig) PluginReadWriter {
+	o := new(GRPCOutput)
+	newConfig := *config
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	var err error
+	newConfig.url, err = url.Parse(address)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("[OUTPUT-GRPC] parse gRPC output URL error[%q]", err))
+	}
+	if newConfig.Timeout < time.Millisecond*100 {
+		newConfig.Timeout = 5 * time.Second
+	}
+	if newConfig.Workers <= 0 {
+		newConfig.Workers = initialDynamicWorkers
+	}
+	o.config = &newConfig
+	o.stop = make(chan bool)
+	o.queue = make(chan *Message, 1000)
+	if o.config.TrackResponses {
+		o.responses = make(chan *response, 1000)
+	}
+	o.client = NewGRPCClient(o.config)
+
+	for i := 0; i < o.config.Workers; i++ {
+		go o.startWorker()
+	}
+	return o
+}
+
+func (o *GRPCOutput) startWorker() {
+	for {
+		select {
+		case <-o.stop:
+			return
+		case msg := <-o.queue:
+			o.sendRequest(msg)
+		}
+	}
+}
+
+// PluginWrite writes message to this plugin
+func (o *GRPCOutput) PluginWrite(msg *Message) (n int, err error) {
+	if !isRequestPayload(msg.Meta) {
+		return len(msg.Data), nil
+	}
+
+	select {
+	case <-o.stop:
+		return 0, ErrorStopped
+	case o.queue <- msg:
+	}
+	return len(msg.Data) + len(msg.Meta), nil
+}
+
+// PluginRead reads message from this plugin
+func (o *GRPCOutput) PluginRead() (*Message, error) {
+	if !o.config.TrackResponses {
+		return nil, ErrorStopped
+	}
+	var resp *response
+	var msg Message
+	select {
+	case <-o.stop:
+		return nil, ErrorStopped
+	case resp = <-o.responses:
+		msg.Data = resp.payload
+	}
+
+	msg.Meta = payloadHeader(ReplayedResponsePayload, resp.uuid, resp.startedAt, resp.roundTripTime)
+
+	return &msg, nil
+}
+
+func (o *GRPCOutput) sendRequest(msg *Message) {
+	uuid := payloadID(msg.Meta)
+	start := time.Now()
+	resp, err := o.client.Send(msg.Data)
+	stop := time.Now()
+
+	if err != nil {
+		Debug(1, fmt.Sprintf("[GRPC-OUTPUT] error when sending: %q", err))
+		return
+	}
+
+	if o.config.TrackResponses {
+		select {
+		case <-o.stop:
+		case o.responses <- &response{resp, uuid, start.UnixNano(), stop.UnixNano() - start.UnixNano()}:
+		}
+	}
+}
+
+func (o *GRPCOutput) String() string {
+	return "gRPC output: " + o.config.url.String()
+}
+
+// Close closes the data channel so that data
+func (o *GRPCOutput) Close() error {
+	close(o.stop)
+	o.client.Client.CloseIdleConnections()
+	return nil
+}
+
+// GRPCClient sends captured gRPC calls over HTTP/2, with prior knowledge for
+// http targets and ALPN for https targets
+type GRPCClient struct {
+	config *GRPCOutputConfig
+	Client *http.Client
+}
+
+// NewGRPCClient returns new HTTP/2 client
+func NewGRPCClient(config *GRPCOutputConfig) *GRPCClient {
+	transport := &xhttp2.Transport{
+		// payloads are compared as they are on the wire
+		DisableCompression: true,
+	}
+	if config.url.Scheme == "https" {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: config.SkipVerify}
+	} else {
+		transport.AllowHTTP = true
+		transport.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}
+	}
+
+	return &GRPCClient{
+		config: config,
+		Client: &http.Client{Timeout: config.Timeout, Transport: transport},
+	}
+}
+
+// Send sends HTTP/1.1 form of a captured call, the response is returned in the
+// same form as captured responses, trailers are sent as chunked trailers.
+func (c *GRPCClient) Send(data []byte) ([]byte, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	// reading the whole body fills trailers of the request
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	target := c.config.url.Scheme + "://" + c.config.url.Host + req.URL.RequestURI()
+	out, err := http.NewRequest(req.Method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range req.Header {
+		switch name {
+		case "Connection", "Transfer-Encoding", "Keep-Alive", "Upgrade", "Trailer", "Te":
+			continue
+		}
+		out.Header[name] = values
+	}
+	out.Header.Set("Te", "trailers")
+	if len(req.Trailer) > 0 {
+		out.Trailer = req.Trailer
+	}
+
+	resp, err := c.Client.Do(out)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// trailers are known only after the body is read
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !c.config.TrackResponses {
+		return nil, nil
+	}
+
+	m := &http2.Message{Body: respBody}
+	m.Headers = append(m.Headers, hpack.HeaderField{Name: ":status", Value: strconv.Itoa(resp.StatusCode)})
+	m.Headers = appendFields(m.Headers, resp.Header)
+	m.Trailers = appendFields(m.Trailers, resp.Trailer)
+	return http2.ResponseHTTP1(m), nil
+}
+
+func appendFields(fields []hpack.HeaderField, h http.Header) []hpack.HeaderField {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range h[name] {
+			fields = append(fields, hpack.HeaderField{Name: strings.ToLower(name), Value: value})
+		}
+	}
+	return fields
+}
@@ -0,0 +1,61 @@
+package goreplay
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	xhttp2 "golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestGRPCOutput(t *testing.T) {
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 {
+			t.Error("Expected HTTP/2 request, got", req.Proto)
+		}
+		if req.URL.Path != "/helloworld.Greeter/SayHello" || req.Header.Get("Content-Type") != "application/grpc" {
+			t.Error("Wrong request", req.URL.Path, req.Header)
+		}
+		body, _ := io.ReadAll(req.Body)
+		if !bytes.Equal(body, []byte("\x00\x00\x00\x00\x03abc")) {
+			t.Errorf("Wrong body %q", body)
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("\x00\x00\x00\x00\x02ok"))
+		w.Header().Set("Grpc-Status", "0")
+	}), &xhttp2.Server{}))
+	defer server.Close()
+
+	output := NewGRPCOutput(server.URL, &GRPCOutputConfig{TrackResponses: true})
+	defer output.(*GRPCOutput).Close()
+
+	req := "POST /helloworld.Greeter/SayHello HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/grpc\r\nTe: trailers\r\nContent-Length: 8\r\n\r\n\x00\x00\x00\x00\x03abc"
+	id := uuid()
+	output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, id, time.Now().UnixNano(), -1), Data: []byte(req)})
+
+	done := make(chan *Message)
+	go func() {
+		msg, _ := output.PluginRead()
+		done <- msg
+	}()
+
+	select {
+	case msg := <-done:
+		if msg.Meta[0] != ReplayedResponsePayload || !bytes.Equal(payloadID(msg.Meta), id) {
+			t.Errorf("Wrong meta %q", msg.Meta)
+		}
+		resp := string(msg.Data)
+		if !strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(resp, "7\r\n\x00\x00\x00\x00\x02ok\r\n0\r\nGrpc-Status: 0\r\n\r\n") {
+			t.Errorf("Wrong response %q", resp)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("No response")
+	}
+}
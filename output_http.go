@@ -4,13 +4,17 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/tls"
+	"errors"
+	"expvar"
 	"fmt"
 	"github.com/buger/goreplay/internal/size"
+	"io"
 	"log"
 	"math"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -19,8 +23,13 @@ const (
 	initialDynamicWorkers = 10
 	readChunkSize         = 64 * 1024
 	maxResponseSize       = 1073741824
+	// number of body chunks buffered per streamed request, the request is
+	// aborted when the target reads them slower than they are captured
+	streamQueueLen = 64
 )
 
+var errStreamOverflow = errors.New("streamed body is read too slowly")
+
 type response struct {
 	payload       []byte
 	uuid          []byte
@@ -43,6 +52,8 @@ type HTTPOutputConfig struct {
 	WorkerTimeout  time.Duration `json:"output-http-worker-timeout"`
 	BufferSize     size.Size     `json:"output-http-response-buffer"`
 	SkipVerify     bool          `json:"output-http-skip-verify"`
+	Sessions       bool          `json:"output-http-sessions"`
+	CookieJar      bool          `json:"output-http-cookie-jar"`
 	rawURL         string
 	url            *url.URL
 }
@@ -62,6 +73,8 @@ func (hoc *HTTPOutputConfig) Copy() *HTTPOutputConfig {
 		WorkerTimeout:  hoc.WorkerTimeout,
 		BufferSize:     hoc.BufferSize,
 		SkipVerify:     hoc.SkipVerify,
+		Sessions:       hoc.Sessions,
+		CookieJar:      hoc.CookieJar,
 	}
 }
 
@@ -78,6 +91,107 @@ type HTTPOutput struct {
 	queue         chan *Message
 	responses     chan *response
 	stop          chan bool // Channel used only to indicate goroutine should shutdown
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*httpSession
+	stats      *expvar.Map
+
+	streamsMu sync.Mutex
+	streams   map[string]*httpStream // bodies of streamed requests by their ID
+
+	cookies *httpCookieJar
+}
+
+// httpStream is the body of a streamed request, chunks captured after its
+// headers are queued to it while the request is being sent. Queuing never
+// blocks, so a slow target does not stall other outputs.
+type httpStream struct {
+	chunks chan []byte
+	done   chan struct{} // closed when the stream is aborted
+	buf    []byte
+	err    error
+
+	mu     sync.Mutex
+	closed bool // the last chunk was queued or the stream was aborted
+}
+
+func newHTTPStream() *httpStream {
+	return &httpStream{chunks: make(chan []byte, streamQueueLen), done: make(chan struct{})}
+}
+
+// Read reads queued chunks until the last one
+func (s *httpStream) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		select {
+		case chunk, ok := <-s.chunks:
+			if !ok {
+				return 0, io.EOF
+			}
+			s.buf = chunk
+		case <-s.done:
+			return 0, s.err
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// write queues the chunk, more tells whether other chunks follow. The stream
+// is aborted if its queue is full.
+func (s *httpStream) write(data []byte, more bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return io.ErrClosedPipe
+	}
+	select {
+	case s.chunks <- data:
+	default:
+		s.abortLocked(errStreamOverflow)
+		return errStreamOverflow
+	}
+	if !more {
+		s.closed = true
+		close(s.chunks)
+	}
+	return nil
+}
+
+// abort fails reading of the body, chunks which were not read are dropped
+func (s *httpStream) abort(err error) {
+	s.mu.Lock()
+	s.abortLocked(err)
+	s.mu.Unlock()
+}
+
+// aborted returns the error the stream was aborted with, or nil
+func (s *httpStream) aborted() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+func (s *httpStream) abortLocked(err error) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	s.closed = true
+	s.err = err
+	close(s.done)
+}
+
+// httpSession replays requests of a captured connection in their order, using
+// a single keep-alive connection
+type httpSession struct {
+	queue   chan *Message
+	client  *HTTPClient
+	sending int // requests being queued, guarded by sessionsMu
 }
 
 // NewHTTPOutput constructor for HTTPOutput
@@ -128,6 +242,17 @@ func NewHTTPOutput(address string, config *HTTPOutputConfig) PluginReadWriter {
 	}
 
 	o.queue = make(chan *Message, o.config.QueueLen)
+	o.sessions = make(map[string]*httpSession)
+	if o.config.Sessions {
+		name := "http-output-" + o.config.rawURL
+		if o.stats, _ = expvar.Get(name).(*expvar.Map); o.stats == nil {
+			o.stats = expvar.NewMap(name)
+		}
+	}
+	o.streams = make(map[string]*httpStream)
+	if o.config.CookieJar {
+		o.cookies = newHTTPCookieJar()
+	}
 	if o.config.TrackResponses {
 		o.responses = make(chan *response, o.config.QueueLen)
 	}
@@ -187,13 +312,49 @@ func (o *HTTPOutput) startWorker() {
 
 // PluginWrite writes message to this plugin
 func (o *HTTPOutput) PluginWrite(msg *Message) (n int, err error) {
+	if msg.Meta[0] == RequestChunkPayload {
+		return o.writeChunk(msg)
+	}
+	if o.cookies != nil && msg.Meta[0] == ResponsePayload {
+		o.cookies.original(payloadID(msg.Meta), msg.Data)
+	}
 	if !isRequestPayload(msg.Meta) {
 		return len(msg.Data), nil
 	}
+	id := string(payloadID(msg.Meta))
+	var stream *httpStream
+	if chunk, more := payloadChunk(msg.Meta); chunk == 1 && more {
+		// the body follows in chunks, the stream is known before a worker
+		// can send the request
+		stream = newHTTPStream()
+		o.streamsMu.Lock()
+		o.streams[id] = stream
+		o.streamsMu.Unlock()
+	}
+
+	var queued bool
+	if o.config.Sessions {
+		queued, err = o.writeSession(msg)
+	} else {
+		queued, err = o.queueRequest(msg)
+	}
+	if !queued && stream != nil {
+		// chunks of the request are dropped
+		o.closeStream(id, stream)
+		stream.abort(io.ErrClosedPipe)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(msg.Data) + len(msg.Meta), nil
+}
 
+// queueRequest queues the request to the workers, it reports whether the
+// request was queued
+func (o *HTTPOutput) queueRequest(msg *Message) (queued bool, err error) {
 	select {
 	case <-o.stop:
-		return 0, ErrorStopped
+		return false, ErrorStopped
 	case o.queue <- msg:
 	}
 
@@ -207,9 +368,100 @@ func (o *HTTPOutput) PluginWrite(msg *Message) (n int, err error) {
 			atomic.AddInt32(&o.activeWorkers, 1)
 		}
 	}
+	return true, nil
+}
+
+// writeSession queues the request to the worker of its captured connection.
+// At most output-http-workers sessions are replayed at once, requests of other
+// sessions are dropped. It reports whether the request was queued.
+func (o *HTTPOutput) writeSession(msg *Message) (queued bool, err error) {
+	connID, _ := payloadSession(msg.Meta)
+
+	o.sessionsMu.Lock()
+	s, ok := o.sessions[string(connID)]
+	if !ok {
+		if len(o.sessions) >= o.config.WorkersMax {
+			o.sessionsMu.Unlock()
+			o.stats.Add("dropped", 1)
+			Debug(2, "[HTTP-OUTPUT] too many sessions, request dropped")
+			return false, nil
+		}
+		s = &httpSession{
+			queue:  make(chan *Message, o.config.QueueLen),
+			client: newSessionHTTPClient(o.config),
+		}
+		o.sessions[string(connID)] = s
+		o.stats.Add("sessions", 1)
+		go o.sessionWorker(string(connID), s)
+	}
+	// the worker does not stop while the request is being queued
+	s.sending++
+	o.sessionsMu.Unlock()
+
+	defer func() {
+		o.sessionsMu.Lock()
+		s.sending--
+		o.sessionsMu.Unlock()
+	}()
+	select {
+	case <-o.stop:
+		return false, ErrorStopped
+	case s.queue <- msg:
+	}
+	return true, nil
+}
+
+// writeChunk queues a body chunk of a streamed request to the request being
+// sent. Chunks of requests which are not sent anymore are dropped, the request
+// is aborted if too many chunks wait for it.
+func (o *HTTPOutput) writeChunk(msg *Message) (n int, err error) {
+	id := string(payloadID(msg.Meta))
+	o.streamsMu.Lock()
+	s, ok := o.streams[id]
+	o.streamsMu.Unlock()
+	if !ok {
+		return len(msg.Data), nil
+	}
+
+	// the stream is forgotten once its request is sent or aborted
+	_, more := payloadChunk(msg.Meta)
+	if err := s.write(msg.Data, more); err != nil {
+		Debug(2, fmt.Sprintf("[HTTP-OUTPUT] body chunk was not sent: %q", err))
+	}
 	return len(msg.Data) + len(msg.Meta), nil
 }
 
+// closeStream forgets the body of a streamed request
+func (o *HTTPOutput) closeStream(id string, s *httpStream) {
+	o.streamsMu.Lock()
+	if o.streams[id] == s {
+		delete(o.streams, id)
+	}
+	o.streamsMu.Unlock()
+}
+
+// sessionWorker sends requests of a session one by one, it stops when the
+// session is idle for output-http-worker-timeout
+func (o *HTTPOutput) sessionWorker(id string, s *httpSession) {
+	defer s.client.Client.CloseIdleConnections()
+	for {
+		select {
+		case <-o.stop:
+			return
+		case msg := <-s.queue:
+			o.sendRequest(s.client, msg)
+		case <-time.After(o.config.WorkerTimeout):
+			o.sessionsMu.Lock()
+			if len(s.queue) == 0 && s.sending == 0 {
+				delete(o.sessions, id)
+				o.sessionsMu.Unlock()
+				return
+			}
+			o.sessionsMu.Unlock()
+		}
+	}
+}
+
 // PluginRead reads message from this plugin
 func (o *HTTPOutput) PluginRead() (*Message, error) {
 	if !o.config.TrackResponses {
@@ -235,14 +487,40 @@ func (o *HTTPOutput) sendRequest(client *HTTPClient, msg *Message) {
 	}
 
 	uuid := payloadID(msg.Meta)
+	var body io.Reader
+	o.streamsMu.Lock()
+	s := o.streams[string(uuid)]
+	o.streamsMu.Unlock()
+	if s != nil {
+		if err := s.aborted(); err != nil {
+			o.closeStream(string(uuid), s)
+			Debug(1, fmt.Sprintf("[HTTP-OUTPUT] error when sending: %q", err))
+			return
+		}
+		body = s
+		defer func() {
+			// chunks which were not sent yet are dropped
+			o.closeStream(string(uuid), s)
+			s.abort(io.ErrClosedPipe)
+		}()
+	}
+
+	data := msg.Data
+	if o.cookies != nil {
+		data = o.cookies.rewrite(data)
+	}
+
 	start := time.Now()
-	resp, err := client.Send(msg.Data)
+	resp, cookies, err := client.sendStream(data, body)
 	stop := time.Now()
 
 	if err != nil {
 		Debug(1, fmt.Sprintf("[HTTP-OUTPUT] error when sending: %q", err))
 		return
 	}
+	if o.cookies != nil {
+		o.cookies.replayed(uuid, msg.Data, cookies)
+	}
 	if resp == nil {
 		return
 	}
@@ -264,6 +542,11 @@ func (o *HTTPOutput) String() string {
 func (o *HTTPOutput) Close() error {
 	close(o.stop)
 	close(o.stopWorker)
+	o.streamsMu.Lock()
+	for _, s := range o.streams {
+		s.abort(ErrorStopped)
+	}
+	o.streamsMu.Unlock()
 	return nil
 }
 
@@ -301,19 +584,48 @@ func NewHTTPClient(config *HTTPOutputConfig) *HTTPClient {
 	return client
 }
 
+// newSessionHTTPClient returns HTTPClient which sends all requests over a
+// single keep-alive connection
+func newSessionHTTPClient(config *HTTPOutputConfig) *HTTPClient {
+	client := NewHTTPClient(config)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.SkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	transport.MaxConnsPerHost = 1
+	transport.MaxIdleConnsPerHost = 1
+	client.Client.Transport = transport
+	return client
+}
+
 // Send sends an http request using client create by NewHTTPClient
 func (c *HTTPClient) Send(data []byte) ([]byte, error) {
+	return c.SendStream(data, nil)
+}
+
+// SendStream sends an http request whose body is read from body while the
+// request is being sent, data is the start of the request with its headers
+func (c *HTTPClient) SendStream(data []byte, body io.Reader) ([]byte, error) {
+	payload, _, err := c.sendStream(data, body)
+	return payload, err
+}
+
+// sendStream is SendStream which also returns cookies set by the response
+func (c *HTTPClient) sendStream(data []byte, body io.Reader) (payload []byte, cookies []*http.Cookie, err error) {
 	var req *http.Request
 	var resp *http.Response
-	var err error
 
-	req, err = http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	var r io.Reader = bytes.NewReader(data)
+	if body != nil {
+		r = io.MultiReader(r, body)
+	}
+	req, err = http.ReadRequest(bufio.NewReader(r))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	// we don't send CONNECT or OPTIONS request
 	if req.Method == http.MethodConnect {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	if !c.config.OriginalHost {
@@ -335,11 +647,13 @@ func (c *HTTPClient) Send(data []byte) ([]byte, error) {
 
 	resp, err = c.Client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	cookies = resp.Cookies()
 	if c.config.TrackResponses {
-		return httputil.DumpResponse(resp, true)
+		payload, err = httputil.DumpResponse(resp, true)
+		return payload, cookies, err
 	}
 	_ = resp.Body.Close()
-	return nil, nil
+	return nil, cookies, nil
 }
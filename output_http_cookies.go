@@ -0,0 +1,186 @@
+package goreplay
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/coocood/freecache"
+)
+
+const (
+	cookieJarSize = 32 * 1024 * 1024 // 32M
+	// seconds the original and the replayed response of a request wait for
+	// each other
+	cookiePendingTimeout = 60
+)
+
+// httpCookieJar keeps cookies issued by the replay target for sessions of the
+// captured traffic. A session is identified by a cookie which the captured
+// server set, like sid=abc. Cookies set by the original and the replayed
+// response to the same request are paired: later requests with sid=abc get
+// the cookies the replay target set instead. The jar is bounded, sessions
+// which were not used for a long time are evicted.
+type httpCookieJar struct {
+	mu    sync.Mutex // serializes updates of jars
+	cache *freecache.Cache
+}
+
+func newHTTPCookieJar() *httpCookieJar {
+	return &httpCookieJar{cache: freecache.NewCache(cookieJarSize)}
+}
+
+// rewrite returns the request with cookies of its sessions, data is not
+// modified. Cookies of the request are replaced by cookies of the same name
+// issued by the replay target, other cookies issued by it are appended.
+func (j *httpCookieJar) rewrite(data []byte) []byte {
+	cookies := requestCookies(data)
+	jar := j.sessionsJar(cookies)
+	if len(jar) == 0 {
+		return data
+	}
+
+	pairs := make([]string, 0, len(cookies)+len(jar))
+	seen := make(map[string]bool)
+	for _, c := range cookies {
+		value := c.Value
+		if v, ok := jar[c.Name]; ok {
+			value = v
+			seen[c.Name] = true
+		}
+		pairs = append(pairs, c.Name+"="+value)
+	}
+	for _, name := range sortedNames(jar) {
+		if !seen[name] {
+			pairs = append(pairs, name+"="+jar[name])
+		}
+	}
+	return proto.SetHeader(append([]byte(nil), data...), []byte("Cookie"), []byte(strings.Join(pairs, "; ")))
+}
+
+// replayed updates jars of sessions of the original request with cookies the
+// replay target set in the response to it
+func (j *httpCookieJar) replayed(id, request []byte, set []*http.Cookie) {
+	cookies := requestCookies(request)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	jar := j.sessionsJar(cookies)
+	if len(set) == 0 && len(jar) == 0 {
+		return
+	}
+	now := time.Now()
+	for _, c := range set {
+		if c.MaxAge < 0 || (!c.Expires.IsZero() && c.Expires.Before(now)) {
+			delete(jar, c.Name)
+		} else {
+			jar[c.Name] = c.Value
+		}
+	}
+	value := encodeCookieJar(jar)
+	for _, c := range cookies {
+		key := sessionKey(c.Name, c.Value)
+		if _, err := j.cache.Get(key); err == nil {
+			j.cache.Set(key, value, 0)
+		}
+	}
+
+	// sessions created by the original response
+	if sessions, err := j.cache.Get(pendingKey('o', id)); err == nil {
+		j.cache.Del(pendingKey('o', id))
+		j.setSessions(sessions, value)
+		return
+	}
+	j.cache.Set(pendingKey('r', id), value, cookiePendingTimeout)
+}
+
+// original creates sessions of cookies set by the original response
+func (j *httpCookieJar) original(id, response []byte) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(response)), nil)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	var keys [][]byte
+	for _, c := range resp.Cookies() {
+		if c.Value != "" && c.MaxAge >= 0 {
+			keys = append(keys, sessionKey(c.Name, c.Value))
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	sessions := bytes.Join(keys, []byte("\n"))
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if jar, err := j.cache.Get(pendingKey('r', id)); err == nil {
+		j.cache.Del(pendingKey('r', id))
+		j.setSessions(sessions, jar)
+		return
+	}
+	j.cache.Set(pendingKey('o', id), sessions, cookiePendingTimeout)
+}
+
+// setSessions sets jars of the sessions, separated by new lines
+func (j *httpCookieJar) setSessions(sessions, jar []byte) {
+	for _, key := range bytes.Split(sessions, []byte("\n")) {
+		j.cache.Set(key, jar, 0)
+	}
+}
+
+// sessionsJar returns cookies of all sessions of the request cookies
+func (j *httpCookieJar) sessionsJar(cookies []*http.Cookie) map[string]string {
+	jar := make(map[string]string)
+	for _, c := range cookies {
+		value, err := j.cache.Get(sessionKey(c.Name, c.Value))
+		if err != nil {
+			continue
+		}
+		for _, pair := range strings.Split(string(value), "; ") {
+			if name, value, ok := strings.Cut(pair, "="); ok {
+				jar[name] = value
+			}
+		}
+	}
+	return jar
+}
+
+func requestCookies(request []byte) []*http.Cookie {
+	header := proto.Header(request, []byte("Cookie"))
+	if len(header) == 0 {
+		return nil
+	}
+	r := http.Request{Header: http.Header{"Cookie": {string(header)}}}
+	return r.Cookies()
+}
+
+func sessionKey(name, value string) []byte {
+	return []byte("s" + name + "=" + value)
+}
+
+func pendingKey(kind byte, id []byte) []byte {
+	return append([]byte{kind}, id...)
+}
+
+func encodeCookieJar(jar map[string]string) []byte {
+	pairs := make([]string, 0, len(jar))
+	for _, name := range sortedNames(jar) {
+		pairs = append(pairs, name+"="+jar[name])
+	}
+	return []byte(strings.Join(pairs, "; "))
+}
+
+func sortedNames(jar map[string]string) []string {
+	names := make([]string, 0, len(jar))
+	for name := range jar {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -1,12 +1,14 @@
 package goreplay
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	_ "net/http/httputil"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestHTTPOutput(t *testing.T) {
@@ -179,6 +181,162 @@ func TestHTTPOutputSessions(t *testing.T) {
 	Settings.SplitOutput = false
 }
 
+func TestHTTPOutputSessionOrder(t *testing.T) {
+	var mu sync.Mutex
+	paths := make(map[string][]string) // remote address -> paths
+	wg := new(sync.WaitGroup)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		paths[req.RemoteAddr] = append(paths[req.RemoteAddr], req.URL.Path)
+		mu.Unlock()
+		wg.Done()
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{Sessions: true, WorkersMax: 3})
+	defer output.(*HTTPOutput).Close()
+
+	for i := 0; i < 10; i++ {
+		for _, conn := range []string{"a", "b", "c"} {
+			wg.Add(1)
+			output.PluginWrite(&Message{
+				Meta: payloadSessionHeader(RequestPayload, uuid(), 1, -1, []byte(conn), uint32(i+1)),
+				Data: []byte(fmt.Sprintf("GET /%s/%d HTTP/1.1\r\n\r\n", conn, i)),
+			})
+		}
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(paths) != 3 {
+		t.Fatalf("expected a connection per session, got %v", paths)
+	}
+	for _, p := range paths {
+		for i := range p {
+			if p[i] != fmt.Sprintf("%s%d", p[0][:3], i) {
+				t.Errorf("requests of a session should be sent in order over one connection: %v", p)
+				break
+			}
+		}
+	}
+	// sessions over output-http-workers are dropped
+	output.PluginWrite(&Message{
+		Meta: payloadSessionHeader(RequestPayload, uuid(), 1, -1, []byte("d"), 1),
+		Data: []byte("GET /d/0 HTTP/1.1\r\n\r\n"),
+	})
+	if dropped := output.(*HTTPOutput).stats.Get("dropped"); dropped == nil || dropped.String() != "1" {
+		t.Errorf("the request of the fourth session should be dropped, got %v", dropped)
+	}
+	// the body of a dropped streamed request is not waited for
+	output.PluginWrite(&Message{
+		Meta: payloadChunkHeader(RequestPayload, uuid(), 1, -1, []byte("d"), 2, 1, true),
+		Data: []byte("POST /d/1 HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n"),
+	})
+	output.(*HTTPOutput).streamsMu.Lock()
+	if streams := len(output.(*HTTPOutput).streams); streams != 0 {
+		t.Errorf("the stream of a dropped request should be forgotten, got %d streams", streams)
+	}
+	output.(*HTTPOutput).streamsMu.Unlock()
+}
+
+func TestHTTPOutputStream(t *testing.T) {
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies <- string(body)
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{})
+	defer output.(*HTTPOutput).Close()
+
+	id := uuid()
+	parts := []struct {
+		payloadType byte
+		data        string
+	}{
+		{RequestPayload, "POST /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n"},
+		{RequestChunkPayload, "5\r\nhello\r\n"},
+		{RequestChunkPayload, "6\r\n world\r\n0\r\n\r\n"},
+	}
+	for i, p := range parts {
+		output.PluginWrite(&Message{
+			Meta: payloadChunkHeader(p.payloadType, id, 1, -1, []byte("conn"), 1, uint32(i+1), i < len(parts)-1),
+			Data: []byte(p.data),
+		})
+	}
+	select {
+	case body := <-bodies:
+		if body != "hello world" {
+			t.Errorf("expected the streamed body, got %q", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the request was not sent")
+	}
+
+	// chunks of requests which are not being sent are dropped
+	done := make(chan struct{})
+	go func() {
+		output.PluginWrite(&Message{Meta: payloadChunkHeader(RequestChunkPayload, uuid(), 1, -1, []byte("conn"), 2, 2, true), Data: []byte("1\r\na\r\n")})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("a chunk without request should not block")
+	}
+}
+
+func TestHTTPOutputStreamOverflow(t *testing.T) {
+	unblock := make(chan struct{})
+	bodies := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			<-unblock
+		}
+		if body, err := ioutil.ReadAll(req.Body); err == nil {
+			bodies <- req.URL.Path + " " + string(body)
+		}
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{WorkersMin: 1, WorkersMax: 1})
+	defer output.(*HTTPOutput).Close()
+
+	// the only worker waits for the slow request, so chunks of the upload
+	// are not read
+	output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, uuid(), 1, -1), Data: []byte("GET /slow HTTP/1.1\r\n\r\n")})
+	id := uuid()
+	output.PluginWrite(&Message{
+		Meta: payloadChunkHeader(RequestPayload, id, 1, -1, []byte("conn"), 1, 1, true),
+		Data: []byte("POST /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n"),
+	})
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i <= streamQueueLen; i++ {
+			output.PluginWrite(&Message{Meta: payloadChunkHeader(RequestChunkPayload, id, 1, -1, []byte("conn"), 1, uint32(i+2), true), Data: []byte("1\r\na\r\n")})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("chunks of a slow request should not block")
+	}
+	close(unblock)
+
+	if body := <-bodies; body != "/slow " {
+		t.Errorf("unexpected request %q", body)
+	}
+	select {
+	case body := <-bodies:
+		t.Errorf("the overflowed request should be aborted, got %q", body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
 func BenchmarkHTTPOutput(b *testing.B) {
 	wg := new(sync.WaitGroup)
 
@@ -236,3 +394,53 @@ func BenchmarkHTTPOutputTLS(b *testing.B) {
 	wg.Wait()
 	emitter.Close()
 }
+
+func TestHTTPOutputCookieJar(t *testing.T) {
+	cookies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/login" {
+			user := req.URL.Query().Get("user")
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "new-" + user})
+			http.SetCookie(w, &http.Cookie{Name: "csrf", Value: "t-" + user})
+			return
+		}
+		cookies <- req.Header.Get("Cookie")
+	}))
+	defer server.Close()
+
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{CookieJar: true, TrackResponses: true})
+	defer output.(*HTTPOutput).Close()
+	send := func(id []byte, request string) {
+		output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, id, 1, -1), Data: []byte(request)})
+		if _, err := output.PluginRead(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, user := range []string{"1", "2"} {
+		id := uuid()
+		original := &Message{
+			Meta: payloadHeader(ResponsePayload, id, 1, 1),
+			Data: []byte("HTTP/1.1 302 Found\r\nSet-Cookie: sid=orig-" + user + "; Path=/\r\nContent-Length: 0\r\n\r\n"),
+		}
+		if user == "1" {
+			send(id, "GET /login?user=1 HTTP/1.1\r\n\r\n")
+			output.PluginWrite(original)
+		} else {
+			// the original response comes before the replayed one
+			output.PluginWrite(original)
+			send(id, "GET /login?user=2 HTTP/1.1\r\n\r\n")
+		}
+	}
+
+	for _, tt := range []struct{ cookie, expected string }{
+		{"sid=orig-1; theme=dark", "sid=new-1; theme=dark; csrf=t-1"},
+		{"sid=orig-2", "sid=new-2; csrf=t-2"},
+		{"sid=unknown", "sid=unknown"},
+	} {
+		output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, uuid(), 1, -1), Data: []byte("GET /profile HTTP/1.1\r\nCookie: " + tt.cookie + "\r\n\r\n")})
+		if cookie := <-cookies; cookie != tt.expected {
+			t.Errorf("expected cookies %q, got %q", tt.expected, cookie)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package goreplay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// myPackets encodes payloads as MySQL packets with increasing sequence ids
+func myPackets(seq byte, payloads ...string) (data []byte) {
+	for _, p := range payloads {
+		data = append(data, byte(len(p)), byte(len(p)>>8), byte(len(p)>>16), seq)
+		data = append(data, p...)
+		seq++
+	}
+	return
+}
+
+// myServer is a MySQL stand-in, which authenticates clients with
+// mysql_native_password, answers queries with their text and records commands
+// using prepared statements
+type myServer struct {
+	ln       net.Listener
+	password string
+	mu       sync.Mutex
+	commands map[string][]string // remote address -> commands
+}
+
+func newMyServer(t *testing.T, password string) *myServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &myServer{ln: ln, password: password, commands: make(map[string][]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *myServer) readPacket(r *bufio.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	_, err := io.ReadFull(r, payload)
+	return payload, err
+}
+
+func (s *myServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	addr := conn.RemoteAddr().String()
+
+	scramble := "abcdefghijklmnopqrst"
+	caps := "\x00\xa2\x0f\x00" // PROTOCOL_41, SECURE_CONNECTION, PLUGIN_AUTH and more
+	conn.Write(myPackets(0, "\x0a8.0.36\x00\x01\x00\x00\x00"+scramble[:8]+"\x00"+caps[:2]+"\x2d\x02\x00"+caps[2:]+
+		"\x15"+strings.Repeat("\x00", 10)+scramble[8:]+"\x00mysql_native_password\x00"))
+
+	response, err := s.readPacket(r)
+	if err != nil {
+		return
+	}
+	h1 := sha1.Sum([]byte(s.password))
+	h2 := sha1.Sum(h1[:])
+	h3 := sha1.Sum(append([]byte(scramble), h2[:]...))
+	for i := range h1 {
+		h1[i] ^= h3[i]
+	}
+	user := response[32:]
+	user = user[bytes.IndexByte(user, 0)+1:]
+	if !bytes.HasPrefix(user, append([]byte{20}, h1[:]...)) {
+		conn.Write(myPackets(2, "\xff\x15\x04#28000Access denied"))
+		return
+	}
+	conn.Write(myPackets(2, "\x00\x00\x00\x02\x00\x00\x00"))
+
+	column := "\x03def\x00\x00\x00\x01q\x00\x0c\x2d\x00\xff\x00\x00\x00\xfd\x00\x00\x00\x00\x00"
+	eof := "\xfe\x00\x00\x02\x00"
+	statements := uint32(100)
+	for {
+		cmd, err := s.readPacket(r)
+		if err != nil || len(cmd) == 0 || cmd[0] == 0x01 {
+			return
+		}
+		var command string
+		switch cmd[0] {
+		case 0x03:
+			command = string(cmd[1:])
+			conn.Write(myPackets(1, "\x01", column, eof, string(append([]byte{byte(len(cmd) - 1)}, cmd[1:]...)), eof))
+		case 0x16:
+			statements++
+			command = fmt.Sprintf("prepare %d", statements)
+			ok := "\x00" + string(binary.LittleEndian.AppendUint32(nil, statements)) + "\x01\x00\x00\x00\x00\x00\x00"
+			conn.Write(myPackets(1, ok, column, eof))
+		case 0x17:
+			command = fmt.Sprintf("execute %d", binary.LittleEndian.Uint32(cmd[1:]))
+			conn.Write(myPackets(1, "\x00\x00\x00\x02\x00\x00\x00"))
+		case 0x19:
+			command = fmt.Sprintf("close %d", binary.LittleEndian.Uint32(cmd[1:]))
+		}
+		s.mu.Lock()
+		s.commands[addr] = append(s.commands[addr], command)
+		s.mu.Unlock()
+	}
+}
+
+func TestMySQLOutput(t *testing.T) {
+	server := newMyServer(t, "secret")
+	defer server.ln.Close()
+
+	output := NewMySQLOutput("mysql://app:secret@"+server.ln.Addr().String()+"/app", &MySQLOutputConfig{TrackResponses: true})
+	defer output.(*MySQLOutput).Close()
+
+	write := func(conn string, seq uint32, typ byte, data []byte) []byte {
+		meta := payloadSessionHeader(typ, uuid(), 1, -1, []byte(conn), seq)
+		output.PluginWrite(&Message{Meta: meta, Data: data})
+		return payloadID(meta)
+	}
+	stmt := func(cmd byte, id uint32) []byte {
+		return myPackets(0, string(cmd)+string(binary.LittleEndian.AppendUint32(nil, id))+"\x00\x01\x00\x00\x00")
+	}
+
+	ids := make(map[string]string)
+	for i, conn := range []string{"a", "b"} {
+		query := fmt.Sprintf("select '%s'", conn)
+		ids[string(write(conn, 1, RequestPayload, myPackets(0, "\x03"+query)))] = query
+		write(conn, 2, RequestPayload, myPackets(0, "\x16select ?"))
+		captured := uint32(7 + i)
+		if conn == "a" {
+			// without the captured response statements are mapped in order
+			write(conn, 2, ResponsePayload, myPackets(1, "\x00"+string(binary.LittleEndian.AppendUint32(nil, captured))+"\x01\x00\x00\x00\x00\x00\x00"))
+		}
+		write(conn, 3, RequestPayload, stmt(0x17, captured))
+		write(conn, 4, RequestPayload, stmt(0x19, captured))
+	}
+
+	for len(ids) > 0 {
+		done := make(chan *Message)
+		go func() {
+			msg, _ := output.PluginRead()
+			done <- msg
+		}()
+		select {
+		case msg := <-done:
+			if msg.Meta[0] != ReplayedResponsePayload {
+				t.Fatalf("wrong meta %q", msg.Meta)
+			}
+			query, ok := ids[string(payloadID(msg.Meta))]
+			if !ok {
+				// responses to prepared statements
+				continue
+			}
+			delete(ids, string(payloadID(msg.Meta)))
+			if !strings.Contains(string(msg.Data), query) {
+				t.Errorf("wrong response %q", msg.Data)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no response")
+		}
+	}
+
+	// the last command does not have a response
+	time.Sleep(100 * time.Millisecond)
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.commands) != 2 {
+		t.Fatalf("expected a connection per session, got %v", server.commands)
+	}
+	for _, commands := range server.commands {
+		expected := []string{commands[0], "prepare 101", "execute 101", "close 101"}
+		if fmt.Sprint(commands) != fmt.Sprint(expected) {
+			t.Errorf("expected %v, got %v", expected, commands)
+		}
+	}
+}
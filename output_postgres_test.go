@@ -0,0 +1,186 @@
+package goreplay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xdg-go/scram"
+)
+
+func pgMessage(typ byte, body string) []byte {
+	msg := []byte{typ, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(body)))
+	return append(msg, body...)
+}
+
+func pgReadMessage(r *bufio.Reader) (typ byte, body []byte, err error) {
+	var header [5]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	body = make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+	_, err = io.ReadFull(r, body)
+	return header[0], body, err
+}
+
+// pgServer is a PostgreSQL stand-in, which authenticates clients with
+// SCRAM-SHA-256 and answers every query with its text
+type pgServer struct {
+	ln      net.Listener
+	mu      sync.Mutex
+	queries map[string][]string // remote address -> queries
+	params  map[string]string   // startup parameters of the last connection
+}
+
+func newPGServer(t *testing.T, user, password string) *pgServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := scram.SHA256.NewClient(user, password, "")
+	credentials := client.GetStoredCredentials(scram.KeyFactors{Salt: "salt", Iters: 4096})
+	server, err := scram.SHA256.NewServer(func(string) (scram.StoredCredentials, error) {
+		return credentials, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &pgServer{ln: ln, queries: make(map[string][]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, server.NewConversation())
+		}
+	}()
+	return s
+}
+
+func (s *pgServer) serve(conn net.Conn, sasl *scram.ServerConversation) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return
+	}
+	startup := make([]byte, binary.BigEndian.Uint32(length[:])-4)
+	if _, err := io.ReadFull(r, startup); err != nil {
+		return
+	}
+	params := make(map[string]string)
+	fields := strings.Split(string(startup[4:]), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		params[fields[i]] = fields[i+1]
+	}
+	s.mu.Lock()
+	s.params = params
+	s.mu.Unlock()
+
+	conn.Write(pgMessage('R', "\x00\x00\x00\x0aSCRAM-SHA-256\x00\x00"))
+	for step := 0; !sasl.Done(); step++ {
+		_, body, err := pgReadMessage(r)
+		if err != nil {
+			return
+		}
+		if step == 0 {
+			// mechanism name and length of the client-first message
+			body = body[strings.IndexByte(string(body), 0)+5:]
+		}
+		resp, err := sasl.Step(string(body))
+		if err != nil {
+			conn.Write(pgMessage('E', "SFATAL\x00VFATAL\x00C28P01\x00Mpassword authentication failed\x00\x00"))
+			return
+		}
+		code := "\x00\x00\x00\x0b"
+		if sasl.Done() {
+			code = "\x00\x00\x00\x0c"
+		}
+		conn.Write(pgMessage('R', code+resp))
+	}
+	conn.Write(append(pgMessage('R', "\x00\x00\x00\x00"), pgMessage('Z', "I")...))
+
+	for {
+		typ, body, err := pgReadMessage(r)
+		if err != nil || typ == 'X' {
+			return
+		}
+		if typ == 'Q' {
+			query := strings.TrimSuffix(string(body), "\x00")
+			s.mu.Lock()
+			s.queries[conn.RemoteAddr().String()] = append(s.queries[conn.RemoteAddr().String()], query)
+			s.mu.Unlock()
+			conn.Write(append(append(pgMessage('D', "\x00\x01"+string(binary.BigEndian.AppendUint32(nil, uint32(len(query))))+query), pgMessage('C', "SELECT 1\x00")...), pgMessage('Z', "I")...))
+		}
+	}
+}
+
+func TestPostgresOutput(t *testing.T) {
+	server := newPGServer(t, "app", "secret")
+	defer server.ln.Close()
+
+	output := NewPostgresOutput("postgres://app:secret@"+server.ln.Addr().String()+"/app", &PostgresOutputConfig{TrackResponses: true, ReadOnly: true})
+	defer output.(*PostgresOutput).Close()
+
+	startup := []byte("\x00\x00\x00\x12\x00\x03\x00\x00user\x00app\x00\x00")
+	ids := make(map[string]string)
+	for i := 0; i < 5; i++ {
+		for _, conn := range []string{"a", "b"} {
+			meta := payloadSessionHeader(RequestPayload, uuid(), 1, -1, []byte(conn), uint32(i+1))
+			data := pgMessage('Q', fmt.Sprintf("select '%s%d'\x00", conn, i))
+			if i == 0 {
+				// the captured startup is replaced by the output's own one
+				output.PluginWrite(&Message{Meta: payloadSessionHeader(RequestPayload, uuid(), 1, -1, []byte(conn), 0), Data: startup})
+			}
+			ids[string(payloadID(meta))] = fmt.Sprintf("%s%d", conn, i)
+			output.PluginWrite(&Message{Meta: meta, Data: data})
+		}
+	}
+
+	for range ids {
+		done := make(chan *Message)
+		go func() {
+			msg, _ := output.PluginRead()
+			done <- msg
+		}()
+		select {
+		case msg := <-done:
+			query, ok := ids[string(payloadID(msg.Meta))]
+			if msg.Meta[0] != ReplayedResponsePayload || !ok {
+				t.Fatalf("wrong meta %q", msg.Meta)
+			}
+			if !strings.Contains(string(msg.Data), "select '"+query+"'") || !strings.HasSuffix(string(msg.Data), "Z\x00\x00\x00\x05I") {
+				t.Errorf("wrong response %q", msg.Data)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no response")
+		}
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.params["default_transaction_read_only"] != "on" || server.params["database"] != "app" {
+		t.Errorf("wrong startup parameters %v", server.params)
+	}
+	if len(server.queries) != 2 {
+		t.Fatalf("expected a connection per session, got %v", server.queries)
+	}
+	for _, queries := range server.queries {
+		for i, q := range queries {
+			if q != fmt.Sprintf("select '%s%d'", queries[0][8:9], i) {
+				t.Errorf("queries of a session should be sent in order over one connection: %v", queries)
+				break
+			}
+		}
+	}
+}
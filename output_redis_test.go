@@ -0,0 +1,172 @@
+package goreplay
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/internal/redis"
+)
+
+// redisServer is a Redis stand-in, which keeps strings in memory and records
+// commands of every connection
+type redisServer struct {
+	ln       net.Listener
+	password string
+	mu       sync.Mutex
+	data     map[string]string
+	commands map[string][]string // remote address -> commands
+}
+
+func newRedisServer(t *testing.T, password string) *redisServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &redisServer{ln: ln, password: password, data: make(map[string]string), commands: make(map[string][]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *redisServer) serve(conn net.Conn) {
+	defer conn.Close()
+	addr := conn.RemoteAddr().String()
+	authenticated := false
+
+	var buf []byte
+	chunk := make([]byte, 4096)
+	for {
+		size, err := redis.Next(buf, true)
+		if err != nil {
+			return
+		}
+		if size < 0 {
+			n, err := conn.Read(chunk)
+			if err != nil {
+				return
+			}
+			buf = append(buf, chunk[:n]...)
+			continue
+		}
+		args := redis.Args(buf[:size])
+		buf = buf[size:]
+
+		s.mu.Lock()
+		s.commands[addr] = append(s.commands[addr], strings.ToUpper(string(bytesJoin(args))))
+		var reply string
+		switch name := redis.Name(args); {
+		case name == "AUTH":
+			authenticated = string(args[len(args)-1]) == s.password
+			reply = "+OK\r\n"
+			if !authenticated {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case name == "SELECT" || name == "QUIT":
+			reply = "+OK\r\n"
+		case name == "SET":
+			s.data[string(args[1])] = string(args[2])
+			reply = "+OK\r\n"
+		case name == "GET":
+			v, ok := s.data[string(args[1])]
+			reply = "$-1\r\n"
+			if ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		s.mu.Unlock()
+
+		conn.Write([]byte(reply))
+		if redis.Name(args) == "QUIT" {
+			return
+		}
+	}
+}
+
+func bytesJoin(args [][]byte) []byte {
+	var joined []byte
+	for i, arg := range args {
+		if i > 0 {
+			joined = append(joined, ' ')
+		}
+		joined = append(joined, arg...)
+	}
+	return joined
+}
+
+func TestRedisOutput(t *testing.T) {
+	server := newRedisServer(t, "secret")
+	defer server.ln.Close()
+
+	output := NewRedisOutput("redis://:secret@"+server.ln.Addr().String()+"/2", &RedisOutputConfig{TrackResponses: true})
+	defer output.(*RedisOutput).Close()
+
+	expected := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		for _, conn := range []string{"a", "b"} {
+			var cmd []byte
+			var reply string
+			switch {
+			case i == 0:
+				// captured credentials are not replayed
+				cmd = redis.Command([]byte("AUTH"), []byte("production"))
+			case i%2 == 1:
+				cmd = redis.Command([]byte("SET"), []byte(fmt.Sprintf("%s%d", conn, i)), []byte(fmt.Sprint(i)))
+				reply = "+OK\r\n"
+			default:
+				cmd = redis.Command([]byte("GET"), []byte(fmt.Sprintf("%s%d", conn, i-1)))
+				reply = fmt.Sprintf("$%d\r\n%d\r\n", len(fmt.Sprint(i-1)), i-1)
+			}
+			meta := payloadSessionHeader(RequestPayload, uuid(), 1, -1, []byte(conn), uint32(i+1))
+			if reply != "" {
+				expected[string(payloadID(meta))] = reply
+			}
+			output.PluginWrite(&Message{Meta: meta, Data: cmd})
+		}
+	}
+
+	for range expected {
+		done := make(chan *Message)
+		go func() {
+			msg, _ := output.PluginRead()
+			done <- msg
+		}()
+		select {
+		case msg := <-done:
+			reply, ok := expected[string(payloadID(msg.Meta))]
+			if msg.Meta[0] != ReplayedResponsePayload || !ok {
+				t.Fatalf("wrong meta %q", msg.Meta)
+			}
+			if string(msg.Data) != reply {
+				t.Errorf("expected reply %q, got %q", reply, msg.Data)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no response")
+		}
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.commands) != 2 {
+		t.Fatalf("expected a connection per session, got %v", server.commands)
+	}
+	for _, commands := range server.commands {
+		if commands[0] != "AUTH SECRET" || commands[1] != "SELECT 2" || len(commands) != 21 {
+			t.Errorf("wrong commands %q", commands)
+		}
+	}
+}
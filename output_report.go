@@ -0,0 +1,127 @@
+package goreplay
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buger/goreplay/internal/report"
+	"github.com/buger/goreplay/proto"
+)
+
+// ReportOutputConfig struct for holding latency report configuration
+type ReportOutputConfig struct {
+	Endpoints  []string      `json:"output-report-endpoint"`
+	Timeout    time.Duration `json:"output-report-timeout"`
+	MaxPending int           `json:"output-report-max-pending"`
+}
+
+// ReportOutput plugin aggregates latencies and statuses of original and
+// replayed responses by endpoint. The summary is printed on exit and written
+// to a JSON or HTML file. Like DiffOutput it needs both
+// --input-raw-track-response and --output-http-track-response.
+type ReportOutput struct {
+	path      string
+	config    *ReportOutputConfig
+	report    *report.Report
+	exchanges *replayExchanges
+	stdout    io.Writer
+}
+
+// NewReportOutput constructor for ReportOutput, path is the file of the report,
+// its format is HTML for .html files and JSON otherwise. The summary is only
+// printed if path is "-".
+func NewReportOutput(path string, config *ReportOutputConfig) PluginWriter {
+	o := new(ReportOutput)
+	newConfig := *config
+	if newConfig.Timeout < time.Millisecond*100 {
+		newConfig.Timeout = 30 * time.Second
+	}
+	if newConfig.MaxPending <= 0 {
+		newConfig.MaxPending = 10000
+	}
+	o.config = &newConfig
+	o.path = path
+	o.stdout = os.Stdout
+
+	if path != "-" {
+		// fail early rather than on exit
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0660)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("[OUTPUT-REPORT] report file error[%q]", err))
+		}
+		f.Close()
+	}
+
+	o.report = report.New(o.config.Endpoints)
+	o.exchanges = newReplayExchanges(o.config.Timeout, o.config.MaxPending, o.add, o.expire)
+	return o
+}
+
+// PluginWrite writes message to this plugin
+func (o *ReportOutput) PluginWrite(msg *Message) (n int, err error) {
+	o.exchanges.add(msg)
+	return len(msg.Data) + len(msg.Meta), nil
+}
+
+// add adds the exchange to the report
+func (o *ReportOutput) add(e *replayExchange) {
+	if e.request == nil {
+		return
+	}
+	o.report.Add(report.Sample{
+		Method:          string(proto.Method(e.request)),
+		Path:            string(proto.Path(e.request)),
+		OriginalStatus:  responseStatus(e.original),
+		ReplayedStatus:  responseStatus(e.replayed),
+		OriginalLatency: e.originalRoundTrip(),
+		ReplayedLatency: time.Duration(e.replayedLatency),
+	})
+}
+
+// expire adds requests which the replay target did not answer, as errors of
+// the replay
+func (o *ReportOutput) expire(e *replayExchange) {
+	if e.original != nil {
+		o.add(e)
+	}
+}
+
+// responseStatus returns the status code of the response or 0
+func responseStatus(data []byte) int {
+	if data == nil {
+		return 0
+	}
+	status, _ := strconv.Atoi(string(proto.Status(data)))
+	return status
+}
+
+func (o *ReportOutput) String() string {
+	return "Report output: " + o.path
+}
+
+// Close prints the summary and writes the report
+func (o *ReportOutput) Close() error {
+	o.exchanges.close()
+	summary := o.report.Summary()
+	if err := summary.WriteTable(o.stdout); err != nil {
+		return err
+	}
+	if o.path == "-" {
+		return nil
+	}
+
+	f, err := os.Create(o.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.HasSuffix(o.path, ".html") {
+		return summary.WriteHTML(f)
+	}
+	return summary.WriteJSON(f)
+}
@@ -0,0 +1,58 @@
+package goreplay
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/internal/report"
+)
+
+func TestReportOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	output := NewReportOutput(path, &ReportOutputConfig{Timeout: 200 * time.Millisecond})
+	o := output.(*ReportOutput)
+	var table bytes.Buffer
+	o.stdout = &table
+
+	for i, status := range []string{"200 OK", "200 OK", "502 Bad Gateway", ""} {
+		id := uuid()
+		output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, id, 1000, -1), Data: []byte("GET /users/" + string(rune('1'+i)) + " HTTP/1.1\r\n\r\n")})
+		output.PluginWrite(&Message{Meta: payloadHeader(ResponsePayload, id, 1000+int64(time.Millisecond), int64(time.Millisecond)), Data: []byte("HTTP/1.1 200 OK\r\n\r\n")})
+		// the replay target did not answer the last request
+		if status != "" {
+			output.PluginWrite(&Message{Meta: payloadHeader(ReplayedResponsePayload, id, 1, int64(5*time.Millisecond)), Data: []byte("HTTP/1.1 " + status + "\r\n\r\n")})
+		}
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(table.String(), "GET /users/:id") {
+		t.Errorf("unexpected table\n%s", table.String())
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary report.Summary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Endpoints) != 1 {
+		t.Fatalf("expected 1 endpoint, got %s", data)
+	}
+	e := summary.Endpoints[0]
+	if e.Requests != 4 || e.Original.Responses != 4 || e.Replayed.Responses != 3 || e.Replayed.Errors != 2 || e.StatusMismatches != 2 {
+		t.Errorf("unexpected endpoint %+v", e)
+	}
+	if e.Original.P50 < 2 || e.Original.P50 > 2.5 || e.Replayed.P50 < 5 || e.Replayed.P50 > 6 {
+		t.Errorf("wrong latencies %v %v", e.Original.P50, e.Replayed.P50)
+	}
+}
@@ -115,7 +115,8 @@ func (o *TCPOutput) writeToConnection(conn net.Conn, msg *Message) (err error) {
 }
 
 func (o *TCPOutput) getBufferIndex(msg *Message) int {
-	if !o.config.Sticky {
+	// parts of a streamed message are sent by the same worker in order
+	if chunk, _ := payloadChunk(msg.Meta); !o.config.Sticky && chunk == 0 {
 		o.workerIndex++
 		return int(o.workerIndex) % o.config.Workers
 	}
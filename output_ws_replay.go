@@ -0,0 +1,291 @@
+package goreplay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/internal/ws"
+	"github.com/buger/goreplay/proto"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketReplayOutputConfig struct for holding WebSocket replay output configuration
+type WebSocketReplayOutputConfig struct {
+	TrackResponses bool          `json:"output-ws-replay-track-response"`
+	Timeout        time.Duration `json:"output-ws-replay-timeout"`
+	SessionTimeout time.Duration `json:"output-ws-replay-session-timeout"`
+	SkipVerify     bool          `json:"output-ws-replay-skip-verify"`
+}
+
+// WebSocketReplayOutput plugin replays captured WebSocket connections. For
+// every captured upgrade request it opens a connection to the target and sends
+// messages of the client in their order, keeping the original gaps between them.
+type WebSocketReplayOutput struct {
+	address   string
+	target    *url.URL
+	config    *WebSocketReplayOutputConfig
+	dialer    *websocket.Dialer
+	responses chan *response
+	stop      chan bool // Channel used only to indicate goroutine should shutdown
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*wsSession
+}
+
+// wsSession replays messages of a captured connection
+type wsSession struct {
+	queue chan *Message
+	conn  *websocket.Conn
+	uuid  []byte // the ID of the upgrade request
+
+	// timestamp of the last captured message and when it was replayed
+	lastTiming int64
+	lastSent   time.Time
+}
+
+// NewWebSocketReplayOutput constructor for WebSocketReplayOutput, address is
+// the target like ws://host:8080 or wss://host
+func NewWebSocketReplayOutput(address string, config *WebSocketReplayOutputConfig) PluginReadWriter {
+	o := new(WebSocketReplayOutput)
+	newConfig := *config
+	if newConfig.Timeout < time.Millisecond*100 {
+		newConfig.Timeout = 5 * time.Second
+	}
+	if newConfig.SessionTimeout <= 0 {
+		newConfig.SessionTimeout = 5 * time.Minute
+	}
+	o.config = &newConfig
+
+	if !strings.Contains(address, "://") {
+		address = "ws://" + address
+	}
+	var err error
+	if o.target, err = url.Parse(address); err != nil {
+		log.Fatal(fmt.Sprintf("[OUTPUT-WS-REPLAY] parse WebSocket replay output URL error[%q]", err))
+	}
+	switch o.target.Scheme {
+	case "http":
+		o.target.Scheme = "ws"
+	case "https":
+		o.target.Scheme = "wss"
+	}
+	o.address = o.target.String()
+	o.dialer = &websocket.Dialer{
+		HandshakeTimeout: o.config.Timeout,
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: o.config.SkipVerify},
+	}
+
+	o.stop = make(chan bool)
+	o.sessions = make(map[string]*wsSession)
+	if o.config.TrackResponses {
+		o.responses = make(chan *response, 1000)
+	}
+	return o
+}
+
+// PluginWrite writes message to this plugin, only upgrade requests and
+// WebSocket messages of clients are replayed
+func (o *WebSocketReplayOutput) PluginWrite(msg *Message) (n int, err error) {
+	upgrade := isRequestPayload(msg.Meta) && bytes.EqualFold(proto.Header(msg.Data, []byte("Upgrade")), []byte("websocket"))
+	if !upgrade && msg.Meta[0] != WebSocketRequestPayload {
+		return len(msg.Data), nil
+	}
+	connID, _ := payloadSession(msg.Meta)
+
+	o.sessionsMu.Lock()
+	defer o.sessionsMu.Unlock()
+	s, ok := o.sessions[string(connID)]
+	if !ok {
+		if !upgrade {
+			// the upgrade request was not captured
+			return len(msg.Data), nil
+		}
+		s = &wsSession{queue: make(chan *Message, 100)}
+		o.sessions[string(connID)] = s
+		go o.sessionWorker(string(connID), s)
+	}
+
+	select {
+	case <-o.stop:
+		return 0, ErrorStopped
+	case s.queue <- msg:
+	}
+	return len(msg.Data) + len(msg.Meta), nil
+}
+
+// sessionWorker replays messages of a session one by one, it stops when the
+// connection is closed or idle for output-ws-replay-session-timeout
+func (o *WebSocketReplayOutput) sessionWorker(id string, s *wsSession) {
+	defer func() {
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	}()
+	for {
+		select {
+		case <-o.stop:
+			return
+		case msg := <-s.queue:
+			if isRequestPayload(msg.Meta) {
+				o.connect(s, msg)
+				continue
+			}
+			if s.conn == nil {
+				continue
+			}
+			o.send(s, msg)
+			if s.conn != nil {
+				continue
+			}
+		case <-time.After(o.config.SessionTimeout):
+		}
+
+		o.sessionsMu.Lock()
+		if len(s.queue) == 0 {
+			delete(o.sessions, id)
+			o.sessionsMu.Unlock()
+			return
+		}
+		o.sessionsMu.Unlock()
+	}
+}
+
+// connect opens the connection with the captured upgrade request
+func (o *WebSocketReplayOutput) connect(s *wsSession, msg *Message) {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(msg.Data)))
+	if err != nil {
+		Debug(1, fmt.Sprintf("[WS-REPLAY-OUTPUT] error when parsing upgrade request: %q", err))
+		return
+	}
+
+	target := *o.target
+	target.Path = strings.TrimSuffix(target.Path, "/") + req.URL.Path
+	target.RawQuery = req.URL.RawQuery
+
+	header := http.Header{}
+	for name, values := range req.Header {
+		switch name {
+		case "Host", "Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version",
+			"Sec-Websocket-Extensions", "Sec-Websocket-Protocol", "Content-Length":
+			// set by the dialer
+		default:
+			header[name] = values
+		}
+	}
+	dialer := *o.dialer
+	if protocols := req.Header.Get("Sec-Websocket-Protocol"); protocols != "" {
+		for _, p := range strings.Split(protocols, ",") {
+			dialer.Subprotocols = append(dialer.Subprotocols, strings.TrimSpace(p))
+		}
+	}
+	deflate, _, _ := ws.Deflate(req.Header.Get("Sec-Websocket-Extensions"))
+	dialer.EnableCompression = deflate
+
+	conn, resp, err := dialer.Dial(target.String(), header)
+	if err != nil {
+		Debug(1, fmt.Sprintf("[WS-REPLAY-OUTPUT] error when connecting: %q", err))
+		return
+	}
+	resp.Body.Close()
+
+	s.conn = conn
+	s.uuid = payloadID(msg.Meta)
+	s.lastTiming = payloadTiming(msg.Meta)
+	s.lastSent = time.Now()
+	go o.receive(conn, s.uuid)
+}
+
+// send sends a message after the gap it had after the previous one
+func (o *WebSocketReplayOutput) send(s *wsSession, msg *Message) {
+	timing := payloadTiming(msg.Meta)
+	if wait := time.Duration(timing-s.lastTiming) - time.Since(s.lastSent); s.lastTiming > 0 && wait > 0 {
+		select {
+		case <-o.stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+	s.lastTiming = timing
+	s.lastSent = time.Now()
+
+	opcode := int(payloadOpcode(msg.Meta))
+	s.conn.SetWriteDeadline(time.Now().Add(o.config.Timeout))
+	var err error
+	switch opcode {
+	case websocket.TextMessage, websocket.BinaryMessage:
+		err = s.conn.WriteMessage(opcode, msg.Data)
+	case websocket.CloseMessage:
+		s.conn.WriteControl(websocket.CloseMessage, msg.Data, time.Now().Add(o.config.Timeout))
+		s.conn.Close()
+		s.conn = nil
+		return
+	default:
+		return
+	}
+	if err != nil {
+		Debug(1, fmt.Sprintf("[WS-REPLAY-OUTPUT] error when sending: %q", err))
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// receive reads messages of the target until the connection is closed
+func (o *WebSocketReplayOutput) receive(conn *websocket.Conn, uuid []byte) {
+	start := time.Now()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		stop := time.Now()
+		if o.config.TrackResponses {
+			select {
+			case <-o.stop:
+				return
+			case o.responses <- &response{data, uuid, stop.UnixNano(), stop.UnixNano() - start.UnixNano()}:
+			}
+		}
+	}
+}
+
+// PluginRead reads message from this plugin
+func (o *WebSocketReplayOutput) PluginRead() (*Message, error) {
+	if !o.config.TrackResponses {
+		return nil, ErrorStopped
+	}
+	var resp *response
+	var msg Message
+	select {
+	case <-o.stop:
+		return nil, ErrorStopped
+	case resp = <-o.responses:
+		msg.Data = resp.payload
+	}
+
+	msg.Meta = payloadHeader(ReplayedResponsePayload, resp.uuid, resp.startedAt, resp.roundTripTime)
+
+	return &msg, nil
+}
+
+func (o *WebSocketReplayOutput) String() string {
+	return "WebSocket replay output: " + o.address
+}
+
+// Close closes the data channel so that data
+func (o *WebSocketReplayOutput) Close() error {
+	close(o.stop)
+	return nil
+}
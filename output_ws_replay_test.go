@@ -0,0 +1,114 @@
+package goreplay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketReplayOutput(t *testing.T) {
+	type received struct {
+		data string
+		at   time.Time
+	}
+	var mu sync.Mutex
+	var messages []received
+	var path, token string
+	closed := make(chan bool, 1)
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		path, token = r.URL.RequestURI(), r.Header.Get("X-Token")
+		mu.Unlock()
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			opcode, data, err := conn.ReadMessage()
+			if err != nil {
+				closed <- true
+				return
+			}
+			mu.Lock()
+			messages = append(messages, received{string(data), time.Now()})
+			mu.Unlock()
+			conn.WriteMessage(opcode, append([]byte("echo:"), data...))
+		}
+	}))
+	defer server.Close()
+
+	output := NewWebSocketReplayOutput(strings.Replace(server.URL, "http", "ws", 1), &WebSocketReplayOutputConfig{TrackResponses: true})
+	defer output.(*WebSocketReplayOutput).Close()
+
+	id := uuid()
+	start := time.Now().UnixNano()
+	upgrade := "GET /chat?room=1 HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\nX-Token: abc\r\n\r\n"
+	output.PluginWrite(&Message{Meta: payloadSessionHeader(RequestPayload, id, start, 0, []byte("conn"), 1), Data: []byte(upgrade)})
+	// the response of the server and messages of other connections are ignored
+	output.PluginWrite(&Message{Meta: payloadWebSocketHeader(WebSocketResponsePayload, id, start, 0, []byte("conn"), 2, websocket.TextMessage), Data: []byte("welcome")})
+	output.PluginWrite(&Message{Meta: payloadWebSocketHeader(WebSocketRequestPayload, uuid(), start, 0, []byte("other"), 2, websocket.TextMessage), Data: []byte("lost")})
+
+	gaps := []time.Duration{50 * time.Millisecond, 200 * time.Millisecond, 10 * time.Millisecond}
+	sent := []string{"first", "second", "\x00\x01"}
+	opcodes := []byte{websocket.TextMessage, websocket.TextMessage, websocket.BinaryMessage}
+	ts := start
+	for i, data := range sent {
+		ts += int64(gaps[i])
+		output.PluginWrite(&Message{Meta: payloadWebSocketHeader(WebSocketRequestPayload, id, ts, 0, []byte("conn"), uint32(i+3), opcodes[i]), Data: []byte(data)})
+	}
+
+	for i := range sent {
+		done := make(chan *Message)
+		go func() {
+			msg, _ := output.PluginRead()
+			done <- msg
+		}()
+		select {
+		case msg := <-done:
+			if msg.Meta[0] != ReplayedResponsePayload || string(payloadID(msg.Meta)) != string(id) {
+				t.Errorf("wrong meta %q", msg.Meta)
+			}
+			if string(msg.Data) != "echo:"+sent[i] {
+				t.Errorf("expected %q, got %q", "echo:"+sent[i], msg.Data)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no response")
+		}
+	}
+
+	output.PluginWrite(&Message{Meta: payloadWebSocketHeader(WebSocketRequestPayload, id, ts, 0, []byte("conn"), 6, websocket.CloseMessage), Data: []byte{3, 232}})
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the connection should be closed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if path != "/chat?room=1" || token != "abc" {
+		t.Errorf("the upgrade request was not replayed: %q %q", path, token)
+	}
+	if len(messages) != len(sent) {
+		t.Fatalf("expected %d messages, got %d", len(sent), len(messages))
+	}
+	for i := range messages {
+		if messages[i].data != sent[i] {
+			t.Errorf("expected %q, got %q", sent[i], messages[i].data)
+		}
+		if i == 0 {
+			continue
+		}
+		if gap := messages[i].at.Sub(messages[i-1].at); gap < gaps[i]-5*time.Millisecond {
+			t.Errorf("message %d: expected gap %s, got %s", i, gaps[i], gap)
+		}
+	}
+}
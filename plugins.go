@@ -3,12 +3,16 @@ package goreplay
 import (
 	"reflect"
 	"strings"
+
+	"github.com/buger/goreplay/internal/tcp"
 )
 
 // Message represents data across plugins
 type Message struct {
 	Meta []byte // metadata
 	Data []byte // actual data
+
+	packets []*tcp.Packet // captured packets of the message, if any
 }
 
 // PluginReader is an interface for input plugins
@@ -34,6 +38,12 @@ type InOutPlugins struct {
 	All     []interface{}
 }
 
+// Failer is implemented by plugins which can fail the run, gor exits with a
+// non-zero code if any of them failed after it was closed
+type Failer interface {
+	Failed() bool
+}
+
 // extractLimitOptions detects if plugin get called with limiter support
 // Returns address and limit
 func extractLimitOptions(options string) (string, string) {
@@ -121,6 +131,10 @@ func NewPlugins() *InOutPlugins {
 		plugins.registerPlugin(NewWebSocketOutput, options, &Settings.OutputWebSocketConfig)
 	}
 
+	for _, options := range Settings.OutputWebSocketReplay {
+		plugins.registerPlugin(NewWebSocketReplayOutput, options, &Settings.OutputWebSocketReplayConfig)
+	}
+
 	for _, options := range Settings.InputFile {
 		plugins.registerPlugin(NewFileInput, options, Settings.InputFileLoop, Settings.InputFileReadDepth, Settings.InputFileMaxWait, Settings.InputFileDryRun)
 	}
@@ -133,10 +147,18 @@ func NewPlugins() *InOutPlugins {
 		}
 	}
 
+	for _, path := range Settings.OutputPcap {
+		plugins.registerPlugin(NewPcapOutput, path, &Settings.OutputFileConfig)
+	}
+
 	for _, options := range Settings.InputHTTP {
 		plugins.registerPlugin(NewHTTPInput, options)
 	}
 
+	for _, options := range Settings.InputProxy {
+		plugins.registerPlugin(NewProxyInput, options, &Settings.InputProxyConfig)
+	}
+
 	// If we explicitly set Host header http output should not rewrite it
 	// Fix: https://github.com/buger/gor/issues/174
 	for _, header := range Settings.ModifierConfig.Headers {
@@ -154,6 +176,38 @@ func NewPlugins() *InOutPlugins {
 		plugins.registerPlugin(NewBinaryOutput, options, &Settings.OutputBinaryConfig)
 	}
 
+	for _, options := range Settings.OutputGRPC {
+		plugins.registerPlugin(NewGRPCOutput, options, &Settings.OutputGRPCConfig)
+	}
+
+	for _, options := range Settings.OutputPostgres {
+		plugins.registerPlugin(NewPostgresOutput, options, &Settings.OutputPostgresConfig)
+	}
+
+	for _, options := range Settings.OutputMySQL {
+		plugins.registerPlugin(NewMySQLOutput, options, &Settings.OutputMySQLConfig)
+	}
+
+	for _, options := range Settings.OutputRedis {
+		plugins.registerPlugin(NewRedisOutput, options, &Settings.OutputRedisConfig)
+	}
+
+	for _, options := range Settings.OutputDNS {
+		plugins.registerPlugin(NewDNSOutput, options, &Settings.OutputDNSConfig)
+	}
+
+	for _, path := range Settings.OutputDiff {
+		plugins.registerPlugin(NewDiffOutput, path, &Settings.OutputDiffConfig)
+	}
+
+	if Settings.OutputReport != "" {
+		plugins.registerPlugin(NewReportOutput, Settings.OutputReport, &Settings.OutputReportConfig)
+	}
+
+	if Settings.ReplayAssert != "" {
+		plugins.registerPlugin(NewAssertOutput, Settings.ReplayAssert, &Settings.ReplayAssertConfig)
+	}
+
 	if Settings.OutputKafkaConfig.Host != "" && Settings.OutputKafkaConfig.Topic != "" {
 		plugins.registerPlugin(NewKafkaOutput, "", &Settings.OutputKafkaConfig, &Settings.KafkaTLSConfig)
 	}
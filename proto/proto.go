@@ -21,7 +21,7 @@ import (
 	"bytes"
 	"github.com/buger/goreplay/internal/byteutils"
 
-	_ "fmt"
+	"fmt"
 	"net/http"
 	"net/textproto"
 	"strings"
@@ -577,6 +577,139 @@ func HasFullPayload(m ProtocolStateSetter, payloads ...[]byte) bool {
 	return state.BodyLen == bodyLen
 }
 
+// MessageEndPos returns the end position of the first full HTTP/1 message of
+// the payload, or -1 if the message is not complete yet. It can be used to
+// split a stream of pipelined messages. Messages without Content-Length and
+// chunked encoding are considered to have no body.
+func MessageEndPos(payload []byte) int {
+	if !HasTitle(payload) {
+		return -1
+	}
+	end := MIMEHeadersEndPos(payload)
+	if end < 0 {
+		return -1
+	}
+	headers := payload[:end]
+
+	if bytes.Contains(bytes.ToLower(Header(headers, []byte("Transfer-Encoding"))), []byte("chunked")) {
+		bodyEnd := chunkedEndPos(payload[end:])
+		if bodyEnd < 0 {
+			return -1
+		}
+		return end + bodyEnd
+	}
+
+	if contentLen := Header(headers, []byte("Content-Length")); len(contentLen) > 0 {
+		n, ok := atoI(contentLen, 10)
+		if !ok || n < 0 || len(payload)-end < n {
+			return -1
+		}
+		return end + n
+	}
+
+	return end
+}
+
+// chunkedEndPos returns the end of chunked body, including trailers
+func chunkedEndPos(body []byte) int {
+	var pos int
+	for {
+		lineEnd := bytes.Index(body[pos:], CRLF)
+		if lineEnd < 1 {
+			return -1
+		}
+		sizeField := body[pos : pos+lineEnd]
+		if i := bytes.IndexByte(sizeField, ';'); i >= 0 {
+			sizeField = sizeField[:i]
+		}
+		sizeField = bytes.TrimSpace(sizeField)
+		size, ok := atoI(sizeField, 16)
+		if !ok || len(sizeField) == 0 || size < 0 {
+			return -1
+		}
+		pos += lineEnd + 2
+
+		if size == 0 {
+			// trailer fields end with an empty line
+			for {
+				lineEnd = bytes.Index(body[pos:], CRLF)
+				if lineEnd < 0 {
+					return -1
+				}
+				pos += lineEnd + 2
+				if lineEnd == 0 {
+					return pos
+				}
+			}
+		}
+
+		if pos += size + 2; pos > len(body) {
+			return -1
+		}
+	}
+}
+
+// maxChunkLineSize limits chunk size and trailer lines buffered by ChunkedScanner
+const maxChunkLineSize = 4096
+
+// ChunkedScanner finds the end of a chunked body which is received in parts,
+// it is used to stream bodies without buffering them whole. The zero value is
+// ready to scan a body from its first chunk.
+type ChunkedScanner struct {
+	remaining int    // bytes left of the current chunk data with its CRLF
+	trailers  bool   // the last chunk was seen
+	line      []byte // incomplete chunk size or trailer line
+}
+
+// Scan consumes the next part of the body, n is the number of bytes of data
+// which belong to the body and done is true once the body is complete.
+func (s *ChunkedScanner) Scan(data []byte) (n int, done bool, err error) {
+	for n < len(data) {
+		if s.remaining > 0 {
+			k := len(data) - n
+			if k > s.remaining {
+				k = s.remaining
+			}
+			n += k
+			s.remaining -= k
+			continue
+		}
+
+		lineEnd := bytes.IndexByte(data[n:], '\n')
+		if lineEnd < 0 {
+			if s.line = append(s.line, data[n:]...); len(s.line) > maxChunkLineSize {
+				return len(data), false, fmt.Errorf("chunk line is too long")
+			}
+			return len(data), false, nil
+		}
+		line := append(s.line, data[n:n+lineEnd]...)
+		s.line = s.line[:0]
+		n += lineEnd + 1
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+
+		if s.trailers {
+			if len(line) == 0 {
+				return n, true, nil
+			}
+			continue
+		}
+		if i := bytes.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		line = bytes.TrimSpace(line)
+		size, ok := atoI(line, 16)
+		if !ok || len(line) == 0 || size < 0 {
+			return n, false, fmt.Errorf("invalid chunk size %q", line)
+		}
+		if size == 0 {
+			s.trailers = true
+		} else {
+			s.remaining = size + 2
+		}
+	}
+	return n, false, nil
+}
+
 // this works with positive integers
 func atoI(s []byte, base int) (num int, ok bool) {
 	var v int
@@ -495,6 +495,50 @@ func TestHasFullPayload(t *testing.T) {
 	}
 }
 
+func TestMessageEndPos(t *testing.T) {
+	tests := []struct {
+		payload  string
+		expected int
+	}{
+		{"GET / HTTP/1.1\r\nHost: a\r\n\r\nGET /b HTTP/1.1\r\n", 27},
+		{"POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhelloGET", 43},
+		{"POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhell", -1},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nWiki\r\n0\r\n\r\nHTTP", 61},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nWiki\r\n0\r\nExpires: 0\r\n\r\n", 73},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nWiki\r\n0\r\nExpires: 0\r\n", -1},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nWi", -1},
+		{"HTTP/1.1 200 OK\r\n", -1},
+		{"Host: a\r\n\r\n", -1},
+	}
+
+	for i, tt := range tests {
+		if got := MessageEndPos([]byte(tt.payload)); got != tt.expected {
+			t.Errorf("#%d expected %d to equal %d", i, got, tt.expected)
+		}
+	}
+}
+
+func TestChunkedScanner(t *testing.T) {
+	body := "4\r\nWiki\r\n5;ext=1\r\npedia\r\n0\r\nExpires: 0\r\n\r\n"
+	// every split of the body finds the same end
+	for split := 0; split < len(body); split++ {
+		var s ChunkedScanner
+		n1, done, err := s.Scan([]byte(body[:split]))
+		if err != nil || done || n1 != split {
+			t.Fatalf("split %d: unexpected %d %v %v", split, n1, done, err)
+		}
+		n2, done, err := s.Scan([]byte(body[split:] + "HTTP/1.1"))
+		if err != nil || !done || n1+n2 != len(body) {
+			t.Errorf("split %d: expected end %d, got %d %v %v", split, len(body), n1+n2, done, err)
+		}
+	}
+
+	var s ChunkedScanner
+	if _, _, err := s.Scan([]byte("zz\r\n")); err == nil {
+		t.Error("expected invalid chunk size error")
+	}
+}
+
 func BenchmarkHasFullPayload(b *testing.B) {
 	data := []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n1e\r\n111111111111111111111111111111\r\n0\r\n\r\n")
 	for i := 0; i < b.N; i++ {
@@ -5,6 +5,9 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 // These constants help to indicate the type of payload
@@ -12,6 +15,13 @@ const (
 	RequestPayload          = '1'
 	ResponsePayload         = '2'
 	ReplayedResponsePayload = '3'
+	// WebSocket messages of upgraded connections, sent by the client and by the server
+	WebSocketRequestPayload  = '4'
+	WebSocketResponsePayload = '5'
+	// Body chunks of streamed requests and responses, they follow the headers
+	// which have RequestPayload or ResponsePayload type
+	RequestChunkPayload  = '6'
+	ResponseChunkPayload = '7'
 )
 
 func randByte(len int) []byte {
@@ -53,6 +63,56 @@ func payloadHeader(payloadType byte, uuid []byte, timing int64, latency int64) (
 	return []byte(fmt.Sprintf("%c %s %d %d\n", payloadType, uuid, timing, latency))
 }
 
+// payloadSessionHeader is payloadHeader which also carries the ID of the
+// captured connection and the number of the message on that connection
+func payloadSessionHeader(payloadType byte, uuid []byte, timing int64, latency int64, connID []byte, seq uint32) (header []byte) {
+	//Example:
+	//  1 7f00000185f07f0000011f9000000003 13923489726487326 1231 7f00000185f07f0000011f90 3\n
+	return []byte(fmt.Sprintf("%c %s %d %d %s %d\n", payloadType, uuid, timing, latency, connID, seq))
+}
+
+// payloadWebSocketHeader is payloadSessionHeader of a WebSocket message, uuid
+// is the ID of the upgrade request and opcode is the type of the message
+func payloadWebSocketHeader(payloadType byte, uuid []byte, timing int64, latency int64, connID []byte, seq uint32, opcode byte) (header []byte) {
+	//Example:
+	//  4 7f00000185f07f0000011f9000000001 13923489726487326 1231 7f00000185f07f0000011f90 3 1\n
+	return []byte(fmt.Sprintf("%c %s %d %d %s %d %d\n", payloadType, uuid, timing, latency, connID, seq, opcode))
+}
+
+// payloadChunkHeader is payloadSessionHeader of a part of a streamed message,
+// chunk numbers the parts from 1 (the headers) and more is 1 if other parts
+// follow
+func payloadChunkHeader(payloadType byte, uuid []byte, timing int64, latency int64, connID []byte, seq uint32, chunk uint32, more bool) (header []byte) {
+	//Example:
+	//  6 7f00000185f07f0000011f9000000003 13923489726487326 1231 7f00000185f07f0000011f90 3 2 1\n
+	var m int
+	if more {
+		m = 1
+	}
+	return []byte(fmt.Sprintf("%c %s %d %d %s %d %d %d\n", payloadType, uuid, timing, latency, connID, seq, chunk, m))
+}
+
+// payloadWithPod appends the pod of a message captured by a k8s:// input to
+// its header, labels are sorted and comma separated
+func payloadWithPod(header []byte, namespace, name string, labels map[string]string) []byte {
+	//Example:
+	//  1 7f00000185f07f0000011f9000000003 13923489726487326 1231 7f00000185f07f0000011f90 3 pod=default/web-1 labels=app=web,tier=front\n
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		keys[i] = k + "=" + labels[k]
+	}
+
+	header = append(header[:len(header)-1], " pod="+namespace+"/"+name...)
+	if len(keys) != 0 {
+		header = append(header, " labels="+strings.Join(keys, ",")...)
+	}
+	return append(header, '\n')
+}
+
 func payloadBody(payload []byte) []byte {
 	headerSize := bytes.IndexByte(payload, '\n')
 	return payload[headerSize+1:]
@@ -66,6 +126,18 @@ func payloadMeta(payload []byte) [][]byte {
 	return bytes.Split(payload[:headerSize], []byte{' '})
 }
 
+// payloadFields returns the meta of the payload without the optional
+// key=value pairs which follow the fields of its type, like pod=
+func payloadFields(payload []byte) [][]byte {
+	meta := payloadMeta(payload)
+	for i, field := range meta {
+		if bytes.IndexByte(field, '=') >= 0 {
+			return meta[:i]
+		}
+	}
+	return meta
+}
+
 func payloadMetaWithBody(payload []byte) (meta, body []byte) {
 	if i := bytes.IndexByte(payload, '\n'); i > 0 && len(payload) > i+1 {
 		meta = payload[:i+1]
@@ -85,8 +157,79 @@ func payloadID(payload []byte) (id []byte) {
 	return meta[1]
 }
 
+// payloadTiming returns the timestamp of the payload
+func payloadTiming(payload []byte) int64 {
+	meta := payloadMeta(payload)
+	if len(meta) < 3 {
+		return 0
+	}
+	timing, _ := strconv.ParseInt(string(meta[2]), 10, 64)
+	return timing
+}
+
+// payloadSession returns the ID of the captured connection of the payload and
+// the number of the message on it. Payloads without session meta have seq 0,
+// their ID without the last 8 characters (the stream part of IDs of input-raw)
+// is used as the connection ID.
+func payloadSession(payload []byte) (connID []byte, seq uint64) {
+	meta := payloadFields(payload)
+	if len(meta) >= 6 {
+		seq, _ = strconv.ParseUint(string(meta[5]), 10, 32)
+		return meta[4], seq
+	}
+	if len(meta) < 2 {
+		return nil, 0
+	}
+	if id := meta[1]; len(id) > 8 {
+		return id[:len(id)-8], 0
+	}
+	return meta[1], 0
+}
+
+// payloadOpcode returns the type of a WebSocket message
+func payloadOpcode(payload []byte) byte {
+	if !isWebSocketPayload(payload) {
+		return 0
+	}
+	meta := payloadFields(payload)
+	if len(meta) != 7 {
+		return 0
+	}
+	opcode, _ := strconv.ParseUint(string(meta[6]), 10, 8)
+	return byte(opcode)
+}
+
+// payloadChunk returns the number of the part of a streamed message and
+// whether other parts follow, chunk is 0 for whole messages
+func payloadChunk(payload []byte) (chunk uint32, more bool) {
+	switch payload[0] {
+	case RequestPayload, ResponsePayload, RequestChunkPayload, ResponseChunkPayload:
+	default:
+		return 0, false
+	}
+	// whole messages have session meta only, parts of streamed messages
+	// also have the chunk number and the flag
+	meta := payloadFields(payload)
+	if len(meta) != 8 {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(string(meta[6]), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(n), string(meta[7]) == "1"
+}
+
 func isOriginPayload(payload []byte) bool {
-	return payload[0] == RequestPayload || payload[0] == ResponsePayload
+	return payload[0] == RequestPayload || payload[0] == ResponsePayload || isWebSocketPayload(payload) || isChunkPayload(payload)
+}
+
+func isChunkPayload(payload []byte) bool {
+	return payload[0] == RequestChunkPayload || payload[0] == ResponseChunkPayload
+}
+
+func isWebSocketPayload(payload []byte) bool {
+	return payload[0] == WebSocketRequestPayload || payload[0] == WebSocketResponsePayload
 }
 
 func isRequestPayload(payload []byte) bool {
@@ -0,0 +1,90 @@
+package goreplay
+
+import (
+	"hash/fnv"
+
+	"github.com/buger/goreplay/internal/redis"
+)
+
+// RedisModifier filters Redis commands by their names and keys
+type RedisModifier struct {
+	config *RedisModifierConfig
+}
+
+// NewRedisModifier returns nil if no filter is configured
+func NewRedisModifier(config *RedisModifierConfig) *RedisModifier {
+	if len(config.Commands) == 0 &&
+		len(config.NegativeCommands) == 0 &&
+		len(config.KeyRegexp) == 0 &&
+		len(config.KeyNegativeRegexp) == 0 &&
+		config.KeyLimiter == 0 {
+		return nil
+	}
+
+	return &RedisModifier{config: config}
+}
+
+// Rewrite returns empty payload if the command should be dropped. Payloads
+// other than commands encoded as RESP arrays are not changed. Key filters do
+// not apply to commands without keys.
+func (m *RedisModifier) Rewrite(payload []byte) (response []byte) {
+	if len(payload) == 0 || payload[0] != '*' {
+		return payload
+	}
+	args := redis.Args(payload)
+	if args == nil {
+		return payload
+	}
+
+	name := redis.Name(args)
+	if len(m.config.Commands) > 0 && !containsString(m.config.Commands, name) {
+		return
+	}
+	if containsString(m.config.NegativeCommands, name) {
+		return
+	}
+
+	key := redis.Key(args)
+	if key == nil {
+		return payload
+	}
+
+	if len(m.config.KeyRegexp) > 0 {
+		matched := false
+		for _, re := range m.config.KeyRegexp {
+			if re.Match(key) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return
+		}
+	}
+
+	for _, re := range m.config.KeyNegativeRegexp {
+		if re.Match(key) {
+			return
+		}
+	}
+
+	if m.config.KeyLimiter > 0 {
+		hasher := fnv.New32a()
+		hasher.Write(key)
+
+		if (hasher.Sum32() % 100) >= uint32(m.config.KeyLimiter) {
+			return
+		}
+	}
+
+	return payload
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
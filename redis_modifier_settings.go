@@ -0,0 +1,72 @@
+package goreplay
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RedisModifierConfig holds configuration options for filtering of Redis commands
+type RedisModifierConfig struct {
+	Commands          RedisCommands   `json:"redis-allow-command"`
+	NegativeCommands  RedisCommands   `json:"redis-disallow-command"`
+	KeyRegexp         RedisKeyRegexp  `json:"redis-allow-key"`
+	KeyNegativeRegexp RedisKeyRegexp  `json:"redis-disallow-key"`
+	KeyLimiter        RedisKeyLimiter `json:"redis-key-limiter"`
+}
+
+//
+// Handling of --redis-allow-command, --redis-disallow-command options
+//
+
+// RedisCommands holds upper case names of commands
+type RedisCommands []string
+
+func (c *RedisCommands) String() string {
+	return fmt.Sprint(*c)
+}
+
+// Set method to implement flags.Value
+func (c *RedisCommands) Set(value string) error {
+	*c = append(*c, strings.ToUpper(strings.TrimSpace(value)))
+	return nil
+}
+
+// Handling of --redis-allow-key, --redis-disallow-key options
+
+// RedisKeyRegexp a slice of regexp to match keys
+type RedisKeyRegexp []*regexp.Regexp
+
+func (r *RedisKeyRegexp) String() string {
+	return fmt.Sprint(*r)
+}
+
+// Set method to implement flags.Value
+func (r *RedisKeyRegexp) Set(value string) error {
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, re)
+	return nil
+}
+
+// Handling of --redis-key-limiter option
+
+// RedisKeyLimiter is the percent of keys whose commands are taken, 0 disables
+// the limiter
+type RedisKeyLimiter uint32
+
+func (l *RedisKeyLimiter) String() string {
+	return fmt.Sprint(uint32(*l))
+}
+
+// Set method to implement flags.Value
+func (l *RedisKeyLimiter) Set(value string) error {
+	percent, err := parsePercent(value)
+	if err != nil {
+		return err
+	}
+	*l = RedisKeyLimiter(percent)
+	return nil
+}
@@ -0,0 +1,84 @@
+package goreplay
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/buger/goreplay/internal/redis"
+)
+
+func TestRedisModifierCommands(t *testing.T) {
+	config := RedisModifierConfig{}
+	config.Commands.Set("get")
+	config.Commands.Set("HGETALL")
+	modifier := NewRedisModifier(&config)
+
+	payloads := map[string]bool{
+		"*2\r\n$3\r\nGET\r\n$1\r\nk\r\n":             true,
+		"*2\r\n$7\r\nhgetall\r\n$1\r\nk\r\n":         true,
+		"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n":  false,
+		"GET / HTTP/1.1\r\nHost: www.w3.org\r\n\r\n": true, // not a redis command
+	}
+	for payload, kept := range payloads {
+		if (len(modifier.Rewrite([]byte(payload))) > 0) != kept {
+			t.Errorf("%q should be kept: %v", payload, kept)
+		}
+	}
+
+	config = RedisModifierConfig{}
+	config.NegativeCommands.Set("FLUSHALL")
+	modifier = NewRedisModifier(&config)
+	if len(modifier.Rewrite([]byte("*1\r\n$8\r\nflushall\r\n"))) != 0 {
+		t.Error("disallowed command should be dropped")
+	}
+	if len(modifier.Rewrite([]byte("*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"))) == 0 {
+		t.Error("other commands should be kept")
+	}
+}
+
+func TestRedisModifierKeys(t *testing.T) {
+	config := RedisModifierConfig{}
+	config.KeyRegexp.Set("^session:")
+	config.KeyNegativeRegexp.Set(":lock$")
+	modifier := NewRedisModifier(&config)
+
+	payloads := map[string]bool{
+		"*2\r\n$3\r\nGET\r\n$9\r\nsession:1\r\n":       true,
+		"*2\r\n$3\r\nGET\r\n$6\r\nuser:1\r\n":          false,
+		"*2\r\n$3\r\nDEL\r\n$14\r\nsession:1:lock\r\n": false,
+		"*1\r\n$4\r\nPING\r\n":                         true, // commands without keys are kept
+	}
+	for payload, kept := range payloads {
+		if (len(modifier.Rewrite([]byte(payload))) > 0) != kept {
+			t.Errorf("%q should be kept: %v", payload, kept)
+		}
+	}
+}
+
+func TestRedisModifierKeyLimiter(t *testing.T) {
+	config := RedisModifierConfig{}
+	if err := config.KeyLimiter.Set("50%"); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.KeyLimiter.Set("50"); err == nil {
+		t.Error("should error because no % symbol")
+	}
+	modifier := NewRedisModifier(&config)
+
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("user:%d", i))
+		get := redis.Command([]byte("GET"), key)
+		set := redis.Command([]byte("SET"), key, []byte("v"))
+		getKept, setKept := len(modifier.Rewrite(get)) > 0, len(modifier.Rewrite(set)) > 0
+		if getKept != setKept {
+			t.Fatalf("commands of the same key should be taken consistently: %q", key)
+		}
+		if getKept {
+			kept++
+		}
+	}
+	if kept < 400 || kept > 600 {
+		t.Errorf("expected about half of keys to be taken, got %d of 1000", kept)
+	}
+}
@@ -0,0 +1,148 @@
+package goreplay
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// replayExchange is a captured request with its original response and the
+// response of the replay target
+type replayExchange struct {
+	id                 string
+	request            []byte
+	original, replayed []byte
+	// timestamps and latencies from meta of the messages, in nanoseconds
+	requestTiming, originalTiming    int64
+	originalLatency, replayedLatency int64
+	created                          time.Time
+}
+
+// originalRoundTrip returns the time from the start of the captured request
+// to the end of the original response, or the latency of the response if the
+// request is not known
+func (e *replayExchange) originalRoundTrip() time.Duration {
+	if e.request != nil && e.originalTiming >= e.requestTiming {
+		return time.Duration(e.originalTiming + e.originalLatency - e.requestTiming)
+	}
+	return time.Duration(e.originalLatency)
+}
+
+// replayExchanges joins requests, original responses (--input-raw-track-response)
+// and replayed responses (--output-http-track-response) by their ID. At most
+// max exchanges are kept, exchanges which are not complete in timeout expire.
+type replayExchanges struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	max     int
+	pending map[string]*replayExchange
+	stop    chan struct{}
+	// complete exchanges without waiting for the original response, for
+	// recordings without responses
+	optionalOriginal bool
+
+	complete func(e *replayExchange) // both responses are known
+	expire   func(e *replayExchange) // the exchange is not complete in time
+}
+
+func newReplayExchanges(timeout time.Duration, max int, complete, expire func(e *replayExchange)) *replayExchanges {
+	x := &replayExchanges{
+		timeout:  timeout,
+		max:      max,
+		pending:  make(map[string]*replayExchange),
+		stop:     make(chan struct{}),
+		complete: complete,
+		expire:   expire,
+	}
+	go x.expireLoop()
+	return x
+}
+
+// add adds a request or a response to its exchange, it reports false if the
+// message was dropped because too many exchanges are pending. Streamed
+// messages and other payloads are ignored.
+func (x *replayExchanges) add(msg *Message) bool {
+	if chunk, _ := payloadChunk(msg.Meta); chunk != 0 {
+		return true
+	}
+	meta := payloadMeta(msg.Meta)
+	if len(meta) < 4 {
+		return true
+	}
+	switch msg.Meta[0] {
+	case RequestPayload, ResponsePayload, ReplayedResponsePayload:
+	default:
+		return true
+	}
+	id := string(meta[1])
+	timing, _ := strconv.ParseInt(string(meta[2]), 10, 64)
+	latency, _ := strconv.ParseInt(string(meta[3]), 10, 64)
+
+	x.mu.Lock()
+	e, ok := x.pending[id]
+	if !ok {
+		if len(x.pending) >= x.max {
+			x.mu.Unlock()
+			return false
+		}
+		e = &replayExchange{id: id, created: time.Now()}
+		x.pending[id] = e
+	}
+	switch msg.Meta[0] {
+	case RequestPayload:
+		e.request, e.requestTiming = msg.Data, timing
+	case ResponsePayload:
+		e.original, e.originalTiming, e.originalLatency = msg.Data, timing, latency
+	case ReplayedResponsePayload:
+		e.replayed, e.replayedLatency = msg.Data, latency
+	}
+	done := e.replayed != nil && (e.original != nil || x.optionalOriginal)
+	if done {
+		delete(x.pending, id)
+	}
+	x.mu.Unlock()
+
+	if done {
+		x.complete(e)
+	}
+	return true
+}
+
+func (x *replayExchanges) expireLoop() {
+	ticker := time.NewTicker(x.timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-x.stop:
+			return
+		case now := <-ticker.C:
+			var expired []*replayExchange
+			x.mu.Lock()
+			for id, e := range x.pending {
+				if now.Sub(e.created) > x.timeout {
+					delete(x.pending, id)
+					expired = append(expired, e)
+				}
+			}
+			x.mu.Unlock()
+			for _, e := range expired {
+				x.expire(e)
+			}
+		}
+	}
+}
+
+// drain removes and returns all pending exchanges
+func (x *replayExchanges) drain() (pending []*replayExchange) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for id, e := range x.pending {
+		delete(x.pending, id)
+		pending = append(pending, e)
+	}
+	return pending
+}
+
+func (x *replayExchanges) close() {
+	close(x.stop)
+}